@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
+	"aktuell/pkg/auth"
 	"aktuell/pkg/models"
 	"aktuell/pkg/server"
 	"aktuell/pkg/sync"
@@ -26,10 +29,34 @@ type Config struct {
 	} `mapstructure:"mongodb"`
 
 	Server struct {
-		Host string `mapstructure:"host"`
-		Port int    `mapstructure:"port"`
+		Host    string               `mapstructure:"host"`
+		Port    int                  `mapstructure:"port"`
+		TLS     server.TLSOptions    `mapstructure:"tls"`
+		Origins server.OriginOptions `mapstructure:"origins"`
 	} `mapstructure:"server"`
 
+	Replay struct {
+		MaxEvents     int           `mapstructure:"max_events"`
+		MaxAge        time.Duration `mapstructure:"max_age"`
+		SpillDir      string        `mapstructure:"spill_dir"`
+		MaxSpillBytes int64         `mapstructure:"max_spill_bytes"`
+	} `mapstructure:"replay"`
+
+	Sessions struct {
+		GracePeriod time.Duration `mapstructure:"grace_period"`
+		QueueSize   int           `mapstructure:"queue_size"`
+	} `mapstructure:"sessions"`
+
+	// Per-connection and per-identity limits on messages, subscriptions and snapshots
+	Limits server.LimitOptions `mapstructure:"limits"`
+
+	Auth struct {
+		JWT        auth.JWTOptions    `mapstructure:"jwt"`
+		APIKeys    auth.APIKeyOptions `mapstructure:"api_keys"`
+		ClientCert bool               `mapstructure:"client_cert"` // Identify connections by their verified TLS client certificate
+		PolicyFile string             `mapstructure:"policy_file"` // YAML file with the authorization policy
+	} `mapstructure:"auth"`
+
 	Logging struct {
 		Level string `mapstructure:"level"`
 	} `mapstructure:"logging"`
@@ -105,6 +132,110 @@ func main() {
 	wsServer.SetValidator(syncManager)
 	wsServer.SetSnapshotStreamer(syncManager)
 
+	// Keep recent changes so reconnecting clients can resume
+	if err := wsServer.SetReplayOptions(server.ReplayOptions{
+		MaxEvents:     config.Replay.MaxEvents,
+		MaxAge:        config.Replay.MaxAge,
+		SpillDir:      config.Replay.SpillDir,
+		MaxSpillBytes: config.Replay.MaxSpillBytes,
+	}); err != nil {
+		logger.WithError(err).Fatal("Failed to configure replay log")
+	}
+
+	// Keep subscriptions of disconnected clients for a grace period
+	wsServer.SetSessionOptions(server.SessionOptions{
+		GracePeriod: config.Sessions.GracePeriod,
+		QueueSize:   config.Sessions.QueueSize,
+	})
+
+	// Restrict the browser origins that may connect
+	if err := wsServer.SetOriginOptions(config.Server.Origins); err != nil {
+		logger.WithError(err).Fatal("Failed to configure allowed origins")
+	}
+	logger.WithFields(logrus.Fields{
+		"allowed":         config.Server.Origins.Allowed,
+		"allow_localhost": config.Server.Origins.AllowLocalhost,
+		"require_origin":  config.Server.Origins.RequireOrigin,
+	}).Info("Configured allowed origins")
+
+	// Terminate TLS, optionally verifying client certificates
+	if err := wsServer.SetTLSOptions(config.Server.TLS); err != nil {
+		logger.WithError(err).Fatal("Failed to configure TLS")
+	}
+	if config.Server.TLS.Enabled() {
+		logger.WithFields(logrus.Fields{
+			"cert_file":   config.Server.TLS.CertFile,
+			"client_auth": config.Server.TLS.ClientCAFile != "",
+		}).Info("TLS enabled")
+	}
+
+	// Bound what a single connection or identity can ask of the server
+	if err := wsServer.SetLimitOptions(config.Limits); err != nil {
+		logger.WithError(err).Fatal("Failed to configure limits")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Require a signed token, an API key or a client certificate on every connection
+	var authenticators auth.Chain
+	if config.Auth.JWT.Enabled() {
+		authenticator, err := auth.NewJWTAuthenticator(config.Auth.JWT)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to configure JWT authentication")
+		}
+		authenticators = append(authenticators, authenticator)
+		logger.Info("JWT authentication enabled")
+	}
+	if config.Auth.APIKeys.Enabled() {
+		var loader auth.APIKeyLoader
+		if config.Auth.APIKeys.Collection != "" {
+			if loader, err = database.APIKeyLoader(config.Auth.APIKeys.Collection); err != nil {
+				logger.WithError(err).Fatal("Failed to configure API key collection")
+			}
+		}
+		keys, err := auth.NewAPIKeyAuthenticator(config.Auth.APIKeys, loader)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to configure API keys")
+		}
+		if err := keys.Refresh(ctx); err != nil {
+			logger.WithError(err).Fatal("Failed to load API keys")
+		}
+		go keys.Watch(ctx, config.Auth.APIKeys.RefreshInterval, func(err error) {
+			logger.WithError(err).Warn("Failed to refresh API keys, keeping the previous ones")
+		})
+		authenticators = append(authenticators, keys)
+		logger.WithField("static_keys", len(config.Auth.APIKeys.Keys)).Info("API key authentication enabled")
+	}
+	if config.Auth.ClientCert {
+		if config.Server.TLS.ClientCAFile == "" {
+			logger.Fatal("Client certificate authentication needs server.tls.client_ca_file")
+		}
+		// Last, so that tokens and API keys take precedence over the certificate
+		authenticators = append(authenticators, auth.ClientCertAuthenticator{})
+		logger.Info("Client certificate authentication enabled")
+	}
+	switch len(authenticators) {
+	case 0:
+	case 1:
+		wsServer.SetAuthenticator(authenticators[0])
+	default:
+		wsServer.SetAuthenticator(authenticators)
+	}
+
+	// Restrict namespaces and operations per role and claim
+	if config.Auth.PolicyFile != "" {
+		policy, err := auth.LoadPolicyFile(config.Auth.PolicyFile)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to load authorization policy")
+		}
+		wsServer.SetValidator(auth.NewPolicyValidator(syncManager, policy))
+		if policy.HasRedactions() {
+			wsServer.SetRedactor(policy)
+		}
+		logger.WithField("file", config.Auth.PolicyFile).Info("Authorization policy enabled")
+	}
+
 	// Start sync manager
 	if err := syncManager.Start(); err != nil {
 		logger.WithError(err).Fatal("Failed to start sync manager")
@@ -153,10 +284,20 @@ func loadConfig() (*Config, error) {
 	viper.SetDefault("server.port", 8080)
 	viper.SetDefault("logging.level", "info")
 
+	// Outside production, local development servers may connect
+	development := os.Getenv("AKTUELL_ENV") != "production"
+	viper.SetDefault("server.origins.allowed", []string{})
+	viper.SetDefault("server.origins.allow_localhost", development)
+	viper.SetDefault("server.origins.require_origin", !development)
+
 	// Environment variable configuration
 	viper.SetEnvPrefix("AKTUELL")
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	// AKTUELL_ALLOWED_ORIGINS is the former name of AKTUELL_SERVER_ORIGINS_ALLOWED
+	if err := viper.BindEnv("server.origins.allowed", "AKTUELL_SERVER_ORIGINS_ALLOWED", "AKTUELL_ALLOWED_ORIGINS"); err != nil {
+		return nil, fmt.Errorf("failed to bind environment: %w", err)
+	}
 
 	// Config file
 	viper.SetConfigName("config")
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"aktuell/pkg/models"
+)
+
+// ErrInvalidAPIKey is returned for API keys that are unknown or disabled
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// Defaults of APIKeyOptions
+const (
+	DefaultAPIKeyHeader    = "X-API-Key"
+	defaultAPIKeyRefresh   = time.Minute
+	apiKeyHashPrefixSHA256 = "sha256:"
+)
+
+// APIKey is the credential of a service. In configuration it holds either
+// the key itself or its hash; keys stored in MongoDB only hold the hash.
+type APIKey struct {
+	Name       string   `mapstructure:"name" bson:"name"` // Identifies the key in logs and statistics
+	Key        string   `mapstructure:"key" bson:"-"`
+	Hash       string   `mapstructure:"hash" bson:"hash"` // Hex SHA-256 of the key, optionally prefixed "sha256:"
+	Roles      []string `mapstructure:"roles" bson:"roles"`
+	Namespaces []string `mapstructure:"namespaces" bson:"namespaces"` // "db.collection" patterns the key may use (all if empty)
+	RateLimit  float64  `mapstructure:"rate_limit" bson:"rate_limit"` // Messages and requests per second over all connections (0: unlimited)
+	Burst      int      `mapstructure:"burst" bson:"burst"`
+	Disabled   bool     `mapstructure:"disabled" bson:"disabled"`
+}
+
+// APIKeyOptions configures API key authentication
+type APIKeyOptions struct {
+	Header          string        `mapstructure:"header"` // Request header carrying the key (default "X-API-Key")
+	Keys            []APIKey      `mapstructure:"keys"`
+	Collection      string        `mapstructure:"collection"`       // "db.collection" holding further keys
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"` // How often keys are reloaded from the collection
+}
+
+// Enabled reports whether API keys are configured
+func (o APIKeyOptions) Enabled() bool {
+	return len(o.Keys) > 0 || o.Collection != ""
+}
+
+// APIKeyLoader loads keys from an external store
+type APIKeyLoader func(ctx context.Context) ([]APIKey, error)
+
+// APIKeyAuthenticator authenticates services by API key
+type APIKeyAuthenticator struct {
+	header string
+	static map[string]*APIKey
+	loader APIKeyLoader
+
+	mu     sync.RWMutex
+	loaded map[string]*APIKey
+}
+
+// NewAPIKeyAuthenticator validates the configured keys. Keys of the loader,
+// if any, are read by Refresh.
+func NewAPIKeyAuthenticator(opts APIKeyOptions, loader APIKeyLoader) (*APIKeyAuthenticator, error) {
+	a := &APIKeyAuthenticator{header: opts.Header, loader: loader}
+	if a.header == "" {
+		a.header = DefaultAPIKeyHeader
+	}
+
+	static, err := indexAPIKeys(opts.Keys)
+	if err != nil {
+		return nil, err
+	}
+	a.static = static
+	return a, nil
+}
+
+// indexAPIKeys validates keys and indexes them by hash
+func indexAPIKeys(keys []APIKey) (map[string]*APIKey, error) {
+	index := make(map[string]*APIKey, len(keys))
+	names := make(map[string]bool, len(keys))
+	for i := range keys {
+		key := keys[i]
+		if key.Name == "" {
+			return nil, fmt.Errorf("API key #%d has no name", i+1)
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("API key name %q is not unique", key.Name)
+		}
+		names[key.Name] = true
+
+		var hash string
+		switch {
+		case key.Key != "" && key.Hash != "":
+			return nil, fmt.Errorf("API key %s: set either key or hash", key.Name)
+		case key.Key != "":
+			hash = HashAPIKey(key.Key)
+		case key.Hash != "":
+			hash = strings.ToLower(strings.TrimPrefix(key.Hash, apiKeyHashPrefixSHA256))
+			if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("API key %s: hash must be a hex SHA-256", key.Name)
+			}
+		default:
+			return nil, fmt.Errorf("API key %s: no key or hash", key.Name)
+		}
+		if key.RateLimit < 0 || key.Burst < 0 {
+			return nil, fmt.Errorf("API key %s: rate limits must not be negative", key.Name)
+		}
+		if err := validatePatterns(key.Namespaces); err != nil {
+			return nil, fmt.Errorf("API key %s: %w", key.Name, err)
+		}
+
+		key.Key = ""
+		index[hash] = &key
+	}
+	return index, nil
+}
+
+// HashAPIKey returns the hash under which a key is stored
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Refresh reloads the keys of the loader. On failure the previous keys stay
+// in effect.
+func (a *APIKeyAuthenticator) Refresh(ctx context.Context) error {
+	if a.loader == nil {
+		return nil
+	}
+	keys, err := a.loader(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load API keys: %w", err)
+	}
+	loaded, err := indexAPIKeys(keys)
+	if err != nil {
+		return fmt.Errorf("failed to load API keys: %w", err)
+	}
+
+	a.mu.Lock()
+	a.loaded = loaded
+	a.mu.Unlock()
+	return nil
+}
+
+// Watch refreshes the keys at an interval until ctx is done, reporting
+// failures to onError
+func (a *APIKeyAuthenticator) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	if a.loader == nil {
+		return
+	}
+	if interval <= 0 {
+		interval = defaultAPIKeyRefresh
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.Refresh(ctx); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// Authenticate implements Authenticator
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*models.Principal, error) {
+	presented := strings.TrimSpace(r.Header.Get(a.header))
+	if presented == "" {
+		return nil, ErrNoCredentials
+	}
+	hash := HashAPIKey(presented)
+
+	key := a.static[hash]
+	if key == nil {
+		a.mu.RLock()
+		key = a.loaded[hash]
+		a.mu.RUnlock()
+	}
+	if key == nil || key.Disabled {
+		return nil, ErrInvalidAPIKey
+	}
+
+	principal := &models.Principal{
+		Subject:    key.Name,
+		Method:     models.AuthMethodAPIKey,
+		Roles:      key.Roles,
+		Namespaces: key.Namespaces,
+	}
+	if key.RateLimit > 0 {
+		principal.RateLimit = &models.RateLimit{PerSecond: key.RateLimit, Burst: key.Burst}
+	}
+	return principal, nil
+}
+
+// NamespaceAllowed reports whether a principal's credential may be used for
+// a namespace. collection is empty for a whole database.
+func NamespaceAllowed(principal *models.Principal, database, collection string) bool {
+	if principal == nil || len(principal.Namespaces) == 0 {
+		return true
+	}
+	return namespaceCovered(principal.Namespaces, namespaceOf(database, collection))
+}
+
+// Chain tries authenticators in order. Requests without credentials for one
+// are passed to the next; invalid credentials fail immediately.
+type Chain []Authenticator
+
+// Authenticate implements Authenticator
+func (c Chain) Authenticate(r *http.Request) (*models.Principal, error) {
+	for _, authenticator := range c {
+		principal, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// VerifyToken implements TokenVerifier with the first authenticator that
+// verifies tokens
+func (c Chain) VerifyToken(token string) (*models.Principal, error) {
+	for _, authenticator := range c {
+		if verifier, ok := authenticator.(TokenVerifier); ok {
+			return verifier.VerifyToken(token)
+		}
+	}
+	return nil, ErrInvalidToken
+}
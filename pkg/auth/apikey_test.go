@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"aktuell/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func authenticateKey(t *testing.T, a *APIKeyAuthenticator, key string) (*models.Principal, error) {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/ws", nil)
+	if key != "" {
+		r.Header.Set(DefaultAPIKeyHeader, key)
+	}
+	return a.Authenticate(r)
+}
+
+func TestAPIKeyAuthenticator_StaticKeys(t *testing.T) {
+	a, err := NewAPIKeyAuthenticator(APIKeyOptions{Keys: []APIKey{
+		{Name: "billing-worker", Key: "plain-secret", Roles: []string{"service"}, Namespaces: []string{"billing.*"}, RateLimit: 5, Burst: 10},
+		{Name: "indexer", Hash: "sha256:" + HashAPIKey("hashed-secret")},
+		{Name: "retired", Key: "old-secret", Disabled: true},
+	}}, nil)
+	require.NoError(t, err)
+
+	principal, err := authenticateKey(t, a, "plain-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "billing-worker", principal.Subject)
+	assert.Equal(t, models.AuthMethodAPIKey, principal.Method)
+	assert.Equal(t, []string{"service"}, principal.Roles)
+	assert.Equal(t, []string{"billing.*"}, principal.Namespaces)
+	assert.Equal(t, &models.RateLimit{PerSecond: 5, Burst: 10}, principal.RateLimit)
+
+	principal, err = authenticateKey(t, a, "hashed-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "indexer", principal.Subject)
+	assert.Nil(t, principal.RateLimit)
+
+	_, err = authenticateKey(t, a, "old-secret")
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+	_, err = authenticateKey(t, a, "guess")
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+	_, err = authenticateKey(t, a, "")
+	assert.ErrorIs(t, err, ErrNoCredentials)
+}
+
+func TestAPIKeyAuthenticator_CustomHeader(t *testing.T) {
+	a, err := NewAPIKeyAuthenticator(APIKeyOptions{Header: "X-Service-Key", Keys: []APIKey{{Name: "worker", Key: "secret"}}}, nil)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("X-Service-Key", "secret")
+	principal, err := a.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "worker", principal.Subject)
+}
+
+func TestAPIKeyAuthenticator_Loader(t *testing.T) {
+	stored := []APIKey{{Name: "loaded", Hash: HashAPIKey("from-mongo")}}
+	var loadErr error
+	a, err := NewAPIKeyAuthenticator(APIKeyOptions{}, func(ctx context.Context) ([]APIKey, error) {
+		return stored, loadErr
+	})
+	require.NoError(t, err)
+
+	_, err = authenticateKey(t, a, "from-mongo")
+	assert.ErrorIs(t, err, ErrInvalidAPIKey, "keys are loaded by Refresh")
+
+	require.NoError(t, a.Refresh(context.Background()))
+	principal, err := authenticateKey(t, a, "from-mongo")
+	require.NoError(t, err)
+	assert.Equal(t, "loaded", principal.Subject)
+
+	// Failed refreshes keep the previous keys
+	loadErr = errors.New("connection refused")
+	assert.Error(t, a.Refresh(context.Background()))
+	stored, loadErr = []APIKey{{Name: "broken"}}, nil
+	assert.Error(t, a.Refresh(context.Background()))
+	_, err = authenticateKey(t, a, "from-mongo")
+	assert.NoError(t, err)
+
+	// Revoked keys stop working after the next refresh
+	stored = []APIKey{{Name: "loaded", Hash: HashAPIKey("from-mongo"), Disabled: true}}
+	require.NoError(t, a.Refresh(context.Background()))
+	_, err = authenticateKey(t, a, "from-mongo")
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+}
+
+func TestAPIKeyAuthenticator_Validation(t *testing.T) {
+	invalid := map[string][]APIKey{
+		"no name":        {{Key: "k"}},
+		"duplicate name": {{Name: "a", Key: "k1"}, {Name: "a", Key: "k2"}},
+		"key and hash":   {{Name: "a", Key: "k", Hash: HashAPIKey("k")}},
+		"no secret":      {{Name: "a"}},
+		"bad hash":       {{Name: "a", Hash: "abc"}},
+		"negative rate":  {{Name: "a", Key: "k", RateLimit: -1}},
+		"bad namespace":  {{Name: "a", Key: "k", Namespaces: []string{"db.["}}},
+	}
+	for name, keys := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewAPIKeyAuthenticator(APIKeyOptions{Keys: keys}, nil)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNamespaceAllowed(t *testing.T) {
+	assert.True(t, NamespaceAllowed(nil, "any", "thing"))
+	assert.True(t, NamespaceAllowed(&models.Principal{Subject: "jwt-user"}, "any", "thing"))
+
+	worker := &models.Principal{Subject: "worker", Namespaces: []string{"billing", "shop.orders"}}
+	assert.True(t, NamespaceAllowed(worker, "billing", "invoices"))
+	assert.True(t, NamespaceAllowed(worker, "billing", ""))
+	assert.True(t, NamespaceAllowed(worker, "shop", "orders"))
+	assert.False(t, NamespaceAllowed(worker, "shop", "users"))
+	assert.False(t, NamespaceAllowed(worker, "shop", ""))
+}
+
+func TestChain(t *testing.T) {
+	jwt, err := NewJWTAuthenticator(JWTOptions{Secrets: []string{testSecret}})
+	require.NoError(t, err)
+	keys, err := NewAPIKeyAuthenticator(APIKeyOptions{Keys: []APIKey{{Name: "worker", Key: "secret"}}}, nil)
+	require.NoError(t, err)
+	chain := Chain{jwt, keys}
+
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set(DefaultAPIKeyHeader, "secret")
+	principal, err := chain.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, models.AuthMethodAPIKey, principal.Method)
+
+	// Invalid credentials are not passed on
+	r.Header.Set("Authorization", "Bearer forged")
+	_, err = chain.Authenticate(r)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = chain.Authenticate(httptest.NewRequest("GET", "/ws", nil))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+
+	_, err = chain.VerifyToken("forged")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
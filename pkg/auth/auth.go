@@ -0,0 +1,51 @@
+// Package auth authenticates connections to the Aktuell server
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request carries
+// none of the credentials it understands
+var ErrNoCredentials = errors.New("no credentials presented")
+
+// Authenticator establishes the identity behind an HTTP or WebSocket
+// handshake request
+type Authenticator interface {
+	Authenticate(r *http.Request) (*models.Principal, error)
+}
+
+// TokenVerifier is implemented by authenticators that can also verify
+// credentials sent on an open connection, e.g. to replace an expiring token
+type TokenVerifier interface {
+	VerifyToken(token string) (*models.Principal, error)
+}
+
+// BearerToken returns the bearer token of a request. It is taken from the
+// Authorization header, a SubprotocolBearerPrefix subprotocol or, if
+// queryParam is set, the query parameter of that name, in this order.
+func BearerToken(r *http.Request, queryParam string) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+
+	for _, protocol := range websocket.Subprotocols(r) {
+		if token, ok := strings.CutPrefix(protocol, models.SubprotocolBearerPrefix); ok {
+			return token
+		}
+	}
+
+	if queryParam != "" {
+		return r.URL.Query().Get(queryParam)
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/http"
+
+	"aktuell/pkg/models"
+)
+
+// ClientCertAuthenticator identifies connections by the client certificate
+// verified during the TLS handshake. The subject is the certificate's common
+// name, or its full distinguished name if it has none. Subject fields and
+// alternative names are exposed as claims for the authorization policy:
+// "dn", "cn", "o", "ou", "dns", "email", "uri" and "serial".
+type ClientCertAuthenticator struct{}
+
+// Authenticate implements Authenticator
+func (ClientCertAuthenticator) Authenticate(r *http.Request) (*models.Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	return CertificatePrincipal(r.TLS.VerifiedChains[0][0]), nil
+}
+
+// CertificatePrincipal returns the identity of a verified client certificate.
+// It expires with the certificate.
+func CertificatePrincipal(cert *x509.Certificate) *models.Principal {
+	claims := map[string]interface{}{
+		"dn":     cert.Subject.String(),
+		"serial": cert.SerialNumber.Text(16),
+	}
+	if cert.Subject.CommonName != "" {
+		claims["cn"] = cert.Subject.CommonName
+	}
+	addList := func(name string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		list := make([]interface{}, len(values))
+		for i, value := range values {
+			list[i] = value
+		}
+		claims[name] = list
+	}
+	addList("o", cert.Subject.Organization)
+	addList("ou", cert.Subject.OrganizationalUnit)
+	addList("dns", cert.DNSNames)
+	addList("email", cert.EmailAddresses)
+	uris := make([]string, len(cert.URIs))
+	for i, uri := range cert.URIs {
+		uris[i] = uri.String()
+	}
+	addList("uri", uris)
+
+	subject := cert.Subject.CommonName
+	if subject == "" {
+		subject = cert.Subject.String()
+	}
+	return &models.Principal{
+		Subject:   subject,
+		Method:    models.AuthMethodClientCert,
+		Claims:    claims,
+		ExpiresAt: cert.NotAfter,
+	}
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCertAuthenticator(t *testing.T) {
+	spiffe, err := url.Parse("spiffe://acme/billing")
+	require.NoError(t, err)
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(255),
+		Subject:      pkix.Name{CommonName: "billing-worker", Organization: []string{"acme"}, OrganizationalUnit: []string{"billing", "ops"}},
+		DNSNames:     []string{"billing.internal"},
+		URIs:         []*url.URL{spiffe},
+		NotAfter:     notAfter,
+	}
+
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	principal, err := ClientCertAuthenticator{}.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "billing-worker", principal.Subject)
+	assert.Equal(t, models.AuthMethodClientCert, principal.Method)
+	assert.Equal(t, notAfter, principal.ExpiresAt)
+	assert.Equal(t, map[string]interface{}{
+		"dn":     "CN=billing-worker,OU=billing+OU=ops,O=acme",
+		"cn":     "billing-worker",
+		"serial": "ff",
+		"o":      []interface{}{"acme"},
+		"ou":     []interface{}{"billing", "ops"},
+		"dns":    []interface{}{"billing.internal"},
+		"uri":    []interface{}{"spiffe://acme/billing"},
+	}, principal.Claims)
+
+	// Certificates without a common name are named by their subject
+	anonymous := CertificatePrincipal(&x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{Organization: []string{"acme"}}})
+	assert.Equal(t, "O=acme", anonymous.Subject)
+}
+
+func TestClientCertAuthenticator_NoCertificate(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws", nil)
+	_, err := ClientCertAuthenticator{}.Authenticate(r)
+	assert.ErrorIs(t, err, ErrNoCredentials)
+
+	// Unverified certificates do not count
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "mallory"}}}}
+	_, err = ClientCertAuthenticator{}.Authenticate(r)
+	assert.ErrorIs(t, err, ErrNoCredentials)
+}
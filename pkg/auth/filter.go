@@ -0,0 +1,353 @@
+package auth
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"aktuell/pkg/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// templatePattern matches placeholders like {{claims.tenant}} or {{subject}}
+var templatePattern = regexp.MustCompile(`\{\{\s*([^{}]+?)\s*\}\}`)
+
+// Field operators that can be evaluated against change events as well as
+// sent to MongoDB
+var filterOperators = map[string]bool{
+	"$eq":     true,
+	"$ne":     true,
+	"$in":     true,
+	"$nin":    true,
+	"$exists": true,
+}
+
+// validateFilter checks that a filter only uses supported operators
+func validateFilter(filter map[string]interface{}) error {
+	for key, value := range filter {
+		switch key {
+		case "$and", "$or":
+			clauses, ok := value.([]interface{})
+			if !ok || len(clauses) == 0 {
+				return fmt.Errorf("%s needs a list of filters", key)
+			}
+			for _, clause := range clauses {
+				sub, ok := clause.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("%s needs a list of filters", key)
+				}
+				if err := validateFilter(sub); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "$") {
+			return fmt.Errorf("unsupported filter operator %s", key)
+		}
+		if ops, ok := value.(map[string]interface{}); ok {
+			for op := range ops {
+				if !filterOperators[op] {
+					return fmt.Errorf("unsupported operator %s on field %s", op, key)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// expandFilter replaces the placeholders of a filter template with values of
+// the principal. A string that is a single placeholder takes the value with
+// its type, e.g. a list claim for $in, and values that are object ID hex
+// strings become object IDs, as change events and MongoDB compare them by
+// type alike; placeholders within a string are formatted into it. Unknown
+// claims are an error.
+func expandFilter(template map[string]interface{}, principal *models.Principal) (map[string]interface{}, error) {
+	expanded, err := expandValue(template, principal)
+	if err != nil {
+		return nil, err
+	}
+	return expanded.(map[string]interface{}), nil
+}
+
+func expandValue(value interface{}, principal *models.Principal) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			expanded, err := expandValue(item, principal)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = expanded
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			expanded, err := expandValue(item, principal)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = expanded
+		}
+		return out, nil
+	case string:
+		if m := templatePattern.FindStringSubmatch(v); m != nil && m[0] == v {
+			resolved, err := templateValue(m[1], principal)
+			if err != nil {
+				return nil, err
+			}
+			return objectIDs(resolved), nil
+		}
+		var err error
+		out := templatePattern.ReplaceAllStringFunc(v, func(placeholder string) string {
+			resolved, e := templateValue(templatePattern.FindStringSubmatch(placeholder)[1], principal)
+			if e != nil {
+				err = e
+				return ""
+			}
+			return fmt.Sprint(resolved)
+		})
+		return out, err
+	default:
+		return value, nil
+	}
+}
+
+// objectIDs converts an object ID hex string, or the ones in a list, to
+// object IDs
+func objectIDs(value interface{}) interface{} {
+	if list, ok := asList(value); ok {
+		out := make([]interface{}, len(list))
+		for i, item := range list {
+			out[i] = objectIDs(item)
+		}
+		return out
+	}
+	if hex, ok := value.(string); ok {
+		if id, err := primitive.ObjectIDFromHex(hex); err == nil {
+			return id
+		}
+	}
+	return value
+}
+
+// templateValue resolves a placeholder name
+func templateValue(name string, principal *models.Principal) (interface{}, error) {
+	if principal == nil {
+		return nil, fmt.Errorf("%s is unknown for anonymous connections", name)
+	}
+	if name == "subject" {
+		return principal.Subject, nil
+	}
+	if claim, ok := strings.CutPrefix(name, "claims."); ok {
+		value := LookupClaim(principal.Claims, claim)
+		if value == nil {
+			return nil, fmt.Errorf("token has no claim %s", claim)
+		}
+		// Objects could smuggle operators into the filter
+		if _, ok := asDocument(value); ok {
+			return nil, fmt.Errorf("claim %s is an object", claim)
+		}
+		if list, ok := asList(value); ok {
+			for _, item := range list {
+				if _, ok := asDocument(item); ok {
+					return nil, fmt.Errorf("claim %s contains objects", claim)
+				}
+			}
+		}
+		return value, nil
+	}
+	return nil, fmt.Errorf("unknown placeholder %s", name)
+}
+
+// MatchFilter evaluates a filter against a document the way MongoDB would for
+// the operators policies may use
+func MatchFilter(filter, doc map[string]interface{}) bool {
+	for key, want := range filter {
+		switch key {
+		case "$and":
+			for _, clause := range want.([]interface{}) {
+				if !MatchFilter(clause.(map[string]interface{}), doc) {
+					return false
+				}
+			}
+		case "$or":
+			matched := false
+			for _, clause := range want.([]interface{}) {
+				if MatchFilter(clause.(map[string]interface{}), doc) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		default:
+			value, found := LookupField(doc, key)
+			if !matchField(value, found, want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchField evaluates the condition on a single field
+func matchField(value interface{}, found bool, want interface{}) bool {
+	ops, ok := want.(map[string]interface{})
+	if !ok {
+		return found && fieldEquals(value, want)
+	}
+	for op, operand := range ops {
+		var ok bool
+		switch op {
+		case "$eq":
+			ok = found && fieldEquals(value, operand)
+		case "$ne":
+			ok = !found || !fieldEquals(value, operand)
+		case "$in":
+			ok = found && fieldIn(value, operand)
+		case "$nin":
+			ok = !found || !fieldIn(value, operand)
+		case "$exists":
+			ok = found == truthy(operand)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldIn reports whether a field equals one of a list of values
+func fieldIn(value, list interface{}) bool {
+	items, ok := list.([]interface{})
+	if !ok {
+		return fieldEquals(value, list)
+	}
+	for _, item := range items {
+		if fieldEquals(value, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldEquals compares a document value with a filter value. Like MongoDB, an
+// array field matches if one of its elements does.
+func fieldEquals(value, want interface{}) bool {
+	if list, ok := asList(value); ok {
+		for _, item := range list {
+			if scalarEquals(item, want) {
+				return true
+			}
+		}
+		return false
+	}
+	return scalarEquals(value, want)
+}
+
+// scalarEquals compares values of the same type like MongoDB does. Numbers
+// compare by value whatever their type.
+func scalarEquals(a, b interface{}) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	if a == nil || b == nil {
+		return a == b
+	}
+	return reflect.TypeOf(a) == reflect.TypeOf(b) && reflect.DeepEqual(a, b)
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func truthy(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	n, ok := number(v)
+	return ok && n != 0
+}
+
+func asList(v interface{}) ([]interface{}, bool) {
+	switch list := v.(type) {
+	case []interface{}:
+		return list, true
+	case primitive.A:
+		return list, true
+	}
+	return nil, false
+}
+
+func asDocument(v interface{}) (map[string]interface{}, bool) {
+	switch doc := v.(type) {
+	case map[string]interface{}:
+		return doc, true
+	case primitive.M:
+		return doc, true
+	}
+	return nil, false
+}
+
+// LookupField returns the value of a dotted field path in a document
+func LookupField(doc map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		fields, ok := asDocument(current)
+		if !ok {
+			return nil, false
+		}
+		if current, ok = fields[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// FilterFields returns the document fields a filter tests
+func FilterFields(filter map[string]interface{}) []string {
+	var fields []string
+	for key, value := range filter {
+		if key == "$and" || key == "$or" {
+			for _, clause := range value.([]interface{}) {
+				fields = append(fields, FilterFields(clause.(map[string]interface{}))...)
+			}
+			continue
+		}
+		fields = append(fields, key)
+	}
+	return fields
+}
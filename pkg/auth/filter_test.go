@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"testing"
+
+	"aktuell/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestExpandFilter(t *testing.T) {
+	principal := &models.Principal{Subject: "alice", Claims: map[string]interface{}{
+		"tenant":  "acme",
+		"regions": []interface{}{"eu", "us"},
+		"org":     map[string]interface{}{"id": float64(42)},
+	}}
+
+	filter, err := expandFilter(map[string]interface{}{
+		"tenantId": "{{claims.tenant}}",
+		"region":   map[string]interface{}{"$in": "{{ claims.regions }}"},
+		"orgId":    "{{claims.org.id}}",
+		"owner":    "user:{{subject}}",
+		"archived": false,
+	}, principal)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"tenantId": "acme",
+		"region":   map[string]interface{}{"$in": []interface{}{"eu", "us"}},
+		"orgId":    float64(42),
+		"owner":    "user:alice",
+		"archived": false,
+	}, filter)
+
+	id := primitive.NewObjectID()
+	principal.Claims["account"] = id.Hex()
+	principal.Claims["accounts"] = []interface{}{id.Hex(), "other"}
+	filter, err = expandFilter(map[string]interface{}{
+		"accountId": "{{claims.account}}",
+		"shared":    map[string]interface{}{"$in": "{{claims.accounts}}"},
+		"label":     "account {{claims.account}}",
+	}, principal)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"accountId": id,
+		"shared":    map[string]interface{}{"$in": []interface{}{id, "other"}},
+		"label":     "account " + id.Hex(),
+	}, filter, "object ID hex strings become object IDs")
+
+	_, err = expandFilter(map[string]interface{}{"tenantId": "{{claims.missing}}"}, principal)
+	assert.ErrorContains(t, err, "no claim missing")
+
+	_, err = expandFilter(map[string]interface{}{"tenantId": "{{claims.org}}"}, principal)
+	assert.ErrorContains(t, err, "is an object", "objects could inject operators")
+
+	_, err = expandFilter(map[string]interface{}{"tenantId": "{{claims.tenant}}"}, nil)
+	assert.Error(t, err)
+
+	_, err = expandFilter(map[string]interface{}{"tenantId": "{{tenant}}"}, principal)
+	assert.ErrorContains(t, err, "unknown placeholder")
+}
+
+func TestMatchFilter(t *testing.T) {
+	id := primitive.NewObjectID()
+	doc := map[string]interface{}{
+		"_id":      id,
+		"tenantId": "acme",
+		"count":    int32(3),
+		"tags":     primitive.A{"red", "blue"},
+		"owner":    primitive.M{"team": "core"},
+	}
+
+	tests := []struct {
+		name   string
+		filter map[string]interface{}
+		want   bool
+	}{
+		{"equal", map[string]interface{}{"tenantId": "acme"}, true},
+		{"not equal", map[string]interface{}{"tenantId": "globex"}, false},
+		{"missing field", map[string]interface{}{"region": "eu"}, false},
+		{"number types", map[string]interface{}{"count": 3}, true},
+		{"number and string", map[string]interface{}{"count": "3"}, false},
+		{"bool and string", map[string]interface{}{"tenantId": true}, false},
+		{"array element", map[string]interface{}{"tags": "blue"}, true},
+		{"nested document", map[string]interface{}{"owner.team": "core"}, true},
+		{"object id", map[string]interface{}{"_id": id}, true},
+		{"object id and hex string", map[string]interface{}{"_id": id.Hex()}, false},
+		{"$in", map[string]interface{}{"tenantId": map[string]interface{}{"$in": []interface{}{"globex", "acme"}}}, true},
+		{"$nin", map[string]interface{}{"tenantId": map[string]interface{}{"$nin": []interface{}{"acme"}}}, false},
+		{"$ne", map[string]interface{}{"tenantId": map[string]interface{}{"$ne": "globex"}}, true},
+		{"$exists", map[string]interface{}{"region": map[string]interface{}{"$exists": false}}, true},
+		{"$or", map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"tenantId": "globex"},
+			map[string]interface{}{"tags": "red"},
+		}}, true},
+		{"$and", map[string]interface{}{"$and": []interface{}{
+			map[string]interface{}{"tenantId": "acme"},
+			map[string]interface{}{"count": 4},
+		}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, MatchFilter(tt.filter, doc))
+		})
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	assert.NoError(t, validateFilter(map[string]interface{}{
+		"tenantId": "{{claims.tenant}}",
+		"$or": []interface{}{
+			map[string]interface{}{"public": true},
+			map[string]interface{}{"owner": map[string]interface{}{"$in": "{{claims.groups}}"}},
+		},
+	}))
+	assert.Error(t, validateFilter(map[string]interface{}{"$where": "true"}))
+	assert.Error(t, validateFilter(map[string]interface{}{"count": map[string]interface{}{"$gt": 3}}))
+	assert.Error(t, validateFilter(map[string]interface{}{"$or": "{{claims.filters}}"}))
+}
+
+func TestFilterFields(t *testing.T) {
+	fields := FilterFields(map[string]interface{}{
+		"tenantId": "acme",
+		"$or":      []interface{}{map[string]interface{}{"region": "eu"}},
+	})
+	assert.ElementsMatch(t, []string{"tenantId", "region"}, fields)
+}
@@ -0,0 +1,285 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Token verification errors
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// defaultTokenQueryParam is the query parameter that carries a token by default
+const defaultTokenQueryParam = "access_token"
+
+// jwksRefreshInterval limits how often the JWKS file is checked for new keys
+const jwksRefreshInterval = 5 * time.Second
+
+// JWTOptions configures the verification of JSON Web Tokens
+type JWTOptions struct {
+	Secrets       []string      `mapstructure:"secrets"`        // HMAC secrets for HS256, HS384 and HS512
+	JWKSFile      string        `mapstructure:"jwks_file"`      // Local JWKS file with RSA, EC or symmetric keys
+	Issuer        string        `mapstructure:"issuer"`         // Required "iss" claim, if set
+	Audience      string        `mapstructure:"audience"`       // Required entry of the "aud" claim, if set
+	Leeway        time.Duration `mapstructure:"leeway"`         // Clock skew tolerated when checking "exp" and "nbf"
+	RequireExpiry bool          `mapstructure:"require_expiry"` // Reject tokens without an "exp" claim
+	RolesClaim    string        `mapstructure:"roles_claim"`    // Claim holding the roles, dotted for nested claims (default: "roles")
+	QueryParam    string        `mapstructure:"query_param"`    // Query parameter carrying the token (default: "access_token")
+}
+
+// Enabled reports whether any verification key is configured
+func (o JWTOptions) Enabled() bool {
+	return len(o.Secrets) > 0 || o.JWKSFile != ""
+}
+
+// JWTAuthenticator authenticates requests with a signed JSON Web Token
+type JWTAuthenticator struct {
+	opts        JWTOptions
+	parser      *jwt.Parser
+	secrets     []verificationKey
+	jwks        []verificationKey
+	jwksModTime time.Time
+	jwksChecked time.Time
+	now         func() time.Time
+	mu          sync.Mutex
+}
+
+// NewJWTAuthenticator creates an authenticator that accepts tokens signed by
+// one of the configured secrets or JWKS keys
+func NewJWTAuthenticator(opts JWTOptions) (*JWTAuthenticator, error) {
+	if !opts.Enabled() {
+		return nil, errors.New("JWT authentication needs a secret or a JWKS file")
+	}
+	if opts.RolesClaim == "" {
+		opts.RolesClaim = "roles"
+	}
+	if opts.QueryParam == "" {
+		opts.QueryParam = defaultTokenQueryParam
+	}
+
+	a := &JWTAuthenticator{opts: opts, now: time.Now}
+	parserOptions := []jwt.ParserOption{
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithLeeway(opts.Leeway),
+		jwt.WithTimeFunc(func() time.Time { return a.now() }),
+	}
+	if opts.Issuer != "" {
+		parserOptions = append(parserOptions, jwt.WithIssuer(opts.Issuer))
+	}
+	if opts.Audience != "" {
+		parserOptions = append(parserOptions, jwt.WithAudience(opts.Audience))
+	}
+	if opts.RequireExpiry {
+		parserOptions = append(parserOptions, jwt.WithExpirationRequired())
+	}
+	a.parser = jwt.NewParser(parserOptions...)
+	for _, secret := range opts.Secrets {
+		if secret == "" {
+			return nil, errors.New("JWT secrets must not be empty")
+		}
+		a.secrets = append(a.secrets, verificationKey{key: []byte(secret)})
+	}
+	if opts.JWKSFile != "" {
+		if err := a.reloadJWKS(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Authenticate verifies the bearer token of a request (see BearerToken)
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*models.Principal, error) {
+	token := BearerToken(r, a.opts.QueryParam)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	return a.VerifyToken(token)
+}
+
+// VerifyToken checks the signature and claims of a token and returns the
+// principal it identifies
+func (a *JWTAuthenticator) VerifyToken(token string) (*models.Principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(token, claims, a.keyfunc); err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, ErrTokenExpired
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return a.principal(claims)
+}
+
+// principal builds the principal of a verified token
+func (a *JWTAuthenticator) principal(claims jwt.MapClaims) (*models.Principal, error) {
+	// Sessions and refreshes rely on the subject to tell callers apart
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: missing sub claim", ErrInvalidToken)
+	}
+
+	var expiresAt time.Time
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		expiresAt = exp.Time
+	}
+	return &models.Principal{
+		Subject:   subject,
+		Method:    models.AuthMethodJWT,
+		Roles:     stringList(LookupClaim(claims, a.opts.RolesClaim)),
+		Claims:    claims,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// keyfunc returns the keys that may have signed a token
+func (a *JWTAuthenticator) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	set := jwt.VerificationKeySet{}
+	for _, key := range a.keysFor(token.Method.Alg(), kid) {
+		set.Keys = append(set.Keys, key.key)
+	}
+	return set, nil
+}
+
+// keysFor returns the keys that may have signed a token. A key ID that is
+// not known yet makes the JWKS file be read again, so rotated keys are
+// picked up without a restart.
+func (a *JWTAuthenticator) keysFor(alg, kid string) []verificationKey {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if kid != "" && a.opts.JWKSFile != "" && !hasKeyID(a.jwks, kid) && a.now().Sub(a.jwksChecked) >= jwksRefreshInterval {
+		// Keep the previous keys if the file is unreadable for a moment
+		_ = a.reloadJWKSLocked()
+	}
+
+	var keys []verificationKey
+	for _, key := range append(a.jwks, a.secrets...) {
+		if kid != "" && key.id != "" && key.id != kid {
+			continue
+		}
+		if key.alg != "" && key.alg != alg {
+			continue
+		}
+		if keyFits(alg, key.key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// reloadJWKS reads the JWKS file
+func (a *JWTAuthenticator) reloadJWKS() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reloadJWKSLocked()
+}
+
+// reloadJWKSLocked reads the JWKS file if it changed. Caller must hold a.mu.
+func (a *JWTAuthenticator) reloadJWKSLocked() error {
+	a.jwksChecked = a.now()
+
+	info, err := os.Stat(a.opts.JWKSFile)
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	if info.ModTime().Equal(a.jwksModTime) && a.jwks != nil {
+		return nil
+	}
+
+	keys, err := loadJWKS(a.opts.JWKSFile)
+	if err != nil {
+		return err
+	}
+	a.jwks = keys
+	a.jwksModTime = info.ModTime()
+	return nil
+}
+
+// hasKeyID reports whether a key with the given ID is known
+func hasKeyID(keys []verificationKey, kid string) bool {
+	for _, key := range keys {
+		if key.id == kid {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupClaim returns the value of a claim; dotted paths address nested
+// objects, e.g. "realm_access.roles"
+func LookupClaim(claims map[string]interface{}, path string) interface{} {
+	if v, ok := claims[path]; ok {
+		return v
+	}
+
+	var current interface{} = claims
+	for _, part := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if current, ok = object[part]; !ok {
+			return nil
+		}
+	}
+	return current
+}
+
+// stringList converts a claim holding a list of strings or a space separated
+// string into a slice
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	default:
+		return nil
+	}
+}
+
+// signingMethods lists the accepted "alg" values; "none" is never accepted
+var signingMethods = []string{
+	"HS256", "HS384", "HS512",
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+}
+
+// keyFits reports whether a key can verify an algorithm, so an RSA public key
+// cannot be abused as an HMAC secret and EC keys only verify their curve
+func keyFits(alg string, key interface{}) bool {
+	switch alg[:2] {
+	case "HS":
+		_, ok := key.([]byte)
+		return ok
+	case "RS", "PS":
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		bits := map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}[alg]
+		return ok && pub.Curve.Params().BitSize == bits
+	default:
+		return false
+	}
+}
@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "test-secret-with-enough-entropy"
+
+// encodeSegment base64url-encodes the JSON of v
+func encodeSegment(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signHS256 creates an HS256 token
+func signHS256(t *testing.T, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	input := encodeSegment(t, map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signRS256 creates an RS256 token with a key ID
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	input := encodeSegment(t, map[string]string{"alg": "RS256", "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// signES256 creates an ES256 token with a key ID
+func signES256(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	input := encodeSegment(t, map[string]string{"alg": "ES256", "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// writeJWKS writes the public keys to a JWKS file
+func writeJWKS(t *testing.T, path string, keys map[string]crypto.PublicKey) {
+	t.Helper()
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	var jwks []map[string]string
+	for kid, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			jwks = append(jwks, map[string]string{
+				"kty": "RSA", "kid": kid, "use": "sig",
+				"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			x, y := make([]byte, 32), make([]byte, 32)
+			key.X.FillBytes(x)
+			key.Y.FillBytes(y)
+			jwks = append(jwks, map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(x), "y": b64(y)})
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{"keys": jwks})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+}
+
+func TestJWT_HMAC(t *testing.T) {
+	a, err := NewJWTAuthenticator(JWTOptions{Secrets: []string{"old-secret", testSecret}})
+	require.NoError(t, err)
+
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	principal, err := a.VerifyToken(signHS256(t, testSecret, map[string]interface{}{
+		"sub":    "alice",
+		"exp":    exp.Unix(),
+		"roles":  []string{"reader", "admin"},
+		"tenant": "acme",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", principal.Subject)
+	assert.Equal(t, models.AuthMethodJWT, principal.Method)
+	assert.Equal(t, []string{"reader", "admin"}, principal.Roles)
+	assert.True(t, principal.HasRole("admin"))
+	assert.Equal(t, "acme", principal.Claims["tenant"])
+	assert.True(t, exp.Equal(principal.ExpiresAt))
+
+	_, err = a.VerifyToken(signHS256(t, "wrong-secret", map[string]interface{}{"sub": "alice"}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = a.VerifyToken("not-a-token")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestJWT_RejectsUnsignedTokens(t *testing.T) {
+	a, err := NewJWTAuthenticator(JWTOptions{Secrets: []string{testSecret}})
+	require.NoError(t, err)
+
+	token := encodeSegment(t, map[string]string{"alg": "none"}) + "." + encodeSegment(t, map[string]interface{}{"sub": "mallory"}) + "."
+	_, err = a.VerifyToken(token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestJWT_TimeClaims(t *testing.T) {
+	a, err := NewJWTAuthenticator(JWTOptions{Secrets: []string{testSecret}, Leeway: 30 * time.Second})
+	require.NoError(t, err)
+	now := time.Now()
+
+	_, err = a.VerifyToken(signHS256(t, testSecret, map[string]interface{}{"exp": now.Add(-time.Minute).Unix()}))
+	assert.ErrorIs(t, err, ErrTokenExpired)
+
+	// Within the leeway
+	_, err = a.VerifyToken(signHS256(t, testSecret, map[string]interface{}{"sub": "svc", "exp": now.Add(-10 * time.Second).Unix()}))
+	assert.NoError(t, err)
+
+	_, err = a.VerifyToken(signHS256(t, testSecret, map[string]interface{}{"nbf": now.Add(time.Minute).Unix()}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// Tokens without expiry are only accepted if allowed
+	_, err = a.VerifyToken(signHS256(t, testSecret, map[string]interface{}{"sub": "svc"}))
+	assert.NoError(t, err)
+
+	strict, err := NewJWTAuthenticator(JWTOptions{Secrets: []string{testSecret}, RequireExpiry: true})
+	require.NoError(t, err)
+	_, err = strict.VerifyToken(signHS256(t, testSecret, map[string]interface{}{"sub": "svc"}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestJWT_RequiresSubject(t *testing.T) {
+	a, err := NewJWTAuthenticator(JWTOptions{Secrets: []string{testSecret}})
+	require.NoError(t, err)
+
+	for _, claims := range []map[string]interface{}{{}, {"sub": ""}, {"sub": 42}} {
+		_, err = a.VerifyToken(signHS256(t, testSecret, claims))
+		assert.ErrorIs(t, err, ErrInvalidToken, claims)
+	}
+}
+
+func TestJWT_IssuerAudienceAndNestedRoles(t *testing.T) {
+	a, err := NewJWTAuthenticator(JWTOptions{
+		Secrets:    []string{testSecret},
+		Issuer:     "https://idp.example.com",
+		Audience:   "aktuell",
+		RolesClaim: "realm_access.roles",
+	})
+	require.NoError(t, err)
+
+	principal, err := a.VerifyToken(signHS256(t, testSecret, map[string]interface{}{
+		"sub":          "alice",
+		"iss":          "https://idp.example.com",
+		"aud":          []string{"other", "aktuell"},
+		"realm_access": map[string]interface{}{"roles": []string{"editor"}},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"editor"}, principal.Roles)
+
+	_, err = a.VerifyToken(signHS256(t, testSecret, map[string]interface{}{"sub": "alice", "iss": "https://evil.example.com", "aud": "aktuell"}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = a.VerifyToken(signHS256(t, testSecret, map[string]interface{}{"sub": "alice", "iss": "https://idp.example.com", "aud": "other"}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestJWT_JWKSKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, map[string]crypto.PublicKey{"rsa-1": &rsaKey.PublicKey, "ec-1": &ecKey.PublicKey})
+
+	a, err := NewJWTAuthenticator(JWTOptions{JWKSFile: path})
+	require.NoError(t, err)
+
+	principal, err := a.VerifyToken(signRS256(t, rsaKey, "rsa-1", map[string]interface{}{"sub": "bob"}))
+	require.NoError(t, err)
+	assert.Equal(t, "bob", principal.Subject)
+
+	principal, err = a.VerifyToken(signES256(t, ecKey, "ec-1", map[string]interface{}{"sub": "carol"}))
+	require.NoError(t, err)
+	assert.Equal(t, "carol", principal.Subject)
+
+	// A token signed by another key is rejected
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = a.VerifyToken(signRS256(t, otherKey, "rsa-1", map[string]interface{}{"sub": "mallory"}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// The RSA public key cannot be used as an HMAC secret
+	forged := signHS256(t, string(rsaKey.PublicKey.N.Bytes()), map[string]interface{}{"sub": "mallory"})
+	_, err = a.VerifyToken(forged)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestJWT_ReloadsJWKSForUnknownKeyID(t *testing.T) {
+	first, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	second, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, map[string]crypto.PublicKey{"k1": &first.PublicKey})
+
+	a, err := NewJWTAuthenticator(JWTOptions{JWKSFile: path})
+	require.NoError(t, err)
+	clock := time.Now()
+	a.now = func() time.Time { return clock }
+
+	// Rotate the keys
+	writeJWKS(t, path, map[string]crypto.PublicKey{"k1": &first.PublicKey, "k2": &second.PublicKey})
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+
+	token := signRS256(t, second, "k2", map[string]interface{}{"sub": "dave"})
+	_, err = a.VerifyToken(token)
+	assert.ErrorIs(t, err, ErrInvalidToken, "the file is not checked again right away")
+
+	clock = clock.Add(jwksRefreshInterval)
+	_, err = a.VerifyToken(token)
+	assert.NoError(t, err)
+}
+
+func TestNewJWTAuthenticator_Validation(t *testing.T) {
+	_, err := NewJWTAuthenticator(JWTOptions{})
+	assert.Error(t, err)
+
+	_, err = NewJWTAuthenticator(JWTOptions{JWKSFile: filepath.Join(t.TempDir(), "missing.json")})
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"keys":[{"kty":"EC","crv":"P-256","x":"AA","y":"AA"}]}`), 0o600))
+	_, err = NewJWTAuthenticator(JWTOptions{JWKSFile: path})
+	assert.Error(t, err)
+}
+
+func TestBearerToken(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws", nil)
+	assert.Empty(t, BearerToken(r, "access_token"))
+
+	r.Header.Set("Authorization", "Bearer from-header")
+	assert.Equal(t, "from-header", BearerToken(r, "access_token"))
+
+	r = httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Sec-WebSocket-Protocol", "aktuell, aktuell.bearer.from-protocol")
+	assert.Equal(t, "from-protocol", BearerToken(r, "access_token"))
+
+	r = httptest.NewRequest("GET", "/ws?access_token=from-query", nil)
+	assert.Equal(t, "from-query", BearerToken(r, "access_token"))
+	assert.Empty(t, BearerToken(r, ""))
+}
+
+func TestJWTAuthenticator_Authenticate(t *testing.T) {
+	a, err := NewJWTAuthenticator(JWTOptions{Secrets: []string{testSecret}})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/ws", nil)
+	_, err = a.Authenticate(r)
+	assert.ErrorIs(t, err, ErrNoCredentials)
+
+	r = httptest.NewRequest("GET", "/ws?access_token="+signHS256(t, testSecret, map[string]interface{}{"sub": "erin"}), nil)
+	principal, err := a.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "erin", principal.Subject)
+}
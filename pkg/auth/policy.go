@@ -0,0 +1,338 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"aktuell/pkg/models"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default decisions for principals that match no policy rule
+const (
+	PolicyDefaultDeny  = "deny"
+	PolicyDefaultAllow = "allow"
+)
+
+// PolicyConfig is the authorization policy as written in a policy file
+type PolicyConfig struct {
+	Default    string          `yaml:"default"` // Decision for principals no rule matches: "deny" (default) or "allow"
+	Rules      []PolicyRule    `yaml:"rules"`
+	Redactions []RedactionRule `yaml:"redactions"`
+}
+
+// PolicyRule grants the principals it matches operations on namespaces. A
+// rule matches a principal that has one of Roles (any role if empty) and all
+// Claims. Rules for unauthenticated connections set Anonymous.
+type PolicyRule struct {
+	Name       string                 `yaml:"name"`
+	Roles      []string               `yaml:"roles"`
+	Claims     map[string]interface{} `yaml:"claims"`     // Required claim values; dotted names address nested claims
+	Anonymous  bool                   `yaml:"anonymous"`  // Match connections without a principal instead
+	Namespaces []string               `yaml:"namespaces"` // "db.collection" patterns, e.g. "shop.*" or "*"
+	Operations []string               `yaml:"operations"` // subscribe, snapshot, write
+	// MaxSnapshot limits the documents of a snapshot (0: no limit)
+	MaxSnapshot int `yaml:"max_snapshot"`
+	// Filter restricts the documents the rule grants. String values may
+	// reference the principal, e.g. {tenantId: "{{claims.tenant}}"}.
+	Filter map[string]interface{} `yaml:"filter"`
+}
+
+// LoadPolicyFile reads a YAML policy file
+func LoadPolicyFile(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	var cfg PolicyConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", filename, err)
+	}
+	return NewPolicy(cfg)
+}
+
+// Policy decides which operations principals may perform on which namespaces
+type Policy struct {
+	allowByDefault bool
+	rules          []PolicyRule
+	redactionRules []RedactionRule
+}
+
+// NewPolicy validates a policy configuration
+func NewPolicy(cfg PolicyConfig) (*Policy, error) {
+	p := &Policy{}
+	switch strings.ToLower(cfg.Default) {
+	case "", PolicyDefaultDeny:
+	case PolicyDefaultAllow:
+		p.allowByDefault = true
+	default:
+		return nil, fmt.Errorf("policy default must be %q or %q, not %q", PolicyDefaultDeny, PolicyDefaultAllow, cfg.Default)
+	}
+
+	for i, rule := range cfg.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+			rule.Name = name
+		}
+		if len(rule.Namespaces) == 0 {
+			return nil, fmt.Errorf("policy rule %s: no namespaces", name)
+		}
+		if err := validatePatterns(rule.Namespaces); err != nil {
+			return nil, fmt.Errorf("policy rule %s: %w", name, err)
+		}
+		if len(rule.Operations) == 0 {
+			return nil, fmt.Errorf("policy rule %s: no operations", name)
+		}
+		for _, op := range rule.Operations {
+			switch op {
+			case models.AccessSubscribe, models.AccessSnapshot, models.AccessWrite:
+			default:
+				return nil, fmt.Errorf("policy rule %s: unknown operation %q", name, op)
+			}
+		}
+		if rule.MaxSnapshot < 0 {
+			return nil, fmt.Errorf("policy rule %s: max_snapshot must not be negative", name)
+		}
+		if rule.Anonymous && (len(rule.Roles) > 0 || len(rule.Claims) > 0) {
+			return nil, fmt.Errorf("policy rule %s: anonymous rules cannot require roles or claims", name)
+		}
+		if err := validateFilter(rule.Filter); err != nil {
+			return nil, fmt.Errorf("policy rule %s: invalid filter: %w", name, err)
+		}
+		p.rules = append(p.rules, rule)
+	}
+
+	for i, rule := range cfg.Redactions {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("redaction rule %s: %w", rule.Name, err)
+		}
+		p.redactionRules = append(p.redactionRules, rule)
+	}
+	return p, nil
+}
+
+// Authorize decides an access request; it returns nil if it is allowed. A
+// principal granted access by rules with filters may see the documents any of
+// them matches, one granted by a rule without filter all documents.
+func (p *Policy) Authorize(req *models.AccessRequest) *models.Denial {
+	namespace := namespaceOf(req.Database, req.Collection)
+
+	var matched, namespaceGranted, granted, unfiltered bool
+	var filters []interface{}
+	var filterErr error
+	maxSnapshot := -1 // -1: no granting rule yet, 0: unlimited
+	for _, rule := range p.rules {
+		if !rule.matches(req.Principal) {
+			continue
+		}
+		matched = true
+		if !rule.coversNamespace(namespace) {
+			continue
+		}
+		namespaceGranted = true
+		if !rule.grants(req.Operation) {
+			continue
+		}
+		if rule.Filter == nil {
+			unfiltered = true
+		} else {
+			filter, err := expandFilter(rule.Filter, req.Principal)
+			if err != nil {
+				// The rule cannot restrict this principal, so it grants nothing
+				filterErr = fmt.Errorf("policy rule %s: %w", rule.Name, err)
+				continue
+			}
+			filters = append(filters, filter)
+		}
+		granted = true
+		if rule.MaxSnapshot == 0 || maxSnapshot == 0 {
+			maxSnapshot = 0
+		} else if rule.MaxSnapshot > maxSnapshot {
+			maxSnapshot = rule.MaxSnapshot
+		}
+	}
+
+	if !matched && p.allowByDefault {
+		return nil
+	}
+	if !namespaceGranted {
+		return &models.Denial{
+			Code:    models.ErrorCodeForbidden,
+			Reason:  models.DenialNamespaceNotAllowed,
+			Message: fmt.Sprintf("Access denied: %s is not allowed for %s", namespace, describePrincipal(req.Principal)),
+		}
+	}
+	if !granted && filterErr != nil {
+		return &models.Denial{
+			Code:    models.ErrorCodeForbidden,
+			Reason:  models.DenialFilterUnresolved,
+			Message: fmt.Sprintf("Access denied: %v", filterErr),
+		}
+	}
+	if !granted {
+		return &models.Denial{
+			Code:    models.ErrorCodeForbidden,
+			Reason:  models.DenialOperationNotAllowed,
+			Message: fmt.Sprintf("Access denied: %s on %s is not allowed for %s", req.Operation, namespace, describePrincipal(req.Principal)),
+		}
+	}
+
+	if req.Operation == models.AccessSnapshot && maxSnapshot > 0 {
+		if req.SnapshotLimit == 0 {
+			req.SnapshotLimit = maxSnapshot
+		} else if req.SnapshotLimit > maxSnapshot {
+			return &models.Denial{
+				Code:    models.ErrorCodeForbidden,
+				Reason:  models.DenialSnapshotTooLarge,
+				Message: fmt.Sprintf("Access denied: snapshots of %s are limited to %d documents", namespace, maxSnapshot),
+			}
+		}
+	}
+
+	switch {
+	case unfiltered:
+		req.Filter = nil
+	case len(filters) == 1:
+		req.Filter = filters[0].(map[string]interface{})
+	default:
+		req.Filter = map[string]interface{}{"$or": filters}
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to a principal
+func (r *PolicyRule) matches(principal *models.Principal) bool {
+	if principal == nil {
+		return r.Anonymous
+	}
+	if r.Anonymous {
+		return false
+	}
+
+	if len(r.Roles) > 0 {
+		hasRole := false
+		for _, role := range r.Roles {
+			if principal.HasRole(role) {
+				hasRole = true
+				break
+			}
+		}
+		if !hasRole {
+			return false
+		}
+	}
+
+	for name, want := range r.Claims {
+		if !claimEquals(LookupClaim(principal.Claims, name), want) {
+			return false
+		}
+	}
+	return true
+}
+
+// coversNamespace reports whether one of the rule's patterns matches
+func (r *PolicyRule) coversNamespace(namespace string) bool {
+	return namespaceCovered(r.Namespaces, namespace)
+}
+
+// validatePatterns checks namespace patterns
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid namespace pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// namespaceCovered reports whether one of the patterns matches a namespace
+func namespaceCovered(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, ".") && pattern != "*" {
+			// A bare database name covers all of its collections
+			pattern += ".*"
+		}
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// grants reports whether the rule allows an operation
+func (r *PolicyRule) grants(operation string) bool {
+	for _, op := range r.Operations {
+		if op == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceOf returns the namespace of a database and collection. A whole
+// database is "db.*", which only patterns covering every collection match.
+func namespaceOf(database, collection string) string {
+	if collection == "" {
+		collection = "*"
+	}
+	return database + "." + collection
+}
+
+// claimEquals compares a claim with a configured value. Numbers compare by
+// value and list claims match if they contain the value.
+func claimEquals(claim, want interface{}) bool {
+	if list, ok := claim.([]interface{}); ok {
+		for _, item := range list {
+			if claimEquals(item, want) {
+				return true
+			}
+		}
+		return false
+	}
+	return claim != nil && fmt.Sprint(claim) == fmt.Sprint(want)
+}
+
+// describePrincipal names a principal in denial messages
+func describePrincipal(principal *models.Principal) string {
+	if principal == nil {
+		return "anonymous connections"
+	}
+	return fmt.Sprintf("%q", principal.Subject)
+}
+
+// PolicyValidator enforces a policy on top of the namespaces another
+// validator accepts
+type PolicyValidator struct {
+	models.SubscriptionValidator
+	policy *Policy
+}
+
+// NewPolicyValidator wraps a validator with a policy
+func NewPolicyValidator(next models.SubscriptionValidator, policy *Policy) *PolicyValidator {
+	return &PolicyValidator{SubscriptionValidator: next, policy: policy}
+}
+
+// Authorize implements models.AuthorizingValidator
+func (v *PolicyValidator) Authorize(req *models.AccessRequest) *models.Denial {
+	if v.SubscriptionValidator != nil && !v.IsValidSubscription(req.Database, req.Collection) {
+		return &models.Denial{
+			Code:    models.ErrorCodeInvalidSubscription,
+			Reason:  models.DenialNamespaceNotConfigured,
+			Message: fmt.Sprintf("Invalid subscription: database '%s' collection '%s' is not configured on the server", req.Database, req.Collection),
+		}
+	}
+	return v.policy.Authorize(req)
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"aktuell/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicy = `
+rules:
+  - name: tenant-readers
+    roles: [reader]
+    claims:
+      org.tenantId: acme
+    namespaces: ["shop.*"]
+    operations: [subscribe, snapshot]
+    max_snapshot: 100
+  - name: public
+    anonymous: true
+    namespaces: [public.news]
+    operations: [subscribe]
+  - name: admins
+    roles: [admin]
+    namespaces: ["*"]
+    operations: [subscribe, snapshot, write]
+`
+
+func writePolicy(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "policy.yaml")
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0o600))
+	return filename
+}
+
+func TestPolicy_Authorize(t *testing.T) {
+	policy, err := LoadPolicyFile(writePolicy(t, testPolicy))
+	require.NoError(t, err)
+
+	reader := &models.Principal{Subject: "alice", Roles: []string{"reader"}, Claims: map[string]interface{}{
+		"org": map[string]interface{}{"tenantId": "acme"},
+	}}
+	otherTenant := &models.Principal{Subject: "bob", Roles: []string{"reader"}, Claims: map[string]interface{}{
+		"org": map[string]interface{}{"tenantId": "globex"},
+	}}
+	admin := &models.Principal{Subject: "root", Roles: []string{"admin"}}
+
+	tests := []struct {
+		name      string
+		principal *models.Principal
+		database  string
+		coll      string
+		operation string
+		reason    string
+	}{
+		{"reader subscribes", reader, "shop", "orders", models.AccessSubscribe, ""},
+		{"reader snapshots", reader, "shop", "orders", models.AccessSnapshot, ""},
+		{"reader cannot write", reader, "shop", "orders", models.AccessWrite, models.DenialOperationNotAllowed},
+		{"reader whole database", reader, "shop", "", models.AccessSubscribe, ""},
+		{"reader other database", reader, "billing", "invoices", models.AccessSubscribe, models.DenialNamespaceNotAllowed},
+		{"claim mismatch", otherTenant, "shop", "orders", models.AccessSubscribe, models.DenialNamespaceNotAllowed},
+		{"anonymous public", nil, "public", "news", models.AccessSubscribe, ""},
+		{"anonymous elsewhere", nil, "shop", "orders", models.AccessSubscribe, models.DenialNamespaceNotAllowed},
+		{"admin anywhere", admin, "billing", "", models.AccessWrite, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			denial := policy.Authorize(&models.AccessRequest{
+				Principal:  tt.principal,
+				Database:   tt.database,
+				Collection: tt.coll,
+				Operation:  tt.operation,
+			})
+			if tt.reason == "" {
+				assert.Nil(t, denial)
+				return
+			}
+			require.NotNil(t, denial)
+			assert.Equal(t, models.ErrorCodeForbidden, denial.Code)
+			assert.Equal(t, tt.reason, denial.Reason)
+		})
+	}
+}
+
+func TestPolicy_SnapshotLimit(t *testing.T) {
+	policy, err := LoadPolicyFile(writePolicy(t, testPolicy))
+	require.NoError(t, err)
+	reader := &models.Principal{Subject: "alice", Roles: []string{"reader"}, Claims: map[string]interface{}{
+		"org": map[string]interface{}{"tenantId": "acme"},
+	}}
+
+	req := &models.AccessRequest{Principal: reader, Database: "shop", Collection: "orders", Operation: models.AccessSnapshot}
+	assert.Nil(t, policy.Authorize(req))
+	assert.Equal(t, 100, req.SnapshotLimit)
+
+	req = &models.AccessRequest{Principal: reader, Database: "shop", Collection: "orders", Operation: models.AccessSnapshot, SnapshotLimit: 20}
+	assert.Nil(t, policy.Authorize(req))
+	assert.Equal(t, 20, req.SnapshotLimit)
+
+	req.SnapshotLimit = 500
+	denial := policy.Authorize(req)
+	require.NotNil(t, denial)
+	assert.Equal(t, models.DenialSnapshotTooLarge, denial.Reason)
+
+	// Another role without a maximum lifts the limit
+	reader.Roles = append(reader.Roles, "admin")
+	assert.Nil(t, policy.Authorize(req))
+}
+
+func TestPolicy_Default(t *testing.T) {
+	policy, err := NewPolicy(PolicyConfig{Default: PolicyDefaultAllow, Rules: []PolicyRule{
+		{Roles: []string{"reader"}, Namespaces: []string{"shop.orders"}, Operations: []string{models.AccessSubscribe}},
+	}})
+	require.NoError(t, err)
+
+	// Principals no rule matches get the default
+	assert.Nil(t, policy.Authorize(&models.AccessRequest{Principal: &models.Principal{Subject: "x"}, Database: "any", Operation: models.AccessWrite}))
+
+	// Matched principals are limited to their grants
+	denial := policy.Authorize(&models.AccessRequest{Principal: &models.Principal{Subject: "r", Roles: []string{"reader"}}, Database: "any", Operation: models.AccessSubscribe})
+	require.NotNil(t, denial)
+	assert.Equal(t, models.DenialNamespaceNotAllowed, denial.Reason)
+}
+
+func TestPolicy_Validation(t *testing.T) {
+	invalid := map[string]string{
+		"unknown default":   "default: maybe\n",
+		"no namespaces":     "rules:\n  - operations: [subscribe]\n",
+		"no operations":     "rules:\n  - namespaces: [shop]\n",
+		"unknown operation": "rules:\n  - namespaces: [shop]\n    operations: [delete]\n",
+		"bad pattern":       "rules:\n  - namespaces: [\"shop.[\"]\n    operations: [subscribe]\n",
+		"anonymous roles":   "rules:\n  - anonymous: true\n    roles: [reader]\n    namespaces: [shop]\n    operations: [subscribe]\n",
+		"unknown field":     "rules:\n  - namespace: [shop]\n    operations: [subscribe]\n",
+	}
+	for name, content := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadPolicyFile(writePolicy(t, content))
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := LoadPolicyFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestPolicyValidator_NotConfigured(t *testing.T) {
+	policy, err := NewPolicy(PolicyConfig{Default: PolicyDefaultAllow})
+	require.NoError(t, err)
+	validator := NewPolicyValidator(configuredOnly{"shop"}, policy)
+
+	assert.Nil(t, validator.Authorize(&models.AccessRequest{Database: "shop", Collection: "orders", Operation: models.AccessSubscribe}))
+	denial := validator.Authorize(&models.AccessRequest{Database: "billing", Operation: models.AccessSubscribe})
+	require.NotNil(t, denial)
+	assert.Equal(t, models.ErrorCodeInvalidSubscription, denial.Code)
+	assert.Equal(t, models.DenialNamespaceNotConfigured, denial.Reason)
+}
+
+func TestPolicy_Filters(t *testing.T) {
+	policy, err := LoadPolicyFile(writePolicy(t, `
+rules:
+  - name: tenants
+    roles: [reader]
+    namespaces: [shop]
+    operations: [subscribe, snapshot]
+    filter:
+      tenantId: "{{claims.tenant}}"
+  - name: own-drafts
+    roles: [author]
+    namespaces: [shop]
+    operations: [subscribe]
+    filter:
+      author: "{{subject}}"
+  - name: support
+    roles: [support]
+    namespaces: [shop]
+    operations: [subscribe]
+`))
+	require.NoError(t, err)
+
+	authorize := func(principal *models.Principal) (*models.AccessRequest, *models.Denial) {
+		req := &models.AccessRequest{Principal: principal, Database: "shop", Collection: "orders", Operation: models.AccessSubscribe}
+		return req, policy.Authorize(req)
+	}
+
+	req, denial := authorize(&models.Principal{Subject: "alice", Roles: []string{"reader"}, Claims: map[string]interface{}{"tenant": "acme"}})
+	require.Nil(t, denial)
+	assert.Equal(t, map[string]interface{}{"tenantId": "acme"}, req.Filter)
+
+	// Filters of several rules widen each other
+	req, denial = authorize(&models.Principal{Subject: "bob", Roles: []string{"reader", "author"}, Claims: map[string]interface{}{"tenant": "acme"}})
+	require.Nil(t, denial)
+	assert.ElementsMatch(t, []interface{}{
+		map[string]interface{}{"tenantId": "acme"},
+		map[string]interface{}{"author": "bob"},
+	}, req.Filter["$or"])
+
+	// A rule without filter grants every document
+	req, denial = authorize(&models.Principal{Subject: "carol", Roles: []string{"reader", "support"}, Claims: map[string]interface{}{"tenant": "acme"}})
+	require.Nil(t, denial)
+	assert.Nil(t, req.Filter)
+
+	// A reader without tenant claim must not see every tenant
+	_, denial = authorize(&models.Principal{Subject: "dave", Roles: []string{"reader"}})
+	require.NotNil(t, denial)
+	assert.Equal(t, models.DenialFilterUnresolved, denial.Reason)
+
+	_, err = NewPolicy(PolicyConfig{Rules: []PolicyRule{{
+		Namespaces: []string{"shop"},
+		Operations: []string{models.AccessSubscribe},
+		Filter:     map[string]interface{}{"$where": "true"},
+	}}})
+	assert.Error(t, err)
+}
+
+// configuredOnly is a validator that accepts whole databases
+type configuredOnly []string
+
+func (c configuredOnly) IsValidSubscription(database, collection string) bool {
+	for _, db := range c {
+		if db == database {
+			return true
+		}
+	}
+	return false
+}
+
+func (c configuredOnly) GetConfiguredDatabases() []models.DatabaseConfig {
+	return nil
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"aktuell/pkg/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Redaction actions
+const (
+	RedactRemove   = "remove"   // Drop the field
+	RedactHash     = "hash"     // Replace the value with its SHA-256
+	RedactTruncate = "truncate" // Keep the first Length characters
+	RedactMask     = "mask"     // Replace all but the last Keep characters with '*'
+)
+
+// RedactionRule obscures fields of the documents in its namespaces. It applies
+// to principals with one of Roles (everyone, including anonymous connections,
+// if empty) unless they have one of ExceptRoles.
+type RedactionRule struct {
+	Name        string           `yaml:"name"`
+	Namespaces  []string         `yaml:"namespaces"` // "db.collection" patterns like those of policy rules
+	Roles       []string         `yaml:"roles"`
+	ExceptRoles []string         `yaml:"except_roles"`
+	Fields      []FieldRedaction `yaml:"fields"`
+}
+
+// FieldRedaction obscures a dotted field path. Paths run through arrays, so
+// "addresses.street" covers the street of every address.
+type FieldRedaction struct {
+	Path   string `yaml:"path"`
+	Action string `yaml:"action"`
+	Length int    `yaml:"length"` // Characters kept by truncate
+	Keep   int    `yaml:"keep"`   // Trailing characters left visible by mask
+	Salt   string `yaml:"salt"`   // Prepended to values before hashing
+}
+
+// validate checks a redaction rule
+func (r *RedactionRule) validate() error {
+	if len(r.Namespaces) == 0 {
+		return fmt.Errorf("no namespaces")
+	}
+	if err := validatePatterns(r.Namespaces); err != nil {
+		return err
+	}
+	if len(r.Fields) == 0 {
+		return fmt.Errorf("no fields")
+	}
+	for _, field := range r.Fields {
+		if field.Path == "" || strings.HasPrefix(field.Path, "$") {
+			return fmt.Errorf("invalid field path %q", field.Path)
+		}
+		switch field.Action {
+		case RedactRemove, RedactHash:
+		case RedactTruncate:
+			if field.Length <= 0 {
+				return fmt.Errorf("field %s: truncate needs a positive length", field.Path)
+			}
+		case RedactMask:
+			if field.Keep < 0 {
+				return fmt.Errorf("field %s: keep must not be negative", field.Path)
+			}
+		default:
+			return fmt.Errorf("field %s: unknown action %q", field.Path, field.Action)
+		}
+	}
+	return nil
+}
+
+// appliesTo reports whether the rule obscures fields for a principal
+func (r *RedactionRule) appliesTo(principal *models.Principal) bool {
+	for _, role := range r.ExceptRoles {
+		if principal.HasRole(role) {
+			return false
+		}
+	}
+	if len(r.Roles) == 0 {
+		return true
+	}
+	for _, role := range r.Roles {
+		if principal.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactions returns the field redactions for a principal in a namespace
+func (p *Policy) redactions(principal *models.Principal, database, collection string) []FieldRedaction {
+	namespace := namespaceOf(database, collection)
+	var fields []FieldRedaction
+	for i := range p.redactionRules {
+		rule := &p.redactionRules[i]
+		if namespaceCovered(rule.Namespaces, namespace) && rule.appliesTo(principal) {
+			fields = append(fields, rule.Fields...)
+		}
+	}
+	return fields
+}
+
+// RedactChange implements models.Redactor. The change is copied before any
+// field is touched, as it is shared by all subscribers.
+func (p *Policy) RedactChange(principal *models.Principal, change *models.ChangeEvent) *models.ChangeEvent {
+	fields := p.redactions(principal, change.Database, change.Collection)
+	if len(fields) == 0 || (change.FullDocument == nil && change.UpdatedFields == nil) {
+		return change
+	}
+
+	redacted := *change
+	if change.FullDocument != nil {
+		redacted.FullDocument = models.CopyDocument(change.FullDocument)
+		for _, field := range fields {
+			redactField(redacted.FullDocument, strings.Split(field.Path, "."), field)
+		}
+	}
+	if change.UpdatedFields != nil {
+		redacted.UpdatedFields = models.CopyDocument(change.UpdatedFields)
+		for _, field := range fields {
+			redactUpdatedFields(redacted.UpdatedFields, field)
+		}
+	}
+	return &redacted
+}
+
+// RedactDocuments implements models.Redactor. Documents are copied before
+// any field is touched.
+func (p *Policy) RedactDocuments(principal *models.Principal, database, collection string, documents []map[string]interface{}) []map[string]interface{} {
+	fields := p.redactions(principal, database, collection)
+	if len(fields) == 0 {
+		return documents
+	}
+
+	redacted := make([]map[string]interface{}, len(documents))
+	for i, doc := range documents {
+		redacted[i] = models.CopyDocument(doc)
+		for _, field := range fields {
+			redactField(redacted[i], strings.Split(field.Path, "."), field)
+		}
+	}
+	return redacted
+}
+
+// HasRedactions reports whether the policy obscures any fields
+func (p *Policy) HasRedactions() bool {
+	return len(p.redactionRules) > 0
+}
+
+// redactField applies a redaction to the field at path within a document
+func redactField(doc map[string]interface{}, path []string, field FieldRedaction) {
+	value, ok := doc[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		if field.Action == RedactRemove {
+			delete(doc, path[0])
+			return
+		}
+		doc[path[0]] = redactValue(value, field)
+		return
+	}
+	redactWithin(value, path[1:], field)
+}
+
+// redactWithin applies a redaction to a path below a value, descending into
+// every element of arrays
+func redactWithin(value interface{}, path []string, field FieldRedaction) {
+	if sub, ok := asDocument(value); ok {
+		redactField(sub, path, field)
+		return
+	}
+	if list, ok := asList(value); ok {
+		for _, item := range list {
+			redactWithin(item, path, field)
+		}
+	}
+}
+
+// redactUpdatedFields applies a redaction to the dotted keys of an update,
+// which may name the field itself ("profile.email"), an enclosing document
+// ("profile") or a part of the field ("phones.0"). Array indices in keys are
+// skipped when comparing them with the field path.
+func redactUpdatedFields(updated map[string]interface{}, field FieldRedaction) {
+	path := strings.Split(field.Path, ".")
+	for key, value := range updated {
+		var keyPath []string
+		for _, segment := range strings.Split(key, ".") {
+			if _, err := strconv.Atoi(segment); err != nil {
+				keyPath = append(keyPath, segment)
+			}
+		}
+
+		switch {
+		case hasPathPrefix(path, keyPath) && len(path) > len(keyPath):
+			// The update replaces a document or array containing the field
+			redactWithin(value, path[len(keyPath):], field)
+		case hasPathPrefix(keyPath, path):
+			// The update sets the field or a part of it
+			if field.Action == RedactRemove {
+				delete(updated, key)
+			} else {
+				updated[key] = redactValue(value, field)
+			}
+		}
+	}
+}
+
+// hasPathPrefix reports whether prefix leads path
+func hasPathPrefix(path, prefix []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// redactValue hashes, truncates or masks a value, or every element of an
+// array. Values that cannot be truncated or masked, like numbers or
+// documents, are replaced by nil rather than leaked.
+func redactValue(value interface{}, field FieldRedaction) interface{} {
+	if list, ok := asList(value); ok {
+		out := make([]interface{}, len(list))
+		for i, item := range list {
+			out[i] = redactValue(item, field)
+		}
+		return out
+	}
+	if value == nil {
+		return nil
+	}
+
+	switch field.Action {
+	case RedactHash:
+		sum := sha256.Sum256([]byte(field.Salt + scalarString(value)))
+		return hex.EncodeToString(sum[:])
+	case RedactTruncate:
+		s, ok := value.(string)
+		if !ok {
+			return nil
+		}
+		if runes := []rune(s); len(runes) > field.Length {
+			return string(runes[:field.Length])
+		}
+		return s
+	case RedactMask:
+		s, ok := value.(string)
+		if !ok {
+			return nil
+		}
+		runes := []rune(s)
+		for i := 0; i < len(runes)-field.Keep; i++ {
+			runes[i] = '*'
+		}
+		return string(runes)
+	}
+	return nil
+}
+
+// scalarString formats a value for hashing so equal values hash alike in
+// change events and snapshots
+func scalarString(value interface{}) string {
+	if oid, ok := value.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	if n, ok := number(value); ok {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"aktuell/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const testRedactions = `
+default: allow
+redactions:
+  - name: user-pii
+    namespaces: [app.users]
+    except_roles: [admin]
+    fields:
+      - {path: passwordHash, action: remove}
+      - {path: email, action: hash, salt: "s1"}
+      - {path: phones, action: mask, keep: 2}
+      - {path: addresses.street, action: truncate, length: 3}
+  - name: support-notes
+    namespaces: [app]
+    roles: [support]
+    fields:
+      - {path: profile.notes, action: remove}
+`
+
+func sha(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func testUser() map[string]interface{} {
+	return map[string]interface{}{
+		"_id":          "u1",
+		"email":        "ada@example.com",
+		"passwordHash": "$2a$10$secret",
+		"phones":       primitive.A{"+4912345", "+4967890"},
+		"addresses": primitive.A{
+			primitive.M{"street": "Main Street 1", "city": "Berlin"},
+			primitive.M{"street": "Side Road", "city": "Hamburg"},
+		},
+		"profile": primitive.M{"notes": "vip", "name": "Ada"},
+	}
+}
+
+func TestRedactChange_FullDocument(t *testing.T) {
+	policy, err := LoadPolicyFile(writePolicy(t, testRedactions))
+	require.NoError(t, err)
+
+	change := &models.ChangeEvent{OperationType: models.OperationInsert, Database: "app", Collection: "users", FullDocument: testUser()}
+	redacted := policy.RedactChange(&models.Principal{Subject: "bob", Roles: []string{"support"}}, change)
+
+	assert.Equal(t, map[string]interface{}{
+		"_id":    "u1",
+		"email":  sha("s1ada@example.com"),
+		"phones": []interface{}{"******45", "******90"},
+		"addresses": []interface{}{
+			map[string]interface{}{"street": "Mai", "city": "Berlin"},
+			map[string]interface{}{"street": "Sid", "city": "Hamburg"},
+		},
+		"profile": map[string]interface{}{"name": "Ada"},
+	}, redacted.FullDocument)
+
+	// The shared event is left alone
+	assert.Equal(t, testUser(), change.FullDocument)
+
+	// Admins are exempt from the first rule, other namespaces from both
+	admin := policy.RedactChange(&models.Principal{Subject: "root", Roles: []string{"admin"}}, change)
+	assert.Same(t, change, admin)
+	other := &models.ChangeEvent{Database: "billing", Collection: "users", FullDocument: testUser()}
+	assert.Same(t, other, policy.RedactChange(nil, other))
+
+	// Anonymous connections get the rules without roles
+	anonymous := policy.RedactChange(nil, change)
+	assert.NotContains(t, anonymous.FullDocument, "passwordHash")
+	assert.Equal(t, "vip", anonymous.FullDocument["profile"].(map[string]interface{})["notes"])
+}
+
+func TestRedactChange_UpdatedFields(t *testing.T) {
+	policy, err := LoadPolicyFile(writePolicy(t, testRedactions))
+	require.NoError(t, err)
+
+	change := &models.ChangeEvent{
+		OperationType: models.OperationUpdate,
+		Database:      "app",
+		Collection:    "users",
+		UpdatedFields: map[string]interface{}{
+			"passwordHash":       "$2a$10$new",
+			"email":              "new@example.com",
+			"phones.1":           "+4955555",
+			"addresses.0.street": "Long Avenue",
+			"addresses.1":        primitive.M{"street": "Short Lane", "city": "Bonn"},
+			"profile":            primitive.M{"notes": "changed", "name": "Ada"},
+			"profile.name":       "Ada L.",
+		},
+	}
+	redacted := policy.RedactChange(&models.Principal{Subject: "bob", Roles: []string{"support"}}, change)
+
+	assert.Equal(t, map[string]interface{}{
+		"email":              sha("s1new@example.com"),
+		"phones.1":           "******55",
+		"addresses.0.street": "Lon",
+		"addresses.1":        map[string]interface{}{"street": "Sho", "city": "Bonn"},
+		"profile":            map[string]interface{}{"name": "Ada"},
+		"profile.name":       "Ada L.",
+	}, redacted.UpdatedFields)
+	assert.Contains(t, change.UpdatedFields, "passwordHash")
+}
+
+func TestRedactDocuments(t *testing.T) {
+	policy, err := LoadPolicyFile(writePolicy(t, testRedactions))
+	require.NoError(t, err)
+
+	docs := []map[string]interface{}{testUser()}
+	redacted := policy.RedactDocuments(nil, "app", "users", docs)
+	require.Len(t, redacted, 1)
+	assert.NotContains(t, redacted[0], "passwordHash")
+	assert.Equal(t, sha("s1ada@example.com"), redacted[0]["email"], "hashes match those of change events")
+	assert.Contains(t, docs[0], "passwordHash")
+}
+
+func TestRedactValue_NonStrings(t *testing.T) {
+	assert.Nil(t, redactValue(int32(42), FieldRedaction{Action: RedactMask}), "numbers cannot be masked")
+	assert.Nil(t, redactValue(primitive.M{"a": 1}, FieldRedaction{Action: RedactTruncate, Length: 1}))
+	assert.Equal(t, sha("42"), redactValue(int64(42), FieldRedaction{Action: RedactHash}))
+	assert.Equal(t, "日本", redactValue("日本語", FieldRedaction{Action: RedactTruncate, Length: 2}))
+}
+
+func TestRedaction_Validation(t *testing.T) {
+	invalid := map[string]string{
+		"no namespaces":   "redactions:\n  - fields: [{path: a, action: remove}]\n",
+		"no fields":       "redactions:\n  - namespaces: [app]\n",
+		"unknown action":  "redactions:\n  - namespaces: [app]\n    fields: [{path: a, action: encrypt}]\n",
+		"truncate length": "redactions:\n  - namespaces: [app]\n    fields: [{path: a, action: truncate}]\n",
+		"empty path":      "redactions:\n  - namespaces: [app]\n    fields: [{action: remove}]\n",
+	}
+	for name, content := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadPolicyFile(writePolicy(t, content))
+			assert.Error(t, err)
+		})
+	}
+}
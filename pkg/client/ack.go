@@ -0,0 +1,133 @@
+package client
+
+import (
+	"aktuell/pkg/models"
+)
+
+// ackState tracks the delivery sequence numbers of an acknowledged
+// subscription. Guarded by the owning Subscription's mutex.
+type ackState struct {
+	manual bool
+	seqs   map[*models.ChangeEvent]uint64 // Delivered events awaiting acknowledgement
+	events map[uint64]*models.ChangeEvent // Unacknowledged events by sequence number
+	acked  map[uint64]bool                // Acknowledged sequence numbers above floor
+	floor  uint64                         // Every sequence number up to here is acknowledged
+}
+
+// newAckState creates the tracking state for a new server-side subscription
+func newAckState(manual bool) *ackState {
+	return &ackState{
+		manual: manual,
+		seqs:   make(map[*models.ChangeEvent]uint64),
+		events: make(map[uint64]*models.ChangeEvent),
+		acked:  make(map[uint64]bool),
+	}
+}
+
+// track records a delivered event and reports whether it is new. Events
+// already acknowledged are duplicates of a redelivery and must not be handed
+// to the application again.
+func (a *ackState) track(change *models.ChangeEvent, seq uint64) bool {
+	if seq <= a.floor || a.acked[seq] {
+		return false
+	}
+	if previous, ok := a.events[seq]; ok {
+		// Redelivered before we got to acknowledge it; the new copy replaces it
+		delete(a.seqs, previous)
+	}
+	a.events[seq] = change
+	a.seqs[change] = seq
+	return true
+}
+
+// ack marks an event as acknowledged. It returns the acknowledgement to send,
+// which is cumulative when the floor moved past the event, and the event at
+// the new floor if the floor advanced.
+func (a *ackState) ack(change *models.ChangeEvent) (*models.ClientMessage, *models.ChangeEvent) {
+	seq, ok := a.seqs[change]
+	if !ok {
+		return nil, nil
+	}
+	delete(a.seqs, change)
+	a.acked[seq] = true
+
+	// Acknowledged events stay in events until the floor passes them, so the
+	// event at the floor is known for resuming
+	previous := a.floor
+	var floorEvent *models.ChangeEvent
+	for a.acked[a.floor+1] {
+		a.floor++
+		delete(a.acked, a.floor)
+		floorEvent = a.events[a.floor]
+		delete(a.events, a.floor)
+	}
+	if a.floor == previous {
+		return &models.ClientMessage{Type: models.MessageTypeAck, Seq: seq}, nil
+	}
+	return &models.ClientMessage{Type: models.MessageTypeAck, Seq: a.floor, Cumulative: true}, floorEvent
+}
+
+// Ack acknowledges a change event of a subscription created with
+// SubscriptionOptions.Ack. Events that are never acknowledged are redelivered
+// by the server. With automatic acknowledgement (ManualAck unset) there is no
+// need to call Ack.
+func (s *Subscription) Ack(change *models.ChangeEvent) error {
+	s.mu.Lock()
+	if s.ack == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	message, floorEvent := s.ack.ack(change)
+	if floorEvent != nil {
+		// Resume after a reconnect from the last event we know was processed
+		s.resume = resumePoint(floorEvent)
+	}
+	s.mu.Unlock()
+
+	if message == nil {
+		return nil
+	}
+	message.SubscriptionID = s.ID()
+	return s.client.sendMessage(message)
+}
+
+// receive records an event of an acknowledged subscription and reports
+// whether it should be handed to the application. Duplicates of already
+// acknowledged events are acknowledged again instead.
+func (s *Subscription) receive(change *models.ChangeEvent, seq uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ack == nil || seq == 0 {
+		return true
+	}
+	if s.ack.track(change, seq) {
+		return true
+	}
+
+	// The server missed our acknowledgement; repeat it
+	go func() {
+		ack := &models.ClientMessage{Type: models.MessageTypeAck, SubscriptionID: s.ID(), Seq: seq}
+		if err := s.client.sendMessage(ack); err != nil {
+			s.client.logger.WithError(err).Debug("Failed to repeat acknowledgement")
+		}
+	}()
+	return false
+}
+
+// autoAck reports whether events are acknowledged by the client library
+func (s *Subscription) autoAck() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ack != nil && !s.ack.manual
+}
+
+// resetAck starts a new sequence space after the subscription was re-created
+// on the server. Unacknowledged events are replayed from the resume point.
+func (s *Subscription) resetAck() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ack != nil {
+		s.ack = newAckState(s.ack.manual)
+	}
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAckState_CumulativeWhenFloorAdvances(t *testing.T) {
+	a := newAckState(true)
+	first := &models.ChangeEvent{ID: "a"}
+	second := &models.ChangeEvent{ID: "b"}
+	require.True(t, a.track(first, 1))
+	require.True(t, a.track(second, 2))
+
+	// Out of order: only an individual ack is possible
+	message, floorEvent := a.ack(second)
+	assert.Equal(t, uint64(2), message.Seq)
+	assert.False(t, message.Cumulative)
+	assert.Nil(t, floorEvent)
+
+	message, floorEvent = a.ack(first)
+	assert.Equal(t, uint64(2), message.Seq)
+	assert.True(t, message.Cumulative)
+	assert.Same(t, second, floorEvent)
+
+	// Redeliveries of acknowledged events are duplicates
+	assert.False(t, a.track(&models.ChangeEvent{ID: "a"}, 1))
+	assert.Empty(t, a.events)
+}
+
+func TestSubscribeContext_AutoAcknowledgesChanges(t *testing.T) {
+	acks := make(chan *models.ClientMessage, 10)
+	fs := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		switch message.Type {
+		case models.MessageTypeAck:
+			acks <- message
+		case models.MessageTypeSubscribe:
+			conn.WriteJSON(&models.ServerMessage{
+				Type:      models.MessageTypeSubscribe,
+				Success:   true,
+				RequestID: message.RequestID,
+				Data:      map[string]interface{}{"subscription_id": "server-sub-1"},
+			})
+			for _, redelivered := range []bool{false, true} {
+				conn.WriteJSON(&models.ServerMessage{
+					Type:            models.MessageTypeChange,
+					SubscriptionIDs: []string{"server-sub-1"},
+					Sequences:       []uint64{1},
+					Redelivered:     redelivered,
+					Change:          &models.ChangeEvent{ID: "evt-1", Database: "testdb", Collection: "users"},
+				})
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+	})
+	c := newTestClient(t, fs.wsURL())
+
+	handled := make(chan *models.ChangeEvent, 10)
+	global := make(chan *models.ChangeEvent, 10)
+	c.OnChange(func(change *models.ChangeEvent) { global <- change })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := c.SubscribeContext(ctx, "testdb", "users", &SubscriptionOptions{
+		Ack:      &models.AckOptions{Window: 10},
+		OnChange: func(change *models.ChangeEvent) { handled <- change },
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case ack := <-acks:
+			assert.Equal(t, "server-sub-1", ack.SubscriptionID)
+			assert.Equal(t, uint64(1), ack.Seq)
+		case <-time.After(2 * time.Second):
+			t.Fatal("change was not acknowledged")
+		}
+	}
+
+	// The redelivered copy is acknowledged again but not handled twice
+	assert.Len(t, handled, 1)
+	assert.Len(t, global, 1)
+}
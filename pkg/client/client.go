@@ -1,9 +1,16 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"aktuell/pkg/models"
@@ -25,28 +32,86 @@ type SnapshotCompleteHandler func()
 // ErrorHandler is a function type for handling errors
 type ErrorHandler func(error)
 
+// ResubscribeHandler is called for every subscription restored after a
+// reconnect; err is nil if the server accepted it again. Subscriptions are
+// restored concurrently, so calls may overlap.
+type ResubscribeHandler func(sub *Subscription, err error)
+
 // Client represents a Aktuell client that connects to the server
 type Client struct {
-	serverURL                string
+	endpoints                *endpointSet
+	dialer                   *websocket.Dialer
+	header                   http.Header
+	headerProvider           HeaderProvider
 	conn                     *websocket.Conn
 	logger                   *logrus.Logger
 	mu                       sync.RWMutex
 	connected                bool
-	reconnecting             bool
+	state                    ConnectionState
+	stateHandler             StateHandler
+	reconnect                *ReconnectPolicy // nil disables automatic reconnection
+	reconnectWait            time.Duration
+	pingInterval             time.Duration
+	requestTimeout           time.Duration // Limit for requests made without a caller-provided context
+	stopCh                   chan struct{} // Closed by Disconnect to end the current run
+	connDone                 chan struct{} // Closed when the current connection ends
 	handlers                 map[string]ChangeHandler
 	snapshotHandlers         map[string]SnapshotHandler
 	snapshotCompleteHandlers map[string]SnapshotCompleteHandler
 	errorHandlers            map[string]ErrorHandler
-	subscriptions            map[string]*models.Subscription
-	doneCh                   chan struct{}
-	reconnectCh              chan struct{}
+	resubscribeHandler       ResubscribeHandler
+	subscriptions            map[string]*Subscription              // Local subscription ID -> handle
+	serverIDs                map[string]string                     // Server-assigned subscription ID -> local subscription ID
+	pending                  map[string]chan *models.ServerMessage // Request ID -> waiting caller
+	writeMu                  sync.Mutex                            // Serializes writes to conn
+	batching                 *models.BatchingOptions
+	session                  string // Session token issued by the server
+	sessionResumed           bool   // The last connect re-attached an existing session
 }
 
 // ClientOptions represents configuration options for the client
 type ClientOptions struct {
 	Logger        *logrus.Logger
-	ReconnectWait time.Duration
-	PingInterval  time.Duration
+	ReconnectWait time.Duration           // Initial wait before reconnecting (default: 1s)
+	Reconnect     *ReconnectPolicy        // Reconnect automatically with this policy
+	PingInterval  time.Duration           // Interval of keep-alive pings (default: 30s)
+	Batching      *models.BatchingOptions // Request that the server groups change events per frame
+	OnStateChange StateHandler            // Called on every connection state change
+
+	// Endpoints are further server URLs to fail over to, after the one
+	// passed to NewClient
+	Endpoints        []string
+	EndpointStrategy EndpointStrategy // Order in which endpoints are tried (default: EndpointOrdered)
+	EndpointCooldown time.Duration    // How long a failed endpoint is tried last (default: 30s)
+
+	// Dialer is the base configuration of the WebSocket handshake (default:
+	// websocket.DefaultDialer). It is copied; the fields below override it.
+	Dialer           *websocket.Dialer
+	TLSConfig        *tls.Config                           // Root CAs, client certificates etc. for wss:// endpoints
+	HandshakeTimeout time.Duration                         // Limit for establishing a connection (default: 45s)
+	Proxy            func(*http.Request) (*url.URL, error) // Proxy for the handshake (default: from the environment)
+	Header           http.Header                           // Sent with every handshake, e.g. cookies
+	HeaderProvider   HeaderProvider                        // Called before every connection attempt, e.g. to refresh tokens
+}
+
+// HeaderProvider returns extra headers for the handshake with an endpoint.
+// Its headers override ClientOptions.Header. ctx is cancelled when the client
+// is disconnected; an error aborts the connection attempt.
+type HeaderProvider func(ctx context.Context, endpoint string) (http.Header, error)
+
+// HandshakeError reports that a server rejected the WebSocket handshake,
+// e.g. with 401 Unauthorized
+type HandshakeError struct {
+	StatusCode int
+	Message    string // Response body, if any
+}
+
+// Error implements the error interface
+func (e *HandshakeError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("handshake rejected: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("handshake rejected: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
 }
 
 // NewClient creates a new Aktuell client
@@ -60,7 +125,7 @@ func NewClient(serverURL string, opts *ClientOptions) *Client {
 	}
 
 	if opts.ReconnectWait == 0 {
-		opts.ReconnectWait = 5 * time.Second
+		opts.ReconnectWait = time.Second
 	}
 
 	if opts.PingInterval == 0 {
@@ -68,65 +133,303 @@ func NewClient(serverURL string, opts *ClientOptions) *Client {
 	}
 
 	return &Client{
-		serverURL:                serverURL,
+		endpoints:                newEndpointSet(append([]string{serverURL}, opts.Endpoints...), opts.EndpointStrategy, opts.EndpointCooldown),
+		dialer:                   newDialer(opts),
+		header:                   opts.Header.Clone(),
+		headerProvider:           opts.HeaderProvider,
 		logger:                   opts.Logger,
 		handlers:                 make(map[string]ChangeHandler),
 		snapshotHandlers:         make(map[string]SnapshotHandler),
 		snapshotCompleteHandlers: make(map[string]SnapshotCompleteHandler),
 		errorHandlers:            make(map[string]ErrorHandler),
-		subscriptions:            make(map[string]*models.Subscription),
-		doneCh:                   make(chan struct{}),
-		reconnectCh:              make(chan struct{}, 1),
+		subscriptions:            make(map[string]*Subscription),
+		serverIDs:                make(map[string]string),
+		pending:                  make(map[string]chan *models.ServerMessage),
+		batching:                 opts.Batching,
+		reconnect:                opts.Reconnect,
+		reconnectWait:            opts.ReconnectWait,
+		pingInterval:             opts.PingInterval,
+		requestTimeout:           defaultRequestTimeout,
+		stateHandler:             opts.OnStateChange,
 	}
 }
 
-// Connect establishes a WebSocket connection to the Aktuell server
+// Connect establishes a WebSocket connection to the Aktuell server. A client
+// closed by Disconnect, or whose reconnection policy gave up, can be
+// connected again; its subscriptions are then restored.
 func (c *Client) Connect() error {
-	u, err := url.Parse(c.serverURL)
-	if err != nil {
+	c.mu.Lock()
+	if c.state != StateClosed {
+		c.mu.Unlock()
+		return ErrAlreadyConnected
+	}
+	c.state = StateConnecting
+	stop := make(chan struct{})
+	c.stopCh = stop
+	restore := len(c.subscriptions) > 0
+	c.mu.Unlock()
+	c.notifyState(StateConnecting, nil)
+
+	if err := c.dial(stop); err != nil {
+		c.mu.Lock()
+		closed := c.state == StateConnecting
+		if closed {
+			c.state = StateClosed
+		}
+		c.mu.Unlock()
+		if closed {
+			c.notifyState(StateClosed, err)
+		}
 		return err
 	}
 
-	c.logger.WithField("server", c.serverURL).Info("Connecting to Aktuell server")
+	if err := c.negotiateBatching(); err != nil {
+		// The connection is broken; reading from it fails and reconnects
+		c.logger.WithError(err).Warn("Failed to negotiate batching")
+	}
+	if restore {
+		c.restoreAfterConnect()
+	}
+	return nil
+}
+
+// dial connects to the first endpoint that accepts the connection and starts
+// reading from it. It fails if stop is closed before a connection is
+// established.
+func (c *Client) dial(stop chan struct{}) error {
+	var errs []error
+	for _, i := range c.endpoints.candidates() {
+		select {
+		case <-stop:
+			return ErrClientClosed
+		default:
+		}
+
+		serverURL := c.endpoints.urls[i]
+		err := c.dialEndpoint(i, stop)
+		if err == nil {
+			c.logger.WithField("server", serverURL).Info("Connected to Aktuell server")
+			c.notifyState(StateConnected, nil)
+			return nil
+		}
+		if errors.Is(err, ErrClientClosed) {
+			return err
+		}
+
+		c.endpoints.failed(i)
+		c.logger.WithError(err).WithField("server", serverURL).Warn("Failed to connect to Aktuell server")
+		errs = append(errs, fmt.Errorf("%s: %w", serverURL, err))
+	}
+	if len(errs) == 1 {
+		return errors.Unwrap(errs[0])
+	}
+	return errors.Join(errs...)
+}
 
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+// dialEndpoint opens a connection to one server and starts reading from it
+func (c *Client) dialEndpoint(i int, stop chan struct{}) error {
+	serverURL := c.endpoints.urls[i]
+	u, err := url.Parse(serverURL)
 	if err != nil {
 		return err
 	}
 
+	c.logger.WithField("server", serverURL).Info("Connecting to Aktuell server")
+
+	// Disconnect aborts the handshake
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	header, err := c.handshakeHeader(ctx, serverURL)
+	if err != nil {
+		return unlessStopped(stop, fmt.Errorf("failed to get handshake headers: %w", err))
+	}
+
+	conn, resp, err := c.dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		return unlessStopped(stop, handshakeError(resp, err))
+	}
+
+	connDone := make(chan struct{})
 	c.mu.Lock()
+	select {
+	case <-stop:
+		// Disconnect was called meanwhile
+		c.mu.Unlock()
+		conn.Close()
+		return ErrClientClosed
+	default:
+	}
 	c.conn = conn
 	c.connected = true
+	c.state = StateConnected
+	c.session = resp.Header.Get(models.HeaderSession)
+	c.sessionResumed = c.session != "" && resp.Header.Get(models.HeaderSessionResumed) == "true"
+	c.connDone = connDone
 	c.mu.Unlock()
+	c.endpoints.connected(i)
 
 	// Start message handling
-	go c.readMessages()
-	go c.pingHandler()
+	go c.readMessages(conn, connDone)
+	go c.pingHandler(connDone)
+	return nil
+}
 
-	c.logger.Info("Connected to Aktuell server")
+// unlessStopped returns ErrClientClosed instead of err if the failure was
+// caused by Disconnect
+func unlessStopped(stop chan struct{}, err error) error {
+	select {
+	case <-stop:
+		return ErrClientClosed
+	default:
+		return err
+	}
+}
+
+// newDialer builds the WebSocket dialer from the client options
+func newDialer(opts *ClientOptions) *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	if opts.Dialer != nil {
+		dialer = *opts.Dialer
+	}
+	if opts.TLSConfig != nil {
+		dialer.TLSClientConfig = opts.TLSConfig
+	}
+	if opts.HandshakeTimeout > 0 {
+		dialer.HandshakeTimeout = opts.HandshakeTimeout
+	}
+	if opts.Proxy != nil {
+		dialer.Proxy = opts.Proxy
+	}
+	return &dialer
+}
+
+// handshakeHeader returns the headers for a connection attempt
+func (c *Client) handshakeHeader(ctx context.Context, serverURL string) (http.Header, error) {
+	header := c.header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+
+	if c.headerProvider != nil {
+		extra, err := c.headerProvider(ctx, serverURL)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range extra {
+			header[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+
+	// Present the session token so the server can re-attach our subscriptions
+	c.mu.RLock()
+	if c.session != "" {
+		header.Set(models.HeaderSession, c.session)
+	}
+	c.mu.RUnlock()
+	return header, nil
+}
+
+// handshakeError turns a rejected handshake into a *HandshakeError
+func handshakeError(resp *http.Response, err error) error {
+	if resp == nil || !errors.Is(err, websocket.ErrBadHandshake) {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &HandshakeError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+}
+
+// negotiateBatching asks the server to batch change events if configured
+func (c *Client) negotiateBatching() error {
+	if c.batching == nil {
+		return nil
+	}
+
+	message := &models.ClientMessage{
+		Type:      models.MessageTypeBatching,
+		RequestID: uuid.New().String(),
+		Batching:  c.batching,
+	}
+	if err := c.sendMessage(message); err != nil {
+		return fmt.Errorf("failed to negotiate batching: %w", err)
+	}
 	return nil
 }
 
-// Disconnect closes the connection to the server
+// AuthError is returned when the server rejects new credentials
+type AuthError struct {
+	Code    int
+	Message string
+}
+
+// Error implements the error interface
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication rejected (code %d): %s", e.Code, e.Message)
+}
+
+// Reauthenticate replaces the token of the open connection, so it is not
+// closed when the current token expires. The token must identify the same
+// subject. Reconnects authenticate through ClientOptions.HeaderProvider.
+func (c *Client) Reauthenticate(ctx context.Context, token string) error {
+	message := &models.ClientMessage{
+		Type:      models.MessageTypeAuth,
+		RequestID: uuid.New().String(),
+		Token:     token,
+	}
+
+	responseCh := c.expectResponse(message.RequestID)
+	defer c.cancelResponse(message.RequestID)
+
+	if err := c.sendMessage(message); err != nil {
+		return err
+	}
+
+	select {
+	case response := <-responseCh:
+		if response.Type == models.MessageTypeError || !response.Success {
+			return &AuthError{Code: response.ErrorCode, Message: response.Error}
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Disconnect closes the connection to the server and stops reconnecting.
+// Subscriptions are kept and restored if the client connects again.
 func (c *Client) Disconnect() error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if !c.connected {
+	if c.state == StateClosed {
+		c.mu.Unlock()
 		return nil
 	}
 
+	c.state = StateClosed
 	c.connected = false
-	close(c.doneCh)
+	if c.stopCh != nil {
+		close(c.stopCh)
+		c.stopCh = nil
+	}
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
 
-	if c.conn != nil {
-		err := c.conn.Close()
-		c.conn = nil
-		return err
+	var err error
+	if conn != nil {
+		err = conn.Close()
 	}
 
 	c.logger.Info("Disconnected from Aktuell server")
-	return nil
+	c.notifyState(StateClosed, nil)
+	return err
 }
 
 // Subscribe subscribes to changes for a specific database and collection
@@ -144,7 +447,9 @@ func (c *Client) SubscribeWithSnapshot(database, collection string, snapOpts *mo
 	return c.SubscribeWithOptions(database, collection, snapOpts, nil, nil, nil, nil)
 }
 
-// SubscribeWithOptions subscribes to changes with full options and handlers
+// SubscribeWithOptions subscribes to changes with full options and handlers.
+// It returns once the request is sent; use SubscribeContext to wait for the
+// server's confirmation.
 func (c *Client) SubscribeWithOptions(
 	database, collection string,
 	snapOpts *models.SnapshotOptions,
@@ -153,40 +458,16 @@ func (c *Client) SubscribeWithOptions(
 	snapshotCompleteHandler SnapshotCompleteHandler,
 	errorHandler ErrorHandler,
 ) error {
-	subscriptionID := uuid.New().String()
-	requestID := uuid.New().String()
-
-	subscription := &models.Subscription{
-		ID:              subscriptionID,
-		Database:        database,
-		Collection:      collection,
-		CreatedAt:       time.Now(),
-		SnapshotOptions: snapOpts,
+	opts := &SubscriptionOptions{
+		Snapshot:           snapOpts,
+		OnChange:           changeHandler,
+		OnSnapshot:         snapshotHandler,
+		OnSnapshotComplete: snapshotCompleteHandler,
+		OnError:            errorHandler,
 	}
 
-	message := &models.ClientMessage{
-		Type:            models.MessageTypeSubscribe,
-		Database:        database,
-		Collection:      collection,
-		RequestID:       requestID,
-		SnapshotOptions: snapOpts,
-	}
-
-	c.mu.Lock()
-	c.subscriptions[subscriptionID] = subscription
-	if changeHandler != nil {
-		c.handlers[subscriptionID] = changeHandler
-	}
-	if snapshotHandler != nil {
-		c.snapshotHandlers[subscriptionID] = snapshotHandler
-	}
-	if snapshotCompleteHandler != nil {
-		c.snapshotCompleteHandlers[subscriptionID] = snapshotCompleteHandler
-	}
-	if errorHandler != nil {
-		c.errorHandlers[subscriptionID] = errorHandler
-	}
-	c.mu.Unlock()
+	sub, message := c.newSubscription(database, collection, opts)
+	c.addSubscription(sub, opts)
 
 	return c.sendMessage(message)
 }
@@ -199,13 +480,19 @@ func (c *Client) Unsubscribe() error {
 	}
 
 	c.mu.Lock()
-	c.subscriptions = make(map[string]*models.Subscription)
+	subscriptions := c.subscriptions
+	c.subscriptions = make(map[string]*Subscription)
+	c.serverIDs = make(map[string]string)
 	c.handlers = make(map[string]ChangeHandler)
 	c.snapshotHandlers = make(map[string]SnapshotHandler)
 	c.snapshotCompleteHandlers = make(map[string]SnapshotCompleteHandler)
 	c.errorHandlers = make(map[string]ErrorHandler)
 	c.mu.Unlock()
 
+	for _, sub := range subscriptions {
+		sub.finish(nil)
+	}
+
 	return c.sendMessage(message)
 }
 
@@ -216,6 +503,22 @@ func (c *Client) OnChange(handler ChangeHandler) {
 	c.mu.Unlock()
 }
 
+// OnResubscribe sets a handler reporting the outcome of restoring each
+// subscription after an automatic reconnect
+func (c *Client) OnResubscribe(handler ResubscribeHandler) {
+	c.mu.Lock()
+	c.resubscribeHandler = handler
+	c.mu.Unlock()
+}
+
+// SessionID returns the session token issued by the server, or an empty
+// string if the server does not keep sessions
+func (c *Client) SessionID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.session
+}
+
 // IsConnected returns true if the client is connected
 func (c *Client) IsConnected() bool {
 	c.mu.RLock()
@@ -234,39 +537,49 @@ func (c *Client) sendMessage(message *models.ClientMessage) error {
 		return ErrNotConnected
 	}
 
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	return conn.WriteJSON(message)
 }
 
-// readMessages handles incoming messages from the server
-func (c *Client) readMessages() {
+// readMessages handles incoming messages from a connection until it fails,
+// then starts reconnecting unless the client was disconnected on purpose
+func (c *Client) readMessages(conn *websocket.Conn, connDone chan struct{}) {
+	var readErr error
 	defer func() {
+		close(connDone)
+		conn.Close()
+
 		c.mu.Lock()
-		if c.conn != nil {
-			c.conn.Close()
+		if c.conn != conn || c.state != StateConnected {
+			// Disconnected on purpose, or already replaced
+			c.mu.Unlock()
+			return
 		}
+		c.conn = nil
 		c.connected = false
+		c.endpoints.lost()
+		policy := c.reconnect
+		stop := c.stopCh
+		if policy == nil {
+			c.state = StateClosed
+		} else {
+			c.state = StateReconnecting
+		}
 		c.mu.Unlock()
 
-		// Trigger reconnection if not intentionally disconnected
-		if !c.reconnecting {
-			select {
-			case c.reconnectCh <- struct{}{}:
-			default:
-			}
+		if policy == nil {
+			c.notifyState(StateClosed, readErr)
+			return
 		}
+		c.notifyState(StateReconnecting, readErr)
+		go c.reconnectLoop(stop, policy.withDefaults(c.reconnectWait))
 	}()
 
 	for {
-		c.mu.RLock()
-		conn := c.conn
-		c.mu.RUnlock()
-
-		if conn == nil {
-			return
-		}
-
 		var message models.ServerMessage
 		if err := conn.ReadJSON(&message); err != nil {
+			readErr = err
 			c.logger.WithError(err).Error("Failed to read message from server")
 			return
 		}
@@ -279,7 +592,25 @@ func (c *Client) readMessages() {
 func (c *Client) handleMessage(message *models.ServerMessage) {
 	switch message.Type {
 	case models.MessageTypeChange:
-		c.handleChangeEvent(message.Change)
+		c.handleChangeEvent(message)
+	case models.MessageTypeSubscribe:
+		c.handleSubscribeResponse(message)
+		c.resolveResponse(message)
+	case models.MessageTypeUnsubscribe:
+		if !c.resolveResponse(message) && !message.Success {
+			c.logger.WithField("error", message.Error).Warn("Server rejected unsubscribe request")
+		}
+	case models.MessageTypeChanges:
+		// Unpack batched frames so handlers see individual events in order
+		for _, batched := range message.Messages {
+			c.handleMessage(batched)
+		}
+	case models.MessageTypeSession:
+		c.logger.WithField("session", message.Data).Debug("Server confirmed session")
+	case models.MessageTypeBatching:
+		c.logger.WithField("batching", message.Data).Debug("Server confirmed change batching")
+	case models.MessageTypeAuth:
+		c.resolveResponse(message)
 	case models.MessageTypeSnapshot:
 		c.handleSnapshotBatch(message)
 	case models.MessageTypeSnapshotStart:
@@ -287,7 +618,10 @@ func (c *Client) handleMessage(message *models.ServerMessage) {
 	case models.MessageTypeSnapshotEnd:
 		c.handleSnapshotEnd(message)
 	case models.MessageTypeError:
-		c.handleError(message)
+		// Errors for synchronous requests are returned to the caller
+		if !c.resolveResponse(message) {
+			c.handleError(message)
+		}
 	case models.MessageTypePong:
 		c.logger.Debug("Received pong from server")
 	default:
@@ -295,8 +629,77 @@ func (c *Client) handleMessage(message *models.ServerMessage) {
 	}
 }
 
+// handleSubscribeResponse records the server-assigned ID of a subscription
+func (c *Client) handleSubscribeResponse(message *models.ServerMessage) {
+	data, ok := message.Data.(map[string]interface{})
+	if !ok {
+		return
+	}
+	serverID, ok := data["subscription_id"].(string)
+	if !ok || serverID == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for localID, sub := range c.subscriptions {
+		if sub.info.RequestID != "" && sub.info.RequestID == message.RequestID {
+			sub.serverID = serverID
+			c.serverIDs[serverID] = localID
+			if sequence, ok := data["sequence"].(float64); ok {
+				sub.startSequence(uint64(sequence))
+			}
+			c.logger.WithFields(logrus.Fields{
+				"subscription_id": serverID,
+				"database":        sub.info.Database,
+				"collection":      sub.info.Collection,
+			}).Debug("Subscription confirmed by server")
+			return
+		}
+	}
+
+	// The subscription was abandoned (e.g. its caller timed out), so release it
+	go func() {
+		if err := c.sendMessage(&models.ClientMessage{
+			Type:           models.MessageTypeUnsubscribe,
+			RequestID:      uuid.New().String(),
+			SubscriptionID: serverID,
+		}); err != nil {
+			c.logger.WithError(err).Debug("Failed to release abandoned subscription")
+		}
+	}()
+}
+
+// targetSubscriptions returns the local subscription IDs a server message is
+// addressed to. The boolean is false when the message carries no routing
+// information (e.g. from an older server) and must be matched by other means.
+// Caller holds c.mu.
+func (c *Client) targetSubscriptions(message *models.ServerMessage) ([]string, bool) {
+	var targets []string
+	for _, serverID := range message.SubscriptionIDs {
+		if localID, ok := c.serverIDs[serverID]; ok {
+			targets = append(targets, localID)
+		}
+	}
+	if len(targets) > 0 {
+		return targets, true
+	}
+
+	if message.RequestID != "" {
+		for localID, sub := range c.subscriptions {
+			if sub.info.RequestID == message.RequestID {
+				return []string{localID}, true
+			}
+		}
+	}
+
+	return nil, len(message.SubscriptionIDs) > 0
+}
+
 // handleChangeEvent handles change events from the server
-func (c *Client) handleChangeEvent(change *models.ChangeEvent) {
+func (c *Client) handleChangeEvent(message *models.ServerMessage) {
+	change := message.Change
 	if change == nil {
 		return
 	}
@@ -307,22 +710,112 @@ func (c *Client) handleChangeEvent(change *models.ChangeEvent) {
 		"collection": change.Collection,
 	}).Debug("Received change event")
 
+	// Check sequence numbers first; gap handlers run without holding locks
+	skip := c.checkSequences(message)
+
+	// Handler queues and channels may block (OverflowBlock), so deliveries
+	// happen after c.mu is released, still on the read loop and therefore in
+	// order
+	for _, d := range c.dispatchChange(message, skip) {
+		if d.handler != nil {
+			if err := c.runChangeHandler(d.sub, change, d.handler); err != nil {
+				c.failSubscription(d.localID, d.sub, err)
+				continue
+			}
+		}
+		if d.sub == nil {
+			continue
+		}
+		delivered, err := d.sub.deliver(change)
+		if err != nil {
+			c.failSubscription(d.localID, d.sub, err)
+			continue
+		}
+		if delivered && d.ack {
+			// Without a handler, handing the event to the channel counts as processed
+			go c.ack(d.sub, change)
+		}
+	}
+}
+
+// changeDelivery is a change event to hand to a subscription's handler and
+// Changes channel
+type changeDelivery struct {
+	localID string
+	sub     *Subscription
+	handler func() // Calls the change handler; nil without one
+	ack     bool   // Acknowledge once delivered to the channel
+}
+
+// dispatchChange returns the deliveries of a change event to its
+// subscriptions
+func (c *Client) dispatchChange(message *models.ServerMessage, skip map[string]bool) []changeDelivery {
+	change := message.Change
+
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	// Call global handler if it exists
+	// Acknowledged messages are addressed to exactly one subscription and
+	// acknowledged by its sequence number
+	var acked *Subscription
+	if len(message.SubscriptionIDs) == 1 && len(message.Sequences) == 1 {
+		if targets, _ := c.targetSubscriptions(message); len(targets) == 1 {
+			acked = c.subscriptions[targets[0]]
+		}
+		if acked != nil && !acked.receive(change, message.Sequences[0]) {
+			return nil
+		}
+	}
+
+	// Call global handler if it exists; redelivered duplicates were dropped above
 	if handler, exists := c.handlers["global"]; exists {
-		go handler(change)
+		c.runChangeHandler(nil, change, func() { handler(change) })
 	}
 
 	// Call specific subscription handlers
-	for subscriptionID, subscription := range c.subscriptions {
-		if c.matchesSubscription(change, subscription) {
-			if handler, exists := c.handlers[subscriptionID]; exists {
-				go handler(change)
+	targets, tagged := c.targetSubscriptions(message)
+	if !tagged {
+		for subscriptionID, sub := range c.subscriptions {
+			if c.matchesSubscription(change, sub.info) {
+				targets = append(targets, subscriptionID)
 			}
 		}
 	}
+
+	var deliveries []changeDelivery
+	for _, subscriptionID := range targets {
+		if skip[subscriptionID] {
+			continue
+		}
+		sub := c.subscriptions[subscriptionID]
+		if sub != nil && sub.observer != nil {
+			sub.observer.changed(change)
+		}
+		autoAck := sub != nil && sub == acked && sub.autoAck()
+
+		d := changeDelivery{localID: subscriptionID, sub: sub}
+		if handler, exists := c.handlers[subscriptionID]; exists {
+			d.handler = func() {
+				handler(change)
+				if autoAck {
+					c.ack(sub, change)
+				}
+			}
+		} else {
+			d.ack = autoAck
+		}
+		if d.sub != nil || d.handler != nil {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries
+}
+
+// ack acknowledges an event on behalf of the application
+func (c *Client) ack(sub *Subscription, change *models.ChangeEvent) {
+	if err := sub.Ack(change); err != nil {
+		c.logger.WithError(err).Debug("Failed to acknowledge change, it will be redelivered")
+	}
 }
 
 // handleSnapshotBatch handles snapshot batch messages from the server
@@ -340,31 +833,63 @@ func (c *Client) handleSnapshotBatch(message *models.ServerMessage) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	// Call snapshot handlers for all subscriptions
-	// In a more sophisticated implementation, we'd match handlers to specific subscriptions
-	for subscriptionID := range c.snapshotHandlers {
+	targets, tagged := c.targetSubscriptions(message)
+	if !tagged {
+		// Untagged batches cannot be attributed, so every snapshot handler gets them
+		for subscriptionID := range c.snapshotHandlers {
+			targets = append(targets, subscriptionID)
+		}
+	}
+
+	for _, subscriptionID := range targets {
+		sub := c.subscriptions[subscriptionID]
+		if sub != nil && sub.observer != nil {
+			sub.observer.snapshotBatch(message.SnapshotData)
+		}
 		if handler, exists := c.snapshotHandlers[subscriptionID]; exists {
-			go handler(message.SnapshotData, message.SnapshotBatch, message.SnapshotRemaining)
+			c.runHandler(sub, func() {
+				handler(message.SnapshotData, message.SnapshotBatch, message.SnapshotRemaining)
+			})
 		}
 	}
 }
 
 // handleSnapshotStart handles snapshot start messages from the server
 func (c *Client) handleSnapshotStart(message *models.ServerMessage) {
-	c.logger.Info("Snapshot streaming started")
+	c.logger.WithField("subscriptions", message.SubscriptionIDs).Info("Snapshot streaming started")
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	targets, _ := c.targetSubscriptions(message)
+	for _, subscriptionID := range targets {
+		if sub, ok := c.subscriptions[subscriptionID]; ok && sub.observer != nil {
+			sub.observer.snapshotStarted()
+		}
+	}
 }
 
 // handleSnapshotEnd handles snapshot end messages from the server
 func (c *Client) handleSnapshotEnd(message *models.ServerMessage) {
-	c.logger.Info("Snapshot streaming completed")
+	c.logger.WithField("subscriptions", message.SubscriptionIDs).Info("Snapshot streaming completed")
 
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	// Call snapshot complete handlers for all subscriptions
-	for subscriptionID := range c.snapshotCompleteHandlers {
+	targets, tagged := c.targetSubscriptions(message)
+	if !tagged {
+		for subscriptionID := range c.snapshotCompleteHandlers {
+			targets = append(targets, subscriptionID)
+		}
+	}
+
+	for _, subscriptionID := range targets {
+		sub := c.subscriptions[subscriptionID]
+		if sub != nil && sub.observer != nil {
+			sub.observer.snapshotEnded()
+		}
 		if handler, exists := c.snapshotCompleteHandlers[subscriptionID]; exists {
-			go handler()
+			c.runHandler(sub, func() { handler() })
 		}
 	}
 }
@@ -376,10 +901,18 @@ func (c *Client) handleError(message *models.ServerMessage) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	// Call error handlers for all subscriptions
-	for subscriptionID := range c.errorHandlers {
+	// Errors without routing information concern the whole connection
+	targets, tagged := c.targetSubscriptions(message)
+	if !tagged {
+		for subscriptionID := range c.errorHandlers {
+			targets = append(targets, subscriptionID)
+		}
+	}
+
+	err := fmt.Errorf("server error: %s", message.Error)
+	for _, subscriptionID := range targets {
 		if handler, exists := c.errorHandlers[subscriptionID]; exists {
-			go handler(fmt.Errorf("server error: %s", message.Error))
+			go handler(err)
 		}
 	}
 }
@@ -400,91 +933,129 @@ func (c *Client) matchesSubscription(change *models.ChangeEvent, subscription *m
 	return true
 }
 
-// pingHandler sends periodic ping messages to keep the connection alive
-func (c *Client) pingHandler() {
-	ticker := time.NewTicker(30 * time.Second)
+// pingHandler sends periodic ping messages to keep a connection alive
+func (c *Client) pingHandler(connDone chan struct{}) {
+	ticker := time.NewTicker(c.pingInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-c.doneCh:
+		case <-connDone:
 			return
 		case <-ticker.C:
-			c.mu.RLock()
-			connected := c.connected
-			c.mu.RUnlock()
-
-			if connected {
-				message := &models.ClientMessage{
-					Type:      models.MessageTypePing,
-					RequestID: uuid.New().String(),
-				}
-				if err := c.sendMessage(message); err != nil {
-					c.logger.WithError(err).Error("Failed to send ping")
-				}
+			message := &models.ClientMessage{
+				Type:      models.MessageTypePing,
+				RequestID: uuid.New().String(),
+			}
+			if err := c.sendMessage(message); err != nil {
+				c.logger.WithError(err).Error("Failed to send ping")
 			}
 		}
 	}
 }
 
-// EnableAutoReconnect enables automatic reconnection when the connection is lost
-func (c *Client) EnableAutoReconnect(wait time.Duration) {
-	go c.reconnectHandler(wait)
-}
-
-// reconnectHandler handles automatic reconnection
-func (c *Client) reconnectHandler(wait time.Duration) {
-	for {
-		select {
-		case <-c.doneCh:
-			return
-		case <-c.reconnectCh:
-			c.mu.Lock()
-			c.reconnecting = true
-			c.mu.Unlock()
-
-			c.logger.WithField("wait", wait).Info("Connection lost, attempting to reconnect")
-			time.Sleep(wait)
-
-			if err := c.Connect(); err != nil {
-				c.logger.WithError(err).Error("Failed to reconnect, will retry")
-				// Trigger another reconnection attempt
-				select {
-				case c.reconnectCh <- struct{}{}:
-				default:
-				}
-			} else {
-				c.mu.Lock()
-				c.reconnecting = false
-				c.mu.Unlock()
+// restoreAfterConnect restores subscriptions on a new connection, unless the
+// server re-attached our session and kept them
+func (c *Client) restoreAfterConnect() {
+	c.mu.RLock()
+	resumed := c.sessionResumed
+	c.mu.RUnlock()
 
-				// Re-establish subscriptions
-				c.resubscribe()
-			}
-		}
+	if resumed {
+		// The server kept our subscriptions and flushes what it queued
+		c.logger.Info("Session resumed, subscriptions kept by server")
+		return
 	}
+	c.resubscribe()
 }
 
-// resubscribe re-establishes all subscriptions after reconnection
+// resubscribe re-establishes all subscriptions after reconnection. Each
+// subscription keeps its handle, handlers and options; only the server ID
+// changes. Up to maxParallelRestores subscriptions are restored at a time.
 func (c *Client) resubscribe() {
-	c.mu.RLock()
-	subscriptions := make([]*models.Subscription, 0, len(c.subscriptions))
+	c.mu.Lock()
+	subscriptions := make([]*Subscription, 0, len(c.subscriptions))
 	for _, sub := range c.subscriptions {
+		// Server IDs from the previous connection are no longer valid
+		sub.serverID = ""
 		subscriptions = append(subscriptions, sub)
 	}
-	c.mu.RUnlock()
+	c.serverIDs = make(map[string]string)
+	handler := c.resubscribeHandler
+	connDone := c.connDone
+	c.mu.Unlock()
 
+	var failed atomic.Int32
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxParallelRestores)
 	for _, sub := range subscriptions {
-		// Re-subscribe without filter since server delivers all events
-		if err := c.Subscribe(sub.Database, sub.Collection); err != nil {
-			c.logger.WithError(err).Error("Failed to re-establish subscription")
-		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(sub *Subscription) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			err := c.restoreWithRetry(sub, connDone)
+			if err != nil {
+				failed.Add(1)
+				c.logger.WithError(err).WithFields(logrus.Fields{
+					"database":   sub.info.Database,
+					"collection": sub.info.Collection,
+				}).Error("Failed to re-establish subscription")
+			}
+			if handler != nil {
+				handler(sub, err)
+			}
+		}(sub)
 	}
+	wg.Wait()
+
+	c.logger.WithFields(logrus.Fields{
+		"restored": len(subscriptions) - int(failed.Load()),
+		"failed":   failed.Load(),
+	}).Info("Re-established subscriptions after reconnection")
+}
+
+// restoreWithRetry restores a subscription on the connection that connDone
+// belongs to. Requests the server did not answer are reported to the
+// subscription's OnError and retried with backoff; after maxRestoreAttempts
+// the subscription ends. If the connection ends first, the next one
+// restores the subscription again.
+func (c *Client) restoreWithRetry(sub *Subscription, connDone chan struct{}) error {
+	delay := restoreRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := c.restoreSubscription(sub, true)
+
+		var subErr *SubscriptionError
+		if err == nil || errors.As(err, &subErr) || errors.Is(err, ErrNotConnected) {
+			// Rejected subscriptions were ended by restoreSubscription
+			return err
+		}
+		err = fmt.Errorf("restoring subscription: %w", err)
+		if attempt == maxRestoreAttempts {
+			c.failSubscription(sub.localID, sub, err)
+			return err
+		}
 
-	c.logger.Info("Re-established subscriptions after reconnection")
+		c.mu.RLock()
+		errorHandler := c.errorHandlers[sub.localID]
+		c.mu.RUnlock()
+		if errorHandler != nil {
+			go errorHandler(err)
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-connDone:
+			return ErrNotConnected
+		}
+	}
 }
 
 // Custom errors
 var (
-	ErrNotConnected = fmt.Errorf("not connected to server")
+	ErrNotConnected     = fmt.Errorf("not connected to server")
+	ErrAlreadyConnected = fmt.Errorf("client is already connected or connecting")
+	ErrClientClosed     = fmt.Errorf("client was disconnected")
 )
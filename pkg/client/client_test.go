@@ -0,0 +1,379 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResubscribe_PreservesHandlersAndOptions(t *testing.T) {
+	var subscribes int32
+	var mu sync.Mutex
+	var received []*models.ClientMessage
+
+	fs := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		if message.Type != models.MessageTypeSubscribe {
+			return
+		}
+		mu.Lock()
+		received = append(received, message)
+		mu.Unlock()
+
+		n := atomic.AddInt32(&subscribes, 1)
+		id := fmt.Sprintf("server-sub-%d", n)
+		conn.WriteJSON(&models.ServerMessage{
+			Type:      models.MessageTypeSubscribe,
+			Success:   true,
+			RequestID: message.RequestID,
+			Data:      map[string]interface{}{"subscription_id": id},
+		})
+		if n == 1 {
+			// Drop the first connection to force a reconnect
+			conn.Close()
+			return
+		}
+		conn.WriteJSON(&models.ServerMessage{
+			Type:            models.MessageTypeChange,
+			SubscriptionIDs: []string{id},
+			Change:          &models.ChangeEvent{ID: "after-reconnect", Database: "testdb", Collection: "users"},
+		})
+	})
+	c := newTestClient(t, fs.wsURL())
+
+	restored := make(chan error, 1)
+	c.OnResubscribe(func(sub *Subscription, err error) { restored <- err })
+	c.EnableAutoReconnect(10 * time.Millisecond)
+
+	changes := make(chan *models.ChangeEvent, 1)
+	snapOpts := &models.SnapshotOptions{IncludeSnapshot: true, SnapshotFilter: map[string]interface{}{"active": true}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub, err := c.SubscribeContext(ctx, "testdb", "users", &SubscriptionOptions{
+		Snapshot: snapOpts,
+		OnChange: func(change *models.ChangeEvent) { changes <- change },
+	})
+	require.NoError(t, err)
+
+	select {
+	case err := <-restored:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription was not restored")
+	}
+
+	select {
+	case change := <-changes:
+		assert.Equal(t, "after-reconnect", change.ID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not fire after reconnect")
+	}
+
+	assert.Equal(t, "server-sub-2", sub.ID())
+
+	c.mu.RLock()
+	assert.Len(t, c.subscriptions, 1)
+	assert.Len(t, c.serverIDs, 1)
+	c.mu.RUnlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 2)
+	assert.Equal(t, received[0].SnapshotOptions.SnapshotFilter, received[1].SnapshotOptions.SnapshotFilter)
+	assert.NotEqual(t, received[0].RequestID, received[1].RequestID)
+}
+
+func TestResubscribe_ResumesFromLastEvent(t *testing.T) {
+	var subscribes int32
+	var mu sync.Mutex
+	var received []*models.ClientMessage
+
+	fs := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		if message.Type != models.MessageTypeSubscribe {
+			return
+		}
+		mu.Lock()
+		received = append(received, message)
+		mu.Unlock()
+
+		n := atomic.AddInt32(&subscribes, 1)
+		if n == 2 {
+			// The server lost the resume point; the client falls back to a snapshot
+			conn.WriteJSON(&models.ServerMessage{
+				Type:      models.MessageTypeError,
+				RequestID: message.RequestID,
+				ErrorCode: models.ErrorCodeResumeWindowExceeded,
+				Error:     "resume window exceeded, resnapshot required",
+			})
+			return
+		}
+
+		id := fmt.Sprintf("server-sub-%d", n)
+		conn.WriteJSON(&models.ServerMessage{
+			Type:      models.MessageTypeSubscribe,
+			Success:   true,
+			RequestID: message.RequestID,
+			Data:      map[string]interface{}{"subscription_id": id},
+		})
+		if n == 1 {
+			conn.WriteJSON(&models.ServerMessage{
+				Type:            models.MessageTypeChange,
+				SubscriptionIDs: []string{id},
+				Change:          &models.ChangeEvent{ID: "evt-1", Database: "testdb", Collection: "users"},
+			})
+			time.Sleep(20 * time.Millisecond)
+			conn.Close()
+		}
+	})
+	c := newTestClient(t, fs.wsURL())
+
+	restored := make(chan error, 1)
+	c.OnResubscribe(func(sub *Subscription, err error) { restored <- err })
+	c.EnableAutoReconnect(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := c.SubscribeContext(ctx, "testdb", "users", &SubscriptionOptions{
+		Snapshot: &models.SnapshotOptions{IncludeSnapshot: true},
+	})
+	require.NoError(t, err)
+
+	select {
+	case err := <-restored:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription was not restored")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 3)
+	assert.Nil(t, received[0].ResumeFrom)
+
+	require.NotNil(t, received[1].ResumeFrom)
+	assert.Equal(t, "evt-1", received[1].ResumeFrom.EventID)
+	assert.Nil(t, received[1].SnapshotOptions)
+
+	assert.Nil(t, received[2].ResumeFrom)
+	require.NotNil(t, received[2].SnapshotOptions)
+	assert.True(t, received[2].SnapshotOptions.IncludeSnapshot)
+}
+
+func TestResubscribe_RetriesUnansweredRequests(t *testing.T) {
+	var subscribes int32
+	fs := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		if message.Type != models.MessageTypeSubscribe {
+			return
+		}
+		n := atomic.AddInt32(&subscribes, 1)
+		if n == 2 {
+			// The first restore gets no answer and times out
+			return
+		}
+		conn.WriteJSON(&models.ServerMessage{
+			Type:      models.MessageTypeSubscribe,
+			Success:   true,
+			RequestID: message.RequestID,
+			Data:      map[string]interface{}{"subscription_id": fmt.Sprintf("server-sub-%d", n)},
+		})
+		if n == 1 {
+			conn.Close()
+		}
+	})
+	c := newTestClient(t, fs.wsURL())
+	c.requestTimeout = 50 * time.Millisecond
+
+	restored := make(chan error, 1)
+	c.OnResubscribe(func(sub *Subscription, err error) { restored <- err })
+	c.EnableAutoReconnect(10 * time.Millisecond)
+
+	errs := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub, err := c.SubscribeContext(ctx, "testdb", "users", &SubscriptionOptions{
+		OnChange: func(*models.ChangeEvent) {},
+		OnError:  func(err error) { errs <- err },
+	})
+	require.NoError(t, err)
+
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out restore was not reported")
+	}
+
+	select {
+	case err := <-restored:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription was not restored")
+	}
+	assert.Equal(t, "server-sub-3", sub.ID())
+	assert.NoError(t, sub.Err())
+}
+
+// headerServer accepts WebSocket connections and records the handshake headers
+func headerServer(t *testing.T, tlsServer bool, authorize func(r *http.Request) bool) (*httptest.Server, func() []http.Header) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var headers []http.Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Clone())
+		mu.Unlock()
+
+		if authorize != nil && !authorize(r) {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+
+	var s *httptest.Server
+	if tlsServer {
+		s = httptest.NewTLSServer(handler)
+	} else {
+		s = httptest.NewServer(handler)
+	}
+	t.Cleanup(s.Close)
+
+	return s, func() []http.Header {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]http.Header(nil), headers...)
+	}
+}
+
+func TestConnect_HeaderProviderRunsOnEveryConnect(t *testing.T) {
+	s, headers := headerServer(t, false, nil)
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	var calls atomic.Int32
+	c := newSilentClient(url, &ClientOptions{
+		Header: http.Header{"Cookie": {"team=blue"}, "Authorization": {"Bearer static"}},
+		HeaderProvider: func(ctx context.Context, endpoint string) (http.Header, error) {
+			assert.Equal(t, url, endpoint)
+			n := calls.Add(1)
+			return http.Header{"authorization": {fmt.Sprintf("Bearer token-%d", n)}}, nil
+		},
+	})
+
+	require.NoError(t, c.Connect())
+	require.NoError(t, c.Disconnect())
+	require.NoError(t, c.Connect())
+	require.NoError(t, c.Disconnect())
+
+	received := headers()
+	require.Len(t, received, 2)
+	assert.Equal(t, "Bearer token-1", received[0].Get("Authorization"))
+	assert.Equal(t, "Bearer token-2", received[1].Get("Authorization"))
+	assert.Equal(t, "team=blue", received[1].Get("Cookie"))
+}
+
+func TestConnect_HeaderProviderErrorAbortsConnect(t *testing.T) {
+	s, headers := headerServer(t, false, nil)
+	providerErr := errors.New("token service unavailable")
+	c := newSilentClient("ws"+strings.TrimPrefix(s.URL, "http"), &ClientOptions{
+		HeaderProvider: func(ctx context.Context, endpoint string) (http.Header, error) {
+			return nil, providerErr
+		},
+	})
+
+	assert.ErrorIs(t, c.Connect(), providerErr)
+	assert.Empty(t, headers())
+	assert.Equal(t, StateClosed, c.State())
+}
+
+func TestConnect_ReportsRejectedHandshake(t *testing.T) {
+	s, _ := headerServer(t, false, func(r *http.Request) bool { return false })
+	c := newSilentClient("ws"+strings.TrimPrefix(s.URL, "http"), &ClientOptions{})
+
+	err := c.Connect()
+	var handshakeErr *HandshakeError
+	require.ErrorAs(t, err, &handshakeErr)
+	assert.Equal(t, http.StatusUnauthorized, handshakeErr.StatusCode)
+	assert.Equal(t, "invalid token", handshakeErr.Message)
+}
+
+func TestConnect_UsesTLSConfig(t *testing.T) {
+	s, _ := headerServer(t, true, nil)
+	url := "wss" + strings.TrimPrefix(s.URL, "https")
+
+	// The test server's certificate is not trusted by default
+	c := newSilentClient(url, &ClientOptions{HandshakeTimeout: time.Second})
+	require.Error(t, c.Connect())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	c = newSilentClient(url, &ClientOptions{TLSConfig: &tls.Config{RootCAs: roots}})
+	require.NoError(t, c.Connect())
+	require.NoError(t, c.Disconnect())
+}
+
+func TestNewDialer_AppliesOverrides(t *testing.T) {
+	base := &websocket.Dialer{HandshakeTimeout: 5 * time.Second, Subprotocols: []string{"aktuell"}}
+	proxy := func(*http.Request) (*neturl.URL, error) { return nil, nil }
+
+	dialer := newDialer(&ClientOptions{Dialer: base, HandshakeTimeout: time.Second, Proxy: proxy})
+	assert.Equal(t, time.Second, dialer.HandshakeTimeout)
+	assert.Equal(t, []string{"aktuell"}, dialer.Subprotocols)
+	assert.NotNil(t, dialer.Proxy)
+	// The caller's dialer is left alone
+	assert.Equal(t, 5*time.Second, base.HandshakeTimeout)
+
+	assert.Equal(t, websocket.DefaultDialer.HandshakeTimeout, newDialer(&ClientOptions{}).HandshakeTimeout)
+}
+
+func TestReauthenticate(t *testing.T) {
+	fs := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		if message.Type != models.MessageTypeAuth {
+			return
+		}
+		if message.Token == "fresh" {
+			conn.WriteJSON(&models.ServerMessage{Type: models.MessageTypeAuth, Success: true, RequestID: message.RequestID})
+			return
+		}
+		conn.WriteJSON(&models.ServerMessage{
+			Type:      models.MessageTypeError,
+			RequestID: message.RequestID,
+			ErrorCode: models.ErrorCodeInvalidToken,
+			Error:     "Invalid token",
+		})
+	})
+	c := newTestClient(t, fs.wsURL())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, c.Reauthenticate(ctx, "fresh"))
+
+	var authErr *AuthError
+	require.ErrorAs(t, c.Reauthenticate(ctx, "stale"), &authErr)
+	assert.Equal(t, models.ErrorCodeInvalidToken, authErr.Code)
+}
@@ -0,0 +1,222 @@
+package client
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// DecodeDocument decodes a document as received from the server into v, which
+// must be a non-nil pointer. Struct fields are matched by their bson tag, then
+// their json tag, then their name, ignoring case, so the structs used with the
+// MongoDB driver work unchanged. Values whose types implement
+// json.Unmarshaler, such as primitive.ObjectID and time.Time, are decoded
+// from their JSON form.
+func DecodeDocument(doc map[string]interface{}, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("decode target must be a non-nil pointer, got %T", v)
+	}
+	return decodeValue(doc, rv.Elem(), "")
+}
+
+// decodeValue decodes src into the settable value dst
+func decodeValue(src interface{}, dst reflect.Value, path string) error {
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	if dst.Kind() == reflect.Ptr {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return decodeValue(src, dst.Elem(), path)
+	}
+
+	if ptr := reflect.PtrTo(dst.Type()); ptr.Implements(jsonUnmarshalerType) || ptr.Implements(textUnmarshalerType) {
+		return decodeJSON(src, dst, path)
+	}
+
+	switch dst.Kind() {
+	case reflect.Struct:
+		doc, ok := src.(map[string]interface{})
+		if !ok {
+			return decodeJSON(src, dst, path)
+		}
+		return decodeStruct(doc, dst, path)
+
+	case reflect.Slice:
+		elements, ok := src.([]interface{})
+		if !ok {
+			return decodeJSON(src, dst, path)
+		}
+		slice := reflect.MakeSlice(dst.Type(), len(elements), len(elements))
+		for i, element := range elements {
+			if err := decodeValue(element, slice.Index(i), fmt.Sprintf("%s.%d", path, i)); err != nil {
+				return err
+			}
+		}
+		dst.Set(slice)
+		return nil
+
+	case reflect.Map:
+		doc, ok := src.(map[string]interface{})
+		if !ok || dst.Type().Key().Kind() != reflect.String {
+			return decodeJSON(src, dst, path)
+		}
+		m := reflect.MakeMapWithSize(dst.Type(), len(doc))
+		for key, value := range doc {
+			elem := reflect.New(dst.Type().Elem()).Elem()
+			if err := decodeValue(value, elem, joinPath(path, key)); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key).Convert(dst.Type().Key()), elem)
+		}
+		dst.Set(m)
+		return nil
+
+	case reflect.Interface:
+		value := reflect.ValueOf(src)
+		if !value.Type().AssignableTo(dst.Type()) {
+			return fmt.Errorf("%s: cannot assign %T to %s", describePath(path), src, dst.Type())
+		}
+		dst.Set(value)
+		return nil
+
+	default:
+		return decodeJSON(src, dst, path)
+	}
+}
+
+// decodeStruct decodes a document into a struct field by field
+func decodeStruct(doc map[string]interface{}, dst reflect.Value, path string) error {
+	fields := structFields(dst.Type())
+
+	for key, value := range doc {
+		field, ok := matchField(fields, key)
+		if !ok {
+			continue
+		}
+		if err := decodeValue(value, dst.FieldByIndex(field.index), joinPath(path, key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeJSON decodes a value through its JSON encoding, which is how the
+// server transmitted it
+func decodeJSON(src interface{}, dst reflect.Value, path string) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", describePath(path), err)
+	}
+	if err := json.Unmarshal(data, dst.Addr().Interface()); err != nil {
+		return fmt.Errorf("%s: %w", describePath(path), err)
+	}
+	return nil
+}
+
+// documentField is a struct field and the document key it is decoded from
+type documentField struct {
+	name  string
+	index []int
+}
+
+// structFields lists the decodable fields of a struct type, flattening
+// embedded and inline structs
+func structFields(t reflect.Type) []documentField {
+	var fields []documentField
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() && !field.Anonymous {
+			continue
+		}
+
+		name, inline, skip := fieldName(field)
+		if skip {
+			continue
+		}
+
+		if (inline || (field.Anonymous && name == "")) && field.Type.Kind() == reflect.Struct {
+			for _, nested := range structFields(field.Type) {
+				nested.index = append([]int{i}, nested.index...)
+				fields = append(fields, nested)
+			}
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, documentField{name: name, index: []int{i}})
+	}
+	return fields
+}
+
+// fieldName returns the document key of a struct field from its bson or json
+// tag, whether the field is inlined, and whether it is excluded
+func fieldName(field reflect.StructField) (name string, inline bool, skip bool) {
+	for _, key := range []string{"bson", "json"} {
+		tag, ok := field.Tag.Lookup(key)
+		if !ok {
+			continue
+		}
+		if tag == "-" {
+			return "", false, true
+		}
+		parts := strings.Split(tag, ",")
+		for _, option := range parts[1:] {
+			if option == "inline" {
+				inline = true
+			}
+		}
+		if parts[0] != "" {
+			return parts[0], inline, false
+		}
+	}
+	return "", inline, false
+}
+
+// matchField finds the field for a document key, preferring an exact match
+func matchField(fields []documentField, key string) (documentField, bool) {
+	for _, field := range fields {
+		if field.name == key {
+			return field, true
+		}
+	}
+	for _, field := range fields {
+		if strings.EqualFold(field.name, key) {
+			return field, true
+		}
+	}
+	return documentField{}, false
+}
+
+// joinPath appends a key to a dotted field path
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// describePath names a field path in error messages
+func describePath(path string) string {
+	if path == "" {
+		return "document"
+	}
+	return "field " + path
+}
@@ -0,0 +1,274 @@
+package client
+
+import (
+	"fmt"
+	"hash/fnv"
+	"runtime/debug"
+	"sync"
+
+	"aktuell/pkg/models"
+)
+
+// DeliveryMode controls how a subscription's handlers are invoked
+type DeliveryMode int
+
+const (
+	// DeliveryConcurrent runs every handler call in its own goroutine, so
+	// events may be processed out of order
+	DeliveryConcurrent DeliveryMode = iota
+	// DeliveryOrdered runs the handlers one at a time in arrival order
+	DeliveryOrdered
+	// DeliveryKeyed runs handlers in arrival order per document key and in
+	// parallel across keys. Snapshot handlers wait for all earlier events.
+	DeliveryKeyed
+)
+
+// defaultKeyedWorkers is the parallelism of DeliveryKeyed
+const defaultKeyedWorkers = 8
+
+// HandlerPanicError reports a panic in a subscription handler. The panic is
+// recovered and the client keeps running.
+type HandlerPanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Error implements the error interface
+func (e *HandlerPanicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v", e.Value)
+}
+
+// handlerQueue runs tasks one at a time in the order they were pushed. Its
+// goroutine exits when the queue is empty and restarts with the next push.
+// Change handler calls are bounded by limit and subject to the overflow
+// policy; snapshot and barrier tasks are always queued.
+type handlerQueue struct {
+	tasks    []queuedTask
+	changes  int // Queued change handler calls
+	limit    int
+	overflow OverflowPolicy
+	done     <-chan struct{} // Ends blocked pushes with OverflowBlock
+	room     chan struct{}   // Signalled when a change handler call leaves the queue
+	running  bool
+	mu       sync.Mutex
+}
+
+// queuedTask is a task waiting in a handlerQueue
+type queuedTask struct {
+	run    func()
+	change bool
+}
+
+// newHandlerQueue creates a queue holding at most limit change handler calls
+func newHandlerQueue(limit int, overflow OverflowPolicy, done <-chan struct{}) *handlerQueue {
+	return &handlerQueue{
+		limit:    limit,
+		overflow: overflow,
+		done:     done,
+		room:     make(chan struct{}, 1),
+	}
+}
+
+// push appends a task. A change handler call that does not fit is handled
+// by the overflow policy: with OverflowBlock push waits for room, and with
+// OverflowClose it returns ErrChangesOverflow.
+func (q *handlerQueue) push(task func(), change bool) error {
+	q.mu.Lock()
+	for change && q.changes >= q.limit {
+		switch q.overflow {
+		case OverflowBlock:
+			q.mu.Unlock()
+			select {
+			case <-q.room:
+			case <-q.done:
+				return nil
+			}
+			q.mu.Lock()
+			continue
+		case OverflowDropOldest:
+			q.dropOldest()
+			continue
+		case OverflowClose:
+			q.mu.Unlock()
+			return ErrChangesOverflow
+		default:
+			q.mu.Unlock()
+			return nil
+		}
+	}
+
+	q.tasks = append(q.tasks, queuedTask{run: task, change: change})
+	if change {
+		q.changes++
+	}
+	if q.running {
+		q.mu.Unlock()
+		return nil
+	}
+	q.running = true
+	q.mu.Unlock()
+
+	go q.run()
+	return nil
+}
+
+// dropOldest removes the oldest queued change handler call. Caller holds q.mu.
+func (q *handlerQueue) dropOldest() {
+	for i, task := range q.tasks {
+		if task.change {
+			q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
+			q.changes--
+			return
+		}
+	}
+}
+
+// run executes queued tasks until the queue is empty
+func (q *handlerQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.tasks) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		task := q.tasks[0]
+		q.tasks[0] = queuedTask{}
+		q.tasks = q.tasks[1:]
+		if task.change {
+			q.changes--
+			select {
+			case q.room <- struct{}{}:
+			default:
+			}
+		}
+		q.mu.Unlock()
+
+		task.run()
+	}
+}
+
+// handlerDispatcher runs a subscription's handlers on one or more ordered
+// queues. A nil dispatcher runs them concurrently.
+type handlerDispatcher struct {
+	lanes []*handlerQueue
+}
+
+// newHandlerDispatcher creates the dispatcher for a delivery mode. Every
+// queue holds up to limit change handler calls and applies overflow to
+// further ones; done ends calls blocked by OverflowBlock.
+func newHandlerDispatcher(mode DeliveryMode, workers, limit int, overflow OverflowPolicy, done <-chan struct{}) *handlerDispatcher {
+	switch mode {
+	case DeliveryOrdered:
+		workers = 1
+	case DeliveryKeyed:
+		if workers <= 0 {
+			workers = defaultKeyedWorkers
+		}
+	default:
+		return nil
+	}
+
+	d := &handlerDispatcher{lanes: make([]*handlerQueue, workers)}
+	for i := range d.lanes {
+		d.lanes[i] = newHandlerQueue(limit, overflow, done)
+	}
+	return d
+}
+
+// dispatch queues a change handler call behind the earlier tasks for the
+// same key. It returns ErrChangesOverflow if the overflow policy ends the
+// subscription.
+func (d *handlerDispatcher) dispatch(key string, task func()) error {
+	return d.lanes[d.laneFor(key)].push(task, true)
+}
+
+// laneFor returns the index of the queue handling a key
+func (d *handlerDispatcher) laneFor(key string) int {
+	if len(d.lanes) == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(d.lanes)))
+}
+
+// barrier queues a task behind the earlier tasks of every key; later tasks
+// wait until it has finished
+func (d *handlerDispatcher) barrier(task func()) {
+	if len(d.lanes) == 1 {
+		d.lanes[0].push(task, false)
+		return
+	}
+
+	var arrived sync.WaitGroup
+	arrived.Add(len(d.lanes))
+	release := make(chan struct{})
+
+	for i, lane := range d.lanes {
+		if i == 0 {
+			lane.push(func() {
+				arrived.Done()
+				arrived.Wait()
+				defer close(release)
+				task()
+			}, false)
+			continue
+		}
+		lane.push(func() {
+			arrived.Done()
+			<-release
+		}, false)
+	}
+}
+
+// runChangeHandler invokes a change handler according to the subscription's
+// delivery mode. With OverflowBlock it may wait for the handler queue, so the
+// caller must not hold c.mu.
+func (c *Client) runChangeHandler(sub *Subscription, change *models.ChangeEvent, task func()) error {
+	safe := func() {
+		defer c.recoverHandler(sub)
+		task()
+	}
+	if sub == nil || sub.dispatcher == nil {
+		go safe()
+		return nil
+	}
+	return sub.dispatcher.dispatch(documentID(change.DocumentKey["_id"]), safe)
+}
+
+// runHandler invokes a snapshot or completion handler after all earlier
+// handler calls of an ordered subscription
+func (c *Client) runHandler(sub *Subscription, task func()) {
+	safe := func() {
+		defer c.recoverHandler(sub)
+		task()
+	}
+	if sub == nil || sub.dispatcher == nil {
+		go safe()
+		return
+	}
+	sub.dispatcher.barrier(safe)
+}
+
+// recoverHandler turns a handler panic into a *HandlerPanicError for the
+// subscription's error handler. It must be deferred directly.
+func (c *Client) recoverHandler(sub *Subscription) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	err := &HandlerPanicError{Value: r, Stack: debug.Stack()}
+	c.logger.WithField("panic", r).Error("Recovered from panic in handler")
+
+	if sub == nil {
+		return
+	}
+	c.mu.RLock()
+	errorHandler := c.errorHandlers[sub.localID]
+	c.mu.RUnlock()
+	if errorHandler != nil {
+		errorHandler(err)
+	}
+}
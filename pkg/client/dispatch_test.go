@@ -0,0 +1,228 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerDispatcher_Ordered(t *testing.T) {
+	assert.Nil(t, newHandlerDispatcher(DeliveryConcurrent, 0, defaultChangeBuffer, OverflowDropNewest, nil))
+
+	d := newHandlerDispatcher(DeliveryOrdered, 0, defaultChangeBuffer, OverflowDropNewest, nil)
+	var (
+		order []int
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+	)
+	wg.Add(100)
+	for i := 0; i < 100; i++ {
+		d.dispatch(fmt.Sprint(i), func() {
+			defer wg.Done()
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	for i, n := range order {
+		require.Equal(t, i, n)
+	}
+}
+
+func TestHandlerDispatcher_KeyedRunsKeysInParallel(t *testing.T) {
+	d := newHandlerDispatcher(DeliveryKeyed, 4, defaultChangeBuffer, OverflowDropNewest, nil)
+
+	// Find two keys on different lanes
+	keyA, keyB := "a", ""
+	for i := 0; keyB == ""; i++ {
+		if candidate := fmt.Sprint("b", i); d.laneFor(candidate) != d.laneFor(keyA) {
+			keyB = candidate
+		}
+	}
+
+	blocked := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	record := func(s string) {
+		mu.Lock()
+		order = append(order, s)
+		mu.Unlock()
+	}
+
+	d.dispatch(keyA, func() { <-blocked; record("a1") })
+	d.dispatch(keyA, func() { record("a2") })
+	done := make(chan struct{})
+	d.dispatch(keyB, func() { record("b1"); close(done) })
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a blocked key held up another key")
+	}
+
+	// A barrier waits for every key
+	barrier := make(chan struct{})
+	d.barrier(func() { record("snapshot"); close(barrier) })
+	d.dispatch(keyB, func() { record("b2") })
+	close(blocked)
+	<-barrier
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(order) == 5
+	}, time.Second, 5*time.Millisecond)
+
+	assert.Equal(t, []string{"b1", "a1", "a2", "snapshot", "b2"}, order)
+}
+
+func TestHandlerQueue_OverflowPolicies(t *testing.T) {
+	// run starts a queue whose goroutine is busy until the returned function
+	// is called, then queues three change handler calls recording their number
+	run := func(overflow OverflowPolicy) (*handlerQueue, []error, func() []int) {
+		q := newHandlerQueue(2, overflow, nil)
+		started, release := make(chan struct{}), make(chan struct{})
+		require.NoError(t, q.push(func() { close(started); <-release }, false))
+		<-started
+
+		var mu sync.Mutex
+		var ran []int
+		var errs []error
+		for i := 1; i <= 3; i++ {
+			errs = append(errs, q.push(func() {
+				mu.Lock()
+				ran = append(ran, i)
+				mu.Unlock()
+			}, true))
+		}
+		return q, errs, func() []int {
+			close(release)
+			var done sync.WaitGroup
+			done.Add(1)
+			require.NoError(t, q.push(done.Done, false))
+			done.Wait()
+			mu.Lock()
+			defer mu.Unlock()
+			return ran
+		}
+	}
+
+	_, errs, finish := run(OverflowDropNewest)
+	assert.Equal(t, []error{nil, nil, nil}, errs)
+	assert.Equal(t, []int{1, 2}, finish())
+
+	_, errs, finish = run(OverflowDropOldest)
+	assert.Equal(t, []error{nil, nil, nil}, errs)
+	assert.Equal(t, []int{2, 3}, finish())
+
+	_, errs, finish = run(OverflowClose)
+	assert.Equal(t, []error{nil, nil, ErrChangesOverflow}, errs)
+	assert.Equal(t, []int{1, 2}, finish())
+}
+
+func TestHandlerQueue_BlockWaitsForRoom(t *testing.T) {
+	done := make(chan struct{})
+	q := newHandlerQueue(1, OverflowBlock, done)
+	started, release := make(chan struct{}), make(chan struct{})
+	require.NoError(t, q.push(func() { close(started); <-release }, true))
+	<-started
+
+	require.NoError(t, q.push(func() {}, true))
+	pushed := make(chan error, 1)
+	go func() { pushed <- q.push(func() {}, true) }()
+
+	select {
+	case <-pushed:
+		t.Fatal("push did not wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Snapshot and barrier tasks are never held back
+	require.NoError(t, q.push(func() {}, false))
+
+	close(release)
+	select {
+	case err := <-pushed:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("push stayed blocked after the queue drained")
+	}
+
+	// A subscription that ends releases blocked pushes
+	blocked := make(chan struct{})
+	require.NoError(t, q.push(func() { <-blocked }, true))
+	require.NoError(t, q.push(func() {}, true))
+	go func() { pushed <- q.push(func() {}, true) }()
+	close(done)
+	select {
+	case err := <-pushed:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("push stayed blocked after the subscription ended")
+	}
+	close(blocked)
+}
+
+func TestSubscribeContext_RecoversHandlerPanics(t *testing.T) {
+	fs := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		if message.Type != models.MessageTypeSubscribe {
+			return
+		}
+		conn.WriteJSON(&models.ServerMessage{
+			Type:      models.MessageTypeSubscribe,
+			Success:   true,
+			RequestID: message.RequestID,
+			Data:      map[string]interface{}{"subscription_id": "server-sub-1"},
+		})
+		for _, id := range []string{"a", "b"} {
+			conn.WriteJSON(&models.ServerMessage{
+				Type:            models.MessageTypeChange,
+				SubscriptionIDs: []string{"server-sub-1"},
+				Change:          &models.ChangeEvent{ID: id, Database: "testdb", Collection: "users"},
+			})
+		}
+	})
+	c := newTestClient(t, fs.wsURL())
+
+	handled := make(chan string, 2)
+	errs := make(chan error, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := c.SubscribeContext(ctx, "testdb", "users", &SubscriptionOptions{
+		Delivery: DeliveryOrdered,
+		OnChange: func(change *models.ChangeEvent) {
+			if change.ID == "a" {
+				panic("boom")
+			}
+			handled <- change.ID
+		},
+		OnError: func(err error) { errs <- err },
+	})
+	require.NoError(t, err)
+
+	select {
+	case err := <-errs:
+		var panicErr *HandlerPanicError
+		require.True(t, errors.As(err, &panicErr))
+		assert.Equal(t, "boom", panicErr.Value)
+		assert.NotEmpty(t, panicErr.Stack)
+	case <-time.After(2 * time.Second):
+		t.Fatal("panic was not reported")
+	}
+
+	select {
+	case id := <-handled:
+		assert.Equal(t, "b", id)
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not continue after the panic")
+	}
+}
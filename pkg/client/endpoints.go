@@ -0,0 +1,129 @@
+package client
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// EndpointStrategy decides which endpoint the client connects to first
+type EndpointStrategy int
+
+const (
+	// EndpointOrdered prefers endpoints in the order they were given
+	EndpointOrdered EndpointStrategy = iota
+	// EndpointRoundRobin starts each connection attempt at the endpoint after
+	// the one used last
+	EndpointRoundRobin
+	// EndpointRandom starts each connection attempt at a random endpoint
+	EndpointRandom
+)
+
+// defaultEndpointCooldown is how long a failed endpoint is tried last
+const defaultEndpointCooldown = 30 * time.Second
+
+// endpointSet tracks the server endpoints of a client and their health.
+// Endpoints that failed recently are only tried after the healthy ones.
+type endpointSet struct {
+	urls     []string
+	strategy EndpointStrategy
+	cooldown time.Duration
+	failedAt []time.Time // Last failure per endpoint
+	current  int         // Endpoint of the current or last connection
+	mu       sync.Mutex
+}
+
+// newEndpointSet creates the endpoint set for the given URLs
+func newEndpointSet(urls []string, strategy EndpointStrategy, cooldown time.Duration) *endpointSet {
+	if cooldown <= 0 {
+		cooldown = defaultEndpointCooldown
+	}
+	return &endpointSet{
+		urls:     urls,
+		strategy: strategy,
+		cooldown: cooldown,
+		failedAt: make([]time.Time, len(urls)),
+		current:  -1,
+	}
+}
+
+// candidates returns the endpoints to try in order: healthy endpoints by
+// strategy first, then those that failed recently, least recent failure first
+func (e *endpointSet) candidates() []int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := len(e.urls)
+	order := make([]int, n)
+	switch e.strategy {
+	case EndpointRoundRobin:
+		for i := range order {
+			order[i] = (e.current + 1 + i) % n
+		}
+	case EndpointRandom:
+		copy(order, rand.Perm(n))
+	default:
+		for i := range order {
+			order[i] = i
+		}
+	}
+
+	now := time.Now()
+	healthy := make([]int, 0, n)
+	var unhealthy []int
+	for _, i := range order {
+		if e.failedAt[i].IsZero() || now.Sub(e.failedAt[i]) >= e.cooldown {
+			healthy = append(healthy, i)
+		} else {
+			unhealthy = append(unhealthy, i)
+		}
+	}
+	// Stable insertion sort keeps the strategy order among equal failure times
+	for i := 1; i < len(unhealthy); i++ {
+		for j := i; j > 0 && e.failedAt[unhealthy[j]].Before(e.failedAt[unhealthy[j-1]]); j-- {
+			unhealthy[j], unhealthy[j-1] = unhealthy[j-1], unhealthy[j]
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// failed marks an endpoint as unhealthy
+func (e *endpointSet) failed(i int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failedAt[i] = time.Now()
+}
+
+// connected records the endpoint of a new connection
+func (e *endpointSet) connected(i int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.current = i
+	e.failedAt[i] = time.Time{}
+}
+
+// lost marks the endpoint of a dropped connection as unhealthy, so the next
+// attempt prefers another one
+func (e *endpointSet) lost() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.current >= 0 && len(e.urls) > 1 {
+		e.failedAt[e.current] = time.Now()
+	}
+}
+
+// currentURL returns the URL of the current or last connection
+func (e *endpointSet) currentURL() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.current < 0 {
+		return ""
+	}
+	return e.urls[e.current]
+}
+
+// Endpoint returns the URL of the server the client is, or was last,
+// connected to
+func (c *Client) Endpoint() string {
+	return c.endpoints.currentURL()
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointSet_Candidates(t *testing.T) {
+	urls := []string{"ws://a", "ws://b", "ws://c"}
+
+	ordered := newEndpointSet(urls, EndpointOrdered, time.Minute)
+	assert.Equal(t, []int{0, 1, 2}, ordered.candidates())
+
+	// Failed endpoints go last, the longest-failed one first
+	ordered.failed(0)
+	time.Sleep(time.Millisecond)
+	ordered.failed(1)
+	assert.Equal(t, []int{2, 0, 1}, ordered.candidates())
+
+	// A successful connection makes an endpoint healthy again
+	ordered.connected(1)
+	assert.Equal(t, []int{1, 2, 0}, ordered.candidates())
+
+	roundRobin := newEndpointSet(urls, EndpointRoundRobin, time.Minute)
+	assert.Equal(t, []int{0, 1, 2}, roundRobin.candidates())
+	roundRobin.connected(0)
+	assert.Equal(t, []int{1, 2, 0}, roundRobin.candidates())
+	roundRobin.connected(2)
+	assert.Equal(t, []int{0, 1, 2}, roundRobin.candidates())
+
+	random := newEndpointSet(urls, EndpointRandom, time.Minute)
+	assert.ElementsMatch(t, []int{0, 1, 2}, random.candidates())
+}
+
+func TestEndpointSet_CooldownExpires(t *testing.T) {
+	e := newEndpointSet([]string{"ws://a", "ws://b"}, EndpointOrdered, 10*time.Millisecond)
+	e.failed(0)
+	assert.Equal(t, []int{1, 0}, e.candidates())
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, []int{0, 1}, e.candidates())
+}
+
+// deadURL returns the URL of a server that no longer accepts connections
+func deadURL() string {
+	s := httptest.NewServer(nil)
+	s.Close()
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+func TestClient_ConnectSkipsFailedEndpoint(t *testing.T) {
+	fs := newFlakyServer(t)
+	dead := deadURL()
+	c := newSilentClient(dead, &ClientOptions{Endpoints: []string{fs.wsURL()}})
+
+	require.NoError(t, c.Connect())
+	defer c.Disconnect()
+	assert.Equal(t, fs.wsURL(), c.Endpoint())
+
+	// The failed endpoint is tried last on the next connect
+	require.NoError(t, c.Disconnect())
+	assert.Equal(t, []int{1, 0}, c.endpoints.candidates())
+}
+
+func TestClient_ConnectFailsWhenNoEndpointAnswers(t *testing.T) {
+	first, second := deadURL(), deadURL()
+	c := newSilentClient(first, &ClientOptions{Endpoints: []string{second}})
+
+	err := c.Connect()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), first)
+	assert.Contains(t, err.Error(), second)
+	assert.Equal(t, StateClosed, c.State())
+}
+
+func TestClient_RoundRobinAcrossConnects(t *testing.T) {
+	a, b := newFlakyServer(t), newFlakyServer(t)
+	c := newSilentClient(a.wsURL(), &ClientOptions{
+		Endpoints:        []string{b.wsURL()},
+		EndpointStrategy: EndpointRoundRobin,
+	})
+
+	var used []string
+	for i := 0; i < 4; i++ {
+		require.NoError(t, c.Connect())
+		used = append(used, c.Endpoint())
+		require.NoError(t, c.Disconnect())
+	}
+	assert.Equal(t, []string{a.wsURL(), b.wsURL(), a.wsURL(), b.wsURL()}, used)
+}
+
+func TestClient_FailoverRestoresSubscriptionsWithResumePoint(t *testing.T) {
+	var mu sync.Mutex
+	var received []*models.ClientMessage
+
+	accept := func(conn *websocket.Conn, message *models.ClientMessage, id string) {
+		conn.WriteJSON(&models.ServerMessage{
+			Type:      models.MessageTypeSubscribe,
+			Success:   true,
+			RequestID: message.RequestID,
+			Data:      map[string]interface{}{"subscription_id": id},
+		})
+	}
+
+	// The primary delivers one event, then goes away
+	primary := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		if message.Type != models.MessageTypeSubscribe {
+			return
+		}
+		accept(conn, message, "primary-sub")
+		conn.WriteJSON(&models.ServerMessage{
+			Type:            models.MessageTypeChange,
+			SubscriptionIDs: []string{"primary-sub"},
+			Change:          &models.ChangeEvent{ID: "evt-1", Database: "testdb", Collection: "users"},
+		})
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+	})
+	secondary := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		if message.Type != models.MessageTypeSubscribe {
+			return
+		}
+		mu.Lock()
+		received = append(received, message)
+		mu.Unlock()
+		accept(conn, message, "secondary-sub")
+	})
+
+	c := newSilentClient(primary.wsURL(), &ClientOptions{
+		Endpoints: []string{secondary.wsURL()},
+		Reconnect: &ReconnectPolicy{InitialDelay: 5 * time.Millisecond},
+	})
+	require.NoError(t, c.Connect())
+	defer c.Disconnect()
+
+	restored := make(chan error, 1)
+	c.OnResubscribe(func(sub *Subscription, err error) { restored <- err })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := c.SubscribeContext(ctx, "testdb", "users", nil)
+	require.NoError(t, err)
+
+	select {
+	case err := <-restored:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription was not restored")
+	}
+	assert.Equal(t, secondary.wsURL(), c.Endpoint())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 1)
+	require.NotNil(t, received[0].ResumeFrom)
+	assert.Equal(t, "evt-1", received[0].ResumeFrom.EventID)
+}
@@ -0,0 +1,557 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"aktuell/pkg/models"
+)
+
+// subscriptionObserver receives a subscription's snapshot and change messages
+// synchronously and in the order they arrived. Implementations must not block.
+type subscriptionObserver interface {
+	snapshotStarted()
+	snapshotBatch(documents []map[string]interface{})
+	snapshotEnded()
+	changed(change *models.ChangeEvent)
+}
+
+// LiveChange describes a change applied to a LiveCollection
+type LiveChange struct {
+	Operation string                 // insert, update, replace, delete or drop
+	ID        interface{}            // _id of the document; nil for drop
+	Document  map[string]interface{} // The document after the change; nil for delete and drop
+}
+
+// LiveChangeHandler is called after a change was applied to a LiveCollection
+type LiveChangeHandler func(LiveChange)
+
+// LiveCollectionOptions configures a LiveCollection created with SubscribeLive
+type LiveCollectionOptions struct {
+	Snapshot *models.SnapshotOptions // Filter, sort and limit of the snapshot; it is always requested
+	Conflate *models.ConflateOptions // Ask the server to conflate events per document
+	OnChange LiveChangeHandler       // Called in order for every applied change
+	OnError  ErrorHandler
+}
+
+// LiveCollection is an in-memory copy of a collection kept up to date by a
+// subscription. It loads the initial snapshot and then applies inserts,
+// updates, replaces and deletes by document _id. It is safe for concurrent use.
+//
+// Documents outside a limited or filtered snapshot are unknown to the
+// collection, so updates to them are ignored until they are inserted or
+// replaced. The documents of the initial snapshot are not reported to
+// OnChange; wait for Ready instead.
+type LiveCollection struct {
+	sub      *Subscription
+	onChange LiveChangeHandler
+	docs     map[string]map[string]interface{} // Documents by formatted _id
+	loaded   map[string]bool                   // Documents of the snapshot that is loading
+	touched  map[string]bool                   // Documents changed by events while a snapshot is loading; deleted ones are absent from docs
+	ready    chan struct{}
+	isReady  bool
+	queue    []LiveChange // Notifications not yet handed to onChange
+	notifyCh chan struct{}
+	done     chan struct{}
+	once     sync.Once
+	mu       sync.RWMutex
+}
+
+// SubscribeLive subscribes to a collection and maintains a LiveCollection of
+// its documents. It returns once the server confirmed the subscription; use
+// Ready or WaitReady to wait for the snapshot.
+func (c *Client) SubscribeLive(ctx context.Context, database, collection string, opts *LiveCollectionOptions) (*LiveCollection, error) {
+	if opts == nil {
+		opts = &LiveCollectionOptions{}
+	}
+
+	snapshot := &models.SnapshotOptions{}
+	if opts.Snapshot != nil {
+		*snapshot = *opts.Snapshot
+	}
+	snapshot.IncludeSnapshot = true
+
+	lc := &LiveCollection{
+		onChange: opts.OnChange,
+		docs:     make(map[string]map[string]interface{}),
+		ready:    make(chan struct{}),
+		notifyCh: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if lc.onChange != nil {
+		go lc.dispatch()
+	}
+
+	sub, err := c.SubscribeContext(ctx, database, collection, &SubscriptionOptions{
+		Snapshot: snapshot,
+		Conflate: opts.Conflate,
+		OnError:  opts.OnError,
+		observer: lc,
+	})
+	if err != nil {
+		lc.stop()
+		return nil, err
+	}
+	lc.sub = sub
+	return lc, nil
+}
+
+// Subscription returns the subscription feeding the collection
+func (lc *LiveCollection) Subscription() *Subscription {
+	return lc.sub
+}
+
+// Ready returns a channel that is closed once the initial snapshot was loaded
+func (lc *LiveCollection) Ready() <-chan struct{} {
+	return lc.ready
+}
+
+// WaitReady blocks until the initial snapshot was loaded or ctx is done
+func (lc *LiveCollection) WaitReady(ctx context.Context) error {
+	select {
+	case <-lc.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Get returns a copy of the document with the given _id
+func (lc *LiveCollection) Get(id interface{}) (map[string]interface{}, bool) {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	doc, ok := lc.docs[documentID(id)]
+	if !ok {
+		return nil, false
+	}
+	return models.CopyDocument(doc), true
+}
+
+// All returns copies of all documents, ordered by _id as Find orders them
+func (lc *LiveCollection) All() []map[string]interface{} {
+	return lc.Find(nil)
+}
+
+// Find returns copies of the documents matching filter, ordered by _id:
+// numeric ids by value ahead of all others, which are ordered as text. The
+// filter maps field paths such as "address.city" to the value they must
+// equal; an array field matches if any of its elements equals the value.
+func (lc *LiveCollection) Find(filter map[string]interface{}) []map[string]interface{} {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	keys := make([]string, 0, len(lc.docs))
+	for key, doc := range lc.docs {
+		if matchesFilter(doc, filter) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return lessID(lc.docs[keys[i]]["_id"], lc.docs[keys[j]]["_id"])
+	})
+
+	result := make([]map[string]interface{}, len(keys))
+	for i, key := range keys {
+		result[i] = models.CopyDocument(lc.docs[key])
+	}
+	return result
+}
+
+// Len returns the number of documents
+func (lc *LiveCollection) Len() int {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	return len(lc.docs)
+}
+
+// Close unsubscribes and stops change notifications. The documents remain
+// readable but are no longer updated.
+func (lc *LiveCollection) Close() error {
+	lc.stop()
+	return lc.sub.Close()
+}
+
+// stop ends the notification dispatcher
+func (lc *LiveCollection) stop() {
+	lc.once.Do(func() { close(lc.done) })
+}
+
+// snapshotStarted begins loading a snapshot. A snapshot after the first one,
+// e.g. after a resnapshot, replaces the documents it no longer contains.
+func (lc *LiveCollection) snapshotStarted() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.loaded = make(map[string]bool)
+	lc.touched = make(map[string]bool)
+}
+
+// snapshotBatch stores a batch of snapshot documents. Documents that change
+// events touched meanwhile are newer than the snapshot and kept as they are,
+// including deleted ones.
+func (lc *LiveCollection) snapshotBatch(documents []map[string]interface{}) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	for _, document := range documents {
+		id, ok := document["_id"]
+		if !ok {
+			continue
+		}
+		key := documentID(id)
+		if lc.touched[key] {
+			continue
+		}
+		previous, existed := lc.docs[key]
+		doc := models.CopyDocument(document)
+		lc.docs[key] = doc
+		if lc.loaded != nil {
+			lc.loaded[key] = true
+		}
+
+		if !lc.isReady {
+			continue
+		}
+		switch {
+		case !existed:
+			lc.notifyLocked(LiveChange{Operation: models.OperationInsert, ID: id, Document: models.CopyDocument(doc)})
+		case !valuesEqual(previous, doc):
+			lc.notifyLocked(LiveChange{Operation: models.OperationReplace, ID: id, Document: models.CopyDocument(doc)})
+		}
+	}
+}
+
+// snapshotEnded finishes loading a snapshot and signals readiness
+func (lc *LiveCollection) snapshotEnded() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.loaded != nil {
+		for key, doc := range lc.docs {
+			if lc.loaded[key] || lc.touched[key] {
+				continue
+			}
+			delete(lc.docs, key)
+			if lc.isReady {
+				lc.notifyLocked(LiveChange{Operation: models.OperationDelete, ID: doc["_id"]})
+			}
+		}
+		lc.loaded, lc.touched = nil, nil
+	}
+
+	if !lc.isReady {
+		lc.isReady = true
+		close(lc.ready)
+	}
+}
+
+// changed applies a change event to the documents
+func (lc *LiveCollection) changed(change *models.ChangeEvent) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	switch change.OperationType {
+	case models.OperationDrop, models.OperationRename, models.OperationDropDatabase, models.OperationInvalidate:
+		lc.docs = make(map[string]map[string]interface{})
+		lc.notifyLocked(LiveChange{Operation: models.OperationDrop})
+		return
+	}
+
+	id, ok := change.DocumentKey["_id"]
+	if !ok {
+		if id, ok = change.FullDocument["_id"]; !ok {
+			return
+		}
+	}
+	key := documentID(id)
+
+	var doc map[string]interface{}
+	switch change.OperationType {
+	case models.OperationInsert, models.OperationReplace:
+		if change.FullDocument == nil {
+			return
+		}
+		doc = models.CopyDocument(change.FullDocument)
+
+	case models.OperationUpdate:
+		if change.FullDocument != nil {
+			// Looked up by the server, so it is complete
+			doc = models.CopyDocument(change.FullDocument)
+			break
+		}
+		existing, ok := lc.docs[key]
+		if !ok {
+			// Still newer than the copy a loading snapshot may bring
+			lc.touchLocked(key)
+			return
+		}
+		doc = existing
+		for path, value := range change.UpdatedFields {
+			setPath(doc, strings.Split(path, "."), models.CopyValue(value))
+		}
+		for _, path := range change.RemovedFields {
+			unsetPath(doc, strings.Split(path, "."))
+		}
+
+	case models.OperationDelete:
+		lc.touchLocked(key)
+		if _, ok := lc.docs[key]; !ok {
+			return
+		}
+		delete(lc.docs, key)
+		lc.notifyLocked(LiveChange{Operation: models.OperationDelete, ID: id})
+		return
+
+	default:
+		return
+	}
+
+	lc.docs[key] = doc
+	lc.touchLocked(key)
+	lc.notifyLocked(LiveChange{Operation: change.OperationType, ID: id, Document: models.CopyDocument(doc)})
+}
+
+// touchLocked marks a document as newer than the snapshot that is loading, if
+// any. Caller holds lc.mu.
+func (lc *LiveCollection) touchLocked(key string) {
+	if lc.touched != nil {
+		lc.touched[key] = true
+	}
+}
+
+// notifyLocked queues a notification for onChange. Caller holds lc.mu.
+func (lc *LiveCollection) notifyLocked(change LiveChange) {
+	if lc.onChange == nil {
+		return
+	}
+	lc.queue = append(lc.queue, change)
+	select {
+	case lc.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands queued notifications to onChange in order until stopped
+func (lc *LiveCollection) dispatch() {
+	for {
+		select {
+		case <-lc.done:
+			return
+		case <-lc.notifyCh:
+		}
+
+		lc.mu.Lock()
+		queue := lc.queue
+		lc.queue = nil
+		lc.mu.Unlock()
+
+		for _, change := range queue {
+			lc.onChange(change)
+		}
+	}
+}
+
+// documentID formats a document _id as a map key; it also orders handler
+// calls per document. Values are compared by their printed form, so Get(42)
+// finds a document whose _id decoded as 42.0.
+func documentID(id interface{}) string {
+	return fmt.Sprint(id)
+}
+
+// lessID orders document _ids, numbers by value ahead of other values, which
+// compare by their printed form
+func lessID(a, b interface{}) bool {
+	x, xNumber := toFloat(a)
+	y, yNumber := toFloat(b)
+	switch {
+	case xNumber && yNumber:
+		return x < y
+	case xNumber != yNumber:
+		return xNumber
+	}
+	return documentID(a) < documentID(b)
+}
+
+// setPath sets a field given as path segments, creating intermediate
+// documents and extending arrays with nulls like MongoDB does
+func setPath(node interface{}, path []string, value interface{}) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		n[path[0]] = setPath(n[path[0]], path[1:], value)
+		return n
+	case []interface{}:
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 {
+			return n
+		}
+		for len(n) <= index {
+			n = append(n, nil)
+		}
+		n[index] = setPath(n[index], path[1:], value)
+		return n
+	default:
+		return map[string]interface{}{path[0]: setPath(nil, path[1:], value)}
+	}
+}
+
+// unsetPath removes a field given as path segments. Array elements are set
+// to null instead, as $unset does.
+func unsetPath(node interface{}, path []string) {
+	if len(path) == 0 {
+		return
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(n, path[0])
+			return
+		}
+		unsetPath(n[path[0]], path[1:])
+	case []interface{}:
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 || index >= len(n) {
+			return
+		}
+		if len(path) == 1 {
+			n[index] = nil
+			return
+		}
+		unsetPath(n[index], path[1:])
+	}
+}
+
+// lookupPath returns the value at a field path
+func lookupPath(node interface{}, path []string) (interface{}, bool) {
+	for _, segment := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			value, ok := n[segment]
+			if !ok {
+				return nil, false
+			}
+			node = value
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(n) {
+				return nil, false
+			}
+			node = n[index]
+		default:
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// matchesFilter reports whether a document satisfies every field of filter.
+// Unlike the server's policy filters it has no operators: a filter value is
+// compared whole, so embedded documents match by equality, and nil matches a
+// missing field.
+func matchesFilter(doc map[string]interface{}, filter map[string]interface{}) bool {
+	for path, want := range filter {
+		value, ok := lookupPath(doc, strings.Split(path, "."))
+		if !ok {
+			if want != nil {
+				return false
+			}
+			continue
+		}
+		if valuesEqual(value, want) {
+			continue
+		}
+		elements, isArray := value.([]interface{})
+		if !isArray || !containsValue(elements, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsValue reports whether an array holds a value
+func containsValue(elements []interface{}, want interface{}) bool {
+	for _, element := range elements {
+		if valuesEqual(element, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// valuesEqual compares decoded document values, treating numbers of
+// different Go types as equal if their values are
+func valuesEqual(a, b interface{}) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			other, ok := y[key]
+			if !ok || !valuesEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !valuesEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+// toFloat converts any Go number to float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
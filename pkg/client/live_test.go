@@ -0,0 +1,201 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetPath_DottedFieldsAndArrays(t *testing.T) {
+	doc := map[string]interface{}{
+		"address": map[string]interface{}{"city": "Berlin"},
+		"tags":    []interface{}{"a", "b"},
+	}
+
+	setPath(doc, strings.Split("address.city", "."), "Hamburg")
+	setPath(doc, strings.Split("address.geo.lat", "."), 53.5)
+	setPath(doc, strings.Split("tags.1", "."), "c")
+	setPath(doc, strings.Split("tags.3", "."), "d")
+	unsetPath(doc, strings.Split("tags.0", "."))
+	unsetPath(doc, strings.Split("address.city", "."))
+
+	assert.Equal(t, map[string]interface{}{
+		"address": map[string]interface{}{"geo": map[string]interface{}{"lat": 53.5}},
+		"tags":    []interface{}{nil, "c", nil, "d"},
+	}, doc)
+}
+
+func TestMatchesFilter(t *testing.T) {
+	doc := map[string]interface{}{
+		"status": "active",
+		"count":  float64(3),
+		"tags":   []interface{}{"x", "y"},
+		"owner":  map[string]interface{}{"team": "core"},
+	}
+
+	assert.True(t, matchesFilter(doc, nil))
+	assert.True(t, matchesFilter(doc, map[string]interface{}{"status": "active", "count": 3}))
+	assert.True(t, matchesFilter(doc, map[string]interface{}{"owner.team": "core", "tags": "y"}))
+	assert.False(t, matchesFilter(doc, map[string]interface{}{"owner.team": "ops"}))
+	assert.False(t, matchesFilter(doc, map[string]interface{}{"missing": "x"}))
+}
+
+func TestSubscribeLive_AppliesSnapshotAndChanges(t *testing.T) {
+	fs := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		if message.Type != models.MessageTypeSubscribe {
+			return
+		}
+		assert.True(t, message.SnapshotOptions.IncludeSnapshot)
+
+		routed := func(m *models.ServerMessage) *models.ServerMessage {
+			m.RequestID = message.RequestID
+			m.SubscriptionIDs = []string{"server-sub-1"}
+			return m
+		}
+		conn.WriteJSON(&models.ServerMessage{
+			Type:      models.MessageTypeSubscribe,
+			Success:   true,
+			RequestID: message.RequestID,
+			Data:      map[string]interface{}{"subscription_id": "server-sub-1"},
+		})
+		conn.WriteJSON(routed(&models.ServerMessage{Type: models.MessageTypeSnapshotStart}))
+		conn.WriteJSON(routed(&models.ServerMessage{
+			Type: models.MessageTypeSnapshot,
+			SnapshotData: []map[string]interface{}{
+				{"_id": "u1", "name": "Ada", "address": map[string]interface{}{"city": "London"}, "legacy": true},
+				{"_id": "u2", "name": "Alan"},
+			},
+			SnapshotBatch: 1,
+		}))
+		conn.WriteJSON(routed(&models.ServerMessage{Type: models.MessageTypeSnapshotEnd}))
+
+		for _, change := range []*models.ChangeEvent{
+			{
+				OperationType: models.OperationUpdate,
+				DocumentKey:   map[string]interface{}{"_id": "u1"},
+				UpdatedFields: map[string]interface{}{"address.city": "Cambridge"},
+				RemovedFields: []string{"legacy"},
+			},
+			{OperationType: models.OperationDelete, DocumentKey: map[string]interface{}{"_id": "u2"}},
+			{
+				OperationType: models.OperationInsert,
+				DocumentKey:   map[string]interface{}{"_id": "u3"},
+				FullDocument:  map[string]interface{}{"_id": "u3", "name": "Grace"},
+			},
+		} {
+			change.Database, change.Collection = "testdb", "users"
+			conn.WriteJSON(routed(&models.ServerMessage{Type: models.MessageTypeChange, Change: change}))
+		}
+	})
+	c := newTestClient(t, fs.wsURL())
+
+	notified := make(chan LiveChange, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	lc, err := c.SubscribeLive(ctx, "testdb", "users", &LiveCollectionOptions{
+		OnChange: func(change LiveChange) { notified <- change },
+	})
+	require.NoError(t, err)
+	require.NoError(t, lc.WaitReady(ctx))
+
+	var ops []string
+	for i := 0; i < 3; i++ {
+		select {
+		case change := <-notified:
+			ops = append(ops, change.Operation)
+		case <-time.After(2 * time.Second):
+			t.Fatal("change was not notified")
+		}
+	}
+	assert.Equal(t, []string{models.OperationUpdate, models.OperationDelete, models.OperationInsert}, ops)
+
+	ada, ok := lc.Get("u1")
+	require.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"_id": "u1", "name": "Ada", "address": map[string]interface{}{"city": "Cambridge"}}, ada)
+
+	// Returned documents are copies
+	ada["name"] = "changed"
+	ada, _ = lc.Get("u1")
+	assert.Equal(t, "Ada", ada["name"])
+
+	_, ok = lc.Get("u2")
+	assert.False(t, ok)
+	assert.Equal(t, 2, lc.Len())
+	assert.Len(t, lc.All(), 2)
+	assert.Equal(t, []map[string]interface{}{{"_id": "u3", "name": "Grace"}}, lc.Find(map[string]interface{}{"name": "Grace"}))
+}
+
+func TestLiveCollection_ResnapshotRemovesVanishedDocuments(t *testing.T) {
+	lc := &LiveCollection{docs: make(map[string]map[string]interface{}), ready: make(chan struct{})}
+
+	lc.snapshotStarted()
+	lc.snapshotBatch([]map[string]interface{}{{"_id": "a"}, {"_id": "b"}})
+	lc.snapshotEnded()
+	assert.Equal(t, 2, lc.Len())
+
+	lc.snapshotStarted()
+	lc.snapshotBatch([]map[string]interface{}{{"_id": "a"}})
+	lc.changed(&models.ChangeEvent{
+		OperationType: models.OperationInsert,
+		DocumentKey:   map[string]interface{}{"_id": "c"},
+		FullDocument:  map[string]interface{}{"_id": "c"},
+	})
+	lc.snapshotEnded()
+
+	ids := make([]interface{}, 0)
+	for _, doc := range lc.All() {
+		ids = append(ids, doc["_id"])
+	}
+	assert.Equal(t, []interface{}{"a", "c"}, ids)
+}
+
+func TestLiveCollection_ChangesDuringSnapshotWin(t *testing.T) {
+	lc := &LiveCollection{docs: make(map[string]map[string]interface{}), ready: make(chan struct{})}
+
+	lc.snapshotStarted()
+	lc.changed(&models.ChangeEvent{
+		OperationType: models.OperationDelete,
+		DocumentKey:   map[string]interface{}{"_id": "a"},
+	})
+	lc.changed(&models.ChangeEvent{
+		OperationType: models.OperationReplace,
+		DocumentKey:   map[string]interface{}{"_id": "b"},
+		FullDocument:  map[string]interface{}{"_id": "b", "version": 2},
+	})
+	lc.changed(&models.ChangeEvent{
+		OperationType: models.OperationUpdate,
+		DocumentKey:   map[string]interface{}{"_id": "d"},
+		UpdatedFields: map[string]interface{}{"version": 2},
+	})
+	lc.snapshotBatch([]map[string]interface{}{{"_id": "a", "version": 1}, {"_id": "b", "version": 1}, {"_id": "c", "version": 1}, {"_id": "d", "version": 1}})
+	lc.snapshotEnded()
+
+	_, ok := lc.Get("a")
+	assert.False(t, ok, "a deleted document does not come back with the older snapshot")
+	b, _ := lc.Get("b")
+	assert.Equal(t, 2, b["version"])
+	_, ok = lc.Get("d")
+	assert.False(t, ok, "an updated document is not restored from the older snapshot")
+	assert.Equal(t, 2, lc.Len())
+}
+
+func TestLiveCollection_AllOrdersNumericIDsByValue(t *testing.T) {
+	lc := &LiveCollection{docs: make(map[string]map[string]interface{}), ready: make(chan struct{})}
+
+	lc.snapshotStarted()
+	lc.snapshotBatch([]map[string]interface{}{{"_id": "b"}, {"_id": 10.0}, {"_id": "a"}, {"_id": 9.0}, {"_id": 100.0}})
+	lc.snapshotEnded()
+
+	ids := make([]interface{}, 0)
+	for _, doc := range lc.All() {
+		ids = append(ids, doc["_id"])
+	}
+	assert.Equal(t, []interface{}{9.0, 10.0, 100.0, "a", "b"}, ids)
+}
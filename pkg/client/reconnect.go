@@ -0,0 +1,225 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ConnectionState is the state of a client's connection to the server
+type ConnectionState int
+
+const (
+	// StateClosed means the client is not connected and not reconnecting
+	StateClosed ConnectionState = iota
+	// StateConnecting means Connect is establishing the first connection
+	StateConnecting
+	// StateConnected means the client has a connection
+	StateConnected
+	// StateReconnecting means the connection was lost and the reconnection
+	// policy is trying to establish a new one
+	StateReconnecting
+)
+
+// String returns the name of the state
+func (s ConnectionState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return fmt.Sprintf("ConnectionState(%d)", int(s))
+	}
+}
+
+// StateHandler is called on every connection state change. err is the reason
+// for entering StateReconnecting or StateClosed, if there is one; it is a
+// *ReconnectError when the reconnection policy gave up. The handler runs
+// synchronously and must not block.
+type StateHandler func(state ConnectionState, err error)
+
+// ReconnectPolicy controls automatic reconnection. The wait before attempt n
+// is InitialDelay * Multiplier^(n-1), capped at MaxDelay, with a random
+// Jitter fraction added or removed.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration // Wait before the first attempt (default: ClientOptions.ReconnectWait)
+	MaxDelay     time.Duration // Upper bound of the wait (default: 30s)
+	Multiplier   float64       // Growth of the wait per failed attempt (default: 2)
+	Jitter       float64       // Randomization of each wait, from 0 to 1
+	MaxAttempts  int           // Give up after this many failed attempts (0: never)
+	MaxElapsed   time.Duration // Give up after reconnecting for this long (0: never)
+}
+
+// DefaultReconnectPolicy returns a policy with exponential backoff from one
+// second up to 30 seconds and 20% jitter that never gives up
+func DefaultReconnectPolicy() *ReconnectPolicy {
+	return &ReconnectPolicy{
+		InitialDelay: time.Second,
+		MaxDelay:     30 * time.Second,
+		Multiplier:   2,
+		Jitter:       0.2,
+	}
+}
+
+// withDefaults returns a copy of the policy with unset fields filled in
+func (p ReconnectPolicy) withDefaults(initialDelay time.Duration) ReconnectPolicy {
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = initialDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 30 * time.Second
+	}
+	if p.MaxDelay < p.InitialDelay {
+		p.MaxDelay = p.InitialDelay
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	}
+	if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+	return p
+}
+
+// delay returns the wait before the given attempt, counting from 1
+func (p ReconnectPolicy) delay(attempt int) time.Duration {
+	wait := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if wait > float64(p.MaxDelay) {
+		wait = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		wait += wait * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(wait)
+}
+
+// ReconnectError reports that the reconnection policy gave up
+type ReconnectError struct {
+	Attempts int
+	Elapsed  time.Duration
+	Err      error // Error of the last attempt
+}
+
+// Error implements the error interface
+func (e *ReconnectError) Error() string {
+	return fmt.Sprintf("gave up reconnecting after %d attempts in %s: %v", e.Attempts, e.Elapsed.Round(time.Millisecond), e.Err)
+}
+
+// Unwrap returns the error of the last attempt
+func (e *ReconnectError) Unwrap() error {
+	return e.Err
+}
+
+// SetReconnectPolicy enables automatic reconnection with the given policy, or
+// disables it if policy is nil. It applies from the next lost connection.
+func (c *Client) SetReconnectPolicy(policy *ReconnectPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconnect = policy
+}
+
+// EnableAutoReconnect enables automatic reconnection with a fixed wait
+// between attempts; see SetReconnectPolicy for backoff and limits
+func (c *Client) EnableAutoReconnect(wait time.Duration) {
+	c.SetReconnectPolicy(&ReconnectPolicy{InitialDelay: wait, MaxDelay: wait, Multiplier: 1})
+}
+
+// OnStateChange sets the handler for connection state changes
+func (c *Client) OnStateChange(handler StateHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stateHandler = handler
+}
+
+// State returns the current connection state
+func (c *Client) State() ConnectionState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state
+}
+
+// notifyState reports a state change that was recorded under c.mu
+func (c *Client) notifyState(state ConnectionState, err error) {
+	entry := c.logger.WithField("state", state)
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Debug("Connection state changed")
+
+	c.mu.RLock()
+	handler := c.stateHandler
+	c.mu.RUnlock()
+	if handler != nil {
+		handler(state, err)
+	}
+}
+
+// reconnectLoop tries to connect again until it succeeds, the policy gives up
+// or stop is closed by Disconnect
+func (c *Client) reconnectLoop(stop chan struct{}, policy ReconnectPolicy) {
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		wait := policy.delay(attempt)
+		c.logger.WithFields(logrus.Fields{
+			"attempt": attempt,
+			"wait":    wait,
+		}).Info("Connection lost, attempting to reconnect")
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := c.dial(stop)
+		if err == nil {
+			if err := c.negotiateBatching(); err != nil {
+				c.logger.WithError(err).Warn("Failed to negotiate batching after reconnect")
+			}
+			c.restoreAfterConnect()
+			return
+		}
+		if errors.Is(err, ErrClientClosed) {
+			return
+		}
+		c.logger.WithError(err).WithField("attempt", attempt).Warn("Failed to reconnect")
+
+		elapsed := time.Since(start)
+		exhausted := policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts
+		expired := policy.MaxElapsed > 0 && elapsed >= policy.MaxElapsed
+		if !exhausted && !expired {
+			continue
+		}
+
+		c.mu.Lock()
+		gaveUp := c.state == StateReconnecting && c.stopCh == stop
+		if gaveUp {
+			c.state = StateClosed
+		}
+		c.mu.Unlock()
+
+		if gaveUp {
+			c.logger.WithFields(logrus.Fields{
+				"attempts": attempt,
+				"elapsed":  elapsed,
+			}).Error("Giving up reconnecting")
+			c.notifyState(StateClosed, &ReconnectError{Attempts: attempt, Elapsed: elapsed, Err: err})
+		}
+		return
+	}
+}
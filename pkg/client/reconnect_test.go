@@ -0,0 +1,191 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconnectPolicy_Delay(t *testing.T) {
+	p := ReconnectPolicy{MaxDelay: 300 * time.Millisecond}.withDefaults(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, p.delay(1))
+	assert.Equal(t, 200*time.Millisecond, p.delay(2))
+	assert.Equal(t, 300*time.Millisecond, p.delay(3))
+	assert.Equal(t, 300*time.Millisecond, p.delay(50))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		wait := p.delay(1)
+		assert.GreaterOrEqual(t, wait, 50*time.Millisecond)
+		assert.LessOrEqual(t, wait, 150*time.Millisecond)
+	}
+}
+
+// stateRecorder collects connection state changes
+type stateRecorder struct {
+	states []ConnectionState
+	errs   []error
+	mu     sync.Mutex
+}
+
+func (r *stateRecorder) record(state ConnectionState, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states = append(r.states, state)
+	r.errs = append(r.errs, err)
+}
+
+func (r *stateRecorder) snapshot() ([]ConnectionState, []error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ConnectionState(nil), r.states...), append([]error(nil), r.errs...)
+}
+
+// flakyServer accepts WebSocket connections until refuse is set, counts the
+// pings it receives and can drop every open connection
+type flakyServer struct {
+	*httptest.Server
+	refuse atomic.Bool
+	pings  atomic.Int32
+	conns  []*websocket.Conn
+	mu     sync.Mutex
+}
+
+func newFlakyServer(t *testing.T) *flakyServer {
+	t.Helper()
+
+	fs := &flakyServer{}
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fs.refuse.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		fs.mu.Lock()
+		fs.conns = append(fs.conns, conn)
+		fs.mu.Unlock()
+
+		for {
+			var message models.ClientMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			if message.Type == models.MessageTypePing {
+				fs.pings.Add(1)
+			}
+		}
+	}))
+	t.Cleanup(fs.Close)
+	return fs
+}
+
+// drop closes every open connection
+func (fs *flakyServer) drop() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, conn := range fs.conns {
+		conn.Close()
+	}
+	fs.conns = nil
+}
+
+func (fs *flakyServer) wsURL() string {
+	return "ws" + strings.TrimPrefix(fs.URL, "http")
+}
+
+func newSilentClient(url string, opts *ClientOptions) *Client {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	opts.Logger = logger
+	return NewClient(url, opts)
+}
+
+func TestClient_StateChangesAndRestart(t *testing.T) {
+	fs := newFlakyServer(t)
+	var recorder stateRecorder
+	c := newSilentClient(fs.wsURL(), &ClientOptions{OnStateChange: recorder.record})
+
+	assert.Equal(t, StateClosed, c.State())
+	require.NoError(t, c.Connect())
+	assert.ErrorIs(t, c.Connect(), ErrAlreadyConnected)
+	require.NoError(t, c.Disconnect())
+
+	// A disconnected client can connect again
+	require.NoError(t, c.Connect())
+	assert.True(t, c.IsConnected())
+	require.NoError(t, c.Disconnect())
+	assert.False(t, c.IsConnected())
+
+	states, _ := recorder.snapshot()
+	assert.Equal(t, []ConnectionState{
+		StateConnecting, StateConnected, StateClosed,
+		StateConnecting, StateConnected, StateClosed,
+	}, states)
+}
+
+func TestClient_ReconnectsWithBackoffAndGivesUp(t *testing.T) {
+	fs := newFlakyServer(t)
+	var recorder stateRecorder
+	c := newSilentClient(fs.wsURL(), &ClientOptions{
+		OnStateChange: recorder.record,
+		Reconnect:     &ReconnectPolicy{InitialDelay: 5 * time.Millisecond, MaxAttempts: 3},
+	})
+	require.NoError(t, c.Connect())
+	defer c.Disconnect()
+
+	// The first loss is repaired
+	fs.drop()
+	require.Eventually(t, func() bool {
+		states, _ := recorder.snapshot()
+		return len(states) == 4
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, StateConnected, c.State())
+
+	// The second one exhausts the attempts
+	fs.refuse.Store(true)
+	fs.drop()
+	require.Eventually(t, func() bool {
+		states, _ := recorder.snapshot()
+		return len(states) == 6
+	}, 2*time.Second, 5*time.Millisecond)
+
+	states, errs := recorder.snapshot()
+	assert.Equal(t, []ConnectionState{
+		StateConnecting, StateConnected,
+		StateReconnecting, StateConnected,
+		StateReconnecting, StateClosed,
+	}, states)
+
+	var reconnectErr *ReconnectError
+	require.True(t, errors.As(errs[5], &reconnectErr))
+	assert.Equal(t, 3, reconnectErr.Attempts)
+
+	// Giving up leaves the client restartable
+	fs.refuse.Store(false)
+	require.NoError(t, c.Connect())
+	assert.Equal(t, StateConnected, c.State())
+}
+
+func TestClient_HonoursPingInterval(t *testing.T) {
+	fs := newFlakyServer(t)
+	c := newSilentClient(fs.wsURL(), &ClientOptions{PingInterval: 10 * time.Millisecond})
+	require.NoError(t, c.Connect())
+	defer c.Disconnect()
+
+	require.Eventually(t, func() bool { return fs.pings.Load() >= 3 }, 2*time.Second, 5*time.Millisecond)
+}
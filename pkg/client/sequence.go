@@ -0,0 +1,220 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"aktuell/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GapAction tells the client how to recover from a sequence gap
+type GapAction int
+
+const (
+	// GapIgnore delivers the event and continues from its sequence number
+	GapIgnore GapAction = iota
+	// GapResume re-creates the subscription from the last event before the gap
+	GapResume
+	// GapResnapshot re-creates the subscription with its original options,
+	// including the initial snapshot
+	GapResnapshot
+	// GapError ends the subscription with a *SequenceError
+	GapError
+)
+
+// SequenceGap describes missing or repeated events on a subscription
+type SequenceGap struct {
+	Expected  uint64 // Sequence number the client expected next
+	Received  uint64 // Sequence number that arrived instead
+	Duplicate bool   // The event was delivered before
+}
+
+// Missing returns the number of events that never arrived
+func (g SequenceGap) Missing() uint64 {
+	if g.Duplicate {
+		return 0
+	}
+	return g.Received - g.Expected
+}
+
+// GapHandler decides how to recover from a gap or duplicate in a
+// subscription's sequence numbers. It runs on the client's read loop and must
+// not block. Duplicates are never delivered, whatever the handler returns.
+type GapHandler func(sub *Subscription, gap SequenceGap) GapAction
+
+// SequenceError ends a subscription whose GapHandler returned GapError
+type SequenceError struct {
+	Gap SequenceGap
+}
+
+// Error implements the error interface
+func (e *SequenceError) Error() string {
+	if e.Gap.Duplicate {
+		return fmt.Sprintf("duplicate event: expected sequence %d, received %d", e.Gap.Expected, e.Gap.Received)
+	}
+	return fmt.Sprintf("missed %d events: expected sequence %d, received %d", e.Gap.Missing(), e.Gap.Expected, e.Gap.Received)
+}
+
+// checkSequence compares a sequence number with the expected one and returns
+// the gap, if any. Acknowledged subscriptions are verified by their acks
+// instead, since redelivery legitimately reorders them.
+func (s *Subscription) checkSequence(seq uint64) *SequenceGap {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ack != nil {
+		return nil
+	}
+
+	expected := s.lastSeq + 1
+	if seq == expected {
+		s.lastSeq = seq
+		return nil
+	}
+	return &SequenceGap{Expected: expected, Received: seq, Duplicate: seq < expected}
+}
+
+// advanceSequence continues the sequence from seq after an ignored gap
+func (s *Subscription) advanceSequence(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq > s.lastSeq {
+		s.lastSeq = seq
+	}
+}
+
+// resetSequence starts over after the subscription was re-created on the server
+func (s *Subscription) resetSequence() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeq = 0
+}
+
+// startSequence continues the sequence after seq, the last number the server
+// used before confirming the subscription
+func (s *Subscription) startSequence(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeq = seq
+	if s.ack != nil && seq > s.ack.floor {
+		s.ack.floor = seq
+	}
+}
+
+// checkSequences verifies the sequence numbers of a change message and
+// returns the local subscriptions that must not receive it
+func (c *Client) checkSequences(message *models.ServerMessage) map[string]bool {
+	if len(message.Sequences) == 0 || len(message.Sequences) != len(message.SubscriptionIDs) {
+		// Older servers do not number their events
+		return nil
+	}
+
+	type gapped struct {
+		localID string
+		sub     *Subscription
+		gap     SequenceGap
+	}
+	var gaps []gapped
+
+	c.mu.RLock()
+	for i, serverID := range message.SubscriptionIDs {
+		localID, ok := c.serverIDs[serverID]
+		if !ok {
+			continue
+		}
+		sub, ok := c.subscriptions[localID]
+		if !ok {
+			continue
+		}
+		if gap := sub.checkSequence(message.Sequences[i]); gap != nil {
+			gaps = append(gaps, gapped{localID: localID, sub: sub, gap: *gap})
+		}
+	}
+	c.mu.RUnlock()
+
+	if len(gaps) == 0 {
+		return nil
+	}
+
+	skip := make(map[string]bool, len(gaps))
+	for _, g := range gaps {
+		if !c.recoverGap(g.localID, g.sub, g.gap) {
+			skip[g.localID] = true
+		}
+	}
+	return skip
+}
+
+// recoverGap applies the subscription's gap policy and reports whether the
+// event that revealed the gap should still be delivered
+func (c *Client) recoverGap(localID string, sub *Subscription, gap SequenceGap) bool {
+	entry := c.logger.WithFields(logrus.Fields{
+		"subscription_id": sub.ID(),
+		"expected":        gap.Expected,
+		"received":        gap.Received,
+	})
+
+	action := GapIgnore
+	if sub.onGap != nil {
+		action = sub.onGap(sub, gap)
+	} else if gap.Duplicate {
+		entry.Debug("Dropping duplicate event")
+	} else {
+		entry.WithField("missing", gap.Missing()).Warn("Events missing from subscription")
+	}
+
+	switch action {
+	case GapResume, GapResnapshot:
+		// Stop routing events of the current server subscription, then replace it
+		c.mu.Lock()
+		oldServerID := sub.serverID
+		delete(c.serverIDs, oldServerID)
+		sub.serverID = ""
+		c.mu.Unlock()
+
+		go c.recreateSubscription(sub, oldServerID, action == GapResume)
+		return false
+
+	case GapError:
+		c.failSubscription(localID, sub, &SequenceError{Gap: gap})
+		return false
+
+	default:
+		if gap.Duplicate {
+			return false
+		}
+		sub.advanceSequence(gap.Received)
+		return true
+	}
+}
+
+// recreateSubscription replaces a server-side subscription after a gap,
+// resuming from the last delivered event or starting with a new snapshot
+func (c *Client) recreateSubscription(sub *Subscription, oldServerID string, resume bool) {
+	go c.releaseServerSubscription(oldServerID)
+
+	if err := c.restoreSubscription(sub, resume); err != nil {
+		c.logger.WithError(err).WithFields(logrus.Fields{
+			"database":   sub.info.Database,
+			"collection": sub.info.Collection,
+		}).Error("Failed to re-create subscription after sequence gap")
+		return
+	}
+	c.logger.WithField("subscription_id", sub.ID()).Info("Re-created subscription after sequence gap")
+}
+
+// releaseServerSubscription unsubscribes a server-side subscription that is
+// no longer used, ignoring failures
+func (c *Client) releaseServerSubscription(serverID string) {
+	if serverID == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+	if err := c.unsubscribe(ctx, serverID); err != nil {
+		c.logger.WithError(err).WithField("subscription_id", serverID).Debug("Failed to release subscription")
+	}
+}
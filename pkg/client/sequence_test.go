@@ -0,0 +1,152 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscription_CheckSequence(t *testing.T) {
+	sub := &Subscription{}
+	assert.Nil(t, sub.checkSequence(1))
+	assert.Nil(t, sub.checkSequence(2))
+
+	gap := sub.checkSequence(5)
+	require.NotNil(t, gap)
+	assert.Equal(t, SequenceGap{Expected: 3, Received: 5}, *gap)
+	assert.Equal(t, uint64(2), gap.Missing())
+
+	gap = sub.checkSequence(2)
+	require.NotNil(t, gap)
+	assert.True(t, gap.Duplicate)
+	assert.Zero(t, gap.Missing())
+
+	sub.advanceSequence(5)
+	assert.Nil(t, sub.checkSequence(6))
+}
+
+func TestSubscription_StartSequence(t *testing.T) {
+	sub := &Subscription{}
+	sub.startSequence(4)
+	assert.Nil(t, sub.checkSequence(5))
+
+	acked := &Subscription{ack: newAckState(false)}
+	acked.startSequence(4)
+	assert.False(t, acked.ack.track(&models.ChangeEvent{}, 4))
+	assert.True(t, acked.ack.track(&models.ChangeEvent{}, 5))
+}
+
+// sequencedServer answers every subscribe with a new server subscription and
+// sends it the changes numbered by seqs
+func sequencedServer(t *testing.T, seqs []uint64, subscribes *atomic.Int32) *fakeServer {
+	return newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		if message.Type != models.MessageTypeSubscribe {
+			return
+		}
+		n := subscribes.Add(1)
+		serverID := "server-sub-" + string(rune('0'+n))
+		conn.WriteJSON(&models.ServerMessage{
+			Type:      models.MessageTypeSubscribe,
+			Success:   true,
+			RequestID: message.RequestID,
+			Data:      map[string]interface{}{"subscription_id": serverID},
+		})
+		if n > 1 {
+			return
+		}
+		for _, seq := range seqs {
+			conn.WriteJSON(&models.ServerMessage{
+				Type:            models.MessageTypeChange,
+				SubscriptionIDs: []string{serverID},
+				Sequences:       []uint64{seq},
+				Change:          &models.ChangeEvent{ID: string(rune('a' + seq)), Database: "testdb", Collection: "users"},
+			})
+		}
+	})
+}
+
+func TestSequenceGap_IgnoreDropsDuplicates(t *testing.T) {
+	var subscribes atomic.Int32
+	fs := sequencedServer(t, []uint64{1, 2, 2, 4, 5}, &subscribes)
+	c := newTestClient(t, fs.wsURL())
+
+	gaps := make(chan SequenceGap, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub, err := c.SubscribeContext(ctx, "testdb", "users", &SubscriptionOptions{
+		OnGap: func(sub *Subscription, gap SequenceGap) GapAction {
+			gaps <- gap
+			return GapIgnore
+		},
+	})
+	require.NoError(t, err)
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		select {
+		case change := <-sub.Changes():
+			ids = append(ids, change.ID)
+		case <-time.After(2 * time.Second):
+			t.Fatal("change was not delivered")
+		}
+	}
+	assert.Equal(t, []string{"b", "c", "e", "f"}, ids)
+
+	require.Len(t, gaps, 2)
+	assert.True(t, (<-gaps).Duplicate)
+	assert.Equal(t, SequenceGap{Expected: 3, Received: 4}, <-gaps)
+}
+
+func TestSequenceGap_ResnapshotRecreatesSubscription(t *testing.T) {
+	var subscribes atomic.Int32
+	fs := sequencedServer(t, []uint64{1, 3}, &subscribes)
+	c := newTestClient(t, fs.wsURL())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub, err := c.SubscribeContext(ctx, "testdb", "users", &SubscriptionOptions{
+		OnGap: func(*Subscription, SequenceGap) GapAction { return GapResnapshot },
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return sub.ID() == "server-sub-2" }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), subscribes.Load())
+}
+
+func TestSequenceGap_ErrorEndsSubscription(t *testing.T) {
+	var subscribes atomic.Int32
+	fs := sequencedServer(t, []uint64{1, 3}, &subscribes)
+	c := newTestClient(t, fs.wsURL())
+
+	errs := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub, err := c.SubscribeContext(ctx, "testdb", "users", &SubscriptionOptions{
+		OnError: func(err error) { errs <- err },
+		OnGap:   func(*Subscription, SequenceGap) GapAction { return GapError },
+	})
+	require.NoError(t, err)
+
+	select {
+	case err := <-errs:
+		var seqErr *SequenceError
+		require.True(t, errors.As(err, &seqErr))
+		assert.Equal(t, uint64(2), seqErr.Gap.Expected)
+	case <-time.After(2 * time.Second):
+		t.Fatal("gap error was not reported")
+	}
+	// The change before the gap was delivered, then the channel was closed
+	change := <-sub.Changes()
+	assert.Equal(t, "b", change.ID)
+	_, open := <-sub.Changes()
+	assert.False(t, open)
+	assert.Error(t, sub.Err())
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"iter"
+
+	"aktuell/pkg/models"
+)
+
+// OverflowPolicy decides what happens when a subscription's Changes channel
+// or one of its ordered handler queues is full
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest drops the event that does not fit
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest buffered event to make room
+	OverflowDropOldest
+	// OverflowBlock waits until the consumer makes room. This stalls the whole
+	// connection, so every subscription on the client waits for the slowest
+	// consumer; combine it with SubscriptionOptions.Ack to let the server hold
+	// events back instead.
+	OverflowBlock
+	// OverflowClose ends the subscription with ErrChangesOverflow
+	OverflowClose
+)
+
+// ErrChangesOverflow ends a subscription with OverflowClose whose consumer
+// fell behind
+var ErrChangesOverflow = errors.New("changes channel overflowed")
+
+// Events returns an iterator over the subscription's change events in arrival
+// order. Iteration ends when ctx is done, when the subscription ends (see Err)
+// or when the loop breaks; the subscription itself stays open until Close.
+func (s *Subscription) Events(ctx context.Context) iter.Seq[*models.ChangeEvent] {
+	changes := s.Changes()
+
+	return func(yield func(*models.ChangeEvent) bool) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case change, ok := <-changes:
+				if !ok || !yield(change) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// CloseOnDone closes the subscription once ctx is done, so a consumer can be
+// shut down by cancelling its context
+func (s *Subscription) CloseOnDone(ctx context.Context) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := s.Close(); err != nil {
+				s.client.logger.WithError(err).Debug("Failed to unsubscribe after context was done")
+			}
+		case <-s.done:
+		}
+	}()
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBufferedSubscription creates an unregistered subscription with a
+// consumed Changes channel of the given capacity
+func newBufferedSubscription(t *testing.T, capacity int, overflow OverflowPolicy) *Subscription {
+	t.Helper()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	c := NewClient("ws://127.0.0.1:0/ws", &ClientOptions{Logger: logger})
+	sub, _ := c.newSubscription("testdb", "users", &SubscriptionOptions{ChangeBuffer: capacity, Overflow: overflow})
+	sub.Changes()
+	return sub
+}
+
+// drainIDs reads the buffered events of a subscription
+func drainIDs(sub *Subscription) []string {
+	var ids []string
+	for {
+		select {
+		case change := <-sub.Changes():
+			ids = append(ids, change.ID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestDeliver_OverflowPolicies(t *testing.T) {
+	events := []*models.ChangeEvent{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+
+	sub := newBufferedSubscription(t, 2, OverflowDropNewest)
+	for _, change := range events {
+		_, err := sub.deliver(change)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"a", "b"}, drainIDs(sub))
+
+	sub = newBufferedSubscription(t, 2, OverflowDropOldest)
+	for _, change := range events {
+		delivered, err := sub.deliver(change)
+		require.NoError(t, err)
+		assert.True(t, delivered)
+	}
+	assert.Equal(t, []string{"b", "c"}, drainIDs(sub))
+
+	sub = newBufferedSubscription(t, 2, OverflowClose)
+	for _, change := range events[:2] {
+		_, err := sub.deliver(change)
+		require.NoError(t, err)
+	}
+	_, err := sub.deliver(events[2])
+	assert.ErrorIs(t, err, ErrChangesOverflow)
+}
+
+func TestDeliver_BlockWaitsForConsumer(t *testing.T) {
+	sub := newBufferedSubscription(t, 1, OverflowBlock)
+	_, err := sub.deliver(&models.ChangeEvent{ID: "a"})
+	require.NoError(t, err)
+
+	done := make(chan bool)
+	go func() {
+		delivered, _ := sub.deliver(&models.ChangeEvent{ID: "b"})
+		done <- delivered
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("delivery did not wait for room in the channel")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, "a", (<-sub.Changes()).ID)
+	assert.True(t, <-done)
+	assert.Equal(t, "b", (<-sub.Changes()).ID)
+
+	// Ending the subscription releases a blocked delivery
+	_, err = sub.deliver(&models.ChangeEvent{ID: "c"})
+	require.NoError(t, err)
+	go func() {
+		delivered, _ := sub.deliver(&models.ChangeEvent{ID: "d"})
+		done <- delivered
+	}()
+	time.Sleep(20 * time.Millisecond)
+	sub.finish(nil)
+	assert.False(t, <-done)
+}
+
+func TestEvents_OrderedUntilContextDone(t *testing.T) {
+	sub := newBufferedSubscription(t, 10, OverflowDropNewest)
+	for _, id := range []string{"a", "b", "c"} {
+		_, err := sub.deliver(&models.ChangeEvent{ID: id})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var ids []string
+	for change := range sub.Events(ctx) {
+		ids = append(ids, change.ID)
+		if len(ids) == 3 {
+			cancel()
+		}
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, ids)
+
+	// The iterator also ends with the subscription
+	sub.finish(nil)
+	for range sub.Events(context.Background()) {
+		t.Fatal("no events expected")
+	}
+}
@@ -0,0 +1,553 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultChangeBuffer is the capacity of a subscription's Changes channel
+	defaultChangeBuffer = 256
+	// defaultRequestTimeout bounds requests made without a caller-provided context
+	defaultRequestTimeout = 10 * time.Second
+	// maxParallelRestores bounds the subscriptions restored at once after a reconnect
+	maxParallelRestores = 8
+	// maxRestoreAttempts is how often an unanswered restore is sent before the subscription ends
+	maxRestoreAttempts = 3
+	// restoreRetryDelay is the wait before the first retry; it doubles per attempt
+	restoreRetryDelay = 500 * time.Millisecond
+)
+
+// SubscriptionOptions configures a subscription created with SubscribeContext
+type SubscriptionOptions struct {
+	Snapshot           *models.SnapshotOptions // Initial snapshot to stream before live changes
+	Conflate           *models.ConflateOptions // Ask the server to conflate events per document
+	ResumeFrom         *models.ResumeOptions   // Replay events missed since this point instead of a snapshot
+	Ack                *models.AckOptions      // At-least-once delivery: unacknowledged events are redelivered
+	ManualAck          bool                    // Acknowledge with Subscription.Ack instead of automatically
+	OnChange           ChangeHandler
+	OnSnapshot         SnapshotHandler
+	OnSnapshotComplete SnapshotCompleteHandler
+	OnError            ErrorHandler
+	OnGap              GapHandler     // Recovery from missing or duplicate events (default: log and continue)
+	ChangeBuffer       int            // Capacity of the Changes channel, allocated only if it is used, and of each ordered handler queue (default: 256)
+	Overflow           OverflowPolicy // What to do when the Changes channel or a handler queue is full (default: drop the new event)
+	Delivery           DeliveryMode   // How handlers are invoked (default: concurrently)
+	Workers            int            // Parallel workers with DeliveryKeyed (default: 8)
+
+	observer subscriptionObserver // Receives snapshots and changes in order, e.g. a LiveCollection
+}
+
+// Subscription is a handle to a subscription registered on the server
+type Subscription struct {
+	client        *Client
+	localID       string // Stable client-side key, independent of the server ID
+	info          *models.Subscription
+	serverID      string
+	bufferCap     int
+	changes       chan *models.ChangeEvent
+	overflow      OverflowPolicy
+	consumed      bool                  // Changes has been called
+	changesClosed bool                  // changes has been closed
+	resume        *models.ResumeOptions // Last event received, used to resume after a reconnect
+	ack           *ackState             // Sequence tracking of acknowledged subscriptions
+	lastSeq       uint64                // Last sequence number delivered
+	onGap         GapHandler
+	observer      subscriptionObserver
+	dispatcher    *handlerDispatcher // Runs handlers in order; nil runs them concurrently
+	err           error
+	closed        bool
+	done          chan struct{}  // Closed when the subscription ends
+	sending       sync.WaitGroup // Blocked sends into changes
+	mu            sync.Mutex
+}
+
+// ID returns the server-assigned subscription ID. It is empty until the
+// server has confirmed the subscription.
+func (s *Subscription) ID() string {
+	s.client.mu.RLock()
+	defer s.client.mu.RUnlock()
+	return s.serverID
+}
+
+// Database returns the subscribed database
+func (s *Subscription) Database() string {
+	return s.info.Database
+}
+
+// Collection returns the subscribed collection
+func (s *Subscription) Collection() string {
+	return s.info.Collection
+}
+
+// Changes returns a channel receiving the subscription's change events in
+// arrival order. The channel is closed when the subscription ends; see Err for
+// the reason. What happens when the buffer is full depends on
+// SubscriptionOptions.Overflow. Subscriptions with an OnChange handler
+// create the channel on the first call, so it only receives later events.
+func (s *Subscription) Changes() <-chan *models.ChangeEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.consumed = true
+	if s.changes == nil {
+		s.changes = make(chan *models.ChangeEvent, s.bufferCap)
+		if s.closed {
+			close(s.changes)
+			s.changesClosed = true
+		}
+	}
+	return s.changes
+}
+
+// Err returns the error that ended the subscription, or nil if it is still
+// active or was closed by the caller
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close unsubscribes from the server and releases the subscription's handlers
+func (s *Subscription) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.client.requestTimeout)
+	defer cancel()
+	return s.CloseContext(ctx)
+}
+
+// CloseContext is like Close but waits for the server's acknowledgement only
+// until ctx is done. Local handlers are released immediately either way.
+func (s *Subscription) CloseContext(ctx context.Context) error {
+	serverID := s.ID()
+	s.client.removeSubscription(s.localID)
+	s.finish(nil)
+
+	if serverID == "" {
+		// Never confirmed; a late confirmation is released by handleSubscribeResponse
+		return nil
+	}
+	return s.client.unsubscribe(ctx, serverID)
+}
+
+// deliver records the change as the resume point and forwards it to the
+// Changes channel if anyone asked for it. It reports whether the change was
+// put into the channel, and returns ErrChangesOverflow if the overflow policy
+// ends the subscription. With OverflowBlock it waits for room in the channel,
+// so the caller must not hold c.mu.
+func (s *Subscription) deliver(change *models.ChangeEvent) (bool, error) {
+	s.mu.Lock()
+
+	// Acknowledged subscriptions resume from the last acknowledged event instead
+	if s.ack == nil {
+		s.resume = resumePoint(change)
+	}
+
+	if s.changes == nil || s.closed {
+		s.mu.Unlock()
+		return false, nil
+	}
+
+	select {
+	case s.changes <- change:
+		s.mu.Unlock()
+		return true, nil
+	default:
+	}
+
+	switch s.overflow {
+	case OverflowBlock:
+		changes := s.changes
+		s.sending.Add(1)
+		s.mu.Unlock()
+		defer s.sending.Done()
+
+		select {
+		case changes <- change:
+			return true, nil
+		case <-s.done:
+			return false, nil
+		}
+
+	case OverflowDropOldest:
+		defer s.mu.Unlock()
+		for {
+			select {
+			case s.changes <- change:
+				s.client.logger.WithField("subscription_id", s.serverID).Debug("Changes channel full, dropped oldest event")
+				return true, nil
+			default:
+			}
+			select {
+			case <-s.changes:
+			default:
+			}
+		}
+
+	case OverflowClose:
+		s.mu.Unlock()
+		return false, ErrChangesOverflow
+
+	default:
+		defer s.mu.Unlock()
+		// Only complain if someone actually reads the channel
+		entry := s.client.logger.WithField("subscription_id", s.serverID)
+		if s.consumed {
+			entry.Warn("Changes channel full, dropping event")
+		} else {
+			entry.Debug("Changes channel not consumed, dropping event")
+		}
+		return false, nil
+	}
+}
+
+// resumePoint returns the resume options pointing at a change event
+func resumePoint(change *models.ChangeEvent) *models.ResumeOptions {
+	resume := &models.ResumeOptions{EventID: change.ID}
+	if !change.Timestamp.IsZero() {
+		ts := change.Timestamp
+		resume.ClusterTime = &ts
+	}
+	return resume
+}
+
+// finish marks the subscription as ended and closes its Changes channel once
+// blocked deliveries have given up
+func (s *Subscription) finish(err error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.err = err
+	close(s.done)
+	s.mu.Unlock()
+
+	s.sending.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.changes != nil && !s.changesClosed {
+		close(s.changes)
+		s.changesClosed = true
+	}
+}
+
+// SubscribeContext subscribes to changes and waits until the server has
+// confirmed or rejected the subscription, or ctx is done
+func (c *Client) SubscribeContext(ctx context.Context, database, collection string, opts *SubscriptionOptions) (*Subscription, error) {
+	if opts == nil {
+		opts = &SubscriptionOptions{}
+	}
+
+	sub, message := c.newSubscription(database, collection, opts)
+	if opts.OnChange == nil && opts.observer == nil {
+		// Without a handler events are read through Changes or Events, so
+		// buffer them from the start and lose none before those are called
+		sub.changes = make(chan *models.ChangeEvent, sub.bufferCap)
+	}
+	responseCh := c.expectResponse(message.RequestID)
+	defer c.cancelResponse(message.RequestID)
+
+	c.addSubscription(sub, opts)
+	if err := c.sendMessage(message); err != nil {
+		c.removeSubscription(sub.localID)
+		return nil, err
+	}
+
+	select {
+	case response := <-responseCh:
+		if response.Type == models.MessageTypeError || !response.Success {
+			err := &SubscriptionError{Code: response.ErrorCode, Message: response.Error}
+			c.removeSubscription(sub.localID)
+			sub.finish(err)
+			return nil, err
+		}
+		return sub, nil
+
+	case <-ctx.Done():
+		// A late confirmation finds no subscription and is unsubscribed again
+		c.removeSubscription(sub.localID)
+		sub.finish(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// UnsubscribeContext removes a single subscription by its server-assigned ID.
+// Only that subscription's change, snapshot, completion and error handlers are
+// released. It waits until the server acknowledges the removal or ctx is done.
+func (c *Client) UnsubscribeContext(ctx context.Context, subscriptionID string) error {
+	c.mu.RLock()
+	localID, known := c.serverIDs[subscriptionID]
+	sub := c.subscriptions[localID]
+	c.mu.RUnlock()
+
+	if known {
+		c.removeSubscription(localID)
+		if sub != nil {
+			sub.finish(nil)
+		}
+	}
+
+	return c.unsubscribe(ctx, subscriptionID)
+}
+
+// unsubscribe sends an unsubscribe request and waits for its acknowledgement
+func (c *Client) unsubscribe(ctx context.Context, subscriptionID string) error {
+	message := &models.ClientMessage{
+		Type:           models.MessageTypeUnsubscribe,
+		RequestID:      uuid.New().String(),
+		SubscriptionID: subscriptionID,
+	}
+
+	responseCh := c.expectResponse(message.RequestID)
+	defer c.cancelResponse(message.RequestID)
+
+	if err := c.sendMessage(message); err != nil {
+		return err
+	}
+
+	select {
+	case response := <-responseCh:
+		if !response.Success {
+			return &SubscriptionError{Code: response.ErrorCode, Message: response.Error}
+		}
+		c.logger.WithField("subscription_id", subscriptionID).Debug("Unsubscribe acknowledged by server")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newSubscription builds a subscription handle and its subscribe request
+func (c *Client) newSubscription(database, collection string, opts *SubscriptionOptions) (*Subscription, *models.ClientMessage) {
+	requestID := uuid.New().String()
+
+	bufferCap := opts.ChangeBuffer
+	if bufferCap <= 0 {
+		bufferCap = defaultChangeBuffer
+	}
+
+	done := make(chan struct{})
+	sub := &Subscription{
+		client:  c,
+		localID: uuid.New().String(),
+		info: &models.Subscription{
+			RequestID:       requestID,
+			Database:        database,
+			Collection:      collection,
+			CreatedAt:       time.Now(),
+			SnapshotOptions: opts.Snapshot,
+			Conflate:        opts.Conflate,
+			Ack:             opts.Ack,
+		},
+		bufferCap:  bufferCap,
+		overflow:   opts.Overflow,
+		done:       done,
+		resume:     opts.ResumeFrom,
+		onGap:      opts.OnGap,
+		observer:   opts.observer,
+		dispatcher: newHandlerDispatcher(opts.Delivery, opts.Workers, bufferCap, opts.Overflow, done),
+	}
+	sub.info.ID = sub.localID
+	if opts.Ack != nil {
+		sub.ack = newAckState(opts.ManualAck)
+	}
+
+	return sub, sub.subscribeMessage(requestID, true)
+}
+
+// subscribeMessage builds the subscribe request for the handle's options. With
+// resume set and a known resume point, missed events are replayed instead of
+// taking a new snapshot.
+func (s *Subscription) subscribeMessage(requestID string, resume bool) *models.ClientMessage {
+	message := &models.ClientMessage{
+		Type:            models.MessageTypeSubscribe,
+		Database:        s.info.Database,
+		Collection:      s.info.Collection,
+		RequestID:       requestID,
+		SnapshotOptions: s.info.SnapshotOptions,
+		Conflate:        s.info.Conflate,
+		Ack:             s.info.Ack,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if resume && s.resume != nil {
+		message.ResumeFrom = s.resume
+		message.SnapshotOptions = nil
+	}
+	return message
+}
+
+// restoreSubscription re-creates an existing subscription with the same
+// options, keeping its handlers and handle intact. With resume set it resumes
+// from the last received event when possible and falls back to the original
+// options (including the snapshot) if the server can no longer replay.
+func (c *Client) restoreSubscription(sub *Subscription, resume bool) error {
+	// The new server-side subscription numbers its events from scratch
+	sub.resetAck()
+	sub.resetSequence()
+
+	err := c.sendSubscribe(sub, sub.subscribeMessage(uuid.New().String(), resume))
+
+	var subErr *SubscriptionError
+	if resume && errors.As(err, &subErr) && subErr.Code == models.ErrorCodeResumeWindowExceeded {
+		c.logger.WithFields(logrus.Fields{
+			"database":   sub.info.Database,
+			"collection": sub.info.Collection,
+		}).Info("Resume window exceeded, subscribing from scratch")
+		err = c.sendSubscribe(sub, sub.subscribeMessage(uuid.New().String(), false))
+	}
+
+	if errors.As(err, &subErr) {
+		// The server no longer accepts this subscription, so it ends here
+		c.removeSubscription(sub.localID)
+		sub.finish(err)
+	}
+	return err
+}
+
+// sendSubscribe sends a subscribe request for an existing handle and waits
+// for the server's answer
+func (c *Client) sendSubscribe(sub *Subscription, message *models.ClientMessage) error {
+	c.mu.Lock()
+	sub.info.RequestID = message.RequestID
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+
+	responseCh := c.expectResponse(message.RequestID)
+	defer c.cancelResponse(message.RequestID)
+
+	if err := c.sendMessage(message); err != nil {
+		return err
+	}
+
+	select {
+	case response := <-responseCh:
+		if response.Type == models.MessageTypeError || !response.Success {
+			return &SubscriptionError{Code: response.ErrorCode, Message: response.Error}
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// addSubscription registers a subscription handle and its handlers
+func (c *Client) addSubscription(sub *Subscription, opts *SubscriptionOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.subscriptions[sub.localID] = sub
+	if opts.OnChange != nil {
+		c.handlers[sub.localID] = opts.OnChange
+	}
+	if opts.OnSnapshot != nil {
+		c.snapshotHandlers[sub.localID] = opts.OnSnapshot
+	}
+	if opts.OnSnapshotComplete != nil {
+		c.snapshotCompleteHandlers[sub.localID] = opts.OnSnapshotComplete
+	}
+	if opts.OnError != nil {
+		c.errorHandlers[sub.localID] = opts.OnError
+	}
+}
+
+// failSubscription ends a subscription because of a client-side error,
+// reports the error to its handler and releases it on the server
+func (c *Client) failSubscription(localID string, sub *Subscription, err error) {
+	serverID := sub.ID()
+
+	c.mu.RLock()
+	errorHandler := c.errorHandlers[localID]
+	c.mu.RUnlock()
+
+	c.removeSubscription(localID)
+	sub.finish(err)
+	if errorHandler != nil {
+		go errorHandler(err)
+	}
+	go c.releaseServerSubscription(serverID)
+}
+
+// removeSubscription drops a subscription and all of its handlers
+func (c *Client) removeSubscription(localID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if sub, ok := c.subscriptions[localID]; ok && sub.serverID != "" {
+		delete(c.serverIDs, sub.serverID)
+	}
+	delete(c.subscriptions, localID)
+	delete(c.handlers, localID)
+	delete(c.snapshotHandlers, localID)
+	delete(c.snapshotCompleteHandlers, localID)
+	delete(c.errorHandlers, localID)
+}
+
+// expectResponse registers interest in the response to a request
+func (c *Client) expectResponse(requestID string) <-chan *models.ServerMessage {
+	ch := make(chan *models.ServerMessage, 1)
+	c.mu.Lock()
+	c.pending[requestID] = ch
+	c.mu.Unlock()
+	return ch
+}
+
+// cancelResponse stops waiting for the response to a request
+func (c *Client) cancelResponse(requestID string) {
+	c.mu.Lock()
+	delete(c.pending, requestID)
+	c.mu.Unlock()
+}
+
+// resolveResponse hands a response to a waiting caller and reports whether
+// one was waiting
+func (c *Client) resolveResponse(message *models.ServerMessage) bool {
+	if message.RequestID == "" {
+		return false
+	}
+
+	c.mu.Lock()
+	ch, ok := c.pending[message.RequestID]
+	delete(c.pending, message.RequestID)
+	c.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"request_id": message.RequestID,
+		"type":       message.Type,
+	}).Debug("Resolved pending request")
+
+	ch <- message
+	return true
+}
+
+// SubscriptionError is returned when the server rejects a subscribe or
+// unsubscribe request
+type SubscriptionError struct {
+	Code    int
+	Message string
+}
+
+// Error implements the error interface
+func (e *SubscriptionError) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("subscription request rejected: %s", e.Message)
+	}
+	return fmt.Sprintf("subscription request rejected (code %d): %s", e.Code, e.Message)
+}
@@ -0,0 +1,236 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer is a minimal Aktuell server that answers client messages with
+// the responses produced by a test-provided function
+type fakeServer struct {
+	*httptest.Server
+	respond func(conn *websocket.Conn, message *models.ClientMessage)
+}
+
+// newFakeServer starts a fake server; respond is called for every client message
+func newFakeServer(t *testing.T, respond func(conn *websocket.Conn, message *models.ClientMessage)) *fakeServer {
+	t.Helper()
+
+	fs := &fakeServer{respond: respond}
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			var message models.ClientMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			fs.respond(conn, &message)
+		}
+	}))
+	t.Cleanup(fs.Close)
+	return fs
+}
+
+// wsURL returns the WebSocket URL of the fake server
+func (fs *fakeServer) wsURL() string {
+	return "ws" + strings.TrimPrefix(fs.URL, "http")
+}
+
+// newTestClient creates a connected client with logging silenced
+func newTestClient(t *testing.T, url string) *Client {
+	t.Helper()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	c := NewClient(url, &ClientOptions{Logger: logger})
+	require.NoError(t, c.Connect())
+	t.Cleanup(func() { c.Disconnect() })
+	return c
+}
+
+func TestSubscribeContext_ReturnsServerID(t *testing.T) {
+	fs := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		if message.Type == models.MessageTypeUnsubscribe {
+			conn.WriteJSON(&models.ServerMessage{Type: models.MessageTypeUnsubscribe, Success: true, RequestID: message.RequestID})
+			return
+		}
+		if message.Type != models.MessageTypeSubscribe {
+			return
+		}
+		conn.WriteJSON(&models.ServerMessage{
+			Type:      models.MessageTypeSubscribe,
+			Success:   true,
+			RequestID: message.RequestID,
+			Data:      map[string]interface{}{"subscription_id": "server-sub-1"},
+		})
+		conn.WriteJSON(&models.ServerMessage{
+			Type:            models.MessageTypeChange,
+			SubscriptionIDs: []string{"server-sub-1"},
+			Change:          &models.ChangeEvent{ID: "evt-1", Database: "testdb", Collection: "users"},
+		})
+	})
+	c := newTestClient(t, fs.wsURL())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	sub, err := c.SubscribeContext(ctx, "testdb", "users", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "server-sub-1", sub.ID())
+
+	select {
+	case change := <-sub.Changes():
+		assert.Equal(t, "evt-1", change.ID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for change")
+	}
+
+	require.NoError(t, sub.Close())
+	_, open := <-sub.Changes()
+	assert.False(t, open)
+	assert.NoError(t, sub.Err())
+}
+
+func TestSubscribeContext_BuffersOnlyWithoutHandler(t *testing.T) {
+	var subscribes int32
+	fs := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		if message.Type != models.MessageTypeSubscribe {
+			return
+		}
+		conn.WriteJSON(&models.ServerMessage{
+			Type:      models.MessageTypeSubscribe,
+			Success:   true,
+			RequestID: message.RequestID,
+			Data:      map[string]interface{}{"subscription_id": fmt.Sprintf("server-sub-%d", atomic.AddInt32(&subscribes, 1))},
+		})
+	})
+	c := newTestClient(t, fs.wsURL())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	handled, err := c.SubscribeContext(ctx, "testdb", "users", &SubscriptionOptions{OnChange: func(*models.ChangeEvent) {}})
+	require.NoError(t, err)
+	handled.mu.Lock()
+	assert.Nil(t, handled.changes)
+	handled.mu.Unlock()
+	assert.Equal(t, defaultChangeBuffer, cap(handled.Changes()))
+
+	streamed, err := c.SubscribeContext(ctx, "testdb", "users", nil)
+	require.NoError(t, err)
+	streamed.mu.Lock()
+	assert.NotNil(t, streamed.changes)
+	streamed.mu.Unlock()
+}
+
+func TestSubscribeContext_ReturnsValidationError(t *testing.T) {
+	fs := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		conn.WriteJSON(&models.ServerMessage{
+			Type:      models.MessageTypeError,
+			RequestID: message.RequestID,
+			ErrorCode: models.ErrorCodeInvalidSubscription,
+			Error:     "not configured",
+		})
+	})
+	c := newTestClient(t, fs.wsURL())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	sub, err := c.SubscribeContext(ctx, "testdb", "secret", nil)
+	assert.Nil(t, sub)
+
+	var subErr *SubscriptionError
+	require.ErrorAs(t, err, &subErr)
+	assert.Equal(t, models.ErrorCodeInvalidSubscription, subErr.Code)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	assert.Empty(t, c.subscriptions)
+}
+
+func TestSubscribeContext_Timeout(t *testing.T) {
+	fs := newFakeServer(t, func(*websocket.Conn, *models.ClientMessage) {})
+	c := newTestClient(t, fs.wsURL())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := c.SubscribeContext(ctx, "testdb", "users", nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	assert.Empty(t, c.subscriptions)
+	assert.Empty(t, c.pending)
+}
+
+func TestUnsubscribeContext_RemovesOnlyThatSubscription(t *testing.T) {
+	var serverSubs = map[string]bool{}
+	var counter int
+	fs := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		switch message.Type {
+		case models.MessageTypeSubscribe:
+			counter++
+			id := fmt.Sprintf("server-sub-%d", counter)
+			serverSubs[id] = true
+			conn.WriteJSON(&models.ServerMessage{
+				Type:      models.MessageTypeSubscribe,
+				Success:   true,
+				RequestID: message.RequestID,
+				Data:      map[string]interface{}{"subscription_id": id},
+			})
+		case models.MessageTypeUnsubscribe:
+			response := &models.ServerMessage{Type: models.MessageTypeUnsubscribe, RequestID: message.RequestID, Success: serverSubs[message.SubscriptionID]}
+			if !response.Success {
+				response.Error = "Subscription not found"
+				response.ErrorCode = models.ErrorCodeUnknownSubscription
+			}
+			delete(serverSubs, message.SubscriptionID)
+			conn.WriteJSON(response)
+		}
+	})
+	c := newTestClient(t, fs.wsURL())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	noop := func(error) {}
+	first, err := c.SubscribeContext(ctx, "testdb", "users", &SubscriptionOptions{OnError: noop})
+	require.NoError(t, err)
+	second, err := c.SubscribeContext(ctx, "testdb", "orders", &SubscriptionOptions{OnError: noop})
+	require.NoError(t, err)
+
+	require.NoError(t, c.UnsubscribeContext(ctx, first.ID()))
+
+	c.mu.RLock()
+	assert.Len(t, c.subscriptions, 1)
+	assert.Contains(t, c.subscriptions, second.localID)
+	assert.Len(t, c.errorHandlers, 1)
+	assert.Contains(t, c.errorHandlers, second.localID)
+	c.mu.RUnlock()
+
+	// A second removal is rejected by the server
+	err = c.UnsubscribeContext(ctx, first.ID())
+	var subErr *SubscriptionError
+	require.ErrorAs(t, err, &subErr)
+	assert.Equal(t, models.ErrorCodeUnknownSubscription, subErr.Code)
+}
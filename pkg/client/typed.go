@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"aktuell/pkg/models"
+)
+
+// TypedChange is a change event whose document was decoded into T
+type TypedChange[T any] struct {
+	*models.ChangeEvent
+	Document *T // Decoded FullDocument; nil if the event carries none, e.g. for deletes
+}
+
+// TypedSubscriptionOptions configures a subscription created with SubscribeTyped
+type TypedSubscriptionOptions[T any] struct {
+	Snapshot           *models.SnapshotOptions
+	Conflate           *models.ConflateOptions
+	ResumeFrom         *models.ResumeOptions
+	Ack                *models.AckOptions
+	ManualAck          bool
+	OnChange           func(TypedChange[T])
+	OnSnapshot         func(documents []T, batchNum int, remaining int)
+	OnSnapshotComplete SnapshotCompleteHandler
+	OnError            ErrorHandler // Also receives a *DecodeError for every document that cannot be decoded
+	OnGap              GapHandler
+	Delivery           DeliveryMode
+	Workers            int
+}
+
+// DecodeError reports a document that could not be decoded into the
+// subscription's type
+type DecodeError struct {
+	Database   string
+	Collection string
+	ID         interface{} // _id of the document, if known
+	Err        error
+}
+
+// Error implements the error interface
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode %s.%s document %v: %v", e.Database, e.Collection, e.ID, e.Err)
+}
+
+// Unwrap returns the underlying decoding error
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// SubscribeTyped subscribes like SubscribeContext but hands the handlers
+// documents decoded into T (see DecodeDocument). Documents that cannot be
+// decoded are reported to OnError as *DecodeError and skipped; with
+// automatic acknowledgement they are acknowledged anyway, so a malformed
+// document is not redelivered forever.
+func SubscribeTyped[T any](ctx context.Context, c *Client, database, collection string, opts *TypedSubscriptionOptions[T]) (*Subscription, error) {
+	if opts == nil {
+		opts = &TypedSubscriptionOptions[T]{}
+	}
+
+	reportError := func(err error) {
+		if opts.OnError != nil {
+			opts.OnError(err)
+			return
+		}
+		c.logger.WithError(err).Warn("Dropping document that cannot be decoded")
+	}
+
+	subOpts := &SubscriptionOptions{
+		Snapshot:           opts.Snapshot,
+		Conflate:           opts.Conflate,
+		ResumeFrom:         opts.ResumeFrom,
+		Ack:                opts.Ack,
+		ManualAck:          opts.ManualAck,
+		OnSnapshotComplete: opts.OnSnapshotComplete,
+		OnError:            opts.OnError,
+		OnGap:              opts.OnGap,
+		Delivery:           opts.Delivery,
+		Workers:            opts.Workers,
+	}
+
+	if opts.OnChange != nil {
+		subOpts.OnChange = func(change *models.ChangeEvent) {
+			typed, err := DecodeChange[T](change)
+			if err != nil {
+				reportError(err)
+				return
+			}
+			opts.OnChange(typed)
+		}
+	}
+
+	if opts.OnSnapshot != nil {
+		subOpts.OnSnapshot = func(documents []map[string]interface{}, batchNum int, remaining int) {
+			decoded := make([]T, 0, len(documents))
+			for _, document := range documents {
+				var v T
+				if err := DecodeDocument(document, &v); err != nil {
+					reportError(&DecodeError{Database: database, Collection: collection, ID: document["_id"], Err: err})
+					continue
+				}
+				decoded = append(decoded, v)
+			}
+			opts.OnSnapshot(decoded, batchNum, remaining)
+		}
+	}
+
+	return c.SubscribeContext(ctx, database, collection, subOpts)
+}
+
+// DecodeChange decodes the full document of a change event into T
+func DecodeChange[T any](change *models.ChangeEvent) (TypedChange[T], error) {
+	typed := TypedChange[T]{ChangeEvent: change}
+	if change.FullDocument == nil {
+		return typed, nil
+	}
+
+	var v T
+	if err := DecodeDocument(change.FullDocument, &v); err != nil {
+		return typed, &DecodeError{
+			Database:   change.Database,
+			Collection: change.Collection,
+			ID:         change.DocumentKey["_id"],
+			Err:        err,
+		}
+	}
+	typed.Document = &v
+	return typed, nil
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type testAddress struct {
+	City string `bson:"city"`
+}
+
+type testAudit struct {
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+type testUser struct {
+	ID        primitive.ObjectID     `bson:"_id"`
+	FullName  string                 `bson:"full_name" json:"name"`
+	Age       int                    `json:"age"`
+	Address   *testAddress           `bson:"address"`
+	Tags      []string               `bson:"tags"`
+	Extra     map[string]interface{} `bson:"extra"`
+	Secret    string                 `bson:"-"`
+	testAudit `bson:",inline"`
+}
+
+func TestDecodeDocument_HonoursTags(t *testing.T) {
+	id := primitive.NewObjectID()
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	var user testUser
+	err := DecodeDocument(map[string]interface{}{
+		"_id":        id.Hex(),
+		"full_name":  "Ada",
+		"age":        float64(36),
+		"address":    map[string]interface{}{"city": "London"},
+		"tags":       []interface{}{"a", "b"},
+		"extra":      map[string]interface{}{"k": "v"},
+		"Secret":     "ignored",
+		"created_at": created.Format(time.RFC3339),
+		"unknown":    true,
+	}, &user)
+	require.NoError(t, err)
+
+	assert.Equal(t, testUser{
+		ID:        id,
+		FullName:  "Ada",
+		Age:       36,
+		Address:   &testAddress{City: "London"},
+		Tags:      []string{"a", "b"},
+		Extra:     map[string]interface{}{"k": "v"},
+		testAudit: testAudit{CreatedAt: created},
+	}, user)
+}
+
+func TestDecodeDocument_ReportsFieldPath(t *testing.T) {
+	var user testUser
+	err := DecodeDocument(map[string]interface{}{"address": map[string]interface{}{"city": 42}}, &user)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "field address.city")
+
+	assert.Error(t, DecodeDocument(nil, user))
+}
+
+func TestSubscribeTyped_DecodesDocumentsAndReportsErrors(t *testing.T) {
+	fs := newFakeServer(t, func(conn *websocket.Conn, message *models.ClientMessage) {
+		if message.Type != models.MessageTypeSubscribe {
+			return
+		}
+		routed := func(m *models.ServerMessage) *models.ServerMessage {
+			m.RequestID = message.RequestID
+			m.SubscriptionIDs = []string{"server-sub-1"}
+			return m
+		}
+		conn.WriteJSON(&models.ServerMessage{
+			Type:      models.MessageTypeSubscribe,
+			Success:   true,
+			RequestID: message.RequestID,
+			Data:      map[string]interface{}{"subscription_id": "server-sub-1"},
+		})
+		conn.WriteJSON(routed(&models.ServerMessage{
+			Type: models.MessageTypeSnapshot,
+			SnapshotData: []map[string]interface{}{
+				{"_id": primitive.NewObjectID().Hex(), "full_name": "Ada"},
+				{"_id": "not-an-object-id"},
+			},
+			SnapshotBatch: 1,
+		}))
+		conn.WriteJSON(routed(&models.ServerMessage{
+			Type: models.MessageTypeChange,
+			Change: &models.ChangeEvent{
+				OperationType: models.OperationInsert,
+				Database:      "testdb",
+				Collection:    "users",
+				DocumentKey:   map[string]interface{}{"_id": "x"},
+				FullDocument:  map[string]interface{}{"full_name": "Grace", "age": float64(45)},
+			},
+		}))
+	})
+	c := newTestClient(t, fs.wsURL())
+
+	snapshots := make(chan []testUser, 1)
+	changes := make(chan TypedChange[testUser], 1)
+	errs := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := SubscribeTyped(ctx, c, "testdb", "users", &TypedSubscriptionOptions[testUser]{
+		Snapshot:   &models.SnapshotOptions{IncludeSnapshot: true},
+		OnSnapshot: func(users []testUser, _ int, _ int) { snapshots <- users },
+		OnChange:   func(change TypedChange[testUser]) { changes <- change },
+		OnError:    func(err error) { errs <- err },
+	})
+	require.NoError(t, err)
+
+	select {
+	case users := <-snapshots:
+		require.Len(t, users, 1)
+		assert.Equal(t, "Ada", users[0].FullName)
+	case <-time.After(2 * time.Second):
+		t.Fatal("snapshot was not delivered")
+	}
+
+	select {
+	case err := <-errs:
+		var decodeErr *DecodeError
+		require.True(t, errors.As(err, &decodeErr))
+		assert.Equal(t, "not-an-object-id", decodeErr.ID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("decode error was not reported")
+	}
+
+	select {
+	case change := <-changes:
+		require.NotNil(t, change.Document)
+		assert.Equal(t, "Grace", change.Document.FullName)
+		assert.Equal(t, 45, change.Document.Age)
+		assert.Equal(t, models.OperationInsert, change.OperationType)
+	case <-time.After(2 * time.Second):
+		t.Fatal("change was not delivered")
+	}
+}
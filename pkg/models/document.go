@@ -0,0 +1,41 @@
+package models
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// CopyDocument returns a deep copy of a document. Nested documents and arrays
+// are copied whether they were decoded from JSON or BSON; BSON ones become
+// plain maps and slices.
+func CopyDocument(doc map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(doc))
+	for key, value := range doc {
+		out[key] = CopyValue(value)
+	}
+	return out
+}
+
+// CopyValue deep-copies nested documents and arrays and returns other values
+// as they are
+func CopyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return CopyDocument(v)
+	case primitive.M:
+		return CopyDocument(v)
+	case []interface{}:
+		return copyList(v)
+	case primitive.A:
+		return copyList(v)
+	}
+	return value
+}
+
+func copyList(list []interface{}) []interface{} {
+	out := make([]interface{}, len(list))
+	for i, item := range list {
+		out[i] = CopyValue(item)
+	}
+	return out
+}
@@ -237,6 +237,22 @@ func TestSnapshotOptions_Defaults(t *testing.T) {
 	}
 }
 
+func TestCopyDocument(t *testing.T) {
+	doc := map[string]interface{}{
+		"_id":     "u1",
+		"profile": primitive.M{"name": "Ada"},
+		"tags":    primitive.A{"a", map[string]interface{}{"b": 1}},
+	}
+
+	copied := CopyDocument(doc)
+	copied["profile"].(map[string]interface{})["name"] = "Grace"
+	copied["tags"].([]interface{})[1].(map[string]interface{})["b"] = 2
+
+	assert.Equal(t, "Ada", doc["profile"].(primitive.M)["name"])
+	assert.Equal(t, 1, doc["tags"].(primitive.A)[1].(map[string]interface{})["b"])
+	assert.Nil(t, CopyDocument(nil))
+}
+
 // Benchmark tests for performance
 func BenchmarkChangeEvent_Creation(b *testing.B) {
 	b.ResetTimer()
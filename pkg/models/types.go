@@ -27,6 +27,32 @@ type SnapshotOptions struct {
 	BatchSize       int                    `json:"batch_size,omitempty"`      // Documents per batch (default: 100)
 	SnapshotFilter  map[string]interface{} `json:"snapshot_filter,omitempty"` // Additional filter for snapshot
 	SnapshotSort    map[string]interface{} `json:"snapshot_sort,omitempty"`   // Sort order for snapshot
+	RowFilter       map[string]interface{} `json:"-"`                         // Mandatory filter of the server's policy, AND-ed with SnapshotFilter
+}
+
+// ConflateOptions configures per-document conflation of change events
+type ConflateOptions struct {
+	IntervalMS int `json:"interval_ms"` // Flush interval in milliseconds
+}
+
+// AckOptions enables acknowledged (at-least-once) delivery for a subscription
+type AckOptions struct {
+	Window    int `json:"window,omitempty"`     // Max unacknowledged events in flight
+	TimeoutMS int `json:"timeout_ms,omitempty"` // Redeliver events not acknowledged within this time
+}
+
+// ResumeOptions identifies the last event a client has seen so the server can
+// replay what it missed. EventID takes precedence over ClusterTime.
+type ResumeOptions struct {
+	EventID     string               `json:"event_id,omitempty"`     // ID of the last received ChangeEvent
+	ClusterTime *primitive.Timestamp `json:"cluster_time,omitempty"` // Replay events strictly after this time
+}
+
+// BatchingOptions negotiates grouping of change events into a single WebSocket frame
+type BatchingOptions struct {
+	MaxEvents  int `json:"max_events"`             // Max events per frame (<= 1 disables batching)
+	MaxBytes   int `json:"max_bytes,omitempty"`    // Max encoded size of the grouped events
+	MaxDelayMS int `json:"max_delay_ms,omitempty"` // Max time the first event may wait for others
 }
 
 // ClientMessage represents a message sent from client to server
@@ -38,6 +64,13 @@ type ClientMessage struct {
 	RequestID       string                 `json:"requestId,omitempty"`
 	SubscriptionID  string                 `json:"subscriptionId,omitempty"`   // Used for unsubscribe requests
 	SnapshotOptions *SnapshotOptions       `json:"snapshot_options,omitempty"` // Options for initial snapshot
+	Conflate        *ConflateOptions       `json:"conflate,omitempty"`         // Keep only the latest event per document within an interval
+	Batching        *BatchingOptions       `json:"batching,omitempty"`         // Requested batching window for change events
+	ResumeFrom      *ResumeOptions         `json:"resume_from,omitempty"`      // Replay missed events before going live
+	Ack             *AckOptions            `json:"ack,omitempty"`              // Acknowledged delivery for this subscription
+	Seq             uint64                 `json:"seq,omitempty"`              // Subscription sequence number being acknowledged
+	Cumulative      bool                   `json:"cumulative,omitempty"`       // Acknowledge every sequence number up to Seq
+	Token           string                 `json:"token,omitempty"`            // Fresh credentials for an auth message
 }
 
 // ServerMessage represents a message sent from server to client
@@ -53,16 +86,24 @@ type ServerMessage struct {
 	SnapshotBatch     int                      `json:"snapshot_batch,omitempty"`     // Current batch number
 	SnapshotTotal     int                      `json:"snapshot_total,omitempty"`     // Total documents in snapshot
 	SnapshotRemaining int                      `json:"snapshot_remaining,omitempty"` // Documents remaining
+	Messages          []*ServerMessage         `json:"messages,omitempty"`           // Grouped change messages, in order
+	SubscriptionIDs   []string                 `json:"subscriptionIds,omitempty"`    // Subscriptions this message is delivered for
+	Sequences         []uint64                 `json:"sequences,omitempty"`          // Per-subscription sequence numbers, parallel to SubscriptionIDs; acknowledgements refer to them
+	Redelivered       bool                     `json:"redelivered,omitempty"`        // The event was sent before but not acknowledged
 }
 
 // Subscription represents a client's subscription to changes
 type Subscription struct {
-	ID              string           `json:"id"`
-	ClientID        string           `json:"clientId"`
-	Database        string           `json:"database"`
-	Collection      string           `json:"collection"`
-	CreatedAt       time.Time        `json:"createdAt"`
-	SnapshotOptions *SnapshotOptions `json:"snapshot_options,omitempty"`
+	ID              string                 `json:"id"`
+	ClientID        string                 `json:"clientId"`
+	RequestID       string                 `json:"requestId,omitempty"` // Subscribe request that created the subscription
+	Database        string                 `json:"database"`
+	Collection      string                 `json:"collection"`
+	CreatedAt       time.Time              `json:"createdAt"`
+	SnapshotOptions *SnapshotOptions       `json:"snapshot_options,omitempty"`
+	Conflate        *ConflateOptions       `json:"conflate,omitempty"`
+	Ack             *AckOptions            `json:"ack,omitempty"`
+	Filter          map[string]interface{} `json:"-"` // Documents the subscriber may see; nil for all
 }
 
 // DatabaseConfig represents configuration for a specific database
@@ -80,6 +121,59 @@ type Client struct {
 	LastSeen      time.Time       `json:"lastSeen"`
 }
 
+// Principal is the authenticated identity behind a connection
+type Principal struct {
+	Subject   string                 `json:"subject"`
+	Method    string                 `json:"method"`              // How the identity was established, e.g. AuthMethodJWT
+	Roles     []string               `json:"roles,omitempty"`     // Roles granted to the subject
+	Claims    map[string]interface{} `json:"claims,omitempty"`    // Verified claims of the credentials
+	ExpiresAt time.Time              `json:"expiresAt,omitempty"` // Zero if the credentials do not expire
+	// Namespaces limits the credentials to "db.collection" patterns; nil for no limit
+	Namespaces []string `json:"namespaces,omitempty"`
+	// RateLimit is shared by all connections with the credentials; nil for no limit
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+}
+
+// RateLimit is a token bucket rate
+type RateLimit struct {
+	PerSecond float64 `json:"perSecond"`
+	Burst     int     `json:"burst,omitempty"` // Defaults to one second's worth
+}
+
+// HasRole reports whether the principal was granted a role
+func (p *Principal) HasRole(role string) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Authentication methods of a Principal
+const (
+	AuthMethodJWT        = "jwt"
+	AuthMethodAPIKey     = "api_key"
+	AuthMethodClientCert = "client_cert"
+)
+
+// WebSocket subprotocols. Browsers cannot set an Authorization header, so
+// they may offer their token as a subprotocol SubprotocolBearerPrefix+token
+// next to SubprotocolAktuell, which the server selects.
+const (
+	SubprotocolAktuell      = "aktuell"
+	SubprotocolBearerPrefix = "aktuell.bearer."
+)
+
+// Handshake headers for durable sessions
+const (
+	HeaderSession        = "X-Aktuell-Session"         // Session token presented by the client and issued by the server
+	HeaderSessionResumed = "X-Aktuell-Session-Resumed" // "true" if an existing session was re-attached
+)
+
 // MessageType constants for different message types
 const (
 	MessageTypeSubscribe     = "subscribe"
@@ -95,16 +189,39 @@ const (
 	MessageTypeSnapshot      = "snapshot"       // Batch of initial documents
 	MessageTypeSnapshotStart = "snapshot_start" // Snapshot streaming started
 	MessageTypeSnapshotEnd   = "snapshot_end"   // Snapshot streaming completed
+	MessageTypeChanges       = "changes"        // Batch of change messages in a single frame
+	MessageTypeBatching      = "batching"       // Negotiate the change batching window
+	MessageTypeSession       = "session"        // Session token of the connection
+	MessageTypeAck           = "ack"            // Acknowledge delivered change events
+	MessageTypeAuth          = "auth"           // Replace the credentials of the connection before they expire
+)
+
+// Error codes sent in ServerMessage.ErrorCode
+const (
+	ErrorCodeInvalidSubscription  = 1  // Database/collection is not configured on the server
+	ErrorCodeInvalidOptions       = 2  // Subscription options are malformed or out of range
+	ErrorCodeUnknownSubscription  = 3  // Subscription ID does not exist on this connection
+	ErrorCodeResumeWindowExceeded = 4  // Resume point is no longer retained; take a new snapshot
+	ErrorCodeAckBacklogExceeded   = 5  // Too many unacknowledged events; the subscription was dropped
+	ErrorCodeTokenExpired         = 6  // The connection's credentials expired; the server closes it
+	ErrorCodeInvalidToken         = 7  // Credentials sent in an auth message were rejected
+	ErrorCodeForbidden            = 8  // The principal is not allowed the request; Data.reason tells why
+	ErrorCodeRateLimited          = 9  // The message exceeded a rate limit and was dropped; Data.limit names the limit
+	ErrorCodeSubscriptionLimit    = 10 // The connection has the maximum number of subscriptions
+	ErrorCodeSnapshotLimit        = 11 // The connection has the maximum number of snapshots streaming
+	ErrorCodeTooManyViolations    = 12 // The connection exceeded its limits repeatedly; the server closes it
 )
 
 // Operation types from MongoDB change streams
 const (
-	OperationInsert  = "insert"
-	OperationUpdate  = "update"
-	OperationReplace = "replace"
-	OperationDelete  = "delete"
-	OperationDrop    = "drop"
-	OperationRename  = "rename"
+	OperationInsert       = "insert"
+	OperationUpdate       = "update"
+	OperationReplace      = "replace"
+	OperationDelete       = "delete"
+	OperationDrop         = "drop"
+	OperationRename       = "rename"
+	OperationDropDatabase = "dropDatabase"
+	OperationInvalidate   = "invalidate"
 )
 
 // SubscriptionValidator interface for validating subscription requests
@@ -113,6 +230,63 @@ type SubscriptionValidator interface {
 	GetConfiguredDatabases() []DatabaseConfig
 }
 
+// Operations a principal can be granted on a namespace
+const (
+	AccessSubscribe = "subscribe" // Receive change events
+	AccessSnapshot  = "snapshot"  // Receive the existing documents
+	AccessWrite     = "write"     // Modify documents
+)
+
+// AccessRequest describes an operation a principal wants to perform
+type AccessRequest struct {
+	Principal  *Principal // nil for unauthenticated connections
+	Database   string
+	Collection string // Empty for the whole database
+	Operation  string // AccessSubscribe, AccessSnapshot or AccessWrite
+	// SnapshotLimit is the requested snapshot size of AccessSnapshot requests.
+	// If it is 0 (the server default), Authorize may set it to the maximum
+	// the principal is allowed.
+	SnapshotLimit int
+	// Filter is set by Authorize to the documents the principal may see, as
+	// a MongoDB query; nil means all documents
+	Filter map[string]interface{}
+}
+
+// Reasons of a Denial
+const (
+	DenialNamespaceNotConfigured = "namespace_not_configured" // The server does not watch the namespace
+	DenialNamespaceNotAllowed    = "namespace_not_allowed"    // No policy grants the principal the namespace
+	DenialOperationNotAllowed    = "operation_not_allowed"    // The namespace is granted, but not the operation
+	DenialSnapshotTooLarge       = "snapshot_too_large"       // The requested snapshot exceeds the principal's maximum
+	DenialFilterUnresolved       = "filter_unresolved"        // A row filter references a claim the principal lacks
+)
+
+// Denial explains why an AccessRequest was refused
+type Denial struct {
+	Code    int    // Error code sent to the client
+	Reason  string // Machine-readable reason, e.g. DenialNamespaceNotAllowed
+	Message string // Human-readable explanation
+}
+
+// Error implements the error interface
+func (d *Denial) Error() string {
+	return d.Message
+}
+
+// AuthorizingValidator is a SubscriptionValidator that decides per principal
+// and operation. The server prefers Authorize over IsValidSubscription.
+type AuthorizingValidator interface {
+	SubscriptionValidator
+	Authorize(req *AccessRequest) *Denial
+}
+
+// Redactor removes or obscures the fields of documents a principal may not
+// see. Implementations must not modify their arguments, which are shared.
+type Redactor interface {
+	RedactChange(principal *Principal, change *ChangeEvent) *ChangeEvent
+	RedactDocuments(principal *Principal, database, collection string, documents []map[string]interface{}) []map[string]interface{}
+}
+
 // SnapshotStreamer interface for streaming initial collection snapshots
 type SnapshotStreamer interface {
 	StreamSnapshot(database, collection string, snapOpts *SnapshotOptions, callback func([]map[string]interface{}, int, int, error))
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Limits for acknowledged delivery
+const (
+	defaultAckWindow  = 100
+	maxAckWindow      = 10000
+	defaultAckTimeout = 30 * time.Second
+	minAckTimeout     = time.Second
+	maxAckTimeout     = 10 * time.Minute
+	// maxAckBacklog bounds the events held back while the window is full
+	maxAckBacklog = 10000
+)
+
+// negotiateAck clamps the requested acknowledgement options to the server limits
+func negotiateAck(opts *models.AckOptions) *models.AckOptions {
+	window := opts.Window
+	if window <= 0 {
+		window = defaultAckWindow
+	}
+	if window > maxAckWindow {
+		window = maxAckWindow
+	}
+
+	timeout := time.Duration(opts.TimeoutMS) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultAckTimeout
+	}
+	if timeout < minAckTimeout {
+		timeout = minAckTimeout
+	}
+	if timeout > maxAckTimeout {
+		timeout = maxAckTimeout
+	}
+
+	return &models.AckOptions{Window: window, TimeoutMS: int(timeout.Milliseconds())}
+}
+
+// inflightEvent is a change event sent but not yet acknowledged
+type inflightEvent struct {
+	message *models.ServerMessage
+	sentAt  time.Time
+}
+
+// ackTracker numbers the events of an acknowledged subscription with the
+// subscription's sequence, keeps them until the client acknowledges them and
+// redelivers them after a timeout. At most window events are in flight;
+// further events wait in a backlog.
+type ackTracker struct {
+	subscriptionID string
+	window         int
+	timeout        time.Duration
+	send           func(*models.ServerMessage)
+	overflow       func()
+	seq            *atomic.Uint64 // The subscription's sequence
+	inflight       map[uint64]*inflightEvent
+	backlog        []*models.ChangeEvent
+	paused         bool // No connection to redeliver to
+	stopped        bool
+	stopCh         chan struct{}
+	mu             sync.Mutex
+}
+
+// newAckTracker creates a tracker and starts its redelivery loop. overflow is
+// called once, asynchronously, if the backlog exceeds its limit.
+func newAckTracker(subscriptionID string, opts *models.AckOptions, seq *atomic.Uint64, send func(*models.ServerMessage), overflow func()) *ackTracker {
+	tr := &ackTracker{
+		subscriptionID: subscriptionID,
+		seq:            seq,
+		window:         opts.Window,
+		timeout:        time.Duration(opts.TimeoutMS) * time.Millisecond,
+		send:           send,
+		overflow:       overflow,
+		inflight:       make(map[uint64]*inflightEvent),
+		stopCh:         make(chan struct{}),
+	}
+	go tr.run()
+	return tr
+}
+
+// add delivers a change event, or holds it back while the window is full
+func (tr *ackTracker) add(change *models.ChangeEvent) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if tr.stopped {
+		return
+	}
+
+	if len(tr.inflight) < tr.window && len(tr.backlog) == 0 {
+		tr.deliverLocked(change)
+		return
+	}
+
+	tr.backlog = append(tr.backlog, change)
+	if len(tr.backlog) > maxAckBacklog {
+		tr.stopLocked()
+		go tr.overflow()
+	}
+}
+
+// ack acknowledges a sequence number, or every number up to it if cumulative,
+// and sends held back events into the freed window
+func (tr *ackTracker) ack(seq uint64, cumulative bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if tr.stopped {
+		return
+	}
+
+	if cumulative {
+		for s := range tr.inflight {
+			if s <= seq {
+				delete(tr.inflight, s)
+			}
+		}
+	} else {
+		delete(tr.inflight, seq)
+	}
+
+	for len(tr.backlog) > 0 && len(tr.inflight) < tr.window {
+		change := tr.backlog[0]
+		tr.backlog[0] = nil
+		tr.backlog = tr.backlog[1:]
+		tr.deliverLocked(change)
+	}
+}
+
+// deliverLocked assigns the next sequence number and sends the event.
+// Caller holds tr.mu.
+func (tr *ackTracker) deliverLocked(change *models.ChangeEvent) {
+	seq := tr.seq.Add(1)
+	message := &models.ServerMessage{
+		Type:            models.MessageTypeChange,
+		Change:          change,
+		SubscriptionIDs: []string{tr.subscriptionID},
+		Sequences:       []uint64{seq},
+	}
+	tr.inflight[seq] = &inflightEvent{message: message, sentAt: time.Now()}
+	tr.send(message)
+}
+
+// pause suspends timeout redelivery while the client is disconnected
+func (tr *ackTracker) pause() {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.paused = true
+}
+
+// redeliver resends unacknowledged events in sequence order. With all set,
+// every in-flight event is resent and a paused tracker resumes; otherwise
+// only events past the timeout are resent.
+func (tr *ackTracker) redeliver(all bool) int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if tr.stopped || (tr.paused && !all) {
+		return 0
+	}
+	tr.paused = false
+
+	now := time.Now()
+	seqs := make([]uint64, 0, len(tr.inflight))
+	for seq, event := range tr.inflight {
+		if all || now.Sub(event.sentAt) >= tr.timeout {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	for _, seq := range seqs {
+		event := tr.inflight[seq]
+		// Copy: the original may still be queued for writing
+		message := *event.message
+		message.Redelivered = true
+		event.message = &message
+		event.sentAt = now
+		tr.send(&message)
+	}
+	return len(seqs)
+}
+
+// run redelivers timed out events until stopped
+func (tr *ackTracker) run() {
+	interval := tr.timeout / 4
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tr.stopCh:
+			return
+		case <-ticker.C:
+			tr.redeliver(false)
+		}
+	}
+}
+
+// stop ends the redelivery loop and discards unacknowledged events
+func (tr *ackTracker) stop() {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.stopLocked()
+}
+
+// stopLocked is stop for callers holding tr.mu
+func (tr *ackTracker) stopLocked() {
+	if tr.stopped {
+		return
+	}
+	tr.stopped = true
+	close(tr.stopCh)
+}
+
+// ackedSender returns the send function for a subscription's ack tracker.
+// Events that do not fit into the queue are redelivered after the timeout.
+func (c *Client) ackedSender() func(*models.ServerMessage) {
+	return func(message *models.ServerMessage) {
+		select {
+		case c.send <- message:
+		default:
+			c.hub.logger.WithField("client_id", c.ID).Debug("Queue full, acknowledged change will be redelivered")
+		}
+	}
+}
+
+// ackOverflow drops an acknowledged subscription whose client stopped
+// acknowledging, and tells the client so it can resume
+func (c *Client) ackOverflow(subscriptionID string) func() {
+	return func() {
+		c.hub.mu.RLock()
+		defer c.hub.mu.RUnlock()
+		if !c.hub.clients[c] {
+			return
+		}
+
+		c.mu.Lock()
+		c.removeSubscriptionLocked(subscriptionID)
+		c.mu.Unlock()
+
+		c.hub.logger.WithFields(logrus.Fields{
+			"client_id":       c.ID,
+			"subscription_id": subscriptionID,
+		}).Warn("Too many unacknowledged events, dropping subscription")
+
+		select {
+		case c.send <- &models.ServerMessage{
+			Type:            models.MessageTypeError,
+			Error:           "Too many unacknowledged events, subscription dropped",
+			ErrorCode:       models.ErrorCodeAckBacklogExceeded,
+			SubscriptionIDs: []string{subscriptionID},
+		}:
+		default:
+		}
+	}
+}
+
+// handleAck processes an acknowledgement from the client
+func (c *Client) handleAck(message *models.ClientMessage) {
+	c.mu.RLock()
+	tr, ok := c.trackers[message.SubscriptionID]
+	c.mu.RUnlock()
+
+	if !ok {
+		c.sendError(message.RequestID, models.ErrorCodeUnknownSubscription, "Subscription not found or not acknowledged")
+		return
+	}
+	tr.ack(message.Seq, message.Cumulative)
+}
+
+// redeliverUnacked resends every unacknowledged event, e.g. after a session
+// was re-attached and earlier sends may have been lost
+func (c *Client) redeliverUnacked() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for id, tr := range c.trackers {
+		if n := tr.redeliver(true); n > 0 {
+			c.hub.logger.WithFields(logrus.Fields{
+				"client_id":       c.ID,
+				"subscription_id": id,
+				"events":          n,
+			}).Debug("Redelivering unacknowledged events")
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSender collects the messages sent by an ack tracker
+type recordingSender struct {
+	messages []*models.ServerMessage
+	mu       sync.Mutex
+}
+
+func (r *recordingSender) send(message *models.ServerMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, message)
+}
+
+func (r *recordingSender) seqs() []uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seqs := make([]uint64, len(r.messages))
+	for i, message := range r.messages {
+		seqs[i] = message.Sequences[0]
+	}
+	return seqs
+}
+
+func TestNegotiateAck(t *testing.T) {
+	opts := negotiateAck(&models.AckOptions{})
+	assert.Equal(t, defaultAckWindow, opts.Window)
+	assert.Equal(t, int(defaultAckTimeout.Milliseconds()), opts.TimeoutMS)
+
+	opts = negotiateAck(&models.AckOptions{Window: 1 << 20, TimeoutMS: 1})
+	assert.Equal(t, maxAckWindow, opts.Window)
+	assert.Equal(t, int(minAckTimeout.Milliseconds()), opts.TimeoutMS)
+}
+
+func TestHandleSubscribe_WarnsAboutAckWithoutSessionsOrReplay(t *testing.T) {
+	subscribeWithAck := func(grace time.Duration) []*logrus.Entry {
+		ws, url := newSessionServer(t, grace)
+		ws.hub.logger.SetLevel(logrus.WarnLevel)
+		hook := logtest.NewLocal(ws.hub.logger)
+
+		conn, _ := dialSession(t, url, "")
+		if grace > 0 {
+			readMessage(t, conn) // session
+		}
+		require.NoError(t, conn.WriteJSON(&models.ClientMessage{
+			Type:       models.MessageTypeSubscribe,
+			RequestID:  "req",
+			Database:   "db",
+			Collection: "items",
+			Ack:        &models.AckOptions{Window: 10},
+		}))
+		require.True(t, readMessage(t, conn).Success)
+		return hook.AllEntries()
+	}
+
+	entries := subscribeWithAck(0)
+	require.Len(t, entries, 1)
+	assert.Contains(t, entries[0].Message, "without sessions or replay")
+
+	assert.Empty(t, subscribeWithAck(time.Minute))
+}
+
+func TestAckTracker_WindowAppliesBackpressure(t *testing.T) {
+	var sent recordingSender
+	tr := newAckTracker("sub-1", &models.AckOptions{Window: 2, TimeoutMS: 60000}, &atomic.Uint64{}, sent.send, func() {})
+	defer tr.stop()
+
+	for i := 0; i < 5; i++ {
+		tr.add(&models.ChangeEvent{ID: string(rune('a' + i))})
+	}
+	assert.Equal(t, []uint64{1, 2}, sent.seqs())
+
+	tr.ack(1, false)
+	assert.Equal(t, []uint64{1, 2, 3}, sent.seqs())
+
+	// A cumulative ack frees the whole window
+	tr.ack(3, true)
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5}, sent.seqs())
+
+	sent.mu.Lock()
+	defer sent.mu.Unlock()
+	for i, message := range sent.messages {
+		assert.Equal(t, string(rune('a'+i)), message.Change.ID)
+		assert.Equal(t, []string{"sub-1"}, message.SubscriptionIDs)
+	}
+}
+
+func TestAckTracker_RedeliversAfterTimeout(t *testing.T) {
+	var sent recordingSender
+	tr := newAckTracker("sub-1", &models.AckOptions{Window: 10, TimeoutMS: 40}, &atomic.Uint64{}, sent.send, func() {})
+	defer tr.stop()
+
+	tr.add(&models.ChangeEvent{ID: "a"})
+	tr.add(&models.ChangeEvent{ID: "b"})
+	tr.ack(2, false)
+
+	require.Eventually(t, func() bool { return len(sent.seqs()) >= 3 }, time.Second, 5*time.Millisecond)
+
+	sent.mu.Lock()
+	original, redelivered := sent.messages[0], sent.messages[2]
+	sent.mu.Unlock()
+	assert.Equal(t, uint64(1), redelivered.Sequences[0])
+	assert.True(t, redelivered.Redelivered)
+	assert.False(t, original.Redelivered, "original message must not be modified")
+}
+
+func TestAckTracker_PausedUntilRedeliverAll(t *testing.T) {
+	var sent recordingSender
+	tr := newAckTracker("sub-1", &models.AckOptions{Window: 10, TimeoutMS: 60000}, &atomic.Uint64{}, sent.send, func() {})
+	defer tr.stop()
+
+	tr.add(&models.ChangeEvent{ID: "a"})
+	tr.pause()
+	assert.Zero(t, tr.redeliver(false))
+	assert.Equal(t, 1, tr.redeliver(true))
+	assert.Equal(t, []uint64{1, 1}, sent.seqs())
+}
+
+func TestAckTracker_BacklogOverflow(t *testing.T) {
+	overflowed := make(chan struct{})
+	tr := newAckTracker("sub-1", &models.AckOptions{Window: 1, TimeoutMS: 60000}, &atomic.Uint64{}, func(*models.ServerMessage) {}, func() { close(overflowed) })
+
+	for i := 0; i <= maxAckBacklog+1; i++ {
+		tr.add(&models.ChangeEvent{})
+	}
+
+	select {
+	case <-overflowed:
+	case <-time.After(time.Second):
+		t.Fatal("overflow was not reported")
+	}
+}
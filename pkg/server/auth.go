@@ -0,0 +1,183 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"aktuell/pkg/auth"
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// SetAuthenticator requires every connection to authenticate during the
+// handshake. It must be called before Start.
+func (ws *WebSocketServer) SetAuthenticator(authenticator auth.Authenticator) {
+	ws.authenticator = authenticator
+}
+
+// SetRedactor obscures fields of the documents sent to clients
+func (ws *WebSocketServer) SetRedactor(redactor models.Redactor) {
+	ws.redactor = redactor
+}
+
+// authenticate establishes the principal of a handshake request. It answers
+// the request with 401 and returns false if authentication fails. Without an
+// authenticator every request is accepted with a nil principal.
+func (h *Hub) authenticate(w http.ResponseWriter, r *http.Request) (*models.Principal, bool) {
+	if h.wsServer == nil || h.wsServer.authenticator == nil {
+		return nil, true
+	}
+
+	principal, err := h.wsServer.authenticator.Authenticate(r)
+	if err != nil {
+		h.logger.WithError(err).WithField("remote", r.RemoteAddr).Warn("Rejected unauthenticated connection")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="aktuell"`)
+		message := "authentication failed"
+		if errors.Is(err, auth.ErrNoCredentials) {
+			message = "authentication required"
+		}
+		http.Error(w, message, http.StatusUnauthorized)
+		return nil, false
+	}
+	return principal, true
+}
+
+// samePrincipal reports whether two principals identify the same subject, so
+// a session may move from a connection of one to a connection of the other.
+// Principals without a subject cannot be told apart and never match.
+func samePrincipal(a, b *models.Principal) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Subject != "" && a.Method == b.Method && a.Subject == b.Subject
+}
+
+// selectSubprotocol answers a handshake that offers the Aktuell subprotocol,
+// which browsers need when they pass their token as a subprotocol
+func selectSubprotocol(r *http.Request, responseHeader http.Header) {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol == models.SubprotocolAktuell {
+			responseHeader.Set("Sec-WebSocket-Protocol", models.SubprotocolAktuell)
+			return
+		}
+	}
+}
+
+// Principal returns the authenticated identity of the client, or nil if the
+// server does not require authentication
+func (c *Client) Principal() *models.Principal {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.principal
+}
+
+// setPrincipal replaces the client's identity and schedules the end of the
+// connection for when its credentials expire
+func (c *Client) setPrincipal(principal *models.Principal) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.principal = principal
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	if principal == nil || principal.ExpiresAt.IsZero() {
+		return
+	}
+	c.expiry = time.AfterFunc(time.Until(principal.ExpiresAt), func() { c.expire(principal) })
+}
+
+// expire closes the connection of a client whose credentials ran out. With
+// sessions the client may re-attach with fresh credentials.
+func (c *Client) expire(principal *models.Principal) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.principal != principal || c.expiry == nil {
+		// Replaced by an auth message or stopped meanwhile
+		return
+	}
+	c.expiry = nil
+	if c.link == nil {
+		// A detached session needs fresh credentials to re-attach anyway
+		return
+	}
+
+	c.hub.logger.WithFields(logrus.Fields{
+		"client_id": c.ID,
+		"subject":   principal.Subject,
+	}).Info("Credentials expired, closing connection")
+	c.link.end(errorMessage("", models.ErrorCodeTokenExpired, "Credentials expired"))
+}
+
+// stopExpiry cancels the expiry of the client's credentials
+func (c *Client) stopExpiry() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+}
+
+// handleAuth replaces the credentials of the connection, typically with a
+// refreshed token before the current one expires. The new token must belong
+// to the same subject.
+func (c *Client) handleAuth(message *models.ClientMessage) {
+	var verifier auth.TokenVerifier
+	if c.hub.wsServer != nil {
+		verifier, _ = c.hub.wsServer.authenticator.(auth.TokenVerifier)
+	}
+	if verifier == nil {
+		c.sendError(message.RequestID, models.ErrorCodeInvalidToken, "Token authentication is not enabled")
+		return
+	}
+
+	principal, err := verifier.VerifyToken(message.Token)
+	if err != nil {
+		c.sendError(message.RequestID, models.ErrorCodeInvalidToken, "Invalid token: "+err.Error())
+		return
+	}
+	if !samePrincipal(c.Principal(), principal) {
+		c.sendError(message.RequestID, models.ErrorCodeInvalidToken, "Invalid token: the token belongs to a different subject")
+		return
+	}
+	c.setPrincipal(principal)
+
+	data := map[string]interface{}{"subject": principal.Subject}
+	if !principal.ExpiresAt.IsZero() {
+		data["expires_at"] = principal.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	response := &models.ServerMessage{
+		Type:      models.MessageTypeAuth,
+		Success:   true,
+		RequestID: message.RequestID,
+		Data:      data,
+	}
+
+	select {
+	case c.send <- response:
+	default:
+		c.hub.logger.Warn("Failed to send auth response")
+	}
+}
+
+// redactChange returns a change as the client may see it. Caller holds c.mu.
+func (c *Client) redactChange(change *models.ChangeEvent) *models.ChangeEvent {
+	if c.hub.wsServer == nil || c.hub.wsServer.redactor == nil {
+		return change
+	}
+	return c.hub.wsServer.redactor.RedactChange(c.principal, change)
+}
+
+// redactDocuments returns snapshot documents as the client may see them
+func (c *Client) redactDocuments(database, collection string, documents []map[string]interface{}) []map[string]interface{} {
+	if c.hub.wsServer == nil || c.hub.wsServer.redactor == nil {
+		return documents
+	}
+	return c.hub.wsServer.redactor.RedactDocuments(c.Principal(), database, collection, documents)
+}
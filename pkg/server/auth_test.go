@@ -0,0 +1,431 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"aktuell/pkg/auth"
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testJWTSecret = "server-test-secret"
+
+// signToken creates an HS256 token for the test secret
+func signToken(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	input := segment(map[string]string{"alg": "HS256"}) + "." + segment(claims)
+	mac := hmac.New(sha256.New, []byte(testJWTSecret))
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newAuthServer starts a server that requires a token signed with the test secret
+func newAuthServer(t *testing.T, grace time.Duration) (*WebSocketServer, string) {
+	t.Helper()
+
+	ws, url := newSessionServer(t, grace)
+	authenticator, err := auth.NewJWTAuthenticator(auth.JWTOptions{Secrets: []string{testJWTSecret}})
+	require.NoError(t, err)
+	ws.SetAuthenticator(authenticator)
+	return ws, url
+}
+
+// dialToken connects with a bearer token and an optional session token
+func dialToken(t *testing.T, url, token, session string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	if session != "" {
+		header.Set(models.HeaderSession, session)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	}
+	return conn, resp, err
+}
+
+// onlyClient returns the single client registered with the hub
+func onlyClient(t *testing.T, ws *WebSocketServer) *Client {
+	t.Helper()
+
+	var client *Client
+	require.Eventually(t, func() bool {
+		ws.hub.mu.RLock()
+		defer ws.hub.mu.RUnlock()
+		for c := range ws.hub.clients {
+			client = c
+		}
+		return len(ws.hub.clients) == 1
+	}, time.Second, 5*time.Millisecond)
+	return client
+}
+
+func TestAuth_RejectsMissingAndInvalidTokens(t *testing.T) {
+	_, url := newAuthServer(t, 0)
+
+	_, resp, err := dialToken(t, url, "", "")
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Bearer")
+
+	_, resp, err = dialToken(t, url, "forged.token.value", "")
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	expired := signToken(t, map[string]interface{}{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()})
+	_, resp, err = dialToken(t, url, expired, "")
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestAuth_AttachesPrincipalToClient(t *testing.T) {
+	ws, url := newAuthServer(t, 0)
+
+	token := signToken(t, map[string]interface{}{"sub": "alice", "roles": []string{"reader"}, "tenant": "acme"})
+	_, _, err := dialToken(t, url, token, "")
+	require.NoError(t, err)
+
+	principal := onlyClient(t, ws).Principal()
+	require.NotNil(t, principal)
+	assert.Equal(t, "alice", principal.Subject)
+	assert.Equal(t, []string{"reader"}, principal.Roles)
+	assert.Equal(t, "acme", principal.Claims["tenant"])
+}
+
+func TestAuth_TokenAsSubprotocol(t *testing.T) {
+	_, url := newAuthServer(t, 0)
+
+	token := signToken(t, map[string]interface{}{"sub": "browser"})
+	dialer := websocket.Dialer{Subprotocols: []string{models.SubprotocolAktuell, models.SubprotocolBearerPrefix + token}}
+	conn, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, models.SubprotocolAktuell, conn.Subprotocol())
+}
+
+// principalValidator records the principals it is asked about
+type principalValidator struct {
+	principals chan *models.Principal
+}
+
+func (v *principalValidator) IsValidSubscription(database, collection string) bool {
+	return true
+}
+
+func (v *principalValidator) Authorize(req *models.AccessRequest) *models.Denial {
+	v.principals <- req.Principal
+	if req.Principal.HasRole("reader") {
+		return nil
+	}
+	return &models.Denial{Code: models.ErrorCodeForbidden, Reason: models.DenialNamespaceNotAllowed, Message: "not a reader"}
+}
+
+func (v *principalValidator) GetConfiguredDatabases() []models.DatabaseConfig {
+	return nil
+}
+
+// reason returns the denial reason of an error response
+func reason(response *models.ServerMessage) interface{} {
+	data, _ := response.Data.(map[string]interface{})
+	return data["reason"]
+}
+
+func TestAuth_ValidatorReceivesPrincipal(t *testing.T) {
+	ws, url := newAuthServer(t, 0)
+	validator := &principalValidator{principals: make(chan *models.Principal, 2)}
+	ws.SetValidator(validator)
+
+	subscribe := func(conn *websocket.Conn) *models.ServerMessage {
+		require.NoError(t, conn.WriteJSON(&models.ClientMessage{Type: models.MessageTypeSubscribe, RequestID: "req", Database: "testdb", Collection: "users"}))
+		return readMessage(t, conn)
+	}
+
+	reader, _, err := dialToken(t, url, signToken(t, map[string]interface{}{"sub": "alice", "roles": []string{"reader"}}), "")
+	require.NoError(t, err)
+	assert.True(t, subscribe(reader).Success)
+	assert.Equal(t, "alice", (<-validator.principals).Subject)
+
+	guest, _, err := dialToken(t, url, signToken(t, map[string]interface{}{"sub": "bob"}), "")
+	require.NoError(t, err)
+	response := subscribe(guest)
+	assert.Equal(t, models.ErrorCodeForbidden, response.ErrorCode)
+	assert.Equal(t, models.DenialNamespaceNotAllowed, reason(response))
+	assert.Equal(t, "bob", (<-validator.principals).Subject)
+}
+
+func TestAuth_PolicyDeniesWithReasonAndLimitsSnapshots(t *testing.T) {
+	ws, url := newAuthServer(t, 0)
+	policy, err := auth.NewPolicy(auth.PolicyConfig{Rules: []auth.PolicyRule{
+		{Roles: []string{"reader"}, Namespaces: []string{"testdb.users"}, Operations: []string{models.AccessSubscribe, models.AccessSnapshot}, MaxSnapshot: 50},
+		{Roles: []string{"auditor"}, Namespaces: []string{"testdb"}, Operations: []string{models.AccessSubscribe}},
+	}})
+	require.NoError(t, err)
+	ws.SetValidator(auth.NewPolicyValidator(nil, policy))
+	limits := make(chan int, 1)
+	ws.SetSnapshotStreamer(snapshotStreamerFunc(func(database, collection string, snapOpts *models.SnapshotOptions, callback func([]map[string]interface{}, int, int, error)) {
+		limits <- snapOpts.SnapshotLimit
+		callback(nil, 1, 0, nil)
+	}))
+
+	subscribe := func(conn *websocket.Conn, collection string, limit int) *models.ServerMessage {
+		require.NoError(t, conn.WriteJSON(&models.ClientMessage{
+			Type:            models.MessageTypeSubscribe,
+			RequestID:       "req",
+			Database:        "testdb",
+			Collection:      collection,
+			SnapshotOptions: &models.SnapshotOptions{IncludeSnapshot: true, SnapshotLimit: limit},
+		}))
+		return readMessage(t, conn)
+	}
+
+	reader, _, err := dialToken(t, url, signToken(t, map[string]interface{}{"sub": "alice", "roles": []string{"reader"}}), "")
+	require.NoError(t, err)
+	denied := subscribe(reader, "orders", 0)
+	assert.Equal(t, models.ErrorCodeForbidden, denied.ErrorCode)
+	assert.Equal(t, models.DenialNamespaceNotAllowed, reason(denied))
+
+	denied = subscribe(reader, "users", 100)
+	assert.Equal(t, models.DenialSnapshotTooLarge, reason(denied))
+
+	assert.True(t, subscribe(reader, "users", 0).Success)
+	assert.Equal(t, 50, <-limits)
+
+	auditor, _, err := dialToken(t, url, signToken(t, map[string]interface{}{"sub": "carol", "roles": []string{"auditor"}}), "")
+	require.NoError(t, err)
+	denied = subscribe(auditor, "orders", 0)
+	assert.Equal(t, models.DenialOperationNotAllowed, reason(denied))
+}
+
+func TestAuth_ExpiryClosesConnection(t *testing.T) {
+	_, url := newAuthServer(t, 0)
+
+	token := signToken(t, map[string]interface{}{"sub": "alice", "exp": float64(time.Now().Add(1500*time.Millisecond).UnixMilli()) / 1000})
+	conn, _, err := dialToken(t, url, token, "")
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+
+	expired := readMessage(t, conn)
+	assert.Equal(t, models.MessageTypeError, expired.Type)
+	assert.Equal(t, models.ErrorCodeTokenExpired, expired.ErrorCode)
+
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, websocket.ClosePolicyViolation, closeErr.Code)
+}
+
+func TestAuth_ExpiryClosesConnectionWithFullQueue(t *testing.T) {
+	client, peer := newTestConnection(t)
+	for len(client.send) < cap(client.send) {
+		client.send <- &models.ServerMessage{Type: models.MessageTypePong}
+	}
+
+	client.setPrincipal(&models.Principal{Subject: "alice", ExpiresAt: time.Now().Add(10 * time.Millisecond)})
+	require.Eventually(t, client.link.ending.Load, time.Second, 5*time.Millisecond)
+	go client.writePump(client.link)
+
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(3*time.Second)))
+	expired := readMessage(t, peer)
+	assert.Equal(t, models.ErrorCodeTokenExpired, expired.ErrorCode)
+
+	_, _, err := peer.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, websocket.ClosePolicyViolation, closeErr.Code)
+}
+
+func TestAuth_RefreshExtendsConnection(t *testing.T) {
+	ws, url := newAuthServer(t, 0)
+
+	soon := time.Now().Add(time.Second)
+	conn, _, err := dialToken(t, url, signToken(t, map[string]interface{}{"sub": "alice", "exp": soon.Unix()}), "")
+	require.NoError(t, err)
+
+	// A token of another subject is refused
+	require.NoError(t, conn.WriteJSON(&models.ClientMessage{
+		Type:      models.MessageTypeAuth,
+		RequestID: "auth-1",
+		Token:     signToken(t, map[string]interface{}{"sub": "mallory", "exp": time.Now().Add(time.Hour).Unix()}),
+	}))
+	refused := readMessage(t, conn)
+	assert.Equal(t, "auth-1", refused.RequestID)
+	assert.Equal(t, models.ErrorCodeInvalidToken, refused.ErrorCode)
+
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, conn.WriteJSON(&models.ClientMessage{
+		Type:      models.MessageTypeAuth,
+		RequestID: "auth-2",
+		Token:     signToken(t, map[string]interface{}{"sub": "alice", "exp": later.Unix()}),
+	}))
+	accepted := readMessage(t, conn)
+	assert.Equal(t, models.MessageTypeAuth, accepted.Type)
+	assert.True(t, accepted.Success)
+	assert.Equal(t, later.Unix(), onlyClient(t, ws).Principal().ExpiresAt.Unix())
+
+	// The original expiry passes without the connection being closed
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(1500*time.Millisecond)))
+	_, _, err = conn.ReadMessage()
+	var netErr interface{ Timeout() bool }
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+}
+
+func TestSamePrincipal(t *testing.T) {
+	alice := &models.Principal{Subject: "alice", Method: models.AuthMethodJWT}
+	assert.True(t, samePrincipal(nil, nil))
+	assert.True(t, samePrincipal(alice, &models.Principal{Subject: "alice", Method: models.AuthMethodJWT}))
+	assert.False(t, samePrincipal(alice, nil))
+	assert.False(t, samePrincipal(alice, &models.Principal{Subject: "alice", Method: models.AuthMethodAPIKey}))
+
+	anonymous := &models.Principal{Method: models.AuthMethodJWT}
+	assert.False(t, samePrincipal(anonymous, &models.Principal{Method: models.AuthMethodJWT}))
+}
+
+func TestAuth_SessionOnlyReattachesForSameSubject(t *testing.T) {
+	ws, url := newAuthServer(t, time.Second)
+
+	conn, resp, err := dialToken(t, url, signToken(t, map[string]interface{}{"sub": "alice"}), "")
+	require.NoError(t, err)
+	session := resp.Header.Get(models.HeaderSession)
+	conn.Close()
+	require.Eventually(t, func() bool {
+		ws.hub.mu.RLock()
+		defer ws.hub.mu.RUnlock()
+		client := ws.hub.sessions[session]
+		return client != nil && !client.attached()
+	}, time.Second, 5*time.Millisecond)
+
+	_, resp, err = dialToken(t, url, signToken(t, map[string]interface{}{"sub": "mallory"}), session)
+	require.NoError(t, err)
+	assert.NotEqual(t, session, resp.Header.Get(models.HeaderSession))
+
+	_, resp, err = dialToken(t, url, signToken(t, map[string]interface{}{"sub": "alice"}), session)
+	require.NoError(t, err)
+	assert.Equal(t, session, resp.Header.Get(models.HeaderSession))
+	assert.Equal(t, "true", resp.Header.Get(models.HeaderSessionResumed))
+}
+
+func TestAuth_RowFilterIsolatesTenants(t *testing.T) {
+	ws, url := newAuthServer(t, 0)
+	policy, err := auth.NewPolicy(auth.PolicyConfig{Rules: []auth.PolicyRule{{
+		Roles:      []string{"reader"},
+		Namespaces: []string{"shop"},
+		Operations: []string{models.AccessSubscribe, models.AccessSnapshot},
+		Filter:     map[string]interface{}{"tenantId": "{{claims.tenant}}"},
+	}}})
+	require.NoError(t, err)
+	ws.SetValidator(auth.NewPolicyValidator(nil, policy))
+	filters := make(chan map[string]interface{}, 1)
+	ws.SetSnapshotStreamer(snapshotStreamerFunc(func(database, collection string, snapOpts *models.SnapshotOptions, callback func([]map[string]interface{}, int, int, error)) {
+		filters <- snapOpts.RowFilter
+		callback([]map[string]interface{}{{"_id": "3", "tenantId": "acme"}}, 1, 0, nil)
+	}))
+
+	connect := func(tenant string, snapshot bool) *websocket.Conn {
+		token := signToken(t, map[string]interface{}{"sub": tenant + "-user", "roles": []string{"reader"}, "tenant": tenant})
+		conn, _, err := dialToken(t, url, token, "")
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteJSON(&models.ClientMessage{
+			Type:            models.MessageTypeSubscribe,
+			RequestID:       "req",
+			Database:        "shop",
+			Collection:      "orders",
+			SnapshotOptions: &models.SnapshotOptions{IncludeSnapshot: snapshot, SnapshotFilter: map[string]interface{}{"status": "open"}},
+		}))
+		require.True(t, readMessage(t, conn).Success)
+		return conn
+	}
+
+	acme := connect("acme", true)
+	assert.Equal(t, map[string]interface{}{"tenantId": "acme"}, <-filters)
+	for readMessage(t, acme).Type != models.MessageTypeSnapshotEnd {
+	}
+	globex := connect("globex", false)
+
+	ws.BroadcastChange(tenantChange(models.OperationInsert, "1", "acme"))
+	ws.BroadcastChange(tenantChange(models.OperationInsert, "2", "globex"))
+	ws.BroadcastChange(tenantChange(models.OperationDelete, "2", ""))
+	ws.BroadcastChange(tenantChange(models.OperationDelete, "3", ""))
+
+	received := func(conn *websocket.Conn, n int) []string {
+		var got []string
+		for i := 0; i < n; i++ {
+			change := readMessage(t, conn).Change
+			require.NotNil(t, change)
+			got = append(got, change.OperationType+" "+change.DocumentKey["_id"].(string))
+		}
+		return got
+	}
+	assert.Equal(t, []string{"insert 1", "delete 3"}, received(acme, 2))
+	assert.Equal(t, []string{"insert 2", "delete 2"}, received(globex, 2))
+}
+
+func TestAuth_RedactsChangesAndSnapshotsPerRole(t *testing.T) {
+	ws, url := newAuthServer(t, 0)
+	policy, err := auth.NewPolicy(auth.PolicyConfig{
+		Default: auth.PolicyDefaultAllow,
+		Redactions: []auth.RedactionRule{{
+			Namespaces:  []string{"app.users"},
+			ExceptRoles: []string{"admin"},
+			Fields:      []auth.FieldRedaction{{Path: "email", Action: auth.RedactMask, Keep: 4}},
+		}},
+	})
+	require.NoError(t, err)
+	ws.SetRedactor(policy)
+	ws.SetSnapshotStreamer(snapshotStreamerFunc(func(database, collection string, snapOpts *models.SnapshotOptions, callback func([]map[string]interface{}, int, int, error)) {
+		callback([]map[string]interface{}{{"_id": "1", "email": "ada@example.com"}}, 1, 0, nil)
+	}))
+
+	connect := func(roles ...string) *websocket.Conn {
+		conn, _, err := dialToken(t, url, signToken(t, map[string]interface{}{"sub": "user", "roles": roles}), "")
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteJSON(&models.ClientMessage{
+			Type:            models.MessageTypeSubscribe,
+			RequestID:       "req",
+			Database:        "app",
+			Collection:      "users",
+			SnapshotOptions: &models.SnapshotOptions{IncludeSnapshot: true},
+		}))
+		require.True(t, readMessage(t, conn).Success)
+		require.Equal(t, models.MessageTypeSnapshotStart, readMessage(t, conn).Type)
+		return conn
+	}
+	reader := connect("reader")
+	admin := connect("admin")
+
+	assert.Equal(t, "***********.com", readMessage(t, reader).SnapshotData[0]["email"])
+	assert.Equal(t, "ada@example.com", readMessage(t, admin).SnapshotData[0]["email"])
+	for _, conn := range []*websocket.Conn{reader, admin} {
+		require.Equal(t, models.MessageTypeSnapshotEnd, readMessage(t, conn).Type)
+	}
+
+	ws.BroadcastChange(&models.ChangeEvent{
+		OperationType: models.OperationUpdate,
+		Database:      "app",
+		Collection:    "users",
+		DocumentKey:   map[string]interface{}{"_id": "1"},
+		UpdatedFields: map[string]interface{}{"email": "bob@example.org"},
+	})
+	assert.Equal(t, "***********.org", readMessage(t, reader).Change.UpdatedFields["email"])
+	assert.Equal(t, "bob@example.org", readMessage(t, admin).Change.UpdatedFields["email"])
+}
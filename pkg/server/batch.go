@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Server-side upper bounds for the batching window a client may negotiate
+const (
+	maxBatchEvents = 1000
+	maxBatchBytes  = 1 << 20 // 1 MiB
+	maxBatchDelay  = time.Second
+)
+
+// batchWindow is the effective batching configuration of a client connection
+type batchWindow struct {
+	maxEvents int
+	maxBytes  int
+	maxDelay  time.Duration
+}
+
+// enabled reports whether change events should be grouped at all
+func (w batchWindow) enabled() bool {
+	return w.maxEvents > 1
+}
+
+// options returns the window in its wire representation
+func (w batchWindow) options() *models.BatchingOptions {
+	return &models.BatchingOptions{
+		MaxEvents:  w.maxEvents,
+		MaxBytes:   w.maxBytes,
+		MaxDelayMS: int(w.maxDelay / time.Millisecond),
+	}
+}
+
+// negotiateBatchWindow clamps the requested batching options to server limits
+func negotiateBatchWindow(opts *models.BatchingOptions) batchWindow {
+	if opts == nil || opts.MaxEvents <= 1 {
+		return batchWindow{}
+	}
+
+	w := batchWindow{
+		maxEvents: opts.MaxEvents,
+		maxBytes:  opts.MaxBytes,
+		maxDelay:  time.Duration(opts.MaxDelayMS) * time.Millisecond,
+	}
+	if w.maxEvents > maxBatchEvents {
+		w.maxEvents = maxBatchEvents
+	}
+	if w.maxBytes <= 0 || w.maxBytes > maxBatchBytes {
+		w.maxBytes = maxBatchBytes
+	}
+	if w.maxDelay < 0 {
+		w.maxDelay = 0
+	}
+	if w.maxDelay > maxBatchDelay {
+		w.maxDelay = maxBatchDelay
+	}
+	return w
+}
+
+// changeBatch accumulates change messages waiting to be written as one frame.
+// Messages are encoded once when added and the frame is built from those bytes.
+type changeBatch struct {
+	messages []*models.ServerMessage
+	encoded  [][]byte
+	bytes    int
+}
+
+// fits reports whether a message of size bytes can join the batch without
+// passing the byte limit. An empty batch takes any message, so a message
+// larger than the limit is sent on its own.
+func (b *changeBatch) fits(size int, w batchWindow) bool {
+	return len(b.messages) == 0 || b.bytes+size <= w.maxBytes
+}
+
+// add appends an encoded message to the batch and reports whether the window is full
+func (b *changeBatch) add(message *models.ServerMessage, data []byte, w batchWindow) bool {
+	b.messages = append(b.messages, message)
+	b.encoded = append(b.encoded, data)
+	b.bytes += len(data)
+	return len(b.messages) >= w.maxEvents || b.bytes >= w.maxBytes
+}
+
+// empty reports whether the batch holds no messages
+func (b *changeBatch) empty() bool {
+	return len(b.messages) == 0
+}
+
+// take returns the pending frame with its encoding and resets the batch. A
+// single message is sent as-is so clients that never see a full window get
+// plain change frames.
+func (b *changeBatch) take() (*models.ServerMessage, []byte) {
+	if len(b.messages) == 0 {
+		return nil, nil
+	}
+
+	frame, data := b.messages[0], b.encoded[0]
+	if len(b.messages) > 1 {
+		frame = &models.ServerMessage{
+			Type:     models.MessageTypeChanges,
+			Messages: b.messages,
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, b.bytes+len(b.messages)+64))
+		buf.WriteString(`{"type":"` + models.MessageTypeChanges + `","messages":[`)
+		for i, encoded := range b.encoded {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(encoded)
+		}
+		buf.WriteString(`]}`)
+		data = buf.Bytes()
+	}
+	b.messages = nil
+	b.encoded = nil
+	b.bytes = 0
+	return frame, data
+}
+
+// batchChange adds a change message to the batch. If the message would push
+// the batch past its byte limit, the batch is written first. It reports
+// whether the batch is full.
+func (c *Client) batchChange(l *link, batch *changeBatch, message *models.ServerMessage, window batchWindow) (bool, error) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		c.hub.logger.WithError(err).WithField("client_id", c.ID).Error("Failed to encode change message")
+		return false, nil
+	}
+	if !batch.fits(len(data), window) {
+		if err := c.writeBatch(l, batch); err != nil {
+			c.keepUnsent(message)
+			return false, err
+		}
+	}
+	return batch.add(message, data, window), nil
+}
+
+// writeBatch writes the pending batch, if any, as one frame
+func (c *Client) writeBatch(l *link, batch *changeBatch) error {
+	message, data := batch.take()
+	if message == nil {
+		return nil
+	}
+	return c.writeEncoded(l, message, data)
+}
+
+// batchWindow returns the client's current batching window
+func (c *Client) batchWindow() batchWindow {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.batching
+}
+
+// handleBatching negotiates the change batching window for the connection
+func (c *Client) handleBatching(message *models.ClientMessage) {
+	window := negotiateBatchWindow(message.Batching)
+
+	c.mu.Lock()
+	c.batching = window
+	c.mu.Unlock()
+
+	response := &models.ServerMessage{
+		Type:      models.MessageTypeBatching,
+		Success:   true,
+		RequestID: message.RequestID,
+		Data:      window.options(),
+	}
+
+	select {
+	case c.send <- response:
+	default:
+		c.hub.logger.Warn("Failed to send batching response")
+	}
+
+	c.hub.logger.WithFields(logrus.Fields{
+		"client_id":  c.ID,
+		"max_events": window.maxEvents,
+		"max_bytes":  window.maxBytes,
+		"max_delay":  window.maxDelay,
+	}).Info("Client negotiated change batching")
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestConnection starts an HTTP test server that upgrades a single
+// connection into a server-side Client and returns it with the dialed peer
+func newTestConnection(t *testing.T) (*Client, *websocket.Conn) {
+	t.Helper()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	ws := NewWebSocketServer("localhost:0", logger)
+
+	clientCh := make(chan *Client, 1)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		clientCh <- newClient(ws.hub, newLink(conn), defaultQueueSize)
+	}))
+	t.Cleanup(httpServer.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { peer.Close() })
+
+	return <-clientCh, peer
+}
+
+func TestNegotiateBatchWindow(t *testing.T) {
+	assert.False(t, negotiateBatchWindow(nil).enabled())
+	assert.False(t, negotiateBatchWindow(&models.BatchingOptions{MaxEvents: 1}).enabled())
+
+	w := negotiateBatchWindow(&models.BatchingOptions{MaxEvents: 50000, MaxBytes: 0, MaxDelayMS: 60000})
+	assert.True(t, w.enabled())
+	assert.Equal(t, maxBatchEvents, w.maxEvents)
+	assert.Equal(t, maxBatchBytes, w.maxBytes)
+	assert.Equal(t, maxBatchDelay, w.maxDelay)
+
+	w = negotiateBatchWindow(&models.BatchingOptions{MaxEvents: 10, MaxBytes: 2048, MaxDelayMS: 5})
+	assert.Equal(t, 10, w.maxEvents)
+	assert.Equal(t, 2048, w.maxBytes)
+	assert.Equal(t, 5*time.Millisecond, w.maxDelay)
+}
+
+func TestChangeBatch_Take(t *testing.T) {
+	window := batchWindow{maxEvents: 3, maxBytes: maxBatchBytes}
+	var batch changeBatch
+	add := func(message *models.ServerMessage) bool {
+		data, err := json.Marshal(message)
+		require.NoError(t, err)
+		return batch.add(message, data, window)
+	}
+
+	frame, data := batch.take()
+	assert.Nil(t, frame)
+	assert.Nil(t, data)
+
+	single := &models.ServerMessage{Type: models.MessageTypeChange}
+	assert.False(t, add(single))
+	frame, data = batch.take()
+	assert.Same(t, single, frame)
+	assert.JSONEq(t, `{"type":"change"}`, string(data))
+	assert.True(t, batch.empty())
+
+	assert.False(t, add(&models.ServerMessage{Type: models.MessageTypeChange, Change: &models.ChangeEvent{ID: "a"}}))
+	assert.False(t, add(&models.ServerMessage{Type: models.MessageTypeChange, Change: &models.ChangeEvent{ID: "b"}}))
+	assert.True(t, add(&models.ServerMessage{Type: models.MessageTypeChange, Change: &models.ChangeEvent{ID: "c"}}))
+
+	frame, data = batch.take()
+	assert.Equal(t, models.MessageTypeChanges, frame.Type)
+	assert.Len(t, frame.Messages, 3)
+
+	encoded, err := json.Marshal(frame)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(encoded), string(data))
+}
+
+func TestChangeBatch_Fits(t *testing.T) {
+	window := batchWindow{maxEvents: 10, maxBytes: 100}
+	var batch changeBatch
+
+	assert.True(t, batch.fits(500, window), "an empty batch takes a message over the limit")
+	batch.add(&models.ServerMessage{Type: models.MessageTypeChange}, make([]byte, 60), window)
+	assert.True(t, batch.fits(40, window))
+	assert.False(t, batch.fits(41, window))
+}
+
+func TestWritePump_BatchesChangesInOrder(t *testing.T) {
+	client, peer := newTestConnection(t)
+	client.batching = batchWindow{maxEvents: 100, maxBytes: maxBatchBytes, maxDelay: 50 * time.Millisecond}
+
+	for i := 0; i < 5; i++ {
+		client.send <- &models.ServerMessage{
+			Type:   models.MessageTypeChange,
+			Change: &models.ChangeEvent{ID: string(rune('a' + i))},
+		}
+	}
+	client.send <- &models.ServerMessage{Type: models.MessageTypePong}
+	go client.writePump(client.link)
+
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(2*time.Second)))
+
+	var frame models.ServerMessage
+	require.NoError(t, peer.ReadJSON(&frame))
+	require.Equal(t, models.MessageTypeChanges, frame.Type)
+	require.Len(t, frame.Messages, 5)
+	for i, message := range frame.Messages {
+		assert.Equal(t, string(rune('a'+i)), message.Change.ID)
+	}
+
+	var pong models.ServerMessage
+	require.NoError(t, peer.ReadJSON(&pong))
+	assert.Equal(t, models.MessageTypePong, pong.Type)
+}
+
+func TestWritePump_LargeChangeStartsNewFrame(t *testing.T) {
+	client, peer := newTestConnection(t)
+	client.batching = batchWindow{maxEvents: 100, maxBytes: 500, maxDelay: 50 * time.Millisecond}
+
+	change := func(id string, size int) *models.ServerMessage {
+		return &models.ServerMessage{
+			Type: models.MessageTypeChange,
+			Change: &models.ChangeEvent{
+				ID:           id,
+				FullDocument: map[string]interface{}{"payload": strings.Repeat("x", size)},
+			},
+		}
+	}
+	client.send <- change("a", 10)
+	client.send <- change("b", 10)
+	client.send <- change("big", 600)
+	client.send <- change("c", 10)
+	go client.writePump(client.link)
+
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(2*time.Second)))
+
+	var frames []models.ServerMessage
+	for len(frames) < 3 {
+		var frame models.ServerMessage
+		require.NoError(t, peer.ReadJSON(&frame))
+		frames = append(frames, frame)
+	}
+
+	require.Equal(t, models.MessageTypeChanges, frames[0].Type)
+	require.Len(t, frames[0].Messages, 2)
+	assert.Equal(t, "a", frames[0].Messages[0].Change.ID)
+	assert.Equal(t, "b", frames[0].Messages[1].Change.ID)
+
+	require.Equal(t, models.MessageTypeChange, frames[1].Type)
+	assert.Equal(t, "big", frames[1].Change.ID)
+
+	require.Equal(t, models.MessageTypeChange, frames[2].Type)
+	assert.Equal(t, "c", frames[2].Change.ID)
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"aktuell/pkg/models"
+)
+
+// Bounds for the conflation interval requested by clients
+const (
+	minConflateInterval = 10 * time.Millisecond
+	maxConflateInterval = time.Minute
+)
+
+// conflator keeps only the most recent change per document for a subscription
+// and flushes the merged events at a fixed interval
+type conflator struct {
+	interval time.Duration
+	flush    func(*models.ChangeEvent)
+	pending  map[string]*models.ChangeEvent
+	order    []string // Document keys in first-seen order
+	stopped  bool
+	stopCh   chan struct{}
+	mu       sync.Mutex
+}
+
+// conflateInterval validates the requested conflation options
+func conflateInterval(opts *models.ConflateOptions) (time.Duration, error) {
+	interval := time.Duration(opts.IntervalMS) * time.Millisecond
+	if interval < minConflateInterval || interval > maxConflateInterval {
+		return 0, fmt.Errorf("conflate interval_ms must be between %d and %d",
+			minConflateInterval.Milliseconds(), maxConflateInterval.Milliseconds())
+	}
+	return interval, nil
+}
+
+// newConflator creates a conflator and starts its flush loop. The flush
+// function is called for every merged event.
+func newConflator(interval time.Duration, flush func(*models.ChangeEvent)) *conflator {
+	cf := &conflator{
+		interval: interval,
+		flush:    flush,
+		pending:  make(map[string]*models.ChangeEvent),
+		stopCh:   make(chan struct{}),
+	}
+	go cf.run()
+	return cf
+}
+
+// add merges a change event into the pending set. Events without a document
+// key (drop, rename, invalidate) are flushed immediately after pending events.
+func (cf *conflator) add(change *models.ChangeEvent) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	if cf.stopped {
+		return
+	}
+
+	if len(change.DocumentKey) == 0 {
+		cf.flushLocked()
+		cf.flush(change)
+		return
+	}
+
+	key := documentKeyString(change.DocumentKey)
+	prev, exists := cf.pending[key]
+	if !exists {
+		cf.pending[key] = change
+		cf.order = append(cf.order, key)
+		return
+	}
+
+	merged, ok := mergeChangeEvents(prev, change)
+	if !ok {
+		// The two events cannot be expressed as one; emit the older one now
+		cf.flush(prev)
+		cf.pending[key] = change
+		return
+	}
+
+	if merged == nil {
+		// Insert followed by delete within the window cancels out
+		delete(cf.pending, key)
+		return
+	}
+	cf.pending[key] = merged
+}
+
+// run flushes pending events every interval until stopped
+func (cf *conflator) run() {
+	ticker := time.NewTicker(cf.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cf.stopCh:
+			return
+		case <-ticker.C:
+			cf.mu.Lock()
+			if !cf.stopped {
+				cf.flushLocked()
+			}
+			cf.mu.Unlock()
+		}
+	}
+}
+
+// flushLocked emits all pending events in first-seen order. Caller holds cf.mu.
+func (cf *conflator) flushLocked() {
+	for _, key := range cf.order {
+		if change, ok := cf.pending[key]; ok {
+			cf.flush(change)
+		}
+	}
+	cf.pending = make(map[string]*models.ChangeEvent)
+	cf.order = cf.order[:0]
+}
+
+// stop terminates the flush loop and discards pending events. Once stop
+// returns the flush function is never called again.
+func (cf *conflator) stop() {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	if cf.stopped {
+		return
+	}
+	cf.stopped = true
+	close(cf.stopCh)
+}
+
+// documentKeyString returns a stable string form of a document key
+func documentKeyString(key map[string]interface{}) string {
+	// encoding/json sorts map keys, which makes the output deterministic
+	data, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Sprintf("%v", key)
+	}
+	return string(data)
+}
+
+// mergeChangeEvents combines two consecutive events for the same document into
+// one that has the same effect for a client. It returns (nil, true) when the
+// events cancel out and (nil, false) when they cannot be merged.
+func mergeChangeEvents(prev, next *models.ChangeEvent) (*models.ChangeEvent, bool) {
+	switch next.OperationType {
+	case models.OperationDelete:
+		if prev.OperationType == models.OperationInsert {
+			return nil, true
+		}
+		return next, true
+
+	case models.OperationInsert, models.OperationReplace:
+		// The client only ever sees the final document state
+		merged := *next
+		merged.OperationType = models.OperationReplace
+		if prev.OperationType == models.OperationInsert {
+			merged.OperationType = models.OperationInsert
+		}
+		return &merged, true
+
+	case models.OperationUpdate:
+		switch prev.OperationType {
+		case models.OperationInsert, models.OperationReplace:
+			// The client has not seen the document state yet, so send it whole
+			if next.FullDocument == nil {
+				return nil, false
+			}
+			merged := *next
+			merged.OperationType = prev.OperationType
+			merged.UpdatedFields = nil
+			merged.RemovedFields = nil
+			return &merged, true
+
+		case models.OperationUpdate:
+			if updatesOverlap(prev, next) {
+				return fullDocumentReplace(next)
+			}
+			merged := *next
+			merged.UpdatedFields = make(map[string]interface{}, len(prev.UpdatedFields)+len(next.UpdatedFields))
+			for field, value := range prev.UpdatedFields {
+				merged.UpdatedFields[field] = value
+			}
+			for field, value := range next.UpdatedFields {
+				merged.UpdatedFields[field] = value
+			}
+			merged.RemovedFields = nil
+			for _, field := range prev.RemovedFields {
+				if _, reset := next.UpdatedFields[field]; !reset {
+					merged.RemovedFields = append(merged.RemovedFields, field)
+				}
+			}
+			for _, field := range next.RemovedFields {
+				delete(merged.UpdatedFields, field)
+				if !containsString(merged.RemovedFields, field) {
+					merged.RemovedFields = append(merged.RemovedFields, field)
+				}
+			}
+			return &merged, true
+		}
+	}
+
+	return nil, false
+}
+
+// fullDocumentReplace turns an update into a replace carrying the full document
+func fullDocumentReplace(change *models.ChangeEvent) (*models.ChangeEvent, bool) {
+	if change.FullDocument == nil {
+		return nil, false
+	}
+	merged := *change
+	merged.OperationType = models.OperationReplace
+	merged.UpdatedFields = nil
+	merged.RemovedFields = nil
+	return &merged, true
+}
+
+// updatesOverlap reports whether two updates touch nested paths of each other
+// (e.g. "a" and "a.b"), in which case merging the field maps is ambiguous
+func updatesOverlap(prev, next *models.ChangeEvent) bool {
+	prevPaths := updatePaths(prev)
+	for _, path := range updatePaths(next) {
+		for _, other := range prevPaths {
+			if path != other && (strings.HasPrefix(path, other+".") || strings.HasPrefix(other, path+".")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// updatePaths returns all field paths touched by an update event
+func updatePaths(change *models.ChangeEvent) []string {
+	paths := make([]string, 0, len(change.UpdatedFields)+len(change.RemovedFields))
+	for field := range change.UpdatedFields {
+		paths = append(paths, field)
+	}
+	return append(paths, change.RemovedFields...)
+}
+
+// containsString reports whether a slice contains the given string
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeChangeEvents(t *testing.T) {
+	key := map[string]interface{}{"_id": "doc-1"}
+
+	tests := []struct {
+		name       string
+		prev       *models.ChangeEvent
+		next       *models.ChangeEvent
+		wantOK     bool
+		wantNil    bool
+		wantOp     string
+		wantFields map[string]interface{}
+		wantRemove []string
+	}{
+		{
+			name:    "insert then delete cancels out",
+			prev:    &models.ChangeEvent{OperationType: models.OperationInsert, DocumentKey: key},
+			next:    &models.ChangeEvent{OperationType: models.OperationDelete, DocumentKey: key},
+			wantOK:  true,
+			wantNil: true,
+		},
+		{
+			name:   "update then delete becomes delete",
+			prev:   &models.ChangeEvent{OperationType: models.OperationUpdate, DocumentKey: key},
+			next:   &models.ChangeEvent{OperationType: models.OperationDelete, DocumentKey: key},
+			wantOK: true,
+			wantOp: models.OperationDelete,
+		},
+		{
+			name: "insert then update stays insert with latest document",
+			prev: &models.ChangeEvent{OperationType: models.OperationInsert, DocumentKey: key,
+				FullDocument: map[string]interface{}{"price": 1}},
+			next: &models.ChangeEvent{OperationType: models.OperationUpdate, DocumentKey: key,
+				UpdatedFields: map[string]interface{}{"price": 2},
+				FullDocument:  map[string]interface{}{"price": 2}},
+			wantOK: true,
+			wantOp: models.OperationInsert,
+		},
+		{
+			name:   "insert then update without full document is not mergeable",
+			prev:   &models.ChangeEvent{OperationType: models.OperationInsert, DocumentKey: key},
+			next:   &models.ChangeEvent{OperationType: models.OperationUpdate, DocumentKey: key},
+			wantOK: false,
+		},
+		{
+			name:   "delete then insert becomes replace",
+			prev:   &models.ChangeEvent{OperationType: models.OperationDelete, DocumentKey: key},
+			next:   &models.ChangeEvent{OperationType: models.OperationInsert, DocumentKey: key},
+			wantOK: true,
+			wantOp: models.OperationReplace,
+		},
+		{
+			name: "updates merge updated and removed fields",
+			prev: &models.ChangeEvent{OperationType: models.OperationUpdate, DocumentKey: key,
+				UpdatedFields: map[string]interface{}{"price": 1, "qty": 5},
+				RemovedFields: []string{"note", "tag"}},
+			next: &models.ChangeEvent{OperationType: models.OperationUpdate, DocumentKey: key,
+				UpdatedFields: map[string]interface{}{"price": 2, "tag": "new"},
+				RemovedFields: []string{"qty"}},
+			wantOK:     true,
+			wantOp:     models.OperationUpdate,
+			wantFields: map[string]interface{}{"price": 2, "tag": "new"},
+			wantRemove: []string{"note", "qty"},
+		},
+		{
+			name: "overlapping paths fall back to full document",
+			prev: &models.ChangeEvent{OperationType: models.OperationUpdate, DocumentKey: key,
+				UpdatedFields: map[string]interface{}{"address.city": "Berlin"}},
+			next: &models.ChangeEvent{OperationType: models.OperationUpdate, DocumentKey: key,
+				UpdatedFields: map[string]interface{}{"address": map[string]interface{}{"city": "Bonn"}},
+				FullDocument:  map[string]interface{}{"address": map[string]interface{}{"city": "Bonn"}}},
+			wantOK: true,
+			wantOp: models.OperationReplace,
+		},
+		{
+			name: "overlapping paths without full document are not mergeable",
+			prev: &models.ChangeEvent{OperationType: models.OperationUpdate, DocumentKey: key,
+				UpdatedFields: map[string]interface{}{"address.city": "Berlin"}},
+			next: &models.ChangeEvent{OperationType: models.OperationUpdate, DocumentKey: key,
+				RemovedFields: []string{"address"}},
+			wantOK: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, ok := mergeChangeEvents(tt.prev, tt.next)
+			assert.Equal(t, tt.wantOK, ok)
+			if !tt.wantOK {
+				return
+			}
+			if tt.wantNil {
+				assert.Nil(t, merged)
+				return
+			}
+			require.NotNil(t, merged)
+			assert.Equal(t, tt.wantOp, merged.OperationType)
+			if tt.wantFields != nil {
+				assert.Equal(t, tt.wantFields, merged.UpdatedFields)
+				assert.ElementsMatch(t, tt.wantRemove, merged.RemovedFields)
+			}
+		})
+	}
+}
+
+func TestConflator_KeepsLatestPerDocument(t *testing.T) {
+	var mu sync.Mutex
+	var flushed []*models.ChangeEvent
+
+	cf := newConflator(20*time.Millisecond, func(change *models.ChangeEvent) {
+		mu.Lock()
+		flushed = append(flushed, change)
+		mu.Unlock()
+	})
+	defer cf.stop()
+
+	for i := 1; i <= 5; i++ {
+		cf.add(&models.ChangeEvent{
+			ID:            "a",
+			OperationType: models.OperationUpdate,
+			DocumentKey:   map[string]interface{}{"_id": "a"},
+			UpdatedFields: map[string]interface{}{"price": i},
+		})
+	}
+	cf.add(&models.ChangeEvent{
+		OperationType: models.OperationUpdate,
+		DocumentKey:   map[string]interface{}{"_id": "b"},
+		UpdatedFields: map[string]interface{}{"price": 10},
+	})
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(flushed) == 2
+	}, time.Second, 5*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]interface{}{"price": 5}, flushed[0].UpdatedFields)
+	assert.Equal(t, map[string]interface{}{"price": 10}, flushed[1].UpdatedFields)
+}
+
+func TestConflator_StopDiscardsPending(t *testing.T) {
+	calls := 0
+	cf := newConflator(time.Hour, func(*models.ChangeEvent) { calls++ })
+
+	cf.add(&models.ChangeEvent{OperationType: models.OperationInsert, DocumentKey: map[string]interface{}{"_id": 1}})
+	cf.stop()
+	cf.add(&models.ChangeEvent{OperationType: models.OperationInsert, DocumentKey: map[string]interface{}{"_id": 2}})
+
+	assert.Equal(t, 0, calls)
+}
+
+func TestConflateInterval(t *testing.T) {
+	_, err := conflateInterval(&models.ConflateOptions{IntervalMS: 0})
+	assert.Error(t, err)
+
+	_, err = conflateInterval(&models.ConflateOptions{IntervalMS: 120000})
+	assert.Error(t, err)
+
+	interval, err := conflateInterval(&models.ConflateOptions{IntervalMS: 250})
+	assert.NoError(t, err)
+	assert.Equal(t, 250*time.Millisecond, interval)
+}
+
+func TestConflator_FullQueueDisconnectsClient(t *testing.T) {
+	client, _ := newTestConnection(t)
+	hub := client.hub
+	hub.mu.Lock()
+	hub.clients[client] = true
+	hub.mu.Unlock()
+
+	client.addSubscription(&models.Subscription{ID: "sub-1", Database: "db", Collection: "c"}, minConflateInterval, nil)
+	for len(client.send) < cap(client.send) {
+		client.send <- &models.ServerMessage{Type: models.MessageTypePong}
+	}
+
+	client.routeChange(&models.ChangeEvent{
+		OperationType: models.OperationInsert,
+		Database:      "db",
+		Collection:    "c",
+		DocumentKey:   map[string]interface{}{"_id": 1},
+	})
+
+	require.Eventually(t, func() bool {
+		hub.mu.RLock()
+		defer hub.mu.RUnlock()
+		return !hub.clients[client]
+	}, time.Second, 5*time.Millisecond)
+	assert.True(t, client.slow.Load())
+}
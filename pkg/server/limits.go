@@ -0,0 +1,252 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults of LimitOptions
+const (
+	defaultMaxMessageSize  = 64 * 1024
+	defaultViolationWindow = time.Minute
+)
+
+// Limits reported in the "limit" field of limit errors
+const (
+	limitMessages         = "messages"
+	limitIdentityMessages = "identity_messages"
+	limitAPIKey           = "api_key"
+	limitSubscriptions    = "subscriptions"
+	limitSnapshots        = "snapshots"
+)
+
+// LimitOptions bounds the load a single connection or identity can put on
+// the server. Zero values disable a limit.
+type LimitOptions struct {
+	MessageRate          float64       `mapstructure:"message_rate"`           // Inbound messages per second per connection
+	MessageBurst         int           `mapstructure:"message_burst"`          // Defaults to one second's worth
+	IdentityMessageRate  float64       `mapstructure:"identity_message_rate"`  // Inbound messages per second over all connections of an authenticated identity
+	IdentityMessageBurst int           `mapstructure:"identity_message_burst"` // Defaults to one second's worth
+	MaxSubscriptions     int           `mapstructure:"max_subscriptions"`      // Subscriptions per connection
+	MaxSnapshots         int           `mapstructure:"max_snapshots"`          // Snapshots streaming at the same time per connection
+	MaxMessageSize       int64         `mapstructure:"max_message_size"`       // Largest inbound message in bytes (default 64 KiB)
+	MaxViolations        int           `mapstructure:"max_violations"`         // Violations within ViolationWindow that close the connection
+	ViolationWindow      time.Duration `mapstructure:"violation_window"`       // Default 1m
+}
+
+// SetLimitOptions configures connection limits. It must be called before
+// Start.
+func (ws *WebSocketServer) SetLimitOptions(opts LimitOptions) error {
+	if opts.MessageRate < 0 || opts.MessageBurst < 0 || opts.IdentityMessageRate < 0 || opts.IdentityMessageBurst < 0 ||
+		opts.MaxSubscriptions < 0 || opts.MaxSnapshots < 0 || opts.MaxMessageSize < 0 || opts.MaxViolations < 0 || opts.ViolationWindow < 0 {
+		return errors.New("limits must not be negative")
+	}
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = defaultMaxMessageSize
+	}
+	if opts.ViolationWindow == 0 {
+		opts.ViolationWindow = defaultViolationWindow
+	}
+	ws.limits = opts
+	return nil
+}
+
+// limitOptions returns the configured limits
+func (h *Hub) limitOptions() LimitOptions {
+	if h.wsServer == nil {
+		return LimitOptions{MaxMessageSize: defaultMaxMessageSize, ViolationWindow: defaultViolationWindow}
+	}
+	return h.wsServer.limits
+}
+
+// identityLimit is the message rate shared by the connections of an identity
+type identityLimit struct {
+	bucket  *tokenBucket
+	clients int
+}
+
+// clientLimits tracks a client's use of its limits
+type clientLimits struct {
+	opts      LimitOptions
+	messages  *tokenBucket // nil without a per-connection rate
+	identity  string       // Key of the identity's limit in the hub; empty without one
+	shared    *tokenBucket
+	snapshots atomic.Int32
+
+	mu          sync.Mutex
+	violations  int
+	windowStart time.Time
+	terminated  bool
+}
+
+// newClientLimits creates the limits of a new connection
+func newClientLimits(opts LimitOptions) *clientLimits {
+	l := &clientLimits{opts: opts}
+	if opts.MessageRate > 0 {
+		l.messages = newTokenBucket(models.RateLimit{PerSecond: opts.MessageRate, Burst: opts.MessageBurst})
+	}
+	return l
+}
+
+// identityKey names the identity of a principal across connections
+func identityKey(principal *models.Principal) string {
+	if principal == nil {
+		return ""
+	}
+	return principal.Method + ":" + principal.Subject
+}
+
+// acquireIdentityLimit shares the message rate of the client's identity
+// with its other connections. Anonymous clients have only the per-connection
+// limit.
+func (h *Hub) acquireIdentityLimit(c *Client, principal *models.Principal) {
+	opts := c.limits.opts
+	key := identityKey(principal)
+	if opts.IdentityMessageRate <= 0 || key == "" {
+		return
+	}
+
+	h.usageMu.Lock()
+	defer h.usageMu.Unlock()
+
+	limit, ok := h.identities[key]
+	if !ok {
+		limit = &identityLimit{bucket: newTokenBucket(models.RateLimit{PerSecond: opts.IdentityMessageRate, Burst: opts.IdentityMessageBurst})}
+		h.identities[key] = limit
+	}
+	limit.clients++
+	c.limits.identity = key
+	c.limits.shared = limit.bucket
+}
+
+// releaseIdentityLimit drops the client's share of its identity's limit
+func (h *Hub) releaseIdentityLimit(c *Client) {
+	if c.limits.identity == "" {
+		return
+	}
+
+	h.usageMu.Lock()
+	defer h.usageMu.Unlock()
+
+	if limit, ok := h.identities[c.limits.identity]; ok {
+		if limit.clients--; limit.clients <= 0 {
+			delete(h.identities, c.limits.identity)
+		}
+	}
+}
+
+// allowed reports whether a bucket, if any, has a token
+func allowed(bucket *tokenBucket) bool {
+	return bucket == nil || bucket.allow()
+}
+
+// allowSubscription checks the subscription limits before a subscription is
+// created. On success the caller owns a snapshot slot if one was requested
+// and must return it with releaseSnapshot.
+func (c *Client) allowSubscription(message *models.ClientMessage) bool {
+	opts := c.limits.opts
+	if opts.MaxSubscriptions > 0 {
+		c.mu.RLock()
+		count := len(c.subscriptions)
+		c.mu.RUnlock()
+		if count >= opts.MaxSubscriptions {
+			c.limitExceeded(message.RequestID, models.ErrorCodeSubscriptionLimit, limitSubscriptions,
+				fmt.Sprintf("Subscription limit exceeded: at most %d subscriptions per connection", opts.MaxSubscriptions))
+			return false
+		}
+	}
+
+	snapshot := message.SnapshotOptions != nil && message.SnapshotOptions.IncludeSnapshot
+	if snapshot && opts.MaxSnapshots > 0 {
+		if c.limits.snapshots.Add(1) > int32(opts.MaxSnapshots) {
+			c.limits.snapshots.Add(-1)
+			c.limitExceeded(message.RequestID, models.ErrorCodeSnapshotLimit, limitSnapshots,
+				fmt.Sprintf("Snapshot limit exceeded: at most %d snapshots at a time", opts.MaxSnapshots))
+			return false
+		}
+	}
+	return true
+}
+
+// releaseSnapshot returns a snapshot slot taken by allowSubscription
+func (c *Client) releaseSnapshot() {
+	if c.limits.opts.MaxSnapshots > 0 {
+		c.limits.snapshots.Add(-1)
+	}
+}
+
+// limitExceeded reports a violated limit to the client and counts it
+func (c *Client) limitExceeded(requestID string, code int, limit, errMsg string) {
+	c.hub.logger.WithFields(logrus.Fields{
+		"client_id": c.ID,
+		"limit":     limit,
+	}).Warn("Client exceeded a limit")
+
+	response := &models.ServerMessage{
+		Type:      models.MessageTypeError,
+		Success:   false,
+		Error:     errMsg,
+		RequestID: requestID,
+		ErrorCode: code,
+		Data:      map[string]interface{}{"limit": limit},
+	}
+	select {
+	case c.send <- response:
+	default:
+		c.hub.logger.Warn("Failed to send limit error response")
+	}
+	c.countViolation()
+}
+
+// countViolation closes the connection and drops its session once the
+// client violated its limits MaxViolations times within the window. The
+// connection stops handling requests right away.
+func (c *Client) countViolation() {
+	opts := c.limits.opts
+	if opts.MaxViolations <= 0 {
+		return
+	}
+
+	l := c.limits
+	l.mu.Lock()
+	now := time.Now()
+	if now.Sub(l.windowStart) > opts.ViolationWindow {
+		l.violations, l.windowStart = 0, now
+	}
+	l.violations++
+	terminate := l.violations >= opts.MaxViolations && !l.terminated
+	if terminate {
+		l.terminated = true
+	}
+	l.mu.Unlock()
+	if !terminate {
+		return
+	}
+
+	c.mu.RLock()
+	link := c.link
+	c.mu.RUnlock()
+	if link == nil {
+		return
+	}
+
+	c.hub.logger.WithFields(logrus.Fields{
+		"client_id":  c.ID,
+		"violations": opts.MaxViolations,
+	}).Warn("Closing connection after repeated limit violations")
+	link.end(errorMessage("", models.ErrorCodeTooManyViolations, "Too many limit violations"))
+}
+
+// isTerminated reports whether the connection was closed for violations
+func (l *clientLimits) isTerminated() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.terminated
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newLimitServer starts a server with connection limits
+func newLimitServer(t *testing.T, grace time.Duration, opts LimitOptions) (*WebSocketServer, string) {
+	t.Helper()
+
+	ws, url := newSessionServer(t, grace)
+	require.NoError(t, ws.SetLimitOptions(opts))
+	return ws, url
+}
+
+// limit returns the limit named by a limit error
+func limit(response *models.ServerMessage) interface{} {
+	data, _ := response.Data.(map[string]interface{})
+	return data["limit"]
+}
+
+// ping sends a ping and returns the response
+func ping(t *testing.T, conn *websocket.Conn) *models.ServerMessage {
+	t.Helper()
+
+	require.NoError(t, conn.WriteJSON(&models.ClientMessage{Type: models.MessageTypePing, RequestID: "ping"}))
+	return readMessage(t, conn)
+}
+
+// subscribeTo subscribes to a collection, optionally with a snapshot
+func subscribeTo(t *testing.T, conn *websocket.Conn, collection string, snapshot bool) *models.ServerMessage {
+	t.Helper()
+
+	message := &models.ClientMessage{Type: models.MessageTypeSubscribe, RequestID: collection, Database: "db", Collection: collection}
+	if snapshot {
+		message.SnapshotOptions = &models.SnapshotOptions{IncludeSnapshot: true}
+	}
+	require.NoError(t, conn.WriteJSON(message))
+	return readMessage(t, conn)
+}
+
+func TestLimits_MessageRate(t *testing.T) {
+	_, url := newLimitServer(t, 0, LimitOptions{MessageRate: 0.1, MessageBurst: 2})
+	conn, _ := dialSession(t, url, "")
+
+	assert.Equal(t, models.MessageTypePong, ping(t, conn).Type)
+	assert.Equal(t, models.MessageTypePong, ping(t, conn).Type)
+	limited := ping(t, conn)
+	assert.Equal(t, models.ErrorCodeRateLimited, limited.ErrorCode)
+	assert.Equal(t, limitMessages, limit(limited))
+	assert.Equal(t, "ping", limited.RequestID)
+
+	// Other connections have their own budget
+	other, _ := dialSession(t, url, "")
+	assert.Equal(t, models.MessageTypePong, ping(t, other).Type)
+}
+
+func TestLimits_IdentityRateIsSharedByConnections(t *testing.T) {
+	ws, url := newAuthServer(t, 0)
+	require.NoError(t, ws.SetLimitOptions(LimitOptions{IdentityMessageRate: 0.1, IdentityMessageBurst: 2}))
+	alice := signToken(t, map[string]interface{}{"sub": "alice"})
+
+	first, _, err := dialToken(t, url, alice, "")
+	require.NoError(t, err)
+	second, _, err := dialToken(t, url, alice, "")
+	require.NoError(t, err)
+	assert.Equal(t, models.MessageTypePong, ping(t, first).Type)
+	assert.Equal(t, models.MessageTypePong, ping(t, second).Type)
+	limited := ping(t, first)
+	assert.Equal(t, models.ErrorCodeRateLimited, limited.ErrorCode)
+	assert.Equal(t, limitIdentityMessages, limit(limited))
+
+	bob, _, err := dialToken(t, url, signToken(t, map[string]interface{}{"sub": "bob"}), "")
+	require.NoError(t, err)
+	assert.Equal(t, models.MessageTypePong, ping(t, bob).Type)
+
+	// The shared limit goes away with the identity's last connection
+	first.Close()
+	second.Close()
+	bob.Close()
+	require.Eventually(t, func() bool {
+		ws.hub.usageMu.Lock()
+		defer ws.hub.usageMu.Unlock()
+		return len(ws.hub.identities) == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestLimits_MaxSubscriptions(t *testing.T) {
+	_, url := newLimitServer(t, 0, LimitOptions{MaxSubscriptions: 2})
+	conn, _ := dialSession(t, url, "")
+
+	first := subscribeTo(t, conn, "a", false)
+	require.True(t, first.Success)
+	require.True(t, subscribeTo(t, conn, "b", false).Success)
+	denied := subscribeTo(t, conn, "c", false)
+	assert.Equal(t, models.ErrorCodeSubscriptionLimit, denied.ErrorCode)
+	assert.Equal(t, limitSubscriptions, limit(denied))
+	assert.Equal(t, "c", denied.RequestID)
+
+	// Unsubscribing frees a slot
+	id := first.Data.(map[string]interface{})["subscription_id"].(string)
+	require.NoError(t, conn.WriteJSON(&models.ClientMessage{Type: models.MessageTypeUnsubscribe, SubscriptionID: id}))
+	readMessage(t, conn)
+	assert.True(t, subscribeTo(t, conn, "c", false).Success)
+}
+
+func TestLimits_MaxSnapshots(t *testing.T) {
+	ws, url := newLimitServer(t, 0, LimitOptions{MaxSnapshots: 1})
+	release := make(chan struct{})
+	ws.SetSnapshotStreamer(snapshotStreamerFunc(func(database, collection string, snapOpts *models.SnapshotOptions, callback func([]map[string]interface{}, int, int, error)) {
+		<-release
+		callback(nil, 1, 0, nil)
+	}))
+	conn, _ := dialSession(t, url, "")
+
+	require.True(t, subscribeTo(t, conn, "a", true).Success)
+	assert.Equal(t, models.MessageTypeSnapshotStart, readMessage(t, conn).Type)
+
+	denied := subscribeTo(t, conn, "b", true)
+	assert.Equal(t, models.ErrorCodeSnapshotLimit, denied.ErrorCode)
+	assert.Equal(t, limitSnapshots, limit(denied))
+	assert.True(t, subscribeTo(t, conn, "c", false).Success, "subscriptions without snapshot are not limited")
+
+	close(release)
+	assert.Equal(t, models.MessageTypeSnapshotEnd, readMessage(t, conn).Type)
+	assert.True(t, subscribeTo(t, conn, "b", true).Success)
+}
+
+func TestLimits_MaxMessageSize(t *testing.T) {
+	_, url := newLimitServer(t, 0, LimitOptions{MaxMessageSize: 1024})
+	conn, _ := dialSession(t, url, "")
+
+	require.NoError(t, conn.WriteJSON(&models.ClientMessage{Type: models.MessageTypePing, RequestID: strings.Repeat("x", 2048)}))
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "got %v", err)
+}
+
+func TestLimits_RepeatedViolationsCloseConnection(t *testing.T) {
+	ws, url := newLimitServer(t, time.Minute, LimitOptions{MessageRate: 0.1, MessageBurst: 1, MaxViolations: 2})
+	conn, _ := dialSession(t, url, "")
+	readMessage(t, conn) // Session message
+
+	assert.Equal(t, models.MessageTypePong, ping(t, conn).Type)
+	assert.Equal(t, models.ErrorCodeRateLimited, ping(t, conn).ErrorCode)
+
+	// The closing error overtakes queued responses
+	require.NoError(t, conn.WriteJSON(&models.ClientMessage{Type: models.MessageTypePing, RequestID: "ping"}))
+	closing := readMessage(t, conn)
+	if closing.ErrorCode == models.ErrorCodeRateLimited {
+		closing = readMessage(t, conn)
+	}
+	assert.Equal(t, models.ErrorCodeTooManyViolations, closing.ErrorCode)
+
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "got %v", err)
+
+	// The session is not kept for a reconnect
+	require.Eventually(t, func() bool {
+		ws.hub.mu.RLock()
+		defer ws.hub.mu.RUnlock()
+		return len(ws.hub.clients) == 0 && len(ws.hub.sessions) == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestLimits_TerminationClosesWithFullQueue(t *testing.T) {
+	client, peer := newTestConnection(t)
+	client.limits = newClientLimits(LimitOptions{MaxViolations: 1, ViolationWindow: time.Minute})
+	for len(client.send) < cap(client.send) {
+		client.send <- &models.ServerMessage{Type: models.MessageTypePong}
+	}
+
+	client.countViolation()
+	assert.True(t, client.link.ending.Load())
+	go client.writePump(client.link)
+
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(3*time.Second)))
+	closing := readMessage(t, peer)
+	assert.Equal(t, models.ErrorCodeTooManyViolations, closing.ErrorCode)
+	_, _, err := peer.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "got %v", err)
+}
+
+func TestLimits_Validation(t *testing.T) {
+	ws := NewWebSocketServer("localhost:0", nil)
+	assert.Error(t, ws.SetLimitOptions(LimitOptions{MaxSubscriptions: -1}))
+	require.NoError(t, ws.SetLimitOptions(LimitOptions{}))
+	assert.Equal(t, int64(defaultMaxMessageSize), ws.limits.MaxMessageSize)
+	assert.Equal(t, defaultViolationWindow, ws.limits.ViolationWindow)
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultCORSMaxAge is how long browsers may cache a preflight response
+const defaultCORSMaxAge = 10 * time.Minute
+
+// OriginOptions configures which browser origins may open WebSockets and
+// read HTTP endpoints. Requests from the server's own origin are always
+// allowed.
+type OriginOptions struct {
+	// Allowed origins: "https://app.example.com", "https://*.example.com" for
+	// any subdomain, "*.example.com" for any scheme, or "*" for all
+	Allowed        []string      `mapstructure:"allowed"`
+	AllowedSchemes []string      `mapstructure:"allowed_schemes"` // Schemes origins may use, e.g. ["https"] (all if empty)
+	AllowLocalhost bool          `mapstructure:"allow_localhost"` // Allow localhost and loopback addresses on any port
+	RequireOrigin  bool          `mapstructure:"require_origin"`  // Reject requests without an Origin header, i.e. non-browser clients
+	CORSMaxAge     time.Duration `mapstructure:"cors_max_age"`    // How long browsers cache preflight responses (default 10m)
+}
+
+// originPattern is a parsed entry of OriginOptions.Allowed
+type originPattern struct {
+	scheme    string // Empty for any scheme
+	host      string // Without the "*." of wildcard patterns
+	port      string // Empty for the default port of the origin's scheme
+	subdomain bool   // Matches subdomains of host, not host itself
+}
+
+// originPolicy decides whether an origin is allowed
+type originPolicy struct {
+	any       bool
+	patterns  []originPattern
+	schemes   map[string]bool
+	localhost bool
+	require   bool
+	maxAge    string
+}
+
+// newOriginPolicy validates the options
+func newOriginPolicy(opts OriginOptions) (*originPolicy, error) {
+	p := &originPolicy{localhost: opts.AllowLocalhost, require: opts.RequireOrigin}
+
+	maxAge := opts.CORSMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultCORSMaxAge
+	}
+	p.maxAge = strconv.Itoa(int(maxAge.Seconds()))
+
+	if len(opts.AllowedSchemes) > 0 {
+		p.schemes = make(map[string]bool, len(opts.AllowedSchemes))
+		for _, scheme := range opts.AllowedSchemes {
+			p.schemes[strings.ToLower(strings.TrimSpace(scheme))] = true
+		}
+	}
+
+	for _, allowed := range opts.Allowed {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "" {
+			continue
+		}
+		if allowed == "*" {
+			p.any = true
+			continue
+		}
+		pattern, err := parseOriginPattern(allowed)
+		if err != nil {
+			return nil, err
+		}
+		p.patterns = append(p.patterns, pattern)
+	}
+	return p, nil
+}
+
+// parseOriginPattern parses "[scheme://][*.]host[:port]"
+func parseOriginPattern(allowed string) (originPattern, error) {
+	var pattern originPattern
+	rest := allowed
+	if scheme, host, ok := strings.Cut(allowed, "://"); ok {
+		pattern.scheme, rest = scheme, host
+	}
+	if pattern.scheme == "*" {
+		pattern.scheme = ""
+	}
+	if host, ok := strings.CutPrefix(rest, "*."); ok {
+		pattern.subdomain, rest = true, host
+	}
+
+	u, err := url.Parse("x://" + rest)
+	if err != nil || u.Hostname() == "" || u.Path != "" || u.User != nil || strings.Contains(u.Hostname(), "*") {
+		return originPattern{}, fmt.Errorf("invalid allowed origin %q", allowed)
+	}
+	pattern.host, pattern.port = u.Hostname(), u.Port()
+	return pattern, nil
+}
+
+// matches reports whether the pattern covers an origin
+func (p originPattern) matches(origin *url.URL) bool {
+	if p.scheme != "" && p.scheme != origin.Scheme {
+		return false
+	}
+	if effectivePort(p.port, origin.Scheme) != effectivePort(origin.Port(), origin.Scheme) {
+		return false
+	}
+	host := origin.Hostname()
+	if p.subdomain {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+	return host == p.host
+}
+
+// effectivePort returns port, or the default port of scheme if it is empty,
+// so that https://host and https://host:443 are the same origin
+func effectivePort(port, scheme string) string {
+	if port != "" {
+		return port
+	}
+	switch scheme {
+	case "https", "wss":
+		return "443"
+	case "http", "ws":
+		return "80"
+	}
+	return ""
+}
+
+// allows reports whether a request's origin is allowed and the reason if not
+func (p *originPolicy) allows(r *http.Request) (bool, string) {
+	header := r.Header.Get("Origin")
+	if header == "" {
+		if p.require {
+			return false, "missing origin"
+		}
+		return true, ""
+	}
+
+	origin, err := url.Parse(strings.ToLower(header))
+	if err != nil || origin.Scheme == "" || origin.Host == "" {
+		return false, "malformed origin"
+	}
+	if p.schemes != nil && !p.schemes[origin.Scheme] {
+		return false, "scheme not allowed"
+	}
+	if p.any || strings.EqualFold(origin.Host, r.Host) {
+		return true, ""
+	}
+	if p.localhost && isLoopback(origin.Hostname()) {
+		return true, ""
+	}
+	for _, pattern := range p.patterns {
+		if pattern.matches(origin) {
+			return true, ""
+		}
+	}
+	return false, "origin not allowed"
+}
+
+// isLoopback reports whether a host names the local machine
+func isLoopback(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// SetOriginOptions replaces the origin policy. It must be called before
+// Start.
+func (ws *WebSocketServer) SetOriginOptions(opts OriginOptions) error {
+	policy, err := newOriginPolicy(opts)
+	if err != nil {
+		return err
+	}
+	ws.origins = policy
+	return nil
+}
+
+// checkOrigin implements websocket.Upgrader.CheckOrigin
+func (ws *WebSocketServer) checkOrigin(r *http.Request) bool {
+	allowed, reason := ws.origins.allows(r)
+	if !allowed {
+		ws.logger.WithFields(logrus.Fields{
+			"origin": r.Header.Get("Origin"),
+			"remote": r.RemoteAddr,
+			"reason": reason,
+		}).Warn("WebSocket connection rejected")
+	}
+	return allowed
+}
+
+// cors adds CORS headers for allowed origins to an HTTP endpoint and answers
+// preflight requests
+func (ws *WebSocketServer) cors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed, reason := ws.origins.allows(r)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !allowed {
+			ws.logger.WithFields(logrus.Fields{
+				"origin": origin,
+				"path":   r.URL.Path,
+				"reason": reason,
+			}).Debug("Cross-origin request without CORS headers")
+			if preflight {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if !preflight {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			// Credentials travel in headers, e.g. Authorization and X-API-Key
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", ws.origins.maxAge)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
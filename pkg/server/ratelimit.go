@@ -0,0 +1,56 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"aktuell/pkg/models"
+)
+
+// tokenBucket allows events at a steady rate with bursts up to its capacity
+type tokenBucket struct {
+	mu     sync.Mutex
+	limit  models.RateLimit
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket for a rate
+func newTokenBucket(limit models.RateLimit) *tokenBucket {
+	b := &tokenBucket{last: time.Now()}
+	b.setLimit(limit)
+	b.tokens = b.burst
+	return b
+}
+
+// setLimit changes the rate, keeping the tokens collected so far
+func (b *tokenBucket) setLimit(limit models.RateLimit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.limit = limit
+	b.rate = limit.PerSecond
+	b.burst = float64(limit.Burst)
+	if b.burst <= 0 {
+		b.burst = math.Max(1, math.Ceil(limit.PerSecond))
+	}
+	b.tokens = math.Min(b.tokens, b.burst)
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
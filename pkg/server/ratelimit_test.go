@@ -0,0 +1,32 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(models.RateLimit{PerSecond: 20, Burst: 3})
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.allow(), "burst %d", i)
+	}
+	assert.False(t, b.allow())
+
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, b.allow(), "refilled at 20/s")
+	assert.False(t, b.allow())
+
+	// Without a burst one second's worth is allowed
+	b = newTokenBucket(models.RateLimit{PerSecond: 2})
+	assert.True(t, b.allow())
+	assert.True(t, b.allow())
+	assert.False(t, b.allow())
+
+	b.setLimit(models.RateLimit{PerSecond: 1000, Burst: 1})
+	time.Sleep(5 * time.Millisecond)
+	assert.True(t, b.allow())
+}
@@ -0,0 +1,627 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrResumeWindowExceeded is returned when a resume point is older than the
+// retained replay log; the client has to take a fresh snapshot instead
+var ErrResumeWindowExceeded = errors.New("resume window exceeded, resnapshot required")
+
+// ReplayOptions configures the replay log kept for resuming subscriptions
+type ReplayOptions struct {
+	MaxEvents     int           // Events kept in memory per database (0 disables replay)
+	MaxAge        time.Duration // Events older than this are discarded (0 keeps them until evicted)
+	SpillDir      string        // Directory for events evicted from memory (empty disables spilling)
+	MaxSpillBytes int64         // Upper bound for spilled data per database
+}
+
+// replayEntry is a change event retained in the replay log
+type replayEntry struct {
+	Seq   uint64              `json:"seq"` // Position in the database's log
+	At    time.Time           `json:"at"`
+	Event *models.ChangeEvent `json:"event"`
+}
+
+// replayBuffer keeps a bounded log of recent change events per database
+type replayBuffer struct {
+	opts    ReplayOptions
+	logger  *logrus.Logger
+	started primitive.Timestamp
+	logs    map[string]*replayLog
+	mu      sync.Mutex
+}
+
+// replayLog is the retained event history of a single database
+type replayLog struct {
+	entries []replayEntry
+	// horizon is the cluster time up to which events may have been lost;
+	// every event after it is still retained
+	horizon primitive.Timestamp
+	spill   *spillFile
+	seq     uint64 // Sequence number of the last appended entry
+	// enqueued is the sequence number of the last entry handed to the spill
+	// writer
+	enqueued uint64
+}
+
+// newReplayBuffer creates a replay buffer with the given limits
+func newReplayBuffer(opts ReplayOptions, logger *logrus.Logger) (*replayBuffer, error) {
+	if opts.SpillDir != "" {
+		if err := os.MkdirAll(opts.SpillDir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create replay spill directory: %w", err)
+		}
+		if opts.MaxSpillBytes <= 0 {
+			opts.MaxSpillBytes = 64 << 20
+		}
+	}
+
+	return &replayBuffer{
+		opts:    opts,
+		logger:  logger,
+		started: primitive.Timestamp{T: uint32(time.Now().Unix())},
+		logs:    make(map[string]*replayLog),
+	}, nil
+}
+
+// append records a change event. Events beyond the memory limit are spilled
+// to disk if configured, otherwise dropped.
+func (rb *replayBuffer) append(change *models.ChangeEvent) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	log, ok := rb.logs[change.Database]
+	if !ok {
+		log = &replayLog{horizon: rb.started}
+		if rb.opts.SpillDir != "" {
+			log.spill = newSpillFile(rb.opts.SpillDir, change.Database, rb.opts.MaxSpillBytes, rb.logger)
+		}
+		rb.logs[change.Database] = log
+	}
+
+	now := time.Now()
+	log.seq++
+	log.entries = append(log.entries, replayEntry{Seq: log.seq, At: now, Event: change})
+
+	// Drop events that are too old to be useful for resuming
+	if rb.opts.MaxAge > 0 {
+		expired := 0
+		for expired < len(log.entries) && now.Sub(log.entries[expired].At) > rb.opts.MaxAge {
+			expired++
+		}
+		if expired > 0 {
+			log.advanceHorizon(log.entries[:expired])
+			log.entries = log.entries[expired:]
+		}
+	}
+
+	// Move events beyond the memory limit to disk, or forget them. The spill
+	// writer does the I/O so that broadcasting never waits for the disk.
+	if overflow := len(log.entries) - rb.opts.MaxEvents; overflow > 0 {
+		evicted := log.entries[:overflow:overflow]
+		switch {
+		case log.spill == nil:
+			log.advanceHorizon(evicted)
+		case log.spill.enqueue(evicted):
+			log.enqueued = evicted[len(evicted)-1].Seq
+		default:
+			rb.logger.WithField("database", change.Database).Warn("Replay spill writer is behind, dropping events")
+			log.spill.lost(evicted)
+		}
+		log.entries = log.entries[overflow:]
+	}
+}
+
+// spills reports whether evicted events are kept on disk
+func (rb *replayBuffer) spills() bool {
+	return rb.opts.SpillDir != ""
+}
+
+// readSpill reads the spilled events of a database. It does not hold the
+// buffer's lock during I/O, so the hub can keep broadcasting meanwhile.
+func (rb *replayBuffer) readSpill(database string) (*spillRead, error) {
+	rb.mu.Lock()
+	log, ok := rb.logs[database]
+	if !ok || log.spill == nil {
+		rb.mu.Unlock()
+		return &spillRead{}, nil
+	}
+	spill, through := log.spill, log.enqueued
+	rb.mu.Unlock()
+
+	return spill.read(rb.opts.MaxAge, through)
+}
+
+// advanceHorizon moves the loss horizon past the given discarded entries
+func (l *replayLog) advanceHorizon(discarded []replayEntry) {
+	for _, entry := range discarded {
+		if timestampAfter(entry.Event.Timestamp, l.horizon) {
+			l.horizon = entry.Event.Timestamp
+		}
+	}
+}
+
+// errSpillOutdated means events were spilled after a spill read, which has to
+// be repeated
+var errSpillOutdated = errors.New("spilled replay events changed during read")
+
+// since returns the events of a subscription's namespace that follow the
+// resume point, oldest first. With spilling, spilled must come from readSpill;
+// errSpillOutdated asks for a new read.
+func (rb *replayBuffer) since(sub *models.Subscription, from *models.ResumeOptions, spilled *spillRead) ([]*models.ChangeEvent, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	log, ok := rb.logs[sub.Database]
+	if !ok {
+		// Nothing recorded yet; only safe if the client was caught up when we started
+		if from.ClusterTime != nil && !timestampBefore(*from.ClusterTime, rb.started) {
+			return nil, nil
+		}
+		return nil, ErrResumeWindowExceeded
+	}
+
+	entries := log.entries
+	var gaps []spillGap
+	if log.spill != nil {
+		if spilled == nil || spilled.through != log.enqueued {
+			return nil, errSpillOutdated
+		}
+		if timestampAfter(spilled.horizon, log.horizon) {
+			log.horizon = spilled.horizon
+		}
+		entries = append(spilled.entries[:len(spilled.entries):len(spilled.entries)], entries...)
+		gaps = log.spill.gaps()
+	}
+
+	start := -1
+	switch {
+	case from.EventID != "":
+		for i, entry := range entries {
+			if entry.Event.ID == from.EventID {
+				start = i + 1
+				break
+			}
+		}
+	case from.ClusterTime != nil:
+		if timestampBefore(*from.ClusterTime, log.horizon) {
+			return nil, ErrResumeWindowExceeded
+		}
+		start = len(entries)
+		for i, entry := range entries {
+			if timestampAfter(entry.Event.Timestamp, *from.ClusterTime) {
+				start = i
+				break
+			}
+		}
+	}
+	if start < 0 {
+		return nil, ErrResumeWindowExceeded
+	}
+
+	// Events that failed to reach the disk are missing from the log
+	for _, gap := range gaps {
+		if from.EventID != "" && gap.last > entries[start-1].Seq {
+			return nil, ErrResumeWindowExceeded
+		}
+		if from.ClusterTime != nil && timestampAfter(gap.newest, *from.ClusterTime) {
+			return nil, ErrResumeWindowExceeded
+		}
+	}
+
+	var events []*models.ChangeEvent
+	for _, entry := range entries[start:] {
+		if subscriptionMatches(sub, entry.Event) {
+			events = append(events, entry.Event)
+		}
+	}
+	return events, nil
+}
+
+// timestampAfter reports whether a is later than b
+func timestampAfter(a, b primitive.Timestamp) bool {
+	return a.T > b.T || (a.T == b.T && a.I > b.I)
+}
+
+// timestampBefore reports whether a is earlier than b
+func timestampBefore(a, b primitive.Timestamp) bool {
+	return timestampAfter(b, a)
+}
+
+// spillQueueSize is the number of evicted batches waiting for the spill writer
+const spillQueueSize = 1024
+
+// spillFile stores evicted replay entries on disk as JSON lines, split into
+// two segments so the oldest half can be discarded when the limit is reached.
+// A goroutine writes the entries through a buffer; entries it could not write
+// are recorded as gaps.
+type spillFile struct {
+	current  string
+	previous string
+	maxBytes int64
+	logger   *logrus.Logger
+	pending  chan []replayEntry
+
+	mu        sync.Mutex // Guards the fields below and the segment files
+	written   *sync.Cond // Signalled when processed advances
+	file      *os.File
+	w         *bufio.Writer
+	size      int64
+	processed uint64 // Sequence number of the last entry written or lost
+	// horizon is the newest cluster time of a discarded segment
+	horizon        primitive.Timestamp
+	currentNewest  primitive.Timestamp
+	previousNewest primitive.Timestamp
+
+	gapMu   sync.Mutex
+	missing []spillGap
+}
+
+// spillGap is a range of entries that never made it to disk
+type spillGap struct {
+	first, last uint64
+	newest      primitive.Timestamp
+}
+
+// spillRead is the content of the spill segments
+type spillRead struct {
+	entries []replayEntry
+	horizon primitive.Timestamp
+	through uint64 // Sequence number of the last entry handed to the writer before the read
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// newSpillFile prepares the spill segments for a database, discarding
+// leftovers from a previous run, and starts its writer
+func newSpillFile(dir, database string, maxBytes int64, logger *logrus.Logger) *spillFile {
+	name := unsafeFileChars.ReplaceAllString(database, "_")
+	sf := &spillFile{
+		current:  filepath.Join(dir, name+".1.jsonl"),
+		previous: filepath.Join(dir, name+".0.jsonl"),
+		maxBytes: maxBytes,
+		logger:   logger,
+		pending:  make(chan []replayEntry, spillQueueSize),
+	}
+	sf.written = sync.NewCond(&sf.mu)
+	os.Remove(sf.current)
+	os.Remove(sf.previous)
+	go sf.run()
+	return sf
+}
+
+// enqueue hands entries to the writer without blocking. It reports false if
+// the writer is too far behind.
+func (sf *spillFile) enqueue(entries []replayEntry) bool {
+	select {
+	case sf.pending <- entries:
+		return true
+	default:
+		return false
+	}
+}
+
+// lost records entries that will not be on disk
+func (sf *spillFile) lost(entries []replayEntry) {
+	gap := spillGap{first: entries[0].Seq, last: entries[len(entries)-1].Seq}
+	for _, entry := range entries {
+		if timestampAfter(entry.Event.Timestamp, gap.newest) {
+			gap.newest = entry.Event.Timestamp
+		}
+	}
+
+	sf.gapMu.Lock()
+	defer sf.gapMu.Unlock()
+	sf.missing = append(sf.missing, gap)
+}
+
+// gaps returns the ranges of entries that failed to be spilled
+func (sf *spillFile) gaps() []spillGap {
+	sf.gapMu.Lock()
+	defer sf.gapMu.Unlock()
+	return append([]spillGap(nil), sf.missing...)
+}
+
+// run writes queued entries, flushing whenever the queue runs empty
+func (sf *spillFile) run() {
+	for entries := range sf.pending {
+		sf.mu.Lock()
+		if err := sf.write(entries); err != nil {
+			sf.logger.WithError(err).WithField("file", sf.current).Warn("Failed to spill replay events")
+			sf.lost(entries)
+			sf.closeFile()
+		}
+		if len(sf.pending) == 0 && sf.w != nil {
+			if err := sf.w.Flush(); err != nil {
+				sf.logger.WithError(err).WithField("file", sf.current).Warn("Failed to flush spilled replay events")
+				sf.closeFile()
+			}
+		}
+		sf.processed = entries[len(entries)-1].Seq
+		sf.written.Broadcast()
+		sf.mu.Unlock()
+	}
+}
+
+// write appends entries to the current segment, rotating when it is full.
+// Caller holds sf.mu.
+func (sf *spillFile) write(entries []replayEntry) error {
+	if sf.size >= sf.maxBytes/2 {
+		if err := sf.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if sf.file == nil {
+		f, err := os.OpenFile(sf.current, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		sf.file, sf.w = f, bufio.NewWriterSize(f, 64*1024)
+	}
+
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		if _, err := sf.w.Write(data); err != nil {
+			return err
+		}
+		sf.size += int64(len(data))
+		if timestampAfter(entry.Event.Timestamp, sf.currentNewest) {
+			sf.currentNewest = entry.Event.Timestamp
+		}
+	}
+	return nil
+}
+
+// closeFile closes the current segment; the next write reopens it. Caller
+// holds sf.mu.
+func (sf *spillFile) closeFile() {
+	if sf.file == nil {
+		return
+	}
+	sf.file.Close()
+	sf.file, sf.w = nil, nil
+}
+
+// rotate discards the previous segment and starts a new current one. Caller
+// holds sf.mu.
+func (sf *spillFile) rotate() error {
+	if sf.w != nil {
+		if err := sf.w.Flush(); err != nil {
+			return err
+		}
+	}
+	sf.closeFile()
+	if err := os.Rename(sf.current, sf.previous); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if timestampAfter(sf.previousNewest, sf.horizon) {
+		sf.horizon = sf.previousNewest
+	}
+	sf.previousNewest, sf.currentNewest = sf.currentNewest, primitive.Timestamp{}
+	sf.size = 0
+
+	// Gaps older than the discarded segment are covered by the horizon
+	sf.gapMu.Lock()
+	kept := sf.missing[:0]
+	for _, gap := range sf.missing {
+		if timestampAfter(gap.newest, sf.horizon) {
+			kept = append(kept, gap)
+		}
+	}
+	sf.missing = kept
+	sf.gapMu.Unlock()
+	return nil
+}
+
+// read waits until the writer processed the entries up to through and returns
+// all spilled entries younger than maxAge with the horizon up to which
+// spilled events were discarded
+func (sf *spillFile) read(maxAge time.Duration, through uint64) (*spillRead, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	for sf.processed < through {
+		sf.written.Wait()
+	}
+	if sf.w != nil {
+		if err := sf.w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	read := &spillRead{horizon: sf.horizon, through: through}
+	for _, path := range []string{sf.previous, sf.current} {
+		segment, err := readSpillSegment(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range segment {
+			if maxAge > 0 && time.Since(entry.At) > maxAge {
+				if timestampAfter(entry.Event.Timestamp, read.horizon) {
+					read.horizon = entry.Event.Timestamp
+				}
+				continue
+			}
+			read.entries = append(read.entries, entry)
+		}
+	}
+	return read, nil
+}
+
+// readSpillSegment decodes a JSON lines segment file. Lines cut short by a
+// failed write are skipped; their entries are recorded as a gap.
+func readSpillSegment(path string) ([]replayEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []replayEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var entry replayEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// maxSpillReads bounds how often a resume rereads spilled events that keep
+// changing under heavy traffic before it asks for a resnapshot
+const maxSpillReads = 3
+
+// resumeRequest asks the hub to replay missed events for a new subscription
+type resumeRequest struct {
+	client       *Client
+	subscription *models.Subscription
+	from         *models.ResumeOptions
+	conflate     time.Duration
+	spilled      *spillRead // Read off the hub before the replay
+	spillErr     error
+	spillReads   int
+}
+
+// handleResume queues the events a resuming subscription missed and then
+// registers it for live delivery. Running on the hub goroutine guarantees no
+// change is broadcast between the replay and the switch to live mode. Spilled
+// events are read on another goroutine first, which then hands the request
+// back to the hub.
+func (h *Hub) handleResume(req *resumeRequest) {
+	c := req.client
+	sub := req.subscription
+
+	h.mu.RLock()
+	_, connected := h.clients[c]
+	h.mu.RUnlock()
+	if !connected {
+		return
+	}
+
+	var replay *replayBuffer
+	if h.wsServer != nil {
+		replay = h.wsServer.replay
+	}
+	if replay == nil {
+		c.sendError(sub.RequestID, models.ErrorCodeResumeWindowExceeded, ErrResumeWindowExceeded.Error())
+		return
+	}
+
+	if replay.spills() && req.spilled == nil && req.spillErr == nil {
+		if req.spillReads >= maxSpillReads {
+			c.sendError(sub.RequestID, models.ErrorCodeResumeWindowExceeded, ErrResumeWindowExceeded.Error())
+			return
+		}
+		req.spillReads++
+		go func() {
+			req.spilled, req.spillErr = replay.readSpill(sub.Database)
+			if req.spillErr != nil {
+				req.spillErr = fmt.Errorf("failed to read spilled replay events: %w", req.spillErr)
+			}
+			h.resume <- req
+		}()
+		return
+	}
+
+	var events []*models.ChangeEvent
+	err := req.spillErr
+	if err == nil {
+		events, err = replay.since(sub, req.from, req.spilled)
+		if errors.Is(err, errSpillOutdated) {
+			req.spilled = nil
+			h.handleResume(req)
+			return
+		}
+	}
+	if err == nil && len(events)+1 > cap(c.send)-len(c.send) {
+		// Too much to queue at once; a snapshot is cheaper than stalling the client
+		err = ErrResumeWindowExceeded
+	}
+	if err != nil {
+		if !errors.Is(err, ErrResumeWindowExceeded) {
+			h.logger.WithError(err).WithField("client_id", c.ID).Error("Failed to read replay log")
+		}
+		c.sendError(sub.RequestID, models.ErrorCodeResumeWindowExceeded, err.Error())
+		return
+	}
+
+	// The hub routes no changes meanwhile, so the response can follow
+	c.addSubscription(sub, req.conflate, nil)
+
+	// Other principals' events must not even show up in the count
+	c.mu.RLock()
+	filter := c.filters[sub.ID]
+	sequence := c.sequences[sub.ID].Load()
+	c.mu.RUnlock()
+	if filter != nil {
+		visible := events[:0]
+		for _, event := range events {
+			if filter.allows(event) {
+				visible = append(visible, event)
+			}
+		}
+		events = visible
+	}
+
+	data := subscribeResponseData(sub)
+	data["replayed"] = len(events)
+	data["sequence"] = sequence
+	select {
+	case c.send <- &models.ServerMessage{Type: models.MessageTypeSubscribe, Success: true, RequestID: sub.RequestID, Data: data}:
+	default:
+		h.logger.WithField("client_id", c.ID).Warn("Failed to send subscription response")
+	}
+
+	// Replayed events are numbered like live ones
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tracker := c.trackers[sub.ID]
+	for _, event := range events {
+		event = c.redactChange(event)
+		if tracker != nil {
+			tracker.add(event)
+			continue
+		}
+		message := &models.ServerMessage{
+			Type:            models.MessageTypeChange,
+			Change:          event,
+			SubscriptionIDs: []string{sub.ID},
+			Sequences:       []uint64{c.nextSequence(sub.ID)},
+		}
+		select {
+		case c.send <- message:
+		default:
+			h.logger.WithField("client_id", c.ID).Warn("Failed to queue replayed change")
+		}
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"client_id":    c.ID,
+		"subscription": sub.ID,
+		"database":     sub.Database,
+		"collection":   sub.Collection,
+		"replayed":     len(events),
+	}).Info("Client resumed subscription")
+}
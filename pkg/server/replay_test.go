@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newTestReplayBuffer(t *testing.T, opts ReplayOptions) *replayBuffer {
+	t.Helper()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	rb, err := newReplayBuffer(opts, logger)
+	require.NoError(t, err)
+	return rb
+}
+
+// replayEvent builds a change event with a cluster time after the buffer start
+func replayEvent(rb *replayBuffer, n int, collection string) *models.ChangeEvent {
+	return &models.ChangeEvent{
+		ID:         fmt.Sprintf("evt-%d", n),
+		Database:   "testdb",
+		Collection: collection,
+		Timestamp:  primitive.Timestamp{T: rb.started.T + 1, I: uint32(n)},
+	}
+}
+
+func eventIDs(events []*models.ChangeEvent) []string {
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return ids
+}
+
+func TestReplayBuffer_SinceEventID(t *testing.T) {
+	rb := newTestReplayBuffer(t, ReplayOptions{MaxEvents: 10})
+	for i := 1; i <= 4; i++ {
+		collection := "users"
+		if i == 3 {
+			collection = "orders"
+		}
+		rb.append(replayEvent(rb, i, collection))
+	}
+
+	sub := &models.Subscription{Database: "testdb", Collection: "users"}
+	events, err := rb.since(sub, &models.ResumeOptions{EventID: "evt-1"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"evt-2", "evt-4"}, eventIDs(events))
+
+	events, err = rb.since(sub, &models.ResumeOptions{EventID: "evt-4"}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	_, err = rb.since(sub, &models.ResumeOptions{EventID: "unknown"}, nil)
+	assert.ErrorIs(t, err, ErrResumeWindowExceeded)
+}
+
+func TestReplayBuffer_SinceClusterTime(t *testing.T) {
+	rb := newTestReplayBuffer(t, ReplayOptions{MaxEvents: 2})
+	for i := 1; i <= 4; i++ {
+		rb.append(replayEvent(rb, i, "users"))
+	}
+
+	sub := &models.Subscription{Database: "testdb"}
+	from := replayEvent(rb, 2, "users").Timestamp
+	events, err := rb.since(sub, &models.ResumeOptions{ClusterTime: &from}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"evt-3", "evt-4"}, eventIDs(events))
+
+	// evt-2 was evicted, so anything before it may have been lost
+	from = replayEvent(rb, 1, "users").Timestamp
+	_, err = rb.since(sub, &models.ResumeOptions{ClusterTime: &from}, nil)
+	assert.ErrorIs(t, err, ErrResumeWindowExceeded)
+}
+
+func TestReplayBuffer_MaxAge(t *testing.T) {
+	rb := newTestReplayBuffer(t, ReplayOptions{MaxEvents: 10, MaxAge: 20 * time.Millisecond})
+	rb.append(replayEvent(rb, 1, "users"))
+	time.Sleep(30 * time.Millisecond)
+	rb.append(replayEvent(rb, 2, "users"))
+
+	sub := &models.Subscription{Database: "testdb"}
+	_, err := rb.since(sub, &models.ResumeOptions{EventID: "evt-1"}, nil)
+	assert.ErrorIs(t, err, ErrResumeWindowExceeded)
+}
+
+func TestReplayBuffer_SpillsToDisk(t *testing.T) {
+	rb := newTestReplayBuffer(t, ReplayOptions{MaxEvents: 2, SpillDir: t.TempDir()})
+	for i := 1; i <= 6; i++ {
+		rb.append(replayEvent(rb, i, "users"))
+	}
+
+	sub := &models.Subscription{Database: "testdb"}
+	spilled, err := rb.readSpill("testdb")
+	require.NoError(t, err)
+	events, err := rb.since(sub, &models.ResumeOptions{EventID: "evt-1"}, spilled)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"evt-2", "evt-3", "evt-4", "evt-5", "evt-6"}, eventIDs(events))
+
+	// Events spilled after the read make it outdated
+	rb.append(replayEvent(rb, 7, "users"))
+	_, err = rb.since(sub, &models.ResumeOptions{EventID: "evt-1"}, spilled)
+	assert.ErrorIs(t, err, errSpillOutdated)
+}
+
+func TestReplayBuffer_ResumeAcrossDroppedSpill(t *testing.T) {
+	rb := newTestReplayBuffer(t, ReplayOptions{MaxEvents: 1, SpillDir: t.TempDir()})
+	rb.append(replayEvent(rb, 1, "users"))
+
+	// A stalled writer lets the queue fill up; further evictions are dropped
+	spill := rb.logs["testdb"].spill
+	spill.mu.Lock()
+	n := 2
+	for ; len(spill.pending) < cap(spill.pending); n++ {
+		rb.append(replayEvent(rb, n, "users"))
+	}
+	rb.append(replayEvent(rb, n, "users"))   // Drops evt-(n-1)
+	rb.append(replayEvent(rb, n+1, "users")) // Drops evt-n
+	spill.mu.Unlock()
+
+	sub := &models.Subscription{Database: "testdb"}
+	spilled, err := rb.readSpill("testdb")
+	require.NoError(t, err)
+	_, err = rb.since(sub, &models.ResumeOptions{EventID: "evt-1"}, spilled)
+	assert.ErrorIs(t, err, ErrResumeWindowExceeded)
+	from := replayEvent(rb, 1, "users").Timestamp
+	_, err = rb.since(sub, &models.ResumeOptions{ClusterTime: &from}, spilled)
+	assert.ErrorIs(t, err, ErrResumeWindowExceeded)
+
+	// Resuming after the dropped events still works
+	from = replayEvent(rb, n, "users").Timestamp
+	events, err := rb.since(sub, &models.ResumeOptions{ClusterTime: &from}, spilled)
+	require.NoError(t, err)
+	assert.Equal(t, []string{fmt.Sprintf("evt-%d", n+1)}, eventIDs(events))
+}
+
+func TestHub_ResumeReplaysBeforeLiveChanges(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testResumeReplaysBeforeLiveChanges(t, ReplayOptions{MaxEvents: 10})
+	})
+	t.Run("spilled", func(t *testing.T) {
+		testResumeReplaysBeforeLiveChanges(t, ReplayOptions{MaxEvents: 1, SpillDir: t.TempDir()})
+	})
+}
+
+func testResumeReplaysBeforeLiveChanges(t *testing.T, opts ReplayOptions) {
+	client, _ := newTestConnection(t)
+	ws := client.hub.wsServer
+	require.NoError(t, ws.SetReplayOptions(opts))
+	go client.hub.run()
+	client.hub.register <- client
+
+	rb := ws.replay
+	ws.BroadcastChange(replayEvent(rb, 1, "users"))
+	ws.BroadcastChange(replayEvent(rb, 2, "users"))
+
+	client.handleSubscribe(&models.ClientMessage{
+		Type:       models.MessageTypeSubscribe,
+		RequestID:  "req-1",
+		Database:   "testdb",
+		Collection: "users",
+		ResumeFrom: &models.ResumeOptions{EventID: "evt-1"},
+	})
+	ws.BroadcastChange(replayEvent(rb, 3, "users"))
+
+	next := func() *models.ServerMessage {
+		select {
+		case message := <-client.send:
+			return message
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+			return nil
+		}
+	}
+
+	response := next()
+	require.Equal(t, models.MessageTypeSubscribe, response.Type)
+	assert.True(t, response.Success)
+	assert.Equal(t, "evt-2", next().Change.ID)
+	assert.Equal(t, "evt-3", next().Change.ID)
+
+	// A resume point that is no longer retained asks for a new snapshot
+	client.handleSubscribe(&models.ClientMessage{
+		Type:       models.MessageTypeSubscribe,
+		RequestID:  "req-2",
+		Database:   "testdb",
+		ResumeFrom: &models.ResumeOptions{EventID: "evt-0"},
+	})
+	failure := next()
+	assert.Equal(t, models.MessageTypeError, failure.Type)
+	assert.Equal(t, models.ErrorCodeResumeWindowExceeded, failure.ErrorCode)
+	assert.Equal(t, "req-2", failure.RequestID)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+
+	"aktuell/pkg/auth"
+	"aktuell/pkg/models"
+)
+
+// rowFilter restricts a subscription to the documents its principal may see.
+// Events that carry the document are matched against the filter. Deletes
+// only carry the document key, so they are matched against the key if it
+// holds every filtered field (e.g. a shard key) and are otherwise delivered
+// only for documents the subscription was sent before. At most maxVisible
+// documents are remembered; deletes of the least recently delivered ones are
+// withheld once they are forgotten.
+type rowFilter struct {
+	filter     map[string]interface{}
+	keyFields  []string
+	maxVisible int
+
+	mu      sync.Mutex
+	visible map[string]*list.Element // Keys of delivered documents
+	recent  *list.List               // Keys of visible, most recently delivered first
+}
+
+// maxVisibleDocuments bounds the documents a row filter remembers per
+// subscription
+const maxVisibleDocuments = 100000
+
+// newRowFilter returns the row filter of a subscription, or nil if it may see
+// every document
+func newRowFilter(filter map[string]interface{}) *rowFilter {
+	if filter == nil {
+		return nil
+	}
+	return &rowFilter{
+		filter:     filter,
+		keyFields:  auth.FilterFields(filter),
+		maxVisible: maxVisibleDocuments,
+		visible:    make(map[string]*list.Element),
+		recent:     list.New(),
+	}
+}
+
+// allows reports whether a change may be delivered and tracks which documents
+// the subscriber has seen
+func (f *rowFilter) allows(change *models.ChangeEvent) bool {
+	id, ok := change.DocumentKey["_id"]
+	if !ok {
+		// Collection-level events like drop reveal nothing filterable
+		return false
+	}
+	key := documentKeyString(map[string]interface{}{"_id": id})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if change.FullDocument != nil {
+		if auth.MatchFilter(f.filter, change.FullDocument) {
+			f.show(key)
+			return true
+		}
+		// The document no longer belongs to the subscriber, if it ever did
+		f.hide(key)
+		return false
+	}
+
+	allowed := false
+	if f.keyHoldsFilter(change.DocumentKey) {
+		allowed = auth.MatchFilter(f.filter, change.DocumentKey)
+	} else {
+		_, allowed = f.visible[key]
+	}
+	if change.OperationType == models.OperationDelete {
+		f.hide(key)
+	}
+	return allowed
+}
+
+// show remembers a delivered document, forgetting the least recently
+// delivered one beyond the limit. Caller holds f.mu.
+func (f *rowFilter) show(key string) {
+	if element, ok := f.visible[key]; ok {
+		f.recent.MoveToFront(element)
+		return
+	}
+	f.visible[key] = f.recent.PushFront(key)
+	if f.recent.Len() > f.maxVisible {
+		f.hide(f.recent.Back().Value.(string))
+	}
+}
+
+// hide forgets a document. Caller holds f.mu.
+func (f *rowFilter) hide(key string) {
+	if element, ok := f.visible[key]; ok {
+		f.recent.Remove(element)
+		delete(f.visible, key)
+	}
+}
+
+// saw records documents delivered by a snapshot
+func (f *rowFilter) saw(documents []map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, doc := range documents {
+		if id, ok := doc["_id"]; ok {
+			f.show(documentKeyString(map[string]interface{}{"_id": id}))
+		}
+	}
+}
+
+// keyHoldsFilter reports whether a document key contains every field the
+// filter tests
+func (f *rowFilter) keyHoldsFilter(documentKey map[string]interface{}) bool {
+	for _, field := range f.keyFields {
+		if _, ok := auth.LookupField(documentKey, field); !ok {
+			return false
+		}
+	}
+	return true
+}
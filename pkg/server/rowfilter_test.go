@@ -0,0 +1,84 @@
+package server
+
+import (
+	"testing"
+
+	"aktuell/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func tenantChange(op, id, tenant string) *models.ChangeEvent {
+	change := &models.ChangeEvent{
+		OperationType: op,
+		Database:      "shop",
+		Collection:    "orders",
+		DocumentKey:   map[string]interface{}{"_id": id},
+	}
+	if tenant != "" {
+		change.FullDocument = map[string]interface{}{"_id": id, "tenantId": tenant}
+	}
+	return change
+}
+
+func TestRowFilter_MatchesDocuments(t *testing.T) {
+	assert.Nil(t, newRowFilter(nil))
+
+	f := newRowFilter(map[string]interface{}{"tenantId": "acme"})
+	assert.True(t, f.allows(tenantChange(models.OperationInsert, "1", "acme")))
+	assert.False(t, f.allows(tenantChange(models.OperationInsert, "2", "globex")))
+	assert.True(t, f.allows(tenantChange(models.OperationUpdate, "1", "acme")))
+
+	// A drop has no document key
+	assert.False(t, f.allows(&models.ChangeEvent{OperationType: "drop", Database: "shop", Collection: "orders"}))
+}
+
+func TestRowFilter_DeletesOfDeliveredDocuments(t *testing.T) {
+	f := newRowFilter(map[string]interface{}{"tenantId": "acme"})
+
+	f.allows(tenantChange(models.OperationInsert, "1", "acme"))
+	f.allows(tenantChange(models.OperationInsert, "2", "globex"))
+	f.saw([]map[string]interface{}{{"_id": "3", "tenantId": "acme"}})
+
+	assert.True(t, f.allows(tenantChange(models.OperationDelete, "1", "")))
+	assert.False(t, f.allows(tenantChange(models.OperationDelete, "2", "")))
+	assert.True(t, f.allows(tenantChange(models.OperationDelete, "3", "")), "documents of the snapshot")
+	assert.False(t, f.allows(tenantChange(models.OperationDelete, "1", "")), "deleted documents are forgotten")
+
+	// Documents moved to another tenant are forgotten too
+	f.allows(tenantChange(models.OperationInsert, "4", "acme"))
+	assert.False(t, f.allows(tenantChange(models.OperationUpdate, "4", "globex")))
+	assert.False(t, f.allows(tenantChange(models.OperationDelete, "4", "")))
+}
+
+func TestRowFilter_RemembersBoundedDocuments(t *testing.T) {
+	f := newRowFilter(map[string]interface{}{"tenantId": "acme"})
+	f.maxVisible = 2
+
+	f.allows(tenantChange(models.OperationInsert, "1", "acme"))
+	f.allows(tenantChange(models.OperationInsert, "2", "acme"))
+	f.allows(tenantChange(models.OperationUpdate, "1", "acme"))
+	f.allows(tenantChange(models.OperationInsert, "3", "acme"))
+	assert.Len(t, f.visible, 2)
+
+	assert.False(t, f.allows(tenantChange(models.OperationDelete, "2", "")), "the least recently delivered document is forgotten")
+	assert.True(t, f.allows(tenantChange(models.OperationDelete, "1", "")))
+	assert.True(t, f.allows(tenantChange(models.OperationDelete, "3", "")))
+	assert.Zero(t, f.recent.Len())
+}
+
+func TestRowFilter_DeletesByDocumentKey(t *testing.T) {
+	f := newRowFilter(map[string]interface{}{"tenantId": "acme"})
+	id := primitive.NewObjectID()
+
+	// Sharded on tenantId, the document key tells the tenant of any delete
+	delete := func(tenant string) *models.ChangeEvent {
+		return &models.ChangeEvent{
+			OperationType: models.OperationDelete,
+			DocumentKey:   map[string]interface{}{"_id": id, "tenantId": tenant},
+		}
+	}
+	assert.True(t, f.allows(delete("acme")))
+	assert.False(t, f.allows(delete("globex")))
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultQueueSize is the capacity of a client's outbound message queue
+const defaultQueueSize = 1024
+
+// SessionOptions configures durable sessions that survive disconnects
+type SessionOptions struct {
+	GracePeriod time.Duration // How long a detached session is kept (0 disables sessions)
+	QueueSize   int           // Outbound messages queued per client; a full queue drops the session
+}
+
+// SetSessionOptions enables durable sessions. It must be called before Start.
+func (ws *WebSocketServer) SetSessionOptions(opts SessionOptions) {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+	ws.sessions = opts
+}
+
+// sessionOptions returns the configured session options
+func (h *Hub) sessionOptions() SessionOptions {
+	if h.wsServer == nil {
+		return SessionOptions{QueueSize: defaultQueueSize}
+	}
+	return h.wsServer.sessions
+}
+
+// sessionToken returns the session token presented on the handshake, either
+// as a header or, for browsers, as the "session" query parameter
+func sessionToken(r *http.Request) string {
+	if token := r.Header.Get(models.HeaderSession); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("session")
+}
+
+// lookupSession returns the live client owning a session token
+func (h *Hub) lookupSession(token string) *Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	client, ok := h.sessions[token]
+	if !ok || !h.clients[client] {
+		return nil
+	}
+	return client
+}
+
+// sessionMessage tells the client its session token and whether an existing
+// session was re-attached
+func sessionMessage(token string, resumed bool) *models.ServerMessage {
+	return &models.ServerMessage{
+		Type:    models.MessageTypeSession,
+		Success: true,
+		Data: map[string]interface{}{
+			"session_id": token,
+			"resumed":    resumed,
+		},
+	}
+}
+
+// link is a single network connection of a client. A session outlives its
+// links: when one drops, the next connection presenting the token takes over.
+type link struct {
+	conn      *websocket.Conn
+	done      chan struct{} // Closed when the link is torn down
+	writeDone chan struct{} // Closed when the link's writePump has exited
+	once      sync.Once
+
+	// The last message before the server closes the link. It bypasses the
+	// send queue so that a full queue cannot keep the link open.
+	final  chan *models.ServerMessage
+	ending atomic.Bool
+}
+
+// newLink wraps a WebSocket connection
+func newLink(conn *websocket.Conn) *link {
+	return &link{
+		conn:      conn,
+		done:      make(chan struct{}),
+		writeDone: make(chan struct{}),
+		final:     make(chan *models.ServerMessage, 1),
+	}
+}
+
+// finalWriteTimeout bounds how long the writePump may take to deliver the
+// final message before the link is closed without it
+const finalWriteTimeout = 10 * time.Second
+
+// end closes the link after the writePump delivered a final message, e.g. an
+// error explaining why. It reports false if the link is already ending.
+func (l *link) end(message *models.ServerMessage) bool {
+	if !l.ending.CompareAndSwap(false, true) {
+		return false
+	}
+	l.final <- message
+	time.AfterFunc(finalWriteTimeout, l.close)
+	return true
+}
+
+// close tears down the link; it is safe to call more than once
+func (l *link) close() {
+	l.once.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
+}
+
+// closed reports whether the link has been torn down
+func (l *link) closed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// attached reports whether the client currently has a connection
+func (c *Client) attached() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.link != nil
+}
+
+// detach ends a link of the client. Without sessions the client is
+// unregistered right away; otherwise its subscriptions and queued messages are
+// kept for the grace period so a new connection can re-attach the session.
+func (c *Client) detach(l *link) {
+	l.close()
+
+	c.mu.Lock()
+	if c.link != l {
+		// Already replaced by a newer link
+		c.mu.Unlock()
+		return
+	}
+	c.link = nil
+
+	grace := c.hub.sessionOptions().GracePeriod
+	if c.session == "" || grace <= 0 || c.limits.isTerminated() {
+		// Connections closed for violating their limits lose their session
+		c.mu.Unlock()
+		c.hub.unregister <- c
+		return
+	}
+	for _, tr := range c.trackers {
+		tr.pause()
+	}
+	c.grace = time.AfterFunc(grace, func() {
+		c.hub.logger.WithField("client_id", c.ID).Info("Session grace period expired")
+		c.hub.unregister <- c
+	})
+	c.mu.Unlock()
+
+	c.hub.logger.WithFields(logrus.Fields{
+		"client_id": c.ID,
+		"grace":     grace,
+	}).Info("Client detached, keeping session")
+}
+
+// attach moves the session onto a new connection. A previous link that is
+// still open is closed first, and its writer is awaited so queued messages
+// keep their order. It refuses a client the hub no longer holds, e.g. because
+// the grace period ran out after the session was looked up.
+func (c *Client) attach(conn *websocket.Conn) bool {
+	c.attachMu.Lock()
+	defer c.attachMu.Unlock()
+
+	// Under h.mu the hub cannot remove the client between the check and
+	// taking over the session; it skips clients that are attached again
+	l := newLink(conn)
+	c.hub.mu.Lock()
+	if !c.hub.clients[c] || c.hub.sessions[c.session] != c {
+		c.hub.mu.Unlock()
+		return false
+	}
+	c.mu.Lock()
+	if c.grace != nil {
+		c.grace.Stop()
+		c.grace = nil
+	}
+	previous := c.link
+	c.link = l
+	c.mu.Unlock()
+	c.hub.mu.Unlock()
+
+	if previous != nil {
+		previous.close()
+		<-previous.writeDone
+	}
+
+	c.mu.Lock()
+	c.unsent = append([]*models.ServerMessage{sessionMessage(c.session, true)}, c.unsent...)
+	queued := len(c.unsent) + len(c.send) - 1
+	c.mu.Unlock()
+
+	c.hub.logger.WithFields(logrus.Fields{
+		"client_id": c.ID,
+		"queued":    queued,
+	}).Info("Client re-attached to session")
+
+	go c.writePump(l)
+	go c.readPump(l)
+
+	// Earlier sends of unacknowledged events may have been lost with the old link
+	c.redeliverUnacked()
+	return true
+}
+
+// keepUnsent stores messages taken from the queue but not written, so the
+// session's next link delivers them first
+func (c *Client) keepUnsent(messages ...*models.ServerMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unsent = append(c.unsent, messages...)
+}
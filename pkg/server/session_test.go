@@ -0,0 +1,145 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSessionServer starts a server with durable sessions and a running hub
+func newSessionServer(t *testing.T, grace time.Duration) (*WebSocketServer, string) {
+	t.Helper()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	ws := NewWebSocketServer("localhost:0", logger)
+	ws.SetSessionOptions(SessionOptions{GracePeriod: grace})
+	go ws.hub.run()
+
+	httpServer := httptest.NewServer(ws.server.Handler)
+	t.Cleanup(httpServer.Close)
+	return ws, "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws"
+}
+
+// dialSession connects with an optional session token
+func dialSession(t *testing.T, url, token string) (*websocket.Conn, *http.Response) {
+	t.Helper()
+
+	header := http.Header{}
+	if token != "" {
+		header.Set(models.HeaderSession, token)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	return conn, resp
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) *models.ServerMessage {
+	t.Helper()
+
+	var message models.ServerMessage
+	require.NoError(t, conn.ReadJSON(&message))
+	return &message
+}
+
+func TestSession_ReattachFlushesQueuedMessages(t *testing.T) {
+	ws, url := newSessionServer(t, time.Second)
+
+	conn, resp := dialSession(t, url, "")
+	token := resp.Header.Get(models.HeaderSession)
+	require.NotEmpty(t, token)
+	assert.Empty(t, resp.Header.Get(models.HeaderSessionResumed))
+
+	hello := readMessage(t, conn)
+	require.Equal(t, models.MessageTypeSession, hello.Type)
+	assert.Equal(t, false, hello.Data.(map[string]interface{})["resumed"])
+
+	require.NoError(t, conn.WriteJSON(&models.ClientMessage{
+		Type:       models.MessageTypeSubscribe,
+		RequestID:  "req-1",
+		Database:   "testdb",
+		Collection: "users",
+	}))
+	subscribed := readMessage(t, conn)
+	require.True(t, subscribed.Success)
+	subscriptionID := subscribed.Data.(map[string]interface{})["subscription_id"].(string)
+
+	// Drop the connection and wait until the server noticed
+	conn.Close()
+	require.Eventually(t, func() bool {
+		ws.hub.mu.RLock()
+		defer ws.hub.mu.RUnlock()
+		client := ws.hub.sessions[token]
+		return client != nil && !client.attached()
+	}, time.Second, 5*time.Millisecond)
+
+	ws.BroadcastChange(&models.ChangeEvent{ID: "while-away", Database: "testdb", Collection: "users"})
+
+	conn, resp = dialSession(t, url, token)
+	assert.Equal(t, token, resp.Header.Get(models.HeaderSession))
+	assert.Equal(t, "true", resp.Header.Get(models.HeaderSessionResumed))
+
+	hello = readMessage(t, conn)
+	require.Equal(t, models.MessageTypeSession, hello.Type)
+	assert.Equal(t, true, hello.Data.(map[string]interface{})["resumed"])
+
+	change := readMessage(t, conn)
+	require.Equal(t, models.MessageTypeChange, change.Type)
+	assert.Equal(t, "while-away", change.Change.ID)
+	assert.Equal(t, []string{subscriptionID}, change.SubscriptionIDs)
+	assert.Equal(t, 1, ws.hub.ClientCount())
+}
+
+func TestSession_ExpiresAfterGracePeriod(t *testing.T) {
+	ws, url := newSessionServer(t, 20*time.Millisecond)
+
+	conn, resp := dialSession(t, url, "")
+	token := resp.Header.Get(models.HeaderSession)
+	conn.Close()
+
+	require.Eventually(t, func() bool { return ws.hub.ClientCount() == 0 }, time.Second, 5*time.Millisecond)
+
+	_, resp = dialSession(t, url, token)
+	assert.NotEqual(t, token, resp.Header.Get(models.HeaderSession))
+	assert.Empty(t, resp.Header.Get(models.HeaderSessionResumed))
+}
+
+func TestSession_DisabledByDefault(t *testing.T) {
+	ws, url := newSessionServer(t, 0)
+
+	conn, resp := dialSession(t, url, "")
+	assert.Empty(t, resp.Header.Get(models.HeaderSession))
+	conn.Close()
+
+	require.Eventually(t, func() bool { return ws.hub.ClientCount() == 0 }, time.Second, 5*time.Millisecond)
+}
+
+func TestSession_RefusesToAttachExpiredClient(t *testing.T) {
+	ws, url := newSessionServer(t, time.Minute)
+
+	conn, _ := dialSession(t, url, "")
+	client := onlyClient(t, ws)
+	conn.Close()
+	require.Eventually(t, func() bool { return !client.attached() }, time.Second, 5*time.Millisecond)
+
+	// The grace period runs out between looking the session up and attaching
+	ws.hub.mu.Lock()
+	ws.hub.removeClient(client)
+	ws.hub.mu.Unlock()
+
+	other, _ := newTestConnection(t)
+	assert.False(t, client.attach(other.link.conn))
+	assert.False(t, client.attached())
+	assert.Equal(t, 0, ws.hub.ClientCount())
+}
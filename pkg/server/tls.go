@@ -0,0 +1,213 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultTLSReloadInterval limits how often the certificate files are checked
+// for changes
+const defaultTLSReloadInterval = 10 * time.Second
+
+// Client certificate modes of TLSOptions
+const (
+	ClientAuthNone     = "none"     // Client certificates are not requested
+	ClientAuthOptional = "optional" // Client certificates are verified if presented
+	ClientAuthRequire  = "require"  // Handshakes without a valid client certificate fail
+)
+
+// TLSOptions configures TLS termination in the server
+type TLSOptions struct {
+	CertFile       string        `mapstructure:"cert_file"`       // PEM certificate chain
+	KeyFile        string        `mapstructure:"key_file"`        // PEM private key
+	MinVersion     string        `mapstructure:"min_version"`     // "1.2" (default) or "1.3"
+	CipherSuites   []string      `mapstructure:"cipher_suites"`   // Names of crypto/tls; applies to TLS 1.2 only
+	ClientCAFile   string        `mapstructure:"client_ca_file"`  // PEM CAs that issue client certificates
+	ClientAuth     string        `mapstructure:"client_auth"`     // "none", "optional" or "require" (default with a CA file)
+	ReloadInterval time.Duration `mapstructure:"reload_interval"` // How often the files are checked for changes (default 10s)
+}
+
+// Enabled reports whether a certificate is configured
+func (o TLSOptions) Enabled() bool {
+	return o.CertFile != "" || o.KeyFile != ""
+}
+
+// SetTLSOptions serves TLS with the given certificate. The certificate, key
+// and client CA files are reloaded when they change. It must be called
+// before Start.
+func (ws *WebSocketServer) SetTLSOptions(opts TLSOptions) error {
+	if !opts.Enabled() {
+		ws.server.TLSConfig = nil
+		return nil
+	}
+
+	config, err := newTLSConfig(opts, ws.logger)
+	if err != nil {
+		return err
+	}
+	ws.server.TLSConfig = config
+	return nil
+}
+
+// newTLSConfig validates the options and loads the files
+func newTLSConfig(opts TLSOptions, logger *logrus.Logger) (*tls.Config, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errors.New("TLS needs both a certificate and a key file")
+	}
+
+	template := &tls.Config{}
+	switch opts.MinVersion {
+	case "", "1.2":
+		template.MinVersion = tls.VersionTLS12
+	case "1.3":
+		template.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported minimum TLS version %q", opts.MinVersion)
+	}
+
+	if len(opts.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range opts.CipherSuites {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			template.CipherSuites = append(template.CipherSuites, id)
+		}
+	}
+
+	switch opts.ClientAuth {
+	case "":
+		if opts.ClientCAFile != "" {
+			template.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	case ClientAuthNone:
+	case ClientAuthOptional:
+		template.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		template.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client_auth %q", opts.ClientAuth)
+	}
+	if template.ClientAuth != tls.NoClientCert && opts.ClientCAFile == "" {
+		return nil, errors.New("client certificate verification needs a client_ca_file")
+	}
+
+	reloader := &certReloader{opts: opts, template: template, logger: logger, now: time.Now}
+	if reloader.opts.ReloadInterval <= 0 {
+		reloader.opts.ReloadInterval = defaultTLSReloadInterval
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	config := template.Clone()
+	config.GetCertificate = reloader.getCertificate
+	config.GetConfigForClient = reloader.getConfigForClient
+	return config, nil
+}
+
+// certReloader keeps the certificate and client CAs in sync with their
+// files. Handshakes check the files at most once per reload interval; a
+// file that cannot be loaded keeps the previous contents in effect.
+type certReloader struct {
+	opts     TLSOptions
+	template *tls.Config
+	logger   *logrus.Logger
+	now      func() time.Time
+
+	mu      sync.Mutex
+	config  *tls.Config
+	modTime map[string]time.Time
+	checked time.Time
+}
+
+// getCertificate implements tls.Config.GetCertificate
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return &r.current().Certificates[0], nil
+}
+
+// getConfigForClient implements tls.Config.GetConfigForClient
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return r.current(), nil
+}
+
+// current returns the configuration of the latest files
+func (r *certReloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.now().Sub(r.checked) >= r.opts.ReloadInterval {
+		if err := r.reloadLocked(); err != nil {
+			r.logger.WithError(err).Warn("Failed to reload TLS certificate, keeping the previous one")
+		}
+	}
+	return r.config
+}
+
+// reload loads the files
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reloadLocked()
+}
+
+// reloadLocked loads the files if any of them changed. Caller must hold r.mu.
+func (r *certReloader) reloadLocked() error {
+	r.checked = r.now()
+
+	files := []string{r.opts.CertFile, r.opts.KeyFile}
+	if r.opts.ClientCAFile != "" {
+		files = append(files, r.opts.ClientCAFile)
+	}
+	modTime := make(map[string]time.Time, len(files))
+	changed := r.config == nil
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS file: %w", err)
+		}
+		modTime[file] = info.ModTime()
+		changed = changed || !info.ModTime().Equal(r.modTime[file])
+	}
+	if !changed {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := r.template.Clone()
+	config.Certificates = []tls.Certificate{cert}
+
+	if r.opts.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.opts.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in client CA file %s", r.opts.ClientCAFile)
+		}
+		config.ClientCAs = pool
+	}
+
+	if r.config != nil {
+		r.logger.WithField("cert_file", r.opts.CertFile).Info("Reloaded TLS certificate")
+	}
+	r.config = config
+	r.modTime = modTime
+	return nil
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"aktuell/pkg/auth"
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Aktuell Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of a leaf certificate
+func (ca *testCA) issue(t *testing.T, subject pkix.Name, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// writeServerCert writes a server certificate and moves its modification
+// time forward so that a reload notices it
+func writeServerCert(t *testing.T, ca *testCA, dir, name string, age time.Duration) TLSOptions {
+	t.Helper()
+
+	certPEM, keyPEM := ca.issue(t, pkix.Name{CommonName: name}, x509.ExtKeyUsageServerAuth)
+	opts := TLSOptions{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	require.NoError(t, os.WriteFile(opts.CertFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(opts.KeyFile, keyPEM, 0o600))
+	modTime := time.Now().Add(age)
+	require.NoError(t, os.Chtimes(opts.CertFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(opts.KeyFile, modTime, modTime))
+	return opts
+}
+
+// startTLSServer starts a server with TLS options and an optional
+// authenticator and returns its address
+func startTLSServer(t *testing.T, opts TLSOptions, authenticator auth.Authenticator) (*WebSocketServer, string) {
+	t.Helper()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	ws := NewWebSocketServer("127.0.0.1:0", logger)
+	require.NoError(t, ws.SetTLSOptions(opts))
+	if authenticator != nil {
+		ws.SetAuthenticator(authenticator)
+	}
+
+	go ws.Start()
+	t.Cleanup(func() { ws.Stop() })
+	require.Eventually(t, func() bool {
+		return !strings.HasSuffix(ws.GetAddr(), ":0")
+	}, time.Second, 5*time.Millisecond)
+	return ws, ws.GetAddr()
+}
+
+// servedName returns the common name of the certificate the server presents
+func servedName(t *testing.T, addr string, config *tls.Config) string {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, config)
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLS_ReloadsChangedCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	opts := writeServerCert(t, ca, dir, "server-1", -time.Minute)
+	opts.ReloadInterval = time.Millisecond
+	_, addr := startTLSServer(t, opts, nil)
+
+	client := &tls.Config{RootCAs: ca.pool()}
+	assert.Equal(t, "server-1", servedName(t, addr, client))
+
+	writeServerCert(t, ca, dir, "server-2", 0)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, "server-2", servedName(t, addr, client))
+
+	// A broken file keeps the previous certificate in effect
+	require.NoError(t, os.WriteFile(opts.CertFile, []byte("not a certificate"), 0o600))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(opts.CertFile, future, future))
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, "server-2", servedName(t, addr, client))
+}
+
+func TestTLS_MinimumVersion(t *testing.T) {
+	ca := newTestCA(t)
+	opts := writeServerCert(t, ca, t.TempDir(), "server", 0)
+	opts.MinVersion = "1.3"
+	_, addr := startTLSServer(t, opts, nil)
+
+	_, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool(), MaxVersion: tls.VersionTLS12})
+	assert.Error(t, err)
+	assert.Equal(t, "server", servedName(t, addr, &tls.Config{RootCAs: ca.pool()}))
+}
+
+func TestTLS_ClientCertificateIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	opts := writeServerCert(t, ca, dir, "server", 0)
+	opts.ClientCAFile = filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(opts.ClientCAFile, ca.pem, 0o600))
+	ws, addr := startTLSServer(t, opts, auth.ClientCertAuthenticator{})
+
+	url := "wss://" + addr + "/ws"
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: ca.pool()}}
+	_, _, err := dialer.Dial(url, nil)
+	assert.Error(t, err, "client certificates are required with a CA file")
+
+	certPEM, keyPEM := ca.issue(t, pkix.Name{CommonName: "billing-worker", Organization: []string{"acme"}}, x509.ExtKeyUsageClientAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	dialer.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	conn, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	principal := onlyClient(t, ws).Principal()
+	require.NotNil(t, principal)
+	assert.Equal(t, "billing-worker", principal.Subject)
+	assert.Equal(t, models.AuthMethodClientCert, principal.Method)
+	assert.Equal(t, []interface{}{"acme"}, principal.Claims["o"])
+}
+
+func TestTLS_Validation(t *testing.T) {
+	ca := newTestCA(t)
+	valid := writeServerCert(t, ca, t.TempDir(), "server", 0)
+
+	invalid := map[string]func(*TLSOptions){
+		"missing key":       func(o *TLSOptions) { o.KeyFile = "" },
+		"unreadable cert":   func(o *TLSOptions) { o.CertFile = "/does/not/exist" },
+		"old version":       func(o *TLSOptions) { o.MinVersion = "1.0" },
+		"insecure cipher":   func(o *TLSOptions) { o.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"} },
+		"client auth no CA": func(o *TLSOptions) { o.ClientAuth = ClientAuthOptional },
+		"unknown mode":      func(o *TLSOptions) { o.ClientAuth = "maybe" },
+	}
+	for name, change := range invalid {
+		t.Run(name, func(t *testing.T) {
+			opts := valid
+			change(&opts)
+			_, err := newTLSConfig(opts, logrus.New())
+			assert.Error(t, err)
+		})
+	}
+
+	opts := valid
+	opts.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+	config, err := newTLSConfig(opts, logrus.New())
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, config.CipherSuites)
+}
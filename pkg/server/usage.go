@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"aktuell/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// credentialUsage counts the use of an API key across all its connections
+// and enforces the key's rate limit
+type credentialUsage struct {
+	name        string
+	clients     atomic.Int64
+	messages    atomic.Uint64
+	requests    atomic.Uint64
+	rateLimited atomic.Uint64
+	bucket      atomic.Pointer[tokenBucket] // nil without rate limit
+}
+
+// CredentialStats is the usage of an API key reported by /stats
+type CredentialStats struct {
+	Clients     int64  `json:"clients"`
+	Messages    uint64 `json:"messages"`
+	Requests    uint64 `json:"requests"`
+	RateLimited uint64 `json:"rate_limited"`
+}
+
+// usageOf returns the usage record of a principal's API key, or nil for
+// other principals. The key's rate limit is updated if it changed.
+func (h *Hub) usageOf(principal *models.Principal) *credentialUsage {
+	if principal == nil || principal.Method != models.AuthMethodAPIKey {
+		return nil
+	}
+
+	h.usageMu.Lock()
+	defer h.usageMu.Unlock()
+
+	usage, ok := h.usage[principal.Subject]
+	if !ok {
+		usage = &credentialUsage{name: principal.Subject}
+		h.usage[principal.Subject] = usage
+	}
+
+	bucket := usage.bucket.Load()
+	switch {
+	case principal.RateLimit == nil:
+		usage.bucket.Store(nil)
+	case bucket == nil:
+		usage.bucket.Store(newTokenBucket(*principal.RateLimit))
+	case bucket.limit != *principal.RateLimit:
+		bucket.setLimit(*principal.RateLimit)
+	}
+	return usage
+}
+
+// allow takes a token from the key's rate limit
+func (u *credentialUsage) allow() bool {
+	bucket := u.bucket.Load()
+	if bucket == nil || bucket.allow() {
+		return true
+	}
+	u.rateLimited.Add(1)
+	return false
+}
+
+// allowMessage checks a client message against the rate limits of the
+// connection, its identity and its API key. Messages over a limit are
+// answered with an error and dropped.
+func (c *Client) allowMessage(message *models.ClientMessage) bool {
+	if message.Type == models.MessageTypeAck {
+		// Throttling acks would only cause redeliveries
+		return true
+	}
+	if c.usage != nil {
+		c.usage.messages.Add(1)
+	}
+
+	var limit string
+	switch {
+	case !allowed(c.limits.messages):
+		limit = limitMessages
+	case !allowed(c.limits.shared):
+		limit = limitIdentityMessages
+	case c.usage != nil && !c.usage.allow():
+		limit = limitAPIKey
+	default:
+		return true
+	}
+	if limit == limitAPIKey {
+		c.hub.logger.WithFields(logrus.Fields{
+			"client_id": c.ID,
+			"api_key":   c.usage.name,
+			"type":      message.Type,
+		}).Warn("API key rate limit exceeded")
+	}
+	c.limitExceeded(message.RequestID, models.ErrorCodeRateLimited, limit, "Rate limit exceeded")
+	return false
+}
+
+// StatsAdminRole is the role that may see the usage of every API key in /stats
+const StatsAdminRole = "admin"
+
+// stats returns the usage of the API keys that were used and the principal
+// may see: all for the admin role, otherwise only the principal's own key
+func (h *Hub) stats(principal *models.Principal) map[string]CredentialStats {
+	h.usageMu.Lock()
+	defer h.usageMu.Unlock()
+
+	all := principal.HasRole(StatsAdminRole)
+	stats := make(map[string]CredentialStats)
+	for name, usage := range h.usage {
+		if !all && (principal == nil || principal.Method != models.AuthMethodAPIKey || principal.Subject != name) {
+			continue
+		}
+		stats[name] = CredentialStats{
+			Clients:     usage.clients.Load(),
+			Messages:    usage.messages.Load(),
+			Requests:    usage.requests.Load(),
+			RateLimited: usage.rateLimited.Load(),
+		}
+	}
+	return stats
+}
+
+// handleStats reports connected clients and the API key usage the caller may
+// see. It requires authentication if the server does.
+func (h *Hub) handleStats(w http.ResponseWriter, r *http.Request) {
+	principal, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if usage := h.usageOf(principal); usage != nil {
+		usage.requests.Add(1)
+		if !usage.allow() {
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"clients":  h.ClientCount(),
+		"api_keys": h.stats(principal),
+	}); err != nil {
+		h.logger.WithError(err).Warn("Failed to encode stats response")
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"aktuell/pkg/auth"
+	"aktuell/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAPIKeyServer starts a server that accepts the given API keys
+func newAPIKeyServer(t *testing.T, keys ...auth.APIKey) (*WebSocketServer, string) {
+	t.Helper()
+
+	ws, url := newSessionServer(t, 0)
+	authenticator, err := auth.NewAPIKeyAuthenticator(auth.APIKeyOptions{Keys: keys}, nil)
+	require.NoError(t, err)
+	ws.SetAuthenticator(authenticator)
+	return ws, url
+}
+
+// dialAPIKey connects with an API key
+func dialAPIKey(t *testing.T, url, key string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{auth.DefaultAPIKeyHeader: {key}})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	return conn
+}
+
+func TestAPIKey_RestrictsNamespaces(t *testing.T) {
+	_, url := newAPIKeyServer(t, auth.APIKey{Name: "billing-worker", Key: "secret", Namespaces: []string{"billing"}})
+
+	conn := dialAPIKey(t, url, "secret")
+	subscribe := func(database string) *models.ServerMessage {
+		require.NoError(t, conn.WriteJSON(&models.ClientMessage{Type: models.MessageTypeSubscribe, RequestID: "req", Database: database, Collection: "invoices"}))
+		return readMessage(t, conn)
+	}
+	assert.True(t, subscribe("billing").Success)
+
+	denied := subscribe("shop")
+	assert.Equal(t, models.ErrorCodeForbidden, denied.ErrorCode)
+	assert.Equal(t, models.DenialNamespaceNotAllowed, reason(denied))
+}
+
+func TestAPIKey_RateLimitIsSharedByConnections(t *testing.T) {
+	_, url := newAPIKeyServer(t, auth.APIKey{Name: "worker", Key: "secret", RateLimit: 0.1, Burst: 2})
+
+	first := dialAPIKey(t, url, "secret")
+	second := dialAPIKey(t, url, "secret")
+	ping := func(conn *websocket.Conn) *models.ServerMessage {
+		require.NoError(t, conn.WriteJSON(&models.ClientMessage{Type: models.MessageTypePing, RequestID: "ping"}))
+		return readMessage(t, conn)
+	}
+
+	assert.Equal(t, models.MessageTypePong, ping(first).Type)
+	assert.Equal(t, models.MessageTypePong, ping(second).Type)
+	limited := ping(first)
+	assert.Equal(t, models.ErrorCodeRateLimited, limited.ErrorCode)
+	assert.Equal(t, "ping", limited.RequestID)
+}
+
+func TestAPIKey_Stats(t *testing.T) {
+	ws, url := newAPIKeyServer(t,
+		auth.APIKey{Name: "worker", Key: "secret"},
+		auth.APIKey{Name: "limited", Key: "slow", RateLimit: 0.1, Burst: 1, Roles: []string{StatsAdminRole}},
+	)
+	conn := dialAPIKey(t, url, "secret")
+	require.NoError(t, conn.WriteJSON(&models.ClientMessage{Type: models.MessageTypePing}))
+	readMessage(t, conn)
+	onlyClient(t, ws)
+
+	statsURL := "http" + strings.TrimSuffix(strings.TrimPrefix(url, "ws"), "/ws") + "/stats"
+	get := func(key string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, statsURL, nil)
+		require.NoError(t, err)
+		if key != "" {
+			req.Header.Set(auth.DefaultAPIKeyHeader, key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get("").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, get("wrong").StatusCode)
+
+	resp := get("slow")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var stats struct {
+		Clients int                        `json:"clients"`
+		APIKeys map[string]CredentialStats `json:"api_keys"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, 1, stats.Clients)
+	assert.Equal(t, CredentialStats{Clients: 1, Messages: 1}, stats.APIKeys["worker"])
+	assert.Equal(t, CredentialStats{Requests: 1}, stats.APIKeys["limited"])
+
+	assert.Equal(t, http.StatusTooManyRequests, get("slow").StatusCode)
+}
+
+func TestAPIKey_StatsShowOnlyOwnKeyToNonAdmins(t *testing.T) {
+	ws, url := newAPIKeyServer(t,
+		auth.APIKey{Name: "worker", Key: "secret"},
+		auth.APIKey{Name: "other", Key: "other-secret"},
+	)
+	conn := dialAPIKey(t, url, "other-secret")
+	require.NoError(t, conn.WriteJSON(&models.ClientMessage{Type: models.MessageTypePing}))
+	readMessage(t, conn)
+	onlyClient(t, ws)
+
+	statsURL := "http" + strings.TrimSuffix(strings.TrimPrefix(url, "ws"), "/ws") + "/stats"
+	req, err := http.NewRequest(http.MethodGet, statsURL, nil)
+	require.NoError(t, err)
+	req.Header.Set(auth.DefaultAPIKeyHeader, "secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var stats struct {
+		APIKeys map[string]CredentialStats `json:"api_keys"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, map[string]CredentialStats{"worker": {Requests: 1}}, stats.APIKeys)
+}
+
+func TestHub_StatsWithoutPrincipal(t *testing.T) {
+	hub := &Hub{usage: make(map[string]*credentialUsage)}
+	hub.usageOf(&models.Principal{Subject: "worker", Method: models.AuthMethodAPIKey})
+
+	assert.Empty(t, hub.stats(nil), "no key usage without authentication")
+	assert.Len(t, hub.stats(&models.Principal{Subject: "root", Roles: []string{StatsAdminRole}}), 1)
+}
@@ -2,15 +2,17 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"os"
-	"strings"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"aktuell/pkg/auth"
 	"aktuell/pkg/models"
 
 	"github.com/google/uuid"
@@ -21,12 +23,18 @@ import (
 // Hub maintains the set of active clients and broadcasts messages to the clients
 type Hub struct {
 	clients    map[*Client]bool
+	sessions   map[string]*Client // Session token -> client, including detached sessions
 	broadcast  chan *models.ServerMessage
 	register   chan *Client
 	unregister chan *Client
+	resume     chan *resumeRequest
 	logger     *logrus.Logger
 	wsServer   *WebSocketServer
 	mu         sync.RWMutex
+
+	usage      map[string]*credentialUsage // API key name -> usage
+	identities map[string]*identityLimit   // Identity -> shared message rate
+	usageMu    sync.Mutex                  // Guards usage and identities
 }
 
 func (h *Hub) ClientCount() int {
@@ -39,10 +47,24 @@ func (h *Hub) ClientCount() int {
 type Client struct {
 	ID            string
 	hub           *Hub
-	conn          *websocket.Conn
-	send          chan *models.ServerMessage
+	link          *link                      // Current connection; nil while a session is detached
+	send          chan *models.ServerMessage // Never closed, as producers may still send after removal
+	removed       chan struct{}              // Closed when the hub drops the client
 	subscriptions map[string]*models.Subscription
-	closed        bool // Track if connection has been closed
+	conflators    map[string]*conflator     // Subscription ID -> conflator for conflated subscriptions
+	trackers      map[string]*ackTracker    // Subscription ID -> tracker for acknowledged subscriptions
+	filters       map[string]*rowFilter     // Subscription ID -> row filter of subscriptions restricted by policy
+	usage         *credentialUsage          // Usage of the client's API key; nil for other principals
+	limits        *clientLimits             // Message rates, subscriptions and snapshots of the connection
+	sequences     map[string]*atomic.Uint64 // Subscription ID -> last sequence number sent
+	batching      batchWindow               // Negotiated change batching window
+	session       string                    // Session token; empty if sessions are disabled
+	grace         *time.Timer               // Expires a detached session
+	unsent        []*models.ServerMessage
+	principal     *models.Principal // Authenticated identity; nil without authentication
+	expiry        *time.Timer       // Closes the connection when the credentials expire
+	slow          atomic.Bool       // Set once a conflated change overflowed the queue
+	attachMu      sync.Mutex        // Serializes re-attaching connections to a session
 	mu            sync.RWMutex
 }
 
@@ -53,78 +75,17 @@ type WebSocketServer struct {
 	logger           *logrus.Logger
 	validator        models.SubscriptionValidator
 	snapshotStreamer models.SnapshotStreamer
+	replay           *replayBuffer
+	sessions         SessionOptions
+	authenticator    auth.Authenticator
+	redactor         models.Redactor
+	origins          *originPolicy
+	limits           LimitOptions
+	upgrader         websocket.Upgrader
 	actualAddr       string     // Store the actual listening address
 	addrMu           sync.Mutex // Protect actualAddr field
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  4096, // Increased from 1024
-	WriteBufferSize: 4096, // Increased from 1024
-	CheckOrigin:     checkOrigin,
-}
-
-// getDefaultAllowedOrigins returns default origins based on environment
-func getDefaultAllowedOrigins() []string {
-	env := os.Getenv("AKTUELL_ENV")
-	if env == "production" {
-		// In production, only allow explicitly configured origins
-		return []string{}
-	}
-
-	// Development defaults
-	return []string{
-		"http://localhost:3000",  // React development server
-		"http://localhost:8080",  // Alternative dev server
-		"https://localhost:3000", // HTTPS dev server
-	}
-}
-
-// checkOrigin validates WebSocket connection origins for security
-func checkOrigin(r *http.Request) bool {
-	origin := r.Header.Get("Origin")
-
-	// In development mode (when AKTUELL_ENV != "production"), allow localhost origins
-	env := os.Getenv("AKTUELL_ENV")
-	if env != "production" {
-		if origin == "" {
-			return true // Allow same-origin requests
-		}
-
-		// Allow any localhost or 127.0.0.1 origin in development
-		if strings.Contains(origin, "localhost") || strings.Contains(origin, "127.0.0.1") {
-			return true
-		}
-	}
-
-	// Priority 1: Check custom allowed origins from environment variable
-	if customOrigins := os.Getenv("AKTUELL_ALLOWED_ORIGINS"); customOrigins != "" {
-		customList := strings.Split(customOrigins, ",")
-		for _, allowed := range customList {
-			if strings.TrimSpace(allowed) == origin {
-				return true
-			}
-		}
-
-		// In production, if AKTUELL_ALLOWED_ORIGINS is set, ONLY use those origins
-		if env == "production" {
-			log.Printf("WebSocket connection rejected from origin: %s (not in AKTUELL_ALLOWED_ORIGINS)", origin)
-			return false
-		}
-	}
-
-	// Priority 2: Check default allowed origins (only used in development)
-	defaultOrigins := getDefaultAllowedOrigins()
-	for _, allowed := range defaultOrigins {
-		if origin == allowed {
-			return true
-		}
-	}
-
-	// Log rejected origins for security monitoring
-	log.Printf("WebSocket connection rejected from origin: %s (remote: %s)", origin, r.RemoteAddr)
-	return false
-}
-
 // NewWebSocketServer creates a new WebSocket server
 func NewWebSocketServer(addr string, logger *logrus.Logger) *WebSocketServer {
 	ws := &WebSocketServer{
@@ -134,14 +95,28 @@ func NewWebSocketServer(addr string, logger *logrus.Logger) *WebSocketServer {
 			WriteTimeout: 60 * time.Second,
 			IdleTimeout:  120 * time.Second,
 		},
-		logger: logger,
+		logger:   logger,
+		sessions: SessionOptions{QueueSize: defaultQueueSize},
+		limits:   LimitOptions{MaxMessageSize: defaultMaxMessageSize, ViolationWindow: defaultViolationWindow},
+	}
+	// Without options only the server's own origin and non-browser clients
+	// may connect
+	ws.origins, _ = newOriginPolicy(OriginOptions{})
+	ws.upgrader = websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin:     ws.checkOrigin,
 	}
 
 	hub := &Hub{
 		clients:    make(map[*Client]bool),
+		sessions:   make(map[string]*Client),
 		broadcast:  make(chan *models.ServerMessage),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		resume:     make(chan *resumeRequest),
+		usage:      make(map[string]*credentialUsage),
+		identities: make(map[string]*identityLimit),
 		logger:     logger,
 		wsServer:   ws, // Set the reference back to the WebSocket server
 	}
@@ -150,7 +125,8 @@ func NewWebSocketServer(addr string, logger *logrus.Logger) *WebSocketServer {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", hub.handleWebSocket)
-	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/health", ws.cors(handleHealth))
+	mux.HandleFunc("/stats", ws.cors(hub.handleStats))
 
 	ws.server.Handler = mux
 
@@ -167,12 +143,31 @@ func (ws *WebSocketServer) SetSnapshotStreamer(streamer models.SnapshotStreamer)
 	ws.snapshotStreamer = streamer
 }
 
+// SetReplayOptions enables the replay log that lets subscriptions resume
+// after a reconnect. It must be called before Start.
+func (ws *WebSocketServer) SetReplayOptions(opts ReplayOptions) error {
+	if opts.MaxEvents <= 0 {
+		ws.replay = nil
+		return nil
+	}
+
+	replay, err := newReplayBuffer(opts, ws.logger)
+	if err != nil {
+		return err
+	}
+	ws.replay = replay
+	return nil
+}
+
 // Start starts the WebSocket server and hub
 func (ws *WebSocketServer) Start() error {
 	// Start the hub in a goroutine
 	go ws.hub.run()
 
-	ws.logger.WithField("addr", ws.server.Addr).Info("Starting WebSocket server")
+	ws.logger.WithFields(logrus.Fields{
+		"addr": ws.server.Addr,
+		"tls":  ws.server.TLSConfig != nil,
+	}).Info("Starting WebSocket server")
 
 	// Create a listener to get the actual address
 	listener, err := net.Listen("tcp", ws.server.Addr)
@@ -185,6 +180,10 @@ func (ws *WebSocketServer) Start() error {
 	ws.actualAddr = listener.Addr().String()
 	ws.addrMu.Unlock()
 
+	if ws.server.TLSConfig != nil {
+		// Certificates come from the TLS config, which reloads them
+		return ws.server.ServeTLS(listener, "", "")
+	}
 	return ws.server.Serve(listener)
 }
 
@@ -229,19 +228,29 @@ func (h *Hub) run() {
 		case client := <-h.register:
 			h.mu.Lock()
 			h.clients[client] = true
+			if client.session != "" {
+				h.sessions[client.session] = client
+			}
 			h.mu.Unlock()
 
-			h.logger.WithFields(logrus.Fields{
+			fields := logrus.Fields{
 				"client_id":     client.ID,
 				"total_clients": len(h.clients),
-			}).Info("Client connected")
+			}
+			if principal := client.Principal(); principal != nil {
+				fields["subject"] = principal.Subject
+				fields["auth_method"] = principal.Method
+			}
+			h.logger.WithFields(fields).Info("Client connected")
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+			if client.attached() {
+				// The session was re-attached before its grace period ran out
+				h.mu.Unlock()
+				continue
 			}
+			h.removeClient(client)
 			h.mu.Unlock()
 
 			h.logger.WithFields(logrus.Fields{
@@ -249,24 +258,74 @@ func (h *Hub) run() {
 				"total_clients": len(h.clients),
 			}).Info("Client disconnected")
 
+		case req := <-h.resume:
+			h.handleResume(req)
+
 		case message := <-h.broadcast:
+			if message.Change != nil && h.wsServer != nil && h.wsServer.replay != nil {
+				h.wsServer.replay.append(message.Change)
+			}
+
+			var slowClients []*Client
 			h.mu.RLock()
 			for client := range h.clients {
 				// Check if client is subscribed to this change
-				if h.isClientSubscribed(client, message) {
-					select {
-					case client.send <- message:
-					default:
-						close(client.send)
-						delete(h.clients, client)
+				if !h.isClientSubscribed(client, message) {
+					continue
+				}
+				outgoing := message
+				if message.Change != nil {
+					// Conflated subscriptions receive the change later from their conflator
+					change, subscriptionIDs, sequences := client.routeChange(message.Change)
+					if len(subscriptionIDs) == 0 {
+						continue
 					}
+					outgoing = &models.ServerMessage{
+						Type:            message.Type,
+						Change:          change,
+						SubscriptionIDs: subscriptionIDs,
+						Sequences:       sequences,
+					}
+				}
+				select {
+				case client.send <- outgoing:
+				default:
+					slowClients = append(slowClients, client)
 				}
 			}
 			h.mu.RUnlock()
+
+			if len(slowClients) > 0 {
+				h.mu.Lock()
+				for _, client := range slowClients {
+					h.removeClient(client)
+				}
+				h.mu.Unlock()
+			}
 		}
 	}
 }
 
+// removeClient drops a client from the hub and tells its writePump to end
+// the connection. The send channel stays open: the read pump, ack trackers
+// and conflators may still send to it. Caller must hold h.mu.
+func (h *Hub) removeClient(client *Client) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	delete(h.clients, client)
+	if client.session != "" && h.sessions[client.session] == client {
+		delete(h.sessions, client.session)
+	}
+	client.stopDelivery()
+	client.stopExpiry()
+	if client.usage != nil {
+		client.usage.clients.Add(-1)
+	}
+	h.releaseIdentityLimit(client)
+	close(client.removed)
+}
+
 // isClientSubscribed checks if a client is subscribed to the change event
 func (h *Hub) isClientSubscribed(client *Client, message *models.ServerMessage) bool {
 	if message.Change == nil {
@@ -283,8 +342,7 @@ func (h *Hub) isClientSubscribed(client *Client, message *models.ServerMessage)
 
 	// Check if any subscription matches the change
 	for _, sub := range client.subscriptions {
-		if sub.Database == message.Change.Database &&
-			(sub.Collection == "" || sub.Collection == message.Change.Collection) {
+		if subscriptionMatches(sub, message.Change) {
 			return true
 		}
 	}
@@ -292,66 +350,254 @@ func (h *Hub) isClientSubscribed(client *Client, message *models.ServerMessage)
 	return false
 }
 
+// routeChange hands the change, redacted for the client, to the ack trackers
+// and conflators of matching subscriptions. It returns the redacted change
+// and the IDs of the subscriptions that still need it delivered immediately,
+// with the next sequence number of each.
+func (c *Client) routeChange(change *models.ChangeEvent) (*models.ChangeEvent, []string, []uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	redacted := change
+	var immediate []string
+	for id, sub := range c.subscriptions {
+		if !subscriptionMatches(sub, change) {
+			continue
+		}
+		if f, ok := c.filters[id]; ok && !f.allows(change) {
+			continue
+		}
+		if redacted == change {
+			redacted = c.redactChange(change)
+		}
+		if tr, ok := c.trackers[id]; ok {
+			tr.add(redacted)
+		} else if cf, ok := c.conflators[id]; ok {
+			cf.add(redacted)
+		} else {
+			immediate = append(immediate, id)
+		}
+	}
+	sort.Strings(immediate)
+
+	var sequences []uint64
+	for _, id := range immediate {
+		sequences = append(sequences, c.nextSequence(id))
+	}
+	return redacted, immediate, sequences
+}
+
+// nextSequence returns the next sequence number of a subscription. Each
+// subscription has a single sender at a time (hub, conflator or ack
+// tracker), so numbers are queued in order. Caller holds c.mu.
+func (c *Client) nextSequence(subscriptionID string) uint64 {
+	if seq, ok := c.sequences[subscriptionID]; ok {
+		return seq.Add(1)
+	}
+	return 0
+}
+
+// subscriptionMatches reports whether a change falls within a subscription's namespace
+func subscriptionMatches(sub *models.Subscription, change *models.ChangeEvent) bool {
+	return sub.Database == change.Database &&
+		(sub.Collection == "" || sub.Collection == change.Collection)
+}
+
+// conflatedSender returns the flush function for a subscription's conflator
+func (c *Client) conflatedSender(subscriptionID string, seq *atomic.Uint64) func(*models.ChangeEvent) {
+	return func(change *models.ChangeEvent) {
+		message := &models.ServerMessage{
+			Type:            models.MessageTypeChange,
+			Change:          change,
+			SubscriptionIDs: []string{subscriptionID},
+			Sequences:       []uint64{seq.Add(1)},
+		}
+
+		select {
+		case c.send <- message:
+		default:
+			c.dropSlow()
+		}
+	}
+}
+
+// dropSlow disconnects a client whose queue overflowed outside a broadcast,
+// as the hub does with slow clients. It runs the removal on its own
+// goroutine because the caller may hold the hub's or a conflator's lock.
+// The client finds the lost changes as a gap when it resumes.
+func (c *Client) dropSlow() {
+	if !c.slow.CompareAndSwap(false, true) {
+		return
+	}
+	c.hub.logger.WithField("client_id", c.ID).Warn("Send queue full, disconnecting slow client")
+
+	go func() {
+		c.hub.mu.Lock()
+		defer c.hub.mu.Unlock()
+		c.hub.removeClient(c)
+	}()
+}
+
+// stopDelivery drops all subscriptions of the client and stops their
+// conflators and ack trackers
+func (c *Client) stopDelivery() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopDeliveryLocked()
+}
+
+// stopDeliveryLocked is stopDelivery for callers holding c.mu
+func (c *Client) stopDeliveryLocked() {
+	for id := range c.subscriptions {
+		c.removeSubscriptionLocked(id)
+	}
+	// State left behind by subscriptions that are already gone
+	for _, cf := range c.conflators {
+		cf.stop()
+	}
+	for _, tr := range c.trackers {
+		tr.stop()
+	}
+	c.subscriptions = make(map[string]*models.Subscription)
+	c.conflators = make(map[string]*conflator)
+	c.trackers = make(map[string]*ackTracker)
+	c.filters = make(map[string]*rowFilter)
+	c.sequences = make(map[string]*atomic.Uint64)
+}
+
+// removeSubscriptionLocked drops a subscription with its conflator, ack
+// tracker, row filter and sequence. Caller holds c.mu.
+func (c *Client) removeSubscriptionLocked(id string) {
+	delete(c.subscriptions, id)
+	if cf, ok := c.conflators[id]; ok {
+		cf.stop()
+		delete(c.conflators, id)
+	}
+	if tr, ok := c.trackers[id]; ok {
+		tr.stop()
+		delete(c.trackers, id)
+	}
+	delete(c.filters, id)
+	delete(c.sequences, id)
+}
+
 // handleWebSocket handles WebSocket upgrade and client management
 func (h *Hub) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	principal, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	opts := h.sessionOptions()
+
+	// Re-attach a detached session instead of starting from scratch
+	var session *Client
+	responseHeader := http.Header{}
+	selectSubprotocol(r, responseHeader)
+	if opts.GracePeriod > 0 {
+		if token := sessionToken(r); token != "" {
+			session = h.lookupSession(token)
+		}
+		if session != nil && !samePrincipal(session.Principal(), principal) {
+			h.logger.WithField("client_id", session.ID).Warn("Refused to re-attach session of another principal")
+			session = nil
+		}
+		if session != nil {
+			responseHeader.Set(models.HeaderSession, session.session)
+			responseHeader.Set(models.HeaderSessionResumed, "true")
+		} else {
+			responseHeader.Set(models.HeaderSession, uuid.New().String())
+		}
+	}
+
+	conn, err := h.wsServer.upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to upgrade WebSocket connection")
 		return
 	}
 
-	client := &Client{
-		ID:            uuid.New().String(),
-		hub:           h,
-		conn:          conn,
-		send:          make(chan *models.ServerMessage, 1024), // Increased from 256
-		subscriptions: make(map[string]*models.Subscription),
+	if session != nil {
+		session.setPrincipal(principal)
+		if !session.attach(conn) {
+			// The session expired during the handshake; the client reconnects
+			// and starts a new one
+			h.logger.WithField("client_id", session.ID).Info("Session expired before it could be re-attached")
+			if err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "session expired")); err != nil {
+				h.logger.WithError(err).Debug("Failed to send close message")
+			}
+			conn.Close()
+		}
+		return
+	}
+
+	client := newClient(h, newLink(conn), opts.QueueSize)
+	client.setPrincipal(principal)
+	h.acquireIdentityLimit(client, principal)
+	if client.usage = h.usageOf(principal); client.usage != nil {
+		client.usage.clients.Add(1)
+	}
+	client.session = responseHeader.Get(models.HeaderSession)
+	if client.session != "" {
+		client.unsent = []*models.ServerMessage{sessionMessage(client.session, false)}
 	}
 
 	client.hub.register <- client
 
 	// Start client goroutines
-	go client.writePump()
-	go client.readPump()
+	go client.writePump(client.link)
+	go client.readPump(client.link)
 }
 
-// safeClose safely closes the WebSocket connection, preventing multiple closes
-func (c *Client) safeClose() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if !c.closed {
-		c.closed = true
-		c.conn.Close()
+// newClient creates a client with an outbound queue of the given size
+func newClient(h *Hub, l *link, queueSize int) *Client {
+	return &Client{
+		ID:            uuid.New().String(),
+		hub:           h,
+		link:          l,
+		send:          make(chan *models.ServerMessage, queueSize),
+		removed:       make(chan struct{}),
+		subscriptions: make(map[string]*models.Subscription),
+		conflators:    make(map[string]*conflator),
+		trackers:      make(map[string]*ackTracker),
+		filters:       make(map[string]*rowFilter),
+		sequences:     make(map[string]*atomic.Uint64),
+		limits:        newClientLimits(h.limitOptions()),
 	}
 }
 
 // readPump handles incoming messages from the client
-func (c *Client) readPump() {
-	defer func() {
-		c.hub.unregister <- c
-		c.safeClose()
-	}()
+func (c *Client) readPump(l *link) {
+	defer c.detach(l)
 
-	if err := c.conn.SetReadDeadline(time.Now().Add(60 * time.Second)); err != nil {
+	if err := l.conn.SetReadDeadline(time.Now().Add(60 * time.Second)); err != nil {
 		c.hub.logger.WithError(err).Error("Failed to set read deadline")
 		return
 	}
-	c.conn.SetPongHandler(func(string) error {
-		if err := c.conn.SetReadDeadline(time.Now().Add(60 * time.Second)); err != nil {
+	l.conn.SetReadLimit(c.limits.opts.MaxMessageSize)
+	l.conn.SetPongHandler(func(string) error {
+		if err := l.conn.SetReadDeadline(time.Now().Add(60 * time.Second)); err != nil {
 			c.hub.logger.WithError(err).Error("Failed to set read deadline in pong handler")
 		}
 		return nil
 	})
 
 	for {
-		_, messageBytes, err := c.conn.ReadMessage()
+		_, messageBytes, err := l.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				// The connection closes with 1009 (message too big)
+				c.hub.logger.WithFields(logrus.Fields{
+					"client_id": c.ID,
+					"limit":     c.limits.opts.MaxMessageSize,
+				}).Warn("Client message exceeds the size limit, closing connection")
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				c.hub.logger.WithError(err).Error("WebSocket error")
 			}
 			break
 		}
+		if l.ending.Load() {
+			// The server is closing the link; further requests are ignored
+			continue
+		}
 
 		var clientMessage models.ClientMessage
 		if err := json.Unmarshal(messageBytes, &clientMessage); err != nil {
@@ -363,70 +609,228 @@ func (c *Client) readPump() {
 	}
 }
 
-// writePump handles outgoing messages to the client
-func (c *Client) writePump() {
+// writePump handles outgoing messages to the client. Messages it could not
+// write before the link went away are kept for the next link of the session.
+func (c *Client) writePump(l *link) {
 	ticker := time.NewTicker(54 * time.Second)
+	flushTimer := time.NewTimer(time.Hour)
+	flushTimer.Stop()
+
+	var batch changeBatch
 	defer func() {
 		ticker.Stop()
-		c.safeClose()
+		flushTimer.Stop()
+		if message, _ := batch.take(); message != nil {
+			c.keepUnsent(message)
+		}
+		l.close()
+		close(l.writeDone)
 	}()
 
+	// Messages left over from a previous link go out first
+	c.mu.Lock()
+	unsent := c.unsent
+	c.unsent = nil
+	c.mu.Unlock()
+	for i, message := range unsent {
+		if c.writeMessage(l, message) != nil {
+			c.keepUnsent(unsent[i+1:]...)
+			return
+		}
+	}
+
 	for {
+		// A final message takes precedence over queued ones
+		select {
+		case message := <-l.final:
+			c.writeFinal(l, message)
+			return
+		default:
+		}
+
 		select {
-		case message, ok := <-c.send:
-			if !ok {
-				// Check if connection is still open before sending close message
-				c.mu.RLock()
-				isClosed := c.closed
-				c.mu.RUnlock()
-
-				if !isClosed {
-					if err := c.conn.WriteMessage(websocket.CloseMessage, []byte{}); err != nil {
-						// Only log as debug since connection may have been closed by peer
-						c.hub.logger.WithError(err).Debug("Failed to send close message - connection may already be closed")
+		case <-l.done:
+			return
+
+		case message := <-l.final:
+			c.writeFinal(l, message)
+			return
+
+		case <-c.removed:
+			// Check if connection is still open before sending close message
+			if !l.closed() {
+				if c.flushQueued(l, &batch) != nil {
+					return
+				}
+				if err := l.conn.WriteMessage(websocket.CloseMessage, []byte{}); err != nil {
+					// Only log as debug since connection may have been closed by peer
+					c.hub.logger.WithError(err).Debug("Failed to send close message - connection may already be closed")
+				}
+			}
+			return
+
+		case message := <-c.send:
+			// Group change events into a single frame when batching was negotiated
+			window := c.batchWindow()
+			if window.enabled() && message.Type == models.MessageTypeChange {
+				full, err := c.batchChange(l, &batch, message, window)
+				if err != nil {
+					return
+				}
+				if !full {
+					if full, err = c.drainChanges(l, &batch, window); err != nil {
+						return
 					}
 				}
-				return
+				if full || window.maxDelay == 0 {
+					flushTimer.Stop()
+					if c.writeBatch(l, &batch) != nil {
+						return
+					}
+				} else if len(batch.messages) == 1 {
+					flushTimer.Reset(window.maxDelay)
+				}
+				continue
 			}
 
-			// Set longer write deadline for snapshot messages which can be large
-			writeDeadline := 10 * time.Second
-			if message.Type == models.MessageTypeSnapshot {
-				writeDeadline = 30 * time.Second // Longer timeout for snapshot data
+			// Preserve ordering: pending changes go out before anything else
+			if !batch.empty() {
+				flushTimer.Stop()
+				if c.writeBatch(l, &batch) != nil {
+					c.keepUnsent(message)
+					return
+				}
 			}
-			if err := c.conn.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
-				c.hub.logger.WithError(err).Error("Failed to set write deadline")
+			if c.writeMessage(l, message) != nil {
 				return
 			}
 
-			if err := c.conn.WriteJSON(message); err != nil {
-				c.hub.logger.WithError(err).WithFields(logrus.Fields{
-					"client_id":    c.ID,
-					"message_type": message.Type,
-				}).Error("Failed to write message to client")
+		case <-flushTimer.C:
+			if c.writeBatch(l, &batch) != nil {
 				return
 			}
 
-			// Log successful message sends for debugging
-			c.hub.logger.WithFields(logrus.Fields{
-				"client_id":    c.ID,
-				"message_type": message.Type,
-			}).Debug("Successfully sent message to client")
-
 		case <-ticker.C:
-			if err := c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+			if err := l.conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
 				c.hub.logger.WithError(err).Error("Failed to set write deadline for ping")
 				return
 			}
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := l.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
 		}
 	}
 }
 
+// drainChanges moves change messages that are already queued into the batch
+// without waiting. A non-change message ends the drain: the batch is written
+// ahead of it to preserve ordering. It reports whether the batch is full.
+func (c *Client) drainChanges(l *link, batch *changeBatch, window batchWindow) (bool, error) {
+	for {
+		select {
+		case message := <-c.send:
+			if message.Type != models.MessageTypeChange {
+				if err := c.writeBatch(l, batch); err != nil {
+					c.keepUnsent(message)
+					return false, err
+				}
+				return false, c.writeMessage(l, message)
+			}
+			full, err := c.batchChange(l, batch, message, window)
+			if full || err != nil {
+				return full, err
+			}
+		default:
+			return false, nil
+		}
+	}
+}
+
+// flushQueued writes the pending batch and the messages queued so far, so a
+// removed client still receives what was sent to it before
+func (c *Client) flushQueued(l *link, batch *changeBatch) error {
+	if err := c.writeBatch(l, batch); err != nil {
+		return err
+	}
+	for queued := len(c.send); queued > 0; queued-- {
+		if err := c.writeMessage(l, <-c.send); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFinal writes the last message of a link followed by a close frame.
+// Queued messages are not flushed ahead of it; with sessions they are kept
+// for the next link.
+func (c *Client) writeFinal(l *link, message *models.ServerMessage) {
+	if err := l.conn.SetWriteDeadline(time.Now().Add(finalWriteTimeout)); err != nil {
+		c.hub.logger.WithError(err).Debug("Failed to set write deadline for final message")
+		return
+	}
+	if err := l.conn.WriteJSON(message); err != nil {
+		c.hub.logger.WithError(err).Debug("Failed to send final message - connection may already be closed")
+		return
+	}
+	if err := l.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, message.Error)); err != nil {
+		c.hub.logger.WithError(err).Debug("Failed to send close message")
+	}
+}
+
+// writeMessage writes a single message to the link with a deadline. A message
+// that fails to be written is kept for the session's next link.
+func (c *Client) writeMessage(l *link, message *models.ServerMessage) error {
+	if message == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		c.hub.logger.WithError(err).WithFields(logrus.Fields{
+			"client_id":    c.ID,
+			"message_type": message.Type,
+		}).Error("Failed to encode message")
+		return nil
+	}
+	return c.writeEncoded(l, message, data)
+}
+
+// writeEncoded writes a message that is already encoded as data
+func (c *Client) writeEncoded(l *link, message *models.ServerMessage, data []byte) error {
+	// Set longer write deadline for snapshot messages which can be large
+	writeDeadline := 10 * time.Second
+	if message.Type == models.MessageTypeSnapshot || message.Type == models.MessageTypeChanges {
+		writeDeadline = 30 * time.Second // Longer timeout for snapshot data
+	}
+	if err := l.conn.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
+		c.hub.logger.WithError(err).Error("Failed to set write deadline")
+		c.keepUnsent(message)
+		return err
+	}
+
+	if err := l.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		c.hub.logger.WithError(err).WithFields(logrus.Fields{
+			"client_id":    c.ID,
+			"message_type": message.Type,
+		}).Error("Failed to write message to client")
+		c.keepUnsent(message)
+		return err
+	}
+
+	// Log successful message sends for debugging
+	c.hub.logger.WithFields(logrus.Fields{
+		"client_id":    c.ID,
+		"message_type": message.Type,
+	}).Debug("Successfully sent message to client")
+	return nil
+}
+
 // handleMessage processes incoming client messages
 func (c *Client) handleMessage(message *models.ClientMessage) {
+	if !c.allowMessage(message) {
+		return
+	}
+
 	switch message.Type {
 	case models.MessageTypeSubscribe:
 		c.handleSubscribe(message)
@@ -436,6 +840,12 @@ func (c *Client) handleMessage(message *models.ClientMessage) {
 		c.handlePing(message)
 	case models.MessageTypeHealth:
 		c.handleHealthWS(message)
+	case models.MessageTypeBatching:
+		c.handleBatching(message)
+	case models.MessageTypeAck:
+		c.handleAck(message)
+	case models.MessageTypeAuth:
+		c.handleAuth(message)
 	default:
 		c.hub.logger.WithField("type", message.Type).Warn("Unknown message type")
 	}
@@ -444,40 +854,63 @@ func (c *Client) handleMessage(message *models.ClientMessage) {
 // handleSubscribe handles subscription requests
 func (c *Client) handleSubscribe(message *models.ClientMessage) {
 	// Validate the subscription if a validator is available
-	if c.hub.wsServer != nil && c.hub.wsServer.validator != nil {
-		if !c.hub.wsServer.validator.IsValidSubscription(message.Database, message.Collection) {
-			// Send error response for invalid subscription
-			response := &models.ServerMessage{
-				Type:      models.MessageTypeError,
-				Success:   false,
-				Error:     fmt.Sprintf("Invalid subscription: database '%s' collection '%s' is not configured on the server", message.Database, message.Collection),
-				RequestID: message.RequestID,
-				ErrorCode: 1,
-			}
-
-			select {
-			case c.send <- response:
-			default:
-				c.hub.logger.Warn("Failed to send subscription error response")
-			}
+	var filter map[string]interface{}
+	if c.hub.wsServer != nil {
+		var denial *models.Denial
+		if filter, denial = c.authorizeSubscription(message); denial != nil {
+			c.sendDenial(message.RequestID, denial)
 
 			c.hub.logger.WithFields(logrus.Fields{
 				"client_id":  c.ID,
 				"database":   message.Database,
 				"collection": message.Collection,
-			}).Warn("Client attempted to subscribe to non-configured database/collection")
+				"reason":     denial.Reason,
+			}).Warn("Client subscription denied")
+			return
+		}
+	}
+
+	var conflateEvery time.Duration
+	if message.Conflate != nil {
+		interval, err := conflateInterval(message.Conflate)
+		if err != nil {
+			c.sendError(message.RequestID, models.ErrorCodeInvalidOptions, fmt.Sprintf("Invalid subscription: %v", err))
 			return
 		}
+		conflateEvery = interval
+	}
+	if message.Ack != nil && message.Conflate != nil {
+		c.sendError(message.RequestID, models.ErrorCodeInvalidOptions, "Invalid subscription: ack cannot be combined with conflate")
+		return
+	}
+
+	if message.ResumeFrom != nil && message.SnapshotOptions != nil && message.SnapshotOptions.IncludeSnapshot {
+		c.sendError(message.RequestID, models.ErrorCodeInvalidOptions, "Invalid subscription: resume_from cannot be combined with a snapshot")
+		return
 	}
 
 	// Valid subscription - create it
 	subscription := &models.Subscription{
 		ID:              uuid.New().String(),
 		ClientID:        c.ID,
+		RequestID:       message.RequestID,
 		Database:        message.Database,
 		Collection:      message.Collection,
 		CreatedAt:       time.Now(),
 		SnapshotOptions: message.SnapshotOptions,
+		Conflate:        message.Conflate,
+		Filter:          filter,
+	}
+	if message.Ack != nil {
+		subscription.Ack = negotiateAck(message.Ack)
+		if c.hub.sessionOptions().GracePeriod <= 0 && (c.hub.wsServer == nil || c.hub.wsServer.replay == nil) {
+			// Unacknowledged events are lost with the connection
+			c.hub.logger.WithFields(logrus.Fields{
+				"client_id":  c.ID,
+				"database":   message.Database,
+				"collection": message.Collection,
+			}).Warn("Acknowledged subscription without sessions or replay, events in flight are lost on reconnect")
+		}
 	}
 
 	// Debug: Log what we received
@@ -496,25 +929,23 @@ func (c *Client) handleSubscribe(message *models.ClientMessage) {
 		}).Debug("Snapshot options details")
 	}
 
-	c.mu.Lock()
-	c.subscriptions[subscription.ID] = subscription
-	c.mu.Unlock()
+	// Takes a snapshot slot if a snapshot was requested
+	if !c.allowSubscription(message) {
+		return
+	}
 
-	// Send successful subscription response
-	response := &models.ServerMessage{
+	if message.ResumeFrom != nil {
+		// The hub registers the subscription once missed events are queued
+		c.hub.resume <- &resumeRequest{client: c, subscription: subscription, from: message.ResumeFrom, conflate: conflateEvery}
+		return
+	}
+
+	c.addSubscription(subscription, conflateEvery, &models.ServerMessage{
 		Type:      models.MessageTypeSubscribe,
 		Success:   true,
 		RequestID: message.RequestID,
-		Data: map[string]interface{}{
-			"subscription_id": subscription.ID,
-		},
-	}
-
-	select {
-	case c.send <- response:
-	default:
-		c.hub.logger.Warn("Failed to send subscription response")
-	}
+		Data:      subscribeResponseData(subscription),
+	})
 
 	c.hub.logger.WithFields(logrus.Fields{
 		"client_id":    c.ID,
@@ -522,6 +953,8 @@ func (c *Client) handleSubscribe(message *models.ClientMessage) {
 		"database":     subscription.Database,
 		"collection":   subscription.Collection,
 		"snapshot":     subscription.SnapshotOptions != nil && subscription.SnapshotOptions.IncludeSnapshot,
+		"conflate":     conflateEvery,
+		"ack":          subscription.Ack != nil,
 	}).Info("Client subscribed")
 
 	// Handle snapshot if requested
@@ -530,33 +963,169 @@ func (c *Client) handleSubscribe(message *models.ClientMessage) {
 	}
 }
 
+// authorizeSubscription asks the validator whether the client may subscribe
+// to a namespace and, if requested, receive its snapshot. It returns the row
+// filter of the change events. A policy may limit or filter the snapshot, in
+// which case message.SnapshotOptions is replaced by a copy with the
+// restrictions applied.
+func (c *Client) authorizeSubscription(message *models.ClientMessage) (map[string]interface{}, *models.Denial) {
+	principal := c.Principal()
+	if !auth.NamespaceAllowed(principal, message.Database, message.Collection) {
+		return nil, &models.Denial{
+			Code:    models.ErrorCodeForbidden,
+			Reason:  models.DenialNamespaceNotAllowed,
+			Message: fmt.Sprintf("Access denied: the credentials of %q are not valid for database '%s' collection '%s'", principal.Subject, message.Database, message.Collection),
+		}
+	}
+	if c.hub.wsServer.validator == nil {
+		return nil, nil
+	}
+
+	validator, ok := c.hub.wsServer.validator.(models.AuthorizingValidator)
+	if !ok {
+		if c.hub.wsServer.validator.IsValidSubscription(message.Database, message.Collection) {
+			return nil, nil
+		}
+		return nil, &models.Denial{
+			Code:    models.ErrorCodeInvalidSubscription,
+			Reason:  models.DenialNamespaceNotConfigured,
+			Message: fmt.Sprintf("Invalid subscription: database '%s' collection '%s' is not configured on the server", message.Database, message.Collection),
+		}
+	}
+
+	subscribe := &models.AccessRequest{
+		Principal:  principal,
+		Database:   message.Database,
+		Collection: message.Collection,
+		Operation:  models.AccessSubscribe,
+	}
+	if denial := validator.Authorize(subscribe); denial != nil {
+		return nil, denial
+	}
+
+	if message.SnapshotOptions == nil || !message.SnapshotOptions.IncludeSnapshot {
+		return subscribe.Filter, nil
+	}
+	req := &models.AccessRequest{
+		Principal:     principal,
+		Database:      message.Database,
+		Collection:    message.Collection,
+		Operation:     models.AccessSnapshot,
+		SnapshotLimit: message.SnapshotOptions.SnapshotLimit,
+	}
+	if denial := validator.Authorize(req); denial != nil {
+		return nil, denial
+	}
+	if req.SnapshotLimit != message.SnapshotOptions.SnapshotLimit || req.Filter != nil {
+		options := *message.SnapshotOptions
+		options.SnapshotLimit = req.SnapshotLimit
+		options.RowFilter = req.Filter
+		message.SnapshotOptions = &options
+	}
+	return subscribe.Filter, nil
+}
+
+// sendDenial sends the error of a refused request with its reason
+func (c *Client) sendDenial(requestID string, denial *models.Denial) {
+	response := &models.ServerMessage{
+		Type:      models.MessageTypeError,
+		Success:   false,
+		Error:     denial.Message,
+		RequestID: requestID,
+		ErrorCode: denial.Code,
+		Data:      map[string]interface{}{"reason": denial.Reason},
+	}
+
+	select {
+	case c.send <- response:
+	default:
+		c.hub.logger.Warn("Failed to send subscription error response")
+	}
+}
+
+// addSubscription registers a subscription and its conflator if requested.
+// The response, if any, is queued before c.mu is released, so no change
+// routed to the new subscription can overtake it.
+func (c *Client) addSubscription(subscription *models.Subscription, conflateEvery time.Duration, response *models.ServerMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.subscriptions[subscription.ID] = subscription
+	seq := &atomic.Uint64{}
+	c.sequences[subscription.ID] = seq
+	if conflateEvery > 0 {
+		c.conflators[subscription.ID] = newConflator(conflateEvery, c.conflatedSender(subscription.ID, seq))
+	}
+	if f := newRowFilter(subscription.Filter); f != nil {
+		c.filters[subscription.ID] = f
+	}
+	if subscription.Ack != nil {
+		c.trackers[subscription.ID] = newAckTracker(subscription.ID, subscription.Ack, seq, c.ackedSender(), c.ackOverflow(subscription.ID))
+	}
+
+	if response == nil {
+		return
+	}
+	if data, ok := response.Data.(map[string]interface{}); ok {
+		// The client expects the next event to be numbered one higher
+		data["sequence"] = seq.Load()
+	}
+	select {
+	case c.send <- response:
+	default:
+		c.hub.logger.Warn("Failed to send subscription response")
+	}
+}
+
+// subscribeResponseData describes a created subscription and its effective options
+func subscribeResponseData(subscription *models.Subscription) map[string]interface{} {
+	data := map[string]interface{}{
+		"subscription_id": subscription.ID,
+	}
+	if subscription.Ack != nil {
+		data["ack"] = subscription.Ack
+	}
+	return data
+}
+
 // handleSnapshot handles initial snapshot streaming for a subscription
 func (c *Client) handleSnapshot(subscription *models.Subscription) {
 	// Check if snapshot streamer is available
 	if c.hub.wsServer == nil || c.hub.wsServer.snapshotStreamer == nil {
 		c.hub.logger.Warn("Snapshot requested but no snapshot streamer configured")
+		c.releaseSnapshot()
 		return
 	}
 
 	// Send snapshot start message
 	startMsg := &models.ServerMessage{
-		Type: models.MessageTypeSnapshotStart,
+		Type:            models.MessageTypeSnapshotStart,
+		RequestID:       subscription.RequestID,
+		SubscriptionIDs: []string{subscription.ID},
 	}
 
 	select {
 	case c.send <- startMsg:
 	default:
 		c.hub.logger.Warn("Failed to send snapshot start message")
+		c.releaseSnapshot()
 		return
 	}
 
+	// Deletes of snapshot documents are only delivered if the filter knows them
+	c.mu.RLock()
+	filter := c.filters[subscription.ID]
+	c.mu.RUnlock()
+
 	// Set up callback for receiving snapshot batches
 	callback := func(batch []map[string]interface{}, batchNum int, remaining int, err error) {
 		if err != nil {
 			// Send error message
 			errorMsg := &models.ServerMessage{
-				Type:  models.MessageTypeError,
-				Error: fmt.Sprintf("Snapshot error: %v", err),
+				Type:            models.MessageTypeError,
+				Error:           fmt.Sprintf("Snapshot error: %v", err),
+				RequestID:       subscription.RequestID,
+				SubscriptionIDs: []string{subscription.ID},
 			}
 
 			select {
@@ -568,9 +1137,16 @@ func (c *Client) handleSnapshot(subscription *models.Subscription) {
 		}
 
 		if len(batch) > 0 {
+			if filter != nil {
+				filter.saw(batch)
+			}
+			batch = c.redactDocuments(subscription.Database, subscription.Collection, batch)
+
 			// Send snapshot batch
 			msg := &models.ServerMessage{
 				Type:              models.MessageTypeSnapshot,
+				RequestID:         subscription.RequestID,
+				SubscriptionIDs:   []string{subscription.ID},
 				SnapshotData:      batch,
 				SnapshotBatch:     batchNum,
 				SnapshotRemaining: remaining,
@@ -596,7 +1172,9 @@ func (c *Client) handleSnapshot(subscription *models.Subscription) {
 		// Send snapshot end message when complete
 		if remaining == 0 {
 			endMsg := &models.ServerMessage{
-				Type: models.MessageTypeSnapshotEnd,
+				Type:            models.MessageTypeSnapshotEnd,
+				RequestID:       subscription.RequestID,
+				SubscriptionIDs: []string{subscription.ID},
 			}
 
 			select {
@@ -615,6 +1193,8 @@ func (c *Client) handleSnapshot(subscription *models.Subscription) {
 
 	// Start snapshot streaming in a goroutine to avoid blocking
 	go func() {
+		defer c.releaseSnapshot()
+
 		c.hub.logger.WithFields(logrus.Fields{
 			"client_id":  c.ID,
 			"database":   subscription.Database,
@@ -637,11 +1217,12 @@ func (c *Client) handleUnsubscribe(message *models.ClientMessage) {
 
 	var success bool
 	var errorMsg string
+	var errorCode int
 
 	if message.SubscriptionID != "" {
 		// Remove specific subscription
 		if _, exists := c.subscriptions[message.SubscriptionID]; exists {
-			delete(c.subscriptions, message.SubscriptionID)
+			c.removeSubscriptionLocked(message.SubscriptionID)
 			success = true
 			c.hub.logger.WithFields(logrus.Fields{
 				"client_id":       c.ID,
@@ -650,10 +1231,11 @@ func (c *Client) handleUnsubscribe(message *models.ClientMessage) {
 		} else {
 			success = false
 			errorMsg = "Subscription not found"
+			errorCode = models.ErrorCodeUnknownSubscription
 		}
 	} else {
 		// Remove all subscriptions if no specific ID provided
-		c.subscriptions = make(map[string]*models.Subscription)
+		c.stopDeliveryLocked()
 		success = true
 		c.hub.logger.WithField("client_id", c.ID).Info("Client unsubscribed from all subscriptions")
 	}
@@ -663,9 +1245,13 @@ func (c *Client) handleUnsubscribe(message *models.ClientMessage) {
 		Success:   success,
 		RequestID: message.RequestID,
 	}
+	if message.SubscriptionID != "" {
+		response.SubscriptionIDs = []string{message.SubscriptionID}
+	}
 
 	if !success && errorMsg != "" {
 		response.Error = errorMsg
+		response.ErrorCode = errorCode
 	}
 
 	select {
@@ -675,6 +1261,28 @@ func (c *Client) handleUnsubscribe(message *models.ClientMessage) {
 	}
 }
 
+// errorMessage builds an error response
+func errorMessage(requestID string, code int, errMsg string) *models.ServerMessage {
+	return &models.ServerMessage{
+		Type:      models.MessageTypeError,
+		Success:   false,
+		Error:     errMsg,
+		RequestID: requestID,
+		ErrorCode: code,
+	}
+}
+
+// sendError queues an error response for a client request
+func (c *Client) sendError(requestID string, code int, errMsg string) {
+	response := errorMessage(requestID, code, errMsg)
+
+	select {
+	case c.send <- response:
+	default:
+		c.hub.logger.Warn("Failed to send error response")
+	}
+}
+
 // handlePing handles ping messages
 func (c *Client) handlePing(message *models.ClientMessage) {
 	response := &models.ServerMessage{
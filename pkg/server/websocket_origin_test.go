@@ -2,297 +2,265 @@ package server
 
 import (
 	"net/http"
-	"os"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestCheckOrigin(t *testing.T) {
+func TestOriginPolicy(t *testing.T) {
 	tests := []struct {
-		name           string
-		env            string
-		allowedOrigins string
-		requestOrigin  string
-		expectedResult bool
-		description    string
+		name          string
+		opts          OriginOptions
+		requestOrigin string
+		expected      bool
+		description   string
 	}{
-		// Development mode tests
 		{
-			name:           "dev_localhost_http",
-			env:            "development",
-			allowedOrigins: "",
-			requestOrigin:  "http://localhost:3000",
-			expectedResult: true,
-			description:    "Development mode should allow localhost HTTP",
+			name:          "no_origin",
+			requestOrigin: "",
+			expected:      true,
+			description:   "Non-browser clients send no origin",
 		},
 		{
-			name:           "dev_localhost_https",
-			env:            "development",
-			allowedOrigins: "",
-			requestOrigin:  "https://localhost:3000",
-			expectedResult: true,
-			description:    "Development mode should allow localhost HTTPS",
+			name:          "no_origin_required",
+			opts:          OriginOptions{RequireOrigin: true},
+			requestOrigin: "",
+			expected:      false,
+			description:   "A required origin rejects non-browser clients",
 		},
 		{
-			name:           "dev_127_0_0_1",
-			env:            "development",
-			allowedOrigins: "",
-			requestOrigin:  "http://127.0.0.1:8080",
-			expectedResult: true,
-			description:    "Development mode should allow 127.0.0.1",
+			name:          "same_origin",
+			requestOrigin: "http://aktuell.example.com",
+			expected:      true,
+			description:   "The server's own origin is always allowed",
 		},
 		{
-			name:           "dev_empty_origin",
-			env:            "development",
-			allowedOrigins: "",
-			requestOrigin:  "",
-			expectedResult: true,
-			description:    "Development mode should allow empty origin (same-origin)",
+			name:          "default_rejects_cross_origin",
+			requestOrigin: "http://localhost:3000",
+			expected:      false,
+			description:   "Without options other origins are rejected",
 		},
 		{
-			name:           "dev_external_domain",
-			env:            "development",
-			allowedOrigins: "",
-			requestOrigin:  "https://evil.com",
-			expectedResult: false,
-			description:    "Development mode should reject external domains",
+			name:          "localhost",
+			opts:          OriginOptions{AllowLocalhost: true},
+			requestOrigin: "http://localhost:5173",
+			expected:      true,
+			description:   "Localhost is allowed on any port",
 		},
 		{
-			name:           "dev_with_custom_origins",
-			env:            "development",
-			allowedOrigins: "https://myapp.com,https://dashboard.myapp.com",
-			requestOrigin:  "https://myapp.com",
-			expectedResult: true,
-			description:    "Development mode should allow custom origins",
+			name:          "loopback_ip",
+			opts:          OriginOptions{AllowLocalhost: true},
+			requestOrigin: "https://127.0.0.1:8443",
+			expected:      true,
+			description:   "Loopback addresses count as localhost",
 		},
-
-		// Production mode tests - no AKTUELL_ALLOWED_ORIGINS
 		{
-			name:           "prod_no_config_localhost",
-			env:            "production",
-			allowedOrigins: "",
-			requestOrigin:  "http://localhost:3000",
-			expectedResult: false,
-			description:    "Production mode without config should reject localhost",
+			name:          "localhost_substring",
+			opts:          OriginOptions{AllowLocalhost: true},
+			requestOrigin: "https://localhost.evil.com",
+			expected:      false,
+			description:   "Hosts merely containing localhost are not local",
 		},
 		{
-			name:           "prod_no_config_external",
-			env:            "production",
-			allowedOrigins: "",
-			requestOrigin:  "https://myapp.com",
-			expectedResult: false,
-			description:    "Production mode without config should reject all origins",
+			name:          "exact",
+			opts:          OriginOptions{Allowed: []string{"https://myapp.com", "https://dashboard.myapp.com"}},
+			requestOrigin: "https://dashboard.myapp.com",
+			expected:      true,
+			description:   "Configured origins are allowed",
 		},
 		{
-			name:           "prod_no_config_empty",
-			env:            "production",
-			allowedOrigins: "",
-			requestOrigin:  "",
-			expectedResult: false,
-			description:    "Production mode without config should reject empty origin",
+			name:          "exact_case_and_whitespace",
+			opts:          OriginOptions{Allowed: []string{" https://MyApp.com "}},
+			requestOrigin: "https://myapp.COM",
+			expected:      true,
+			description:   "Origins compare case-insensitively",
 		},
-
-		// Production mode tests - with AKTUELL_ALLOWED_ORIGINS
 		{
-			name:           "prod_with_config_allowed",
-			env:            "production",
-			allowedOrigins: "https://myapp.com,https://dashboard.myapp.com",
-			requestOrigin:  "https://myapp.com",
-			expectedResult: true,
-			description:    "Production mode should allow configured origins",
+			name:          "exact_other_scheme",
+			opts:          OriginOptions{Allowed: []string{"https://myapp.com"}},
+			requestOrigin: "http://myapp.com",
+			expected:      false,
+			description:   "The scheme of an origin must match",
 		},
 		{
-			name:           "prod_with_config_allowed_second",
-			env:            "production",
-			allowedOrigins: "https://myapp.com,https://dashboard.myapp.com",
-			requestOrigin:  "https://dashboard.myapp.com",
-			expectedResult: true,
-			description:    "Production mode should allow second configured origin",
+			name:          "exact_other_port",
+			opts:          OriginOptions{Allowed: []string{"https://myapp.com"}},
+			requestOrigin: "https://myapp.com:8443",
+			expected:      false,
+			description:   "The port of an origin must match",
 		},
 		{
-			name:           "prod_with_config_rejected",
-			env:            "production",
-			allowedOrigins: "https://myapp.com,https://dashboard.myapp.com",
-			requestOrigin:  "https://evil.com",
-			expectedResult: false,
-			description:    "Production mode should reject non-configured origins",
+			name:          "exact_explicit_default_port",
+			opts:          OriginOptions{Allowed: []string{"https://myapp.com"}},
+			requestOrigin: "https://myapp.com:443",
+			expected:      true,
+			description:   "An explicit default port is the same origin",
 		},
 		{
-			name:           "prod_with_config_localhost_rejected",
-			env:            "production",
-			allowedOrigins: "https://myapp.com,https://dashboard.myapp.com",
-			requestOrigin:  "http://localhost:3000",
-			expectedResult: false,
-			description:    "Production mode should reject localhost even with config",
+			name:          "pattern_explicit_default_port",
+			opts:          OriginOptions{Allowed: []string{"http://myapp.com:80"}},
+			requestOrigin: "http://myapp.com",
+			expected:      true,
+			description:   "A pattern may spell out the default port",
 		},
 		{
-			name:           "prod_with_config_empty_rejected",
-			env:            "production",
-			allowedOrigins: "https://myapp.com,https://dashboard.myapp.com",
-			requestOrigin:  "",
-			expectedResult: false,
-			description:    "Production mode should reject empty origin even with config",
+			name:          "any_scheme_default_port",
+			opts:          OriginOptions{Allowed: []string{"myapp.com:443"}},
+			requestOrigin: "https://myapp.com",
+			expected:      true,
+			description:   "Port 443 matches https origins without a port",
+		},
+		{
+			name:          "any_scheme_other_default_port",
+			opts:          OriginOptions{Allowed: []string{"myapp.com:443"}},
+			requestOrigin: "http://myapp.com",
+			expected:      false,
+			description:   "Port 443 does not match http origins without a port",
+		},
+		{
+			name:          "exact_suffix",
+			opts:          OriginOptions{Allowed: []string{"https://myapp.com"}},
+			requestOrigin: "https://evilmyapp.com",
+			expected:      false,
+			description:   "Other hosts ending in an allowed host are rejected",
+		},
+		{
+			name:          "wildcard_subdomain",
+			opts:          OriginOptions{Allowed: []string{"https://*.myapp.com"}},
+			requestOrigin: "https://eu.dashboard.myapp.com",
+			expected:      true,
+			description:   "Wildcards cover nested subdomains",
+		},
+		{
+			name:          "wildcard_apex",
+			opts:          OriginOptions{Allowed: []string{"https://*.myapp.com"}},
+			requestOrigin: "https://myapp.com",
+			expected:      false,
+			description:   "Wildcards do not cover the domain itself",
+		},
+		{
+			name:          "wildcard_any_scheme",
+			opts:          OriginOptions{Allowed: []string{"*.myapp.com"}},
+			requestOrigin: "http://app.myapp.com",
+			expected:      true,
+			description:   "Patterns without scheme allow any scheme",
+		},
+		{
+			name:          "scheme_restriction",
+			opts:          OriginOptions{Allowed: []string{"*.myapp.com"}, AllowedSchemes: []string{"https"}},
+			requestOrigin: "http://app.myapp.com",
+			expected:      false,
+			description:   "Allowed schemes apply to every pattern",
 		},
-
-		// Edge cases
 		{
-			name:           "prod_whitespace_in_origins",
-			env:            "production",
-			allowedOrigins: " https://myapp.com , https://dashboard.myapp.com ",
-			requestOrigin:  "https://myapp.com",
-			expectedResult: true,
-			description:    "Should handle whitespace in AKTUELL_ALLOWED_ORIGINS",
+			name:          "scheme_restriction_localhost",
+			opts:          OriginOptions{AllowLocalhost: true, AllowedSchemes: []string{"https"}},
+			requestOrigin: "http://localhost:3000",
+			expected:      false,
+			description:   "Allowed schemes apply to localhost",
 		},
 		{
-			name:           "unset_env_localhost",
-			env:            "",
-			allowedOrigins: "",
-			requestOrigin:  "http://localhost:3000",
-			expectedResult: true,
-			description:    "Unset environment should behave like development mode",
+			name:          "any",
+			opts:          OriginOptions{Allowed: []string{"*"}},
+			requestOrigin: "https://anything.example.org",
+			expected:      true,
+			description:   "A single star allows every origin",
+		},
+		{
+			name:          "malformed",
+			opts:          OriginOptions{Allowed: []string{"*"}},
+			requestOrigin: "null",
+			expected:      false,
+			description:   "Opaque origins are rejected",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Store original environment values
-			originalEnv := os.Getenv("AKTUELL_ENV")
-			originalOrigins := os.Getenv("AKTUELL_ALLOWED_ORIGINS")
-
-			// Set test environment
-			if tt.env != "" {
-				os.Setenv("AKTUELL_ENV", tt.env)
-			} else {
-				os.Unsetenv("AKTUELL_ENV")
-			}
+			policy, err := newOriginPolicy(tt.opts)
+			require.NoError(t, err)
 
-			if tt.allowedOrigins != "" {
-				os.Setenv("AKTUELL_ALLOWED_ORIGINS", tt.allowedOrigins)
-			} else {
-				os.Unsetenv("AKTUELL_ALLOWED_ORIGINS")
-			}
-
-			// Create test request
-			req := &http.Request{
-				Header: make(http.Header),
-			}
+			req := httptest.NewRequest("GET", "http://aktuell.example.com/ws", nil)
 			if tt.requestOrigin != "" {
 				req.Header.Set("Origin", tt.requestOrigin)
 			}
-
-			// Test the function
-			result := checkOrigin(req)
-
-			// Verify result
-			if result != tt.expectedResult {
-				t.Errorf("%s: expected %v, got %v - %s",
-					tt.name, tt.expectedResult, result, tt.description)
-			}
-
-			// Restore original environment
-			if originalEnv != "" {
-				os.Setenv("AKTUELL_ENV", originalEnv)
-			} else {
-				os.Unsetenv("AKTUELL_ENV")
-			}
-
-			if originalOrigins != "" {
-				os.Setenv("AKTUELL_ALLOWED_ORIGINS", originalOrigins)
-			} else {
-				os.Unsetenv("AKTUELL_ALLOWED_ORIGINS")
-			}
+			allowed, _ := policy.allows(req)
+			assert.Equal(t, tt.expected, allowed, tt.description)
 		})
 	}
 }
 
-func TestGetDefaultAllowedOrigins(t *testing.T) {
-	tests := []struct {
-		name        string
-		env         string
-		expectedLen int
-		description string
-	}{
-		{
-			name:        "development_mode",
-			env:         "development",
-			expectedLen: 3,
-			description: "Development mode should return default localhost origins",
-		},
-		{
-			name:        "production_mode",
-			env:         "production",
-			expectedLen: 0,
-			description: "Production mode should return empty slice",
-		},
-		{
-			name:        "unset_env",
-			env:         "",
-			expectedLen: 3,
-			description: "Unset environment should behave like development",
-		},
+func TestOriginPolicy_InvalidPatterns(t *testing.T) {
+	for _, allowed := range []string{"https://", "https://app.*.com", "https://myapp.com/path", "https://user@myapp.com"} {
+		_, err := newOriginPolicy(OriginOptions{Allowed: []string{allowed}})
+		assert.Error(t, err, allowed)
 	}
+}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// Store original environment value
-			originalEnv := os.Getenv("AKTUELL_ENV")
-
-			// Set test environment
-			if tt.env != "" {
-				os.Setenv("AKTUELL_ENV", tt.env)
-			} else {
-				os.Unsetenv("AKTUELL_ENV")
-			}
+func TestOrigin_WebSocketHandshake(t *testing.T) {
+	ws, url := newSessionServer(t, 0)
+	require.NoError(t, ws.SetOriginOptions(OriginOptions{Allowed: []string{"https://*.myapp.com"}}))
 
-			// Test the function
-			origins := getDefaultAllowedOrigins()
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://app.myapp.com"}})
+	require.NoError(t, err)
+	conn.Close()
 
-			// Verify result
-			if len(origins) != tt.expectedLen {
-				t.Errorf("%s: expected %d origins, got %d - %s",
-					tt.name, tt.expectedLen, len(origins), tt.description)
-			}
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.com"}})
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
 
-			// In development mode, verify we have localhost origins
-			if tt.env != "production" && tt.expectedLen > 0 {
-				foundLocalhost := false
-				for _, origin := range origins {
-					if origin == "http://localhost:3000" {
-						foundLocalhost = true
-						break
-					}
-				}
-				if !foundLocalhost {
-					t.Errorf("%s: expected to find localhost:3000 in default origins", tt.name)
-				}
-			}
+func TestOrigin_CORS(t *testing.T) {
+	ws, url := newSessionServer(t, 0)
+	require.NoError(t, ws.SetOriginOptions(OriginOptions{Allowed: []string{"https://app.myapp.com"}}))
+	health := "http" + strings.TrimSuffix(strings.TrimPrefix(url, "ws"), "/ws") + "/health"
 
-			// Restore original environment
-			if originalEnv != "" {
-				os.Setenv("AKTUELL_ENV", originalEnv)
-			} else {
-				os.Unsetenv("AKTUELL_ENV")
-			}
-		})
+	request := func(method, origin string) *http.Response {
+		req, err := http.NewRequest(method, health, nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			req.Header.Set("Access-Control-Request-Headers", "authorization, x-api-key")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
 	}
+
+	resp := request(http.MethodGet, "https://app.myapp.com")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "https://app.myapp.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", resp.Header.Get("Vary"))
+
+	resp = request(http.MethodOptions, "https://app.myapp.com")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "authorization, x-api-key", resp.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", resp.Header.Get("Access-Control-Max-Age"))
+
+	// Other origins get no CORS headers, so browsers hide the response
+	resp = request(http.MethodGet, "https://evil.com")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+	resp = request(http.MethodOptions, "https://evil.com")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
 }
 
-// Benchmark the origin checking function
-func BenchmarkCheckOrigin(b *testing.B) {
-	// Set up test environment
-	os.Setenv("AKTUELL_ENV", "production")
-	os.Setenv("AKTUELL_ALLOWED_ORIGINS", "https://app1.com,https://app2.com,https://app3.com")
-	defer func() {
-		os.Unsetenv("AKTUELL_ENV")
-		os.Unsetenv("AKTUELL_ALLOWED_ORIGINS")
-	}()
+func BenchmarkOriginPolicy(b *testing.B) {
+	policy, err := newOriginPolicy(OriginOptions{Allowed: []string{"https://app1.com", "https://app2.com", "https://*.app3.com"}})
+	require.NoError(b, err)
 
-	req := &http.Request{
-		Header: make(http.Header),
-	}
-	req.Header.Set("Origin", "https://app2.com")
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Origin", "https://eu.app3.com")
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		checkOrigin(req)
+		policy.allows(req)
 	}
 }
@@ -2,7 +2,9 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
 	"aktuell/pkg/models"
 
@@ -85,6 +87,13 @@ func (m *MockSnapshotStreamer) StreamSnapshot(database, collection string, snapO
 	}
 }
 
+// snapshotStreamerFunc adapts a function to the SnapshotStreamer interface
+type snapshotStreamerFunc func(database, collection string, snapOpts *models.SnapshotOptions, callback func([]map[string]interface{}, int, int, error))
+
+func (f snapshotStreamerFunc) StreamSnapshot(database, collection string, snapOpts *models.SnapshotOptions, callback func([]map[string]interface{}, int, int, error)) {
+	f(database, collection, snapOpts, callback)
+}
+
 func TestWebSocketServer_Creation(t *testing.T) {
 	logger := logrus.New()
 	logger.SetLevel(logrus.FatalLevel) // Suppress logs during testing
@@ -309,3 +318,181 @@ func BenchmarkClientMessage_Unmarshal(b *testing.B) {
 		}
 	}
 }
+
+func TestClient_RouteChangeReturnsMatchingSubscriptions(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	server := NewWebSocketServer("localhost:8080", logger)
+
+	client := newClient(server.hub, nil, 10)
+	client.addSubscription(&models.Subscription{ID: "sub-b", Database: "testdb", Collection: "users"}, 0, nil)
+	client.addSubscription(&models.Subscription{ID: "sub-a", Database: "testdb"}, 0, nil)
+	client.addSubscription(&models.Subscription{ID: "sub-other", Database: "testdb", Collection: "orders"}, 0, nil)
+
+	change := &models.ChangeEvent{Database: "testdb", Collection: "users", DocumentKey: map[string]interface{}{"_id": 1}}
+	_, ids, sequences := client.routeChange(change)
+	assert.Equal(t, []string{"sub-a", "sub-b"}, ids)
+	assert.Equal(t, []uint64{1, 1}, sequences)
+
+	// Conflated subscriptions are excluded from immediate delivery
+	client.conflators["sub-a"] = newConflator(time.Hour, client.conflatedSender("sub-a", client.sequences["sub-a"]))
+	defer client.stopDelivery()
+	_, ids, sequences = client.routeChange(change)
+	assert.Equal(t, []string{"sub-b"}, ids)
+	assert.Equal(t, []uint64{2}, sequences)
+}
+
+func TestClient_SnapshotMessagesAreTagged(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	server := NewWebSocketServer("localhost:8080", logger)
+
+	server.SetSnapshotStreamer(snapshotStreamerFunc(func(database, collection string, snapOpts *models.SnapshotOptions, callback func([]map[string]interface{}, int, int, error)) {
+		callback([]map[string]interface{}{{"_id": "1"}}, 1, 0, nil)
+	}))
+
+	client := newClient(server.hub, nil, 10)
+
+	client.handleSubscribe(&models.ClientMessage{
+		Type:            models.MessageTypeSubscribe,
+		Database:        "testdb",
+		Collection:      "users",
+		RequestID:       "req-1",
+		SnapshotOptions: &models.SnapshotOptions{IncludeSnapshot: true},
+	})
+
+	response := <-client.send
+	require.Equal(t, models.MessageTypeSubscribe, response.Type)
+	subscriptionID := response.Data.(map[string]interface{})["subscription_id"].(string)
+
+	for _, wantType := range []string{models.MessageTypeSnapshotStart, models.MessageTypeSnapshot, models.MessageTypeSnapshotEnd} {
+		select {
+		case message := <-client.send:
+			assert.Equal(t, wantType, message.Type)
+			assert.Equal(t, "req-1", message.RequestID)
+			assert.Equal(t, []string{subscriptionID}, message.SubscriptionIDs)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s message", wantType)
+		}
+	}
+}
+
+func TestHandleSubscribe_ResponsePrecedesChanges(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	server := NewWebSocketServer("localhost:8080", logger)
+	go server.hub.run()
+
+	client := newClient(server.hub, nil, 1<<16)
+	server.hub.register <- client
+
+	stop := make(chan struct{})
+	broadcasting := make(chan struct{})
+	go func() {
+		defer close(broadcasting)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			server.BroadcastChange(&models.ChangeEvent{
+				ID:          fmt.Sprintf("evt-%d", i),
+				Database:    "testdb",
+				Collection:  "users",
+				DocumentKey: map[string]interface{}{"_id": i},
+			})
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		client.handleSubscribe(&models.ClientMessage{
+			Type:       models.MessageTypeSubscribe,
+			Database:   "testdb",
+			Collection: "users",
+			RequestID:  fmt.Sprintf("req-%d", i),
+		})
+	}
+	close(stop)
+	<-broadcasting
+	// The hub handles one request at a time, so the last broadcast is queued
+	// once it accepts another
+	server.hub.register <- newClient(server.hub, nil, 1)
+
+	confirmed := make(map[string]bool)
+	for len(client.send) > 0 {
+		message := <-client.send
+		switch message.Type {
+		case models.MessageTypeSubscribe:
+			data := message.Data.(map[string]interface{})
+			assert.Equal(t, uint64(0), data["sequence"])
+			confirmed[data["subscription_id"].(string)] = true
+		case models.MessageTypeChange:
+			for _, id := range message.SubscriptionIDs {
+				require.True(t, confirmed[id], "change for %s overtook its subscribe response", id)
+			}
+		}
+	}
+	assert.Len(t, confirmed, 50)
+}
+
+func TestClient_UnsubscribeAllClearsSubscriptionState(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	server := NewWebSocketServer("localhost:8080", logger)
+
+	client := newClient(server.hub, nil, 10)
+	client.addSubscription(&models.Subscription{
+		ID:       "sub-1",
+		Database: "testdb",
+		Filter:   map[string]interface{}{"tenant": "acme"},
+		Ack:      &models.AckOptions{Window: 10, TimeoutMS: 1000},
+	}, time.Hour, nil)
+	client.addSubscription(&models.Subscription{ID: "sub-2", Database: "testdb"}, time.Hour, nil)
+
+	client.handleUnsubscribe(&models.ClientMessage{Type: models.MessageTypeUnsubscribe, RequestID: "req-1"})
+
+	client.mu.RLock()
+	defer client.mu.RUnlock()
+	assert.Empty(t, client.subscriptions)
+	assert.Empty(t, client.conflators)
+	assert.Empty(t, client.trackers)
+	assert.Empty(t, client.filters)
+	assert.Empty(t, client.sequences)
+}
+
+func TestHub_RemovedClientStillAcceptsSends(t *testing.T) {
+	client, peer := newTestConnection(t)
+	hub := client.hub
+	hub.mu.Lock()
+	hub.clients[client] = true
+	hub.mu.Unlock()
+
+	client.send <- &models.ServerMessage{Type: models.MessageTypePong, RequestID: "queued"}
+	hub.mu.Lock()
+	hub.removeClient(client)
+	hub.mu.Unlock()
+
+	// Producers that raced the removal must not panic
+	assert.NotPanics(t, func() {
+		client.sendError("late", models.ErrorCodeUnknownSubscription, "late")
+		client.ackedSender()(&models.ServerMessage{Type: models.MessageTypeChange})
+	})
+
+	done := make(chan struct{})
+	go func() {
+		client.writePump(client.link)
+		close(done)
+	}()
+
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(2*time.Second)))
+	var message models.ServerMessage
+	require.NoError(t, peer.ReadJSON(&message))
+	assert.Equal(t, "queued", message.RequestID)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("writePump did not end after the client was removed")
+	}
+}
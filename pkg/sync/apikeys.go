@@ -0,0 +1,34 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"aktuell/pkg/auth"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// APIKeyLoader returns a loader for the API keys stored in a collection,
+// given as "db.collection". Documents hold the fields of auth.APIKey, with
+// the key only as its hash.
+func (d *Database) APIKeyLoader(namespace string) (auth.APIKeyLoader, error) {
+	database, collection, ok := strings.Cut(namespace, ".")
+	if !ok || database == "" || collection == "" {
+		return nil, fmt.Errorf("API key collection must be given as database.collection, not %q", namespace)
+	}
+	coll := d.client.Database(database).Collection(collection)
+
+	return func(ctx context.Context) ([]auth.APIKey, error) {
+		cursor, err := coll.Find(ctx, bson.M{})
+		if err != nil {
+			return nil, err
+		}
+		var keys []auth.APIKey
+		if err := cursor.All(ctx, &keys); err != nil {
+			return nil, err
+		}
+		return keys, nil
+	}, nil
+}
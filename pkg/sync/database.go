@@ -221,6 +221,21 @@ func (d *Database) GetConnectionURI() string {
 	return d.connectionURI
 }
 
+// snapshotFilter combines the client's filter with the mandatory row filter
+func snapshotFilter(snapOpts *models.SnapshotOptions) bson.M {
+	switch {
+	case snapOpts.RowFilter == nil && snapOpts.SnapshotFilter == nil:
+		return bson.M{}
+	case snapOpts.RowFilter == nil:
+		return snapOpts.SnapshotFilter
+	case snapOpts.SnapshotFilter == nil:
+		return snapOpts.RowFilter
+	default:
+		// $and keeps operators of the client's filter from overriding the row filter
+		return bson.M{"$and": bson.A{snapOpts.RowFilter, snapOpts.SnapshotFilter}}
+	}
+}
+
 // StreamSnapshot streams existing documents from a collection in batches
 func (d *Database) StreamSnapshot(collection string, snapOpts *models.SnapshotOptions, callback func([]map[string]interface{}, int, int, error)) {
 	if snapOpts == nil {
@@ -240,10 +255,7 @@ func (d *Database) StreamSnapshot(collection string, snapOpts *models.SnapshotOp
 	}
 
 	// Build the filter
-	filter := bson.M{}
-	if snapOpts.SnapshotFilter != nil {
-		filter = snapOpts.SnapshotFilter
-	}
+	filter := snapshotFilter(snapOpts)
 
 	// Build find options
 	findOpts := options.Find().SetLimit(int64(limit))
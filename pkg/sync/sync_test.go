@@ -7,6 +7,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 // MockWebSocketServer implements a mock WebSocket server for testing
@@ -97,6 +98,18 @@ func TestMockInterfaces(t *testing.T) {
 	mockDB.AssertExpectations(t)
 }
 
+func TestSnapshotFilter_RowFilter(t *testing.T) {
+	row := map[string]interface{}{"tenantId": "acme"}
+	client := map[string]interface{}{"$or": []interface{}{map[string]interface{}{"tenantId": "globex"}}}
+
+	assert.Equal(t, bson.M{}, snapshotFilter(&models.SnapshotOptions{}))
+	assert.Equal(t, bson.M(client), snapshotFilter(&models.SnapshotOptions{SnapshotFilter: client}))
+	assert.Equal(t, bson.M(row), snapshotFilter(&models.SnapshotOptions{RowFilter: row}))
+
+	// The client's filter cannot widen the row filter
+	assert.Equal(t, bson.M{"$and": bson.A{row, client}}, snapshotFilter(&models.SnapshotOptions{RowFilter: row, SnapshotFilter: client}))
+}
+
 // Benchmark test
 func BenchmarkDatabaseConfig_Access(b *testing.B) {
 	configs := []models.DatabaseConfig{
@@ -5,7 +5,6 @@ package tests
 
 import (
 	"net/url"
-	"os"
 	"testing"
 	"time"
 
@@ -17,12 +16,15 @@ import (
 	"aktuell/pkg/server"
 )
 
-func TestWebSocketOriginSecurity(t *testing.T) {
-	// Create a WebSocket server for testing
+// startOriginServer starts a server with an origin policy and returns its address
+func startOriginServer(t *testing.T, opts server.OriginOptions) string {
+	t.Helper()
+
 	logger := logrus.New()
 	logger.SetLevel(logrus.ErrorLevel) // Reduce noise in tests
 
 	wsServer := server.NewWebSocketServer("localhost:0", logger)
+	require.NoError(t, wsServer.SetOriginOptions(opts))
 
 	// Start server in background
 	go func() {
@@ -30,61 +32,78 @@ func TestWebSocketOriginSecurity(t *testing.T) {
 			logger.WithError(err).Debug("Server stopped")
 		}
 	}()
+	t.Cleanup(func() { wsServer.Stop() })
 
 	// Wait for server to start
 	time.Sleep(100 * time.Millisecond)
 	serverAddr := wsServer.GetAddr()
 	require.NotEmpty(t, serverAddr, "Server should have started with valid address")
+	return serverAddr
+}
 
-	defer wsServer.Stop()
+func TestWebSocketOriginSecurity(t *testing.T) {
+	development := server.OriginOptions{AllowLocalhost: true}
+	production := server.OriginOptions{
+		Allowed:        []string{"https://myapp.com", "https://*.myapp.com"},
+		AllowedSchemes: []string{"https"},
+		RequireOrigin:  true,
+	}
 
 	tests := []struct {
 		name             string
-		env              string
-		allowedOrigins   string
+		opts             server.OriginOptions
 		requestOrigin    string
 		expectConnection bool
 		description      string
 	}{
-		// Development mode tests
+		// Development configuration
 		{
 			name:             "dev_localhost_allowed",
-			env:              "development",
-			allowedOrigins:   "",
+			opts:             development,
 			requestOrigin:    "http://localhost:3000",
 			expectConnection: true,
-			description:      "Development mode should allow localhost",
+			description:      "Development configuration should allow localhost",
 		},
 		{
 			name:             "dev_external_rejected",
-			env:              "development",
-			allowedOrigins:   "",
+			opts:             development,
 			requestOrigin:    "https://evil.com",
 			expectConnection: false,
-			description:      "Development mode should reject external domains",
+			description:      "Development configuration should reject external domains",
 		},
 
-		// Production mode tests
+		// Production configuration
 		{
 			name:             "prod_no_config_all_rejected",
-			env:              "production",
-			allowedOrigins:   "",
+			opts:             server.OriginOptions{RequireOrigin: true},
 			requestOrigin:    "https://myapp.com",
 			expectConnection: false,
-			description:      "Production without config should reject all",
+			description:      "Production without allowed origins should reject all",
 		},
 		{
 			name:             "prod_with_config_allowed",
-			env:              "production",
-			allowedOrigins:   "https://myapp.com,https://dashboard.myapp.com",
+			opts:             production,
 			requestOrigin:    "https://myapp.com",
 			expectConnection: true,
 			description:      "Production should allow configured origins",
 		},
+		{
+			name:             "prod_subdomain_allowed",
+			opts:             production,
+			requestOrigin:    "https://dashboard.myapp.com",
+			expectConnection: true,
+			description:      "Production should allow wildcard subdomains",
+		},
+		{
+			name:             "prod_http_rejected",
+			opts:             production,
+			requestOrigin:    "http://myapp.com",
+			expectConnection: false,
+			description:      "Production should reject disallowed schemes",
+		},
 		{
 			name:             "prod_with_config_rejected",
-			env:              "production",
-			allowedOrigins:   "https://myapp.com,https://dashboard.myapp.com",
+			opts:             production,
 			requestOrigin:    "https://evil.com",
 			expectConnection: false,
 			description:      "Production should reject non-configured origins",
@@ -93,22 +112,7 @@ func TestWebSocketOriginSecurity(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Store original environment values
-			originalEnv := os.Getenv("AKTUELL_ENV")
-			originalOrigins := os.Getenv("AKTUELL_ALLOWED_ORIGINS")
-
-			// Set test environment
-			if tt.env != "" {
-				os.Setenv("AKTUELL_ENV", tt.env)
-			} else {
-				os.Unsetenv("AKTUELL_ENV")
-			}
-
-			if tt.allowedOrigins != "" {
-				os.Setenv("AKTUELL_ALLOWED_ORIGINS", tt.allowedOrigins)
-			} else {
-				os.Unsetenv("AKTUELL_ALLOWED_ORIGINS")
-			}
+			serverAddr := startOriginServer(t, tt.opts)
 
 			// Create WebSocket dialer with custom origin
 			dialer := websocket.DefaultDialer
@@ -140,19 +144,6 @@ func TestWebSocketOriginSecurity(t *testing.T) {
 			if resp != nil {
 				resp.Body.Close()
 			}
-
-			// Restore original environment
-			if originalEnv != "" {
-				os.Setenv("AKTUELL_ENV", originalEnv)
-			} else {
-				os.Unsetenv("AKTUELL_ENV")
-			}
-
-			if originalOrigins != "" {
-				os.Setenv("AKTUELL_ALLOWED_ORIGINS", originalOrigins)
-			} else {
-				os.Unsetenv("AKTUELL_ALLOWED_ORIGINS")
-			}
 		})
 	}
 }
@@ -163,44 +154,11 @@ func TestWebSocketOriginSecurityConcurrent(t *testing.T) {
 		t.Skip("Skipping concurrent origin test in short mode")
 	}
 
-	// Create a WebSocket server for testing
-	logger := logrus.New()
-	logger.SetLevel(logrus.ErrorLevel) // Reduce noise in tests
-
-	wsServer := server.NewWebSocketServer("localhost:0", logger)
-
-	// Start server in background
-	go func() {
-		if err := wsServer.Start(); err != nil {
-			logger.WithError(err).Debug("Server stopped")
-		}
-	}()
-
-	// Wait for server to start
-	time.Sleep(100 * time.Millisecond)
-	serverAddr := wsServer.GetAddr()
-	require.NotEmpty(t, serverAddr, "Server should have started with valid address")
-
-	defer wsServer.Stop()
-
-	// Set production mode with specific allowed origins
-	originalEnv := os.Getenv("AKTUELL_ENV")
-	originalOrigins := os.Getenv("AKTUELL_ALLOWED_ORIGINS")
-	defer func() {
-		if originalEnv != "" {
-			os.Setenv("AKTUELL_ENV", originalEnv)
-		} else {
-			os.Unsetenv("AKTUELL_ENV")
-		}
-		if originalOrigins != "" {
-			os.Setenv("AKTUELL_ALLOWED_ORIGINS", originalOrigins)
-		} else {
-			os.Unsetenv("AKTUELL_ALLOWED_ORIGINS")
-		}
-	}()
-
-	os.Setenv("AKTUELL_ENV", "production")
-	os.Setenv("AKTUELL_ALLOWED_ORIGINS", "https://app1.com,https://app2.com")
+	// Production configuration with specific allowed origins
+	serverAddr := startOriginServer(t, server.OriginOptions{
+		Allowed:       []string{"https://app1.com", "https://app2.com"},
+		RequireOrigin: true,
+	})
 
 	// Test multiple concurrent connections
 	origins := []struct {